@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -12,12 +14,43 @@ type Config struct {
 	AnthropicModel    string
 	OpenAIAPIKey      string
 	OpenAIModel       string
+	OpenAIBaseURL     string // OpenAI-compatible API root, e.g. a vLLM or llama.cpp server
+	OllamaModel       string
 	EmbeddingProvider string
 	EmbeddingModel    string
+	EmbeddingDims     int // requested vector size for OpenAI models that support shortening, 0 for full size
+	EmbeddingBatch    int // texts per embedding request
+	EmbeddingWorkers  int // embedding requests in flight at once
 	OllamaHost        string
 	Port              string
 	DBPath            string
+	UploadDir         string
+	AudioDir          string // voiceovers, served under /audio
+	PromptsDir        string
 	MaxUploadSize     int64
+	ChunkSize         int    // default chunk length, per upload overridable
+	ChunkOverlap      int    // default overlap between chunks of a section
+	ChunkUnit         string // chars or tokens
+	OCREngine         string // tesseract, fake or none
+	TesseractPath     string
+	OCRLanguages      string // tesseract language codes, e.g. "eng+deu"
+	PdftoppmPath      string // renders scanned PDF pages for OCR
+	OCRDPI            int
+	OCRMaxPages       int // PDF pages recognized per upload, 0 for no limit
+	JobWorkers        int
+	JobTimeout        time.Duration // deadline for a single generation job, 0 for none
+	VectorIndex       string        // hnsw (approximate, persisted) or flat (exact, in memory)
+	VectorIndexDir    string
+	RetrievalStrategy string // default chat retrieval: hybrid, semantic or lexical
+	RetrievalTopK     int
+	PriceTableFile    string        // JSON price overrides, see services.LoadPriceTable
+	BudgetPeriod      string        // day, month or all: how far back spending counts against the budgets
+	BudgetGlobal      float64       // USD for all courses together, 0 for no limit
+	BudgetCourse      float64       // USD per course unless the course sets its own, 0 for no limit
+	BudgetUser        float64       // USD per user, 0 for no limit
+	ModelFallbacks    string        // providers tried after MODEL_PROVIDER fails, e.g. "openai,ollama:llama3.1"
+	CircuitFailures   int           // consecutive failures that take a provider out of the fallback chain
+	CircuitCooldown   time.Duration // how long a failing provider is skipped before it is tried again
 }
 
 func Load() (*Config, error) {
@@ -30,12 +63,52 @@ func Load() (*Config, error) {
 		AnthropicModel:    getEnv("ANTHROPIC_MODEL", "claude-3-5-sonnet-20241022"),
 		OpenAIAPIKey:      getEnv("OPENAI_API_KEY", ""),
 		OpenAIModel:       getEnv("OPENAI_MODEL", "gpt-4o-mini"),
+		OpenAIBaseURL:     getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"),
+		OllamaModel:       getEnv("OLLAMA_MODEL", "llama3.1"),
 		EmbeddingProvider: getEnv("EMBEDDING_PROVIDER", "openai"),
 		EmbeddingModel:    getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
+		EmbeddingDims:     getEnvInt("EMBEDDING_DIMENSIONS", 0),
+		EmbeddingBatch:    getEnvInt("EMBEDDING_BATCH_SIZE", 64),
+		EmbeddingWorkers:  getEnvInt("EMBEDDING_CONCURRENCY", 4),
 		OllamaHost:        getEnv("OLLAMA_HOST", "http://localhost:11434"),
 		Port:              getEnv("PORT", "8080"),
 		DBPath:            getEnv("DB_PATH", "./storage/elearn.db"),
+		UploadDir:         getEnv("UPLOAD_DIR", "./storage/uploads"),
+		AudioDir:          getEnv("AUDIO_DIR", "./storage/audio"),
+		PromptsDir:        getEnv("PROMPTS_DIR", "./api/prompts"),
 		MaxUploadSize:     52428800, // 50MB default
+		ChunkSize:         getEnvInt("CHUNK_SIZE", 1000),
+		ChunkOverlap:      getEnvInt("CHUNK_OVERLAP", 200),
+		ChunkUnit:         getEnv("CHUNK_UNIT", "chars"),
+		OCREngine:         getEnv("OCR_ENGINE", "tesseract"),
+		TesseractPath:     getEnv("TESSERACT_PATH", "tesseract"),
+		OCRLanguages:      getEnv("OCR_LANGUAGES", "eng"),
+		PdftoppmPath:      getEnv("PDFTOPPM_PATH", "pdftoppm"),
+		OCRDPI:            getEnvInt("OCR_DPI", 300),
+		OCRMaxPages:       getEnvInt("OCR_MAX_PAGES", 200),
+		JobWorkers:        getEnvInt("JOB_WORKERS", 2),
+		JobTimeout:        time.Duration(getEnvInt("JOB_TIMEOUT_MINUTES", 60)) * time.Minute,
+		VectorIndex:       getEnv("VECTOR_INDEX", "hnsw"),
+		VectorIndexDir:    getEnv("VECTOR_INDEX_DIR", "./storage/indexes"),
+		RetrievalStrategy: getEnv("RETRIEVAL_STRATEGY", "hybrid"),
+		RetrievalTopK:     getEnvInt("RETRIEVAL_TOP_K", 6),
+		PriceTableFile:    getEnv("PRICE_TABLE_FILE", ""),
+		BudgetPeriod:      getEnv("BUDGET_PERIOD", "month"),
+		BudgetGlobal:      getEnvFloat("BUDGET_GLOBAL_USD", 0),
+		BudgetCourse:      getEnvFloat("BUDGET_COURSE_USD", 0),
+		BudgetUser:        getEnvFloat("BUDGET_USER_USD", 0),
+		ModelFallbacks:    getEnv("MODEL_FALLBACKS", ""),
+		CircuitFailures:   getEnvInt("CIRCUIT_BREAKER_FAILURES", 5),
+		CircuitCooldown:   time.Duration(getEnvInt("CIRCUIT_BREAKER_COOLDOWN_SECONDS", 60)) * time.Second,
+	}
+
+	// The fake model runs fully offline, so it brings fake embeddings and OCR unless told
+	// otherwise
+	if cfg.ModelProvider == "fake" && os.Getenv("EMBEDDING_PROVIDER") == "" {
+		cfg.EmbeddingProvider = "fake"
+	}
+	if cfg.ModelProvider == "fake" && os.Getenv("OCR_ENGINE") == "" {
+		cfg.OCREngine = "fake"
 	}
 
 	return cfg, nil
@@ -47,3 +120,21 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/local/elearn/api/models"
 	"gorm.io/driver/sqlite"
@@ -10,8 +11,15 @@ import (
 )
 
 func Init(dbPath string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent),
+	// Generation jobs write from background workers, so wait on locks instead of failing
+	dsn := dbPath
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=5000"
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true, // unique violations come back as gorm.ErrDuplicatedKey
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
@@ -22,5 +30,24 @@ func Init(dbPath string) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	// Embeddings used to be saved with a guessed dimension per provider; record the real one
+	if err := db.Exec("UPDATE embeddings SET dimension = json_array_length(vector) " +
+		"WHERE json_valid(vector) AND dimension <> json_array_length(vector)").Error; err != nil {
+		return nil, fmt.Errorf("failed to fix embedding dimensions: %w", err)
+	}
+
+	// A course runs one job at a time; older databases may hold several active jobs, of
+	// which the first one stays
+	if err := db.Exec("UPDATE generation_jobs SET status = 'canceled', message = 'Superseded by another job of the course' " +
+		"WHERE status IN ('queued', 'running') AND EXISTS (SELECT 1 FROM generation_jobs AS other " +
+		"WHERE other.course_id = generation_jobs.course_id AND other.status IN ('queued', 'running') " +
+		"AND (other.created_at < generation_jobs.created_at OR (other.created_at = generation_jobs.created_at AND other.id < generation_jobs.id)))").Error; err != nil {
+		return nil, fmt.Errorf("failed to cancel duplicate jobs: %w", err)
+	}
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_generation_jobs_active ON generation_jobs(course_id) " +
+		"WHERE status IN ('queued', 'running')").Error; err != nil {
+		return nil, fmt.Errorf("failed to index active jobs: %w", err)
+	}
+
 	return db, nil
 }
@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+)
+
+// ContextUserID is the gin context key holding the ID of the authenticated user. Nothing
+// sets it yet; an authentication middleware that does makes per-user budgets apply.
+const ContextUserID = "user_id"
+
+// Budget scopes
+const (
+	BudgetScopeGlobal = "global"
+	BudgetScopeCourse = "course"
+	BudgetScopeUser   = "user"
+)
+
+// Rough sizes used to estimate a generation before it runs
+const (
+	promptOverheadTokens   = 800  // system prompt and instructions of a call
+	estimatedSummaryTokens = 400  // summary of one source part
+	estimatedPlanTokens    = 1000 // outline of the sections or of one module
+	estimatedSlideTokens   = 1200 // one slide with its instructor script and question
+	estimatedScriptChars   = 2500 // instructor script read by the voiceover
+)
+
+// requestUser returns the authenticated user of the request, empty without authentication
+func requestUser(c *gin.Context) string {
+	return c.GetString(ContextUserID)
+}
+
+// BudgetStatus is how much of one budget has been spent in the current period
+type BudgetStatus struct {
+	Scope     string  `json:"scope"`        // global, course or user
+	ID        string  `json:"id,omitempty"` // course or user ID
+	Period    string  `json:"period"`       // day, month or all
+	Limit     float64 `json:"limit"`        // USD
+	Spent     float64 `json:"spent"`
+	Remaining float64 `json:"remaining"`
+}
+
+// EstimateItem is the expected usage of one step of a generation
+type EstimateItem struct {
+	Step         string  `json:"step"` // outline, slides, images, voiceover
+	Provider     string  `json:"provider"`
+	Model        string  `json:"model"`
+	InputTokens  int     `json:"input_tokens,omitempty"`
+	OutputTokens int     `json:"output_tokens,omitempty"`
+	Images       int     `json:"images,omitempty"`
+	Characters   int     `json:"characters,omitempty"`
+	Cost         float64 `json:"cost"` // USD
+}
+
+// CostEstimate is the expected cost of a generation, checked against the budgets before it starts
+type CostEstimate struct {
+	Items []EstimateItem `json:"items"`
+	Total float64        `json:"total"` // USD
+}
+
+func (e *CostEstimate) add(h *Handler, step string, usage services.Usage) {
+	cost, _ := h.prices.Cost(usage)
+	e.Items = append(e.Items, EstimateItem{
+		Step:         step,
+		Provider:     usage.Provider,
+		Model:        usage.Model,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Images:       usage.Images,
+		Characters:   usage.Characters,
+		Cost:         cost,
+	})
+	e.Total += cost
+}
+
+// EstimateResponse is the pre-flight answer to a generation request
+type EstimateResponse struct {
+	Estimate *CostEstimate  `json:"estimate"`
+	Budgets  []BudgetStatus `json:"budgets"`
+	Allowed  bool           `json:"allowed"`
+	Error    string         `json:"error,omitempty"` // which budget the generation would exceed
+}
+
+// budgetPeriodStart returns when the current budget period began, zero when spending
+// counts for all time
+func (h *Handler) budgetPeriodStart() time.Time {
+	now := time.Now().UTC()
+	switch h.cfg.BudgetPeriod {
+	case "day":
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	case "all":
+		return time.Time{}
+	default:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// courseBudget returns the course's own limit, or the default per-course limit. own
+// reports whether the course set its own limit, in which case 0 blocks all spending
+// rather than meaning no limit.
+func (h *Handler) courseBudget(courseID string) (limit float64, own bool) {
+	var course models.Course
+	if err := h.db.Select("budget_usd").Where("id = ?", courseID).First(&course).Error; err == nil && course.BudgetUSD != nil {
+		return *course.BudgetUSD, true
+	}
+	return h.cfg.BudgetCourse, false
+}
+
+// budgetStatuses reports every budget that applies to work on the course for the user
+func (h *Handler) budgetStatuses(courseID, userID string) ([]BudgetStatus, error) {
+	period := h.cfg.BudgetPeriod
+	if period != "day" && period != "all" {
+		period = "month"
+	}
+	since := h.budgetPeriodStart()
+
+	type budget struct {
+		scope, id, column string
+		limit             float64
+		enforced          bool // a limit of 0 only caps spending when set explicitly
+	}
+	budgets := []budget{{scope: BudgetScopeGlobal, limit: h.cfg.BudgetGlobal}}
+	if courseID != "" {
+		limit, own := h.courseBudget(courseID)
+		budgets = append(budgets, budget{BudgetScopeCourse, courseID, "course_id", limit, own})
+	}
+	if userID != "" {
+		budgets = append(budgets, budget{BudgetScopeUser, userID, "user_id", h.cfg.BudgetUser, false})
+	}
+
+	statuses := []BudgetStatus{}
+	for _, b := range budgets {
+		if b.limit <= 0 && !b.enforced {
+			continue
+		}
+		query := h.db.Model(&models.UsageRecord{}).Where("created_at >= ?", since)
+		if b.column != "" {
+			query = query.Where(b.column+" = ?", b.id)
+		}
+		var spent float64
+		if err := query.Select("COALESCE(SUM(cost), 0)").Scan(&spent).Error; err != nil {
+			return nil, fmt.Errorf("failed to sum %s spending: %w", b.scope, err)
+		}
+		statuses = append(statuses, BudgetStatus{
+			Scope:     b.scope,
+			ID:        b.id,
+			Period:    period,
+			Limit:     b.limit,
+			Spent:     spent,
+			Remaining: max(0, b.limit-spent),
+		})
+	}
+	return statuses, nil
+}
+
+// checkBudget returns a *services.BudgetError when spending cost more would take any budget
+// of the course or user over its limit
+func (h *Handler) checkBudget(courseID, userID string, cost float64) ([]BudgetStatus, error) {
+	statuses, err := h.budgetStatuses(courseID, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if status.Spent+cost > status.Limit {
+			return statuses, &services.BudgetError{Scope: status.Scope, Limit: status.Limit, Spent: status.Spent, Estimate: cost}
+		}
+	}
+	return statuses, nil
+}
+
+// CheckUsage refuses a provider call that would take a budget over its limit
+func (r *usageRecorder) CheckUsage(estimate services.Usage) error {
+	cost, _ := r.h.prices.Cost(estimate)
+	_, err := r.h.checkBudget(r.CourseID, r.UserID, cost)
+	return err
+}
+
+// textModel returns the provider and model course generation and chat use
+func (h *Handler) textModel() (string, string) {
+	switch h.cfg.ModelProvider {
+	case "openai":
+		return "openai", h.cfg.OpenAIModel
+	case "ollama":
+		return "ollama", h.cfg.OllamaModel
+	case "fake":
+		return "fake", services.FakeModel
+	default:
+		return "anthropic", h.cfg.AnthropicModel
+	}
+}
+
+// estimateOutline adds the expected cost of planning an outline: summarizing every source
+// part, grouping them into modules and planning each module
+func (h *Handler) estimateOutline(estimate *CostEstimate, courseID string, numSlides int) error {
+	parts, err := h.loadSourceParts(courseID)
+	if err != nil {
+		return err
+	}
+	provider, model := h.textModel()
+
+	usage := services.Usage{Provider: provider, Model: model, Kind: services.UsageText}
+	if len(parts) > 1 {
+		for _, part := range parts {
+			usage.InputTokens += services.EstimateTokens(part.Content) + promptOverheadTokens
+			usage.OutputTokens += estimatedSummaryTokens
+		}
+		usage.InputTokens += len(parts)*estimatedSummaryTokens + promptOverheadTokens
+		usage.OutputTokens += estimatedPlanTokens
+	}
+	modules := max(1, min(len(parts), numSlides))
+	usage.InputTokens += modules * (maxContentLength/4 + promptOverheadTokens)
+	usage.OutputTokens += modules * estimatedPlanTokens
+	estimate.add(h, "outline", usage)
+	return nil
+}
+
+// estimateCourse returns the expected cost of a course generation request. Repair
+// attempts of invalid answers aren't included.
+func (h *Handler) estimateCourse(req GenerateCourseRequest) (*CostEstimate, error) {
+	estimate := &CostEstimate{Items: []EstimateItem{}}
+
+	numSlides := req.NumSlides
+	if req.UseOutline {
+		_, outline, err := h.loadOutline(req.CourseID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load outline: %w", err)
+		}
+		numSlides = len(outline.slides())
+	} else if err := h.estimateOutline(estimate, req.CourseID, numSlides); err != nil {
+		return nil, err
+	}
+
+	var sourceChars int
+	if err := h.db.Model(&models.Chunk{}).Where("course_id = ?", req.CourseID).
+		Select("COALESCE(SUM(LENGTH(content)), 0)").Scan(&sourceChars).Error; err != nil {
+		return nil, fmt.Errorf("failed to measure course content: %w", err)
+	}
+
+	provider, model := h.textModel()
+	estimate.add(h, "slides", services.Usage{
+		Provider:     provider,
+		Model:        model,
+		Kind:         services.UsageText,
+		InputTokens:  numSlides * (min(sourceChars, maxContentLength)/4 + promptOverheadTokens),
+		OutputTokens: numSlides * estimatedSlideTokens,
+	})
+
+	// Web images are always found first when enabled, so DALL-E is only used without them
+	if req.GenerateImages && req.UseDalle && !req.UseWebImages && h.images != nil {
+		estimate.add(h, "images", services.Usage{Provider: h.images.GetProviderName(), Model: h.images.GetModelName(), Kind: services.UsageImage, Images: numSlides})
+	}
+	if req.GenerateVoiceover && h.voiceover != nil {
+		estimate.add(h, "voiceover", services.Usage{Provider: h.voiceover.GetProviderName(), Model: h.voiceover.GetModelName(), Kind: services.UsageSpeech, Characters: numSlides * estimatedScriptChars})
+	}
+	return estimate, nil
+}
+
+// preflight checks an estimate against the budgets, answering 402 with the estimate when
+// the work would exceed one. It reports whether the work may start.
+func (h *Handler) preflight(c *gin.Context, courseID string, estimate *CostEstimate) bool {
+	statuses, err := h.checkBudget(courseID, requestUser(c), estimate.Total)
+	var budgetErr *services.BudgetError
+	if errors.As(err, &budgetErr) {
+		c.JSON(http.StatusPaymentRequired, EstimateResponse{
+			Estimate: estimate,
+			Budgets:  statuses,
+			Error:    budgetErr.Error(),
+		})
+		return false
+	}
+	if err != nil {
+		log.Error().Err(err).Str("course_id", courseID).Msg("Failed to check budgets")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check budgets"})
+		return false
+	}
+	return true
+}
+
+// respondBudgetError answers 402 when err is a refused call, reporting whether it was
+func respondBudgetError(c *gin.Context, err error) bool {
+	var budgetErr *services.BudgetError
+	if !errors.As(err, &budgetErr) {
+		return false
+	}
+	c.JSON(http.StatusPaymentRequired, gin.H{"error": budgetErr.Error(), "scope": budgetErr.Scope})
+	return true
+}
+
+// EstimateCourse returns the expected cost of a generation request and whether the
+// budgets allow it, so the UI can show the cost before starting
+func (h *Handler) EstimateCourse(c *gin.Context) {
+	var req GenerateCourseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.UseOutline && req.NumSlides == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "num_slides is required when not generating from an outline"})
+		return
+	}
+
+	estimate, err := h.estimateCourse(req)
+	if err != nil {
+		log.Error().Err(err).Str("course_id", req.CourseID).Msg("Failed to estimate course cost")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to estimate cost"})
+		return
+	}
+
+	statuses, err := h.checkBudget(req.CourseID, requestUser(c), estimate.Total)
+	resp := EstimateResponse{Estimate: estimate, Budgets: statuses, Allowed: err == nil}
+	var budgetErr *services.BudgetError
+	if errors.As(err, &budgetErr) {
+		resp.Error = budgetErr.Error()
+	} else if err != nil {
+		log.Error().Err(err).Str("course_id", req.CourseID).Msg("Failed to check budgets")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check budgets"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetBudgets reports the budgets that apply to a course (?course_id=) and the current user
+func (h *Handler) GetBudgets(c *gin.Context) {
+	statuses, err := h.budgetStatuses(c.Query("course_id"), requestUser(c))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load budgets")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load budgets"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"budgets": statuses})
+}
+
+// SetCourseBudgetRequest sets a course's own spending limit; null restores the default.
+// Unlike the defaults, where 0 means no limit, a course's own limit of 0 blocks all
+// paid calls for the course.
+type SetCourseBudgetRequest struct {
+	BudgetUSD *float64 `json:"budget_usd"`
+}
+
+// SetCourseBudget gives a course its own spending limit instead of BUDGET_COURSE_USD
+func (h *Handler) SetCourseBudget(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var req SetCourseBudgetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.BudgetUSD != nil && *req.BudgetUSD < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "budget_usd must not be negative"})
+		return
+	}
+
+	result := h.db.Model(&models.Course{}).Where("id = ?", courseID).Update("budget_usd", req.BudgetUSD)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update budget"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+
+	statuses, err := h.budgetStatuses(courseID, requestUser(c))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load budgets")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load budgets"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"course_id": courseID, "budget_usd": req.BudgetUSD, "budgets": statuses})
+}
@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	chatHistoryMessages = 10   // Previous messages fed into query rewriting and the answer prompt
+	chatHistoryMaxChars = 1000 // Per message, so one long answer can't crowd out the context
+)
+
+type ChatRequest struct {
+	CourseID  string `json:"course_id" binding:"required"`
+	Question  string `json:"question" binding:"required"`
+	SessionID string `json:"session_id"` // empty starts a new session
+	LearnerID string `json:"learner_id"`
+	RetrievalOptions
+}
+
+type ChatResponse struct {
+	SessionID string            `json:"session_id"`
+	Answer    string            `json:"answer"`
+	Citations []models.Citation `json:"citations"`
+}
+
+type CreateChatSessionRequest struct {
+	CourseID  string `json:"course_id" binding:"required"`
+	LearnerID string `json:"learner_id"`
+	Title     string `json:"title"`
+}
+
+var errSessionCourse = errors.New("session belongs to a different course")
+
+// resolveSession loads the session of a chat request, or starts a new one
+func (h *Handler) resolveSession(req ChatRequest) (*models.ChatSession, error) {
+	if req.SessionID != "" {
+		var session models.ChatSession
+		if err := h.db.Where("id = ?", req.SessionID).First(&session).Error; err != nil {
+			return nil, err
+		}
+		if session.CourseID != req.CourseID {
+			return nil, errSessionCourse
+		}
+		return &session, nil
+	}
+
+	session := &models.ChatSession{
+		ID:        uuid.New().String(),
+		CourseID:  req.CourseID,
+		LearnerID: req.LearnerID,
+		Title:     truncateText(req.Question, 80),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := h.db.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// chatHistory returns the most recent messages of a session, oldest first
+func (h *Handler) chatHistory(sessionID string) []models.ChatMessage {
+	var history []models.ChatMessage
+	h.db.Where("session_id = ?", sessionID).Order("created_at DESC").Limit(chatHistoryMessages).Find(&history)
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history
+}
+
+func formatHistory(history []models.ChatMessage) string {
+	if len(history) == 0 {
+		return "(This is the first question of the conversation.)"
+	}
+
+	var b strings.Builder
+	for _, msg := range history {
+		speaker := "Student"
+		if msg.Role == "assistant" {
+			speaker = "Assistant"
+		}
+		b.WriteString(fmt.Sprintf("%s: %s\n\n", speaker, truncateText(msg.Content, chatHistoryMaxChars)))
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// rewriteQuery turns a follow-up question into a standalone retrieval query using the
+// conversation, so "explain that more simply" still finds the right chunks
+func (h *Handler) rewriteQuery(ctx context.Context, history []models.ChatMessage, question string) string {
+	if len(history) == 0 {
+		return question
+	}
+
+	systemPrompt := h.readPrompt("query_rewrite.md")
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{history}", formatHistory(history))
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{question}", question)
+
+	rewritten, err := h.aiProvider.GenerateText(ctx, question, systemPrompt)
+	rewritten = strings.Trim(strings.TrimSpace(rewritten), "\"")
+	if err != nil || rewritten == "" {
+		log.Warn().Err(err).Msg("Failed to rewrite chat query, using previous question as context")
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Role == "user" {
+				return history[i].Content + "\n" + question
+			}
+		}
+		return question
+	}
+
+	log.Debug().Str("question", question).Str("query", rewritten).Msg("Rewrote follow-up question")
+	return rewritten
+}
+
+// groundedAnswerPrompt retrieves the chunks most relevant to the search query and builds the
+// system prompt that grounds the answer in them and the conversation so far
+func (h *Handler) groundedAnswerPrompt(ctx context.Context, req ChatRequest, searchQuery string, history []models.ChatMessage) (string, []models.Citation, error) {
+	topChunks, err := h.retrieveChunks(ctx, req.CourseID, searchQuery, req.RetrievalOptions)
+	if err != nil {
+		return "", nil, err
+	}
+
+	citations := make([]models.Citation, len(topChunks))
+	for i, sc := range topChunks {
+		citations[i] = models.Citation{
+			Number:        i + 1,
+			ChunkID:       sc.Chunk.ID,
+			SourceFileID:  sc.Chunk.SourceFileID,
+			PageStart:     sc.Chunk.PageNum,
+			PageEnd:       sc.Chunk.PageEnd,
+			Section:       sc.Chunk.HeadingPath,
+			OCRConfidence: sc.Chunk.OCRConfidence,
+			Snippet:       citationSnippet(sc.Chunk.Content, searchQuery),
+			Score:         sc.Score,
+		}
+	}
+	h.resolveCitations(citations)
+
+	contextBuilder := strings.Builder{}
+	for i, sc := range topChunks {
+		contextBuilder.WriteString(fmt.Sprintf("[%d] (%s)\n%s\n\n", i+1, citationLabel(citations[i]), sc.Chunk.Content))
+	}
+
+	systemPrompt := h.readPrompt("answer_grounded.md")
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{context}", contextBuilder.String())
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{history}", formatHistory(history))
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{question}", req.Question)
+
+	return systemPrompt, citations, nil
+}
+
+// resolveCitations fills in the file names of cited chunks and the slides that cover them
+func (h *Handler) resolveCitations(citations []models.Citation) {
+	if len(citations) == 0 {
+		return
+	}
+
+	var fileIDs, chunkIDs []string
+	for _, citation := range citations {
+		fileIDs = append(fileIDs, citation.SourceFileID)
+		chunkIDs = append(chunkIDs, citation.ChunkID)
+	}
+
+	var files []models.SourceFile
+	h.db.Where("id IN ?", fileIDs).Find(&files)
+	fileNames := make(map[string]string, len(files))
+	for _, file := range files {
+		fileNames[file.ID] = file.Filename
+	}
+
+	var covering []struct {
+		ChunkID     string
+		ID          string
+		SlideNumber int
+		Title       string
+	}
+	h.db.Table("slide_sources").
+		Select("slide_sources.chunk_id, slides.id, slides.slide_number, slides.title").
+		Joins("JOIN slides ON slides.id = slide_sources.slide_id").
+		Where("slide_sources.chunk_id IN ?", chunkIDs).
+		Order("slides.slide_number ASC").
+		Scan(&covering)
+	slidesByChunk := make(map[string][]models.CitationSlide)
+	for _, row := range covering {
+		slidesByChunk[row.ChunkID] = append(slidesByChunk[row.ChunkID], models.CitationSlide{
+			ID:          row.ID,
+			SlideNumber: row.SlideNumber,
+			Title:       row.Title,
+		})
+	}
+
+	for i := range citations {
+		citations[i].FileName = fileNames[citations[i].SourceFileID]
+		citations[i].Slides = slidesByChunk[citations[i].ChunkID]
+	}
+}
+
+// citationLabel describes where a cited chunk comes from, e.g. "notes.pdf, pages 3-4,
+// Cells > Organelles"
+func citationLabel(citation models.Citation) string {
+	label := citation.FileName
+	if label == "" {
+		label = "course material"
+	}
+	switch {
+	case citation.PageStart == 0:
+	case citation.PageEnd > citation.PageStart:
+		label += fmt.Sprintf(", pages %d-%d", citation.PageStart, citation.PageEnd)
+	default:
+		label += fmt.Sprintf(", page %d", citation.PageStart)
+	}
+	if citation.Section != "" {
+		label += ", " + citation.Section
+	}
+	return label
+}
+
+// citationSnippet quotes the part of a chunk that best matches the query: the sentence
+// sharing the most words with it, extended with the following sentences up to a few
+// hundred characters
+func citationSnippet(content, query string) string {
+	const maxSnippet = 300
+
+	content = strings.Join(strings.Fields(content), " ")
+	sentences := splitSentences(content)
+	if len(sentences) == 0 {
+		return ""
+	}
+
+	terms := make(map[string]bool)
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		word = strings.Trim(word, ".,;:!?\"'()")
+		if len(word) > 3 {
+			terms[word] = true
+		}
+	}
+
+	best, bestScore := 0, 0
+	for i, sentence := range sentences {
+		score := 0
+		for _, word := range strings.Fields(strings.ToLower(sentence)) {
+			if terms[strings.Trim(word, ".,;:!?\"'()")] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	snippet := sentences[best]
+	for _, next := range sentences[best+1:] {
+		if len(snippet)+1+len(next) > maxSnippet {
+			break
+		}
+		snippet += " " + next
+	}
+	if len(snippet) > maxSnippet {
+		snippet = truncateText(snippet, maxSnippet)
+		if cut := strings.LastIndex(snippet, " "); cut > maxSnippet/2 {
+			snippet = snippet[:cut]
+		}
+		snippet += "…"
+	}
+	return snippet
+}
+
+// splitSentences splits text after sentence-ending punctuation followed by a space
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	for i := 0; i < len(text)-1; i++ {
+		if (text[i] == '.' || text[i] == '!' || text[i] == '?') && text[i+1] == ' ' {
+			sentences = append(sentences, text[start:i+1])
+			start = i + 2
+		}
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
+
+// saveChatTurn stores a question and its answer in the session
+func (h *Handler) saveChatTurn(session *models.ChatSession, question, searchQuery, answer string, citations []models.Citation) {
+	citationsJSON, _ := json.Marshal(citations)
+	now := time.Now()
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		messages := []models.ChatMessage{
+			{
+				ID:          uuid.New().String(),
+				CourseID:    session.CourseID,
+				SessionID:   session.ID,
+				Role:        "user",
+				Content:     question,
+				SearchQuery: searchQuery,
+				CreatedAt:   now,
+			},
+			{
+				ID:            uuid.New().String(),
+				CourseID:      session.CourseID,
+				SessionID:     session.ID,
+				Role:          "assistant",
+				Content:       answer,
+				CitationsJSON: string(citationsJSON),
+				CreatedAt:     now.Add(time.Millisecond), // keep the answer after its question
+			},
+		}
+		if err := tx.Create(&messages).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.ChatSession{}).Where("id = ?", session.ID).Update("updated_at", now).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Str("session_id", session.ID).Msg("Failed to save chat messages")
+	}
+}
+
+// prepareChat resolves the session and history of a chat request and builds the answer
+// prompt, writing an error response and returning ok=false when that fails
+func (h *Handler) prepareChat(c *gin.Context, req ChatRequest) (session *models.ChatSession, searchQuery, systemPrompt string, citations []models.Citation, ok bool) {
+	options, err := h.retrievalOptions(req.RetrievalOptions)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, "", "", nil, false
+	}
+	req.RetrievalOptions = options
+
+	// Lexical retrieval alone doesn't compare vectors, so it works during a model migration
+	if options.Strategy != RetrievalLexical || options.MMR {
+		if err := h.checkEmbeddingModel(req.CourseID); errors.Is(err, errEmbeddingModel) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return nil, "", "", nil, false
+		} else if err != nil {
+			log.Error().Err(err).Msg("Failed to check embedding models")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve context"})
+			return nil, "", "", nil, false
+		}
+	}
+
+	session, err = h.resolveSession(req)
+	if errors.Is(err, errSessionCourse) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, "", "", nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat session not found"})
+		return nil, "", "", nil, false
+	}
+
+	// Record the rewrite, retrieval and answer calls against the course
+	c.Request = c.Request.WithContext(h.withUsage(c.Request.Context(), usageScope{CourseID: req.CourseID, UserID: requestUser(c), Operation: OperationChat}))
+	ctx := c.Request.Context()
+	history := h.chatHistory(session.ID)
+	searchQuery = h.rewriteQuery(ctx, history, req.Question)
+
+	systemPrompt, citations, err = h.groundedAnswerPrompt(ctx, req, searchQuery, history)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve context")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to embed question"})
+		return nil, "", "", nil, false
+	}
+
+	return session, searchQuery, systemPrompt, citations, true
+}
+
+func (h *Handler) ChatAsk(c *gin.Context) {
+	var req ChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, searchQuery, systemPrompt, citations, ok := h.prepareChat(c, req)
+	if !ok {
+		return
+	}
+
+	answer, err := h.aiProvider.GenerateText(c.Request.Context(), req.Question, systemPrompt)
+	if respondBudgetError(c, err) {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate answer")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate answer"})
+		return
+	}
+
+	h.saveChatTurn(session, req.Question, searchQuery, answer, citations)
+
+	c.JSON(http.StatusOK, ChatResponse{
+		SessionID: session.ID,
+		Answer:    answer,
+		Citations: citations,
+	})
+}
+
+// ChatAskStream answers like ChatAsk but streams the answer as server-sent events:
+// "citations" first (with the session ID), then a "token" event per piece of text and
+// finally "done" with the complete answer (or "error" if generation fails midway)
+func (h *Handler) ChatAskStream(c *gin.Context) {
+	var req ChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, searchQuery, systemPrompt, citations, ok := h.prepareChat(c, req)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.SSEvent("citations", gin.H{"session_id": session.ID, "citations": citations})
+	c.Writer.Flush()
+
+	ctx := c.Request.Context()
+	answer, err := h.aiProvider.StreamText(ctx, req.Question, systemPrompt, func(token string) error {
+		c.SSEvent("token", gin.H{"text": token})
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Info().Str("course_id", req.CourseID).Msg("Client left during streamed answer")
+			return
+		}
+		var budgetErr *services.BudgetError
+		if errors.As(err, &budgetErr) {
+			c.SSEvent("error", gin.H{"error": budgetErr.Error(), "scope": budgetErr.Scope})
+			c.Writer.Flush()
+			return
+		}
+		log.Error().Err(err).Msg("Failed to stream answer")
+		c.SSEvent("error", gin.H{"error": "Failed to generate answer"})
+		c.Writer.Flush()
+		return
+	}
+
+	h.saveChatTurn(session, req.Question, searchQuery, answer, citations)
+
+	c.SSEvent("done", ChatResponse{
+		SessionID: session.ID,
+		Answer:    answer,
+		Citations: citations,
+	})
+	c.Writer.Flush()
+}
+
+func (h *Handler) CreateChatSession(c *gin.Context) {
+	var req CreateChatSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var course models.Course
+	if err := h.db.Where("id = ?", req.CourseID).First(&course).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+
+	session := &models.ChatSession{
+		ID:        uuid.New().String(),
+		CourseID:  req.CourseID,
+		LearnerID: req.LearnerID,
+		Title:     req.Title,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := h.db.Create(session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat session"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// ListChatSessions returns the sessions of a course (?course_id=), optionally only those
+// of one learner (&learner_id=), most recently active first
+func (h *Handler) ListChatSessions(c *gin.Context) {
+	courseID := c.Query("course_id")
+	if courseID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "course_id is required"})
+		return
+	}
+
+	query := h.db.Where("course_id = ?", courseID)
+	if learnerID := c.Query("learner_id"); learnerID != "" {
+		query = query.Where("learner_id = ?", learnerID)
+	}
+
+	var sessions []models.ChatSession
+	if err := query.Order("updated_at DESC").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"course_id": courseID,
+		"sessions":  sessions,
+	})
+}
+
+func (h *Handler) GetChatMessages(c *gin.Context) {
+	sessionID := c.Param("sessionId")
+
+	var session models.ChatSession
+	if err := h.db.Where("id = ?", sessionID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat session not found"})
+		return
+	}
+
+	var messages []models.ChatMessage
+	if err := h.db.Where("session_id = ?", sessionID).Order("created_at ASC").Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat messages"})
+		return
+	}
+	for i := range messages {
+		if messages[i].CitationsJSON != "" {
+			// Messages saved before citations were structured hold plain strings
+			if err := json.Unmarshal([]byte(messages[i].CitationsJSON), &messages[i].Citations); err != nil {
+				messages[i].Citations = nil
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session":  session,
+		"messages": messages,
+	})
+}
+
+func (h *Handler) DeleteChatSession(c *gin.Context) {
+	sessionID := c.Param("sessionId")
+
+	var session models.ChatSession
+	if err := h.db.Where("id = ?", sessionID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat session not found"})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ?", sessionID).Delete(&models.ChatMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&session).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Chat session deleted successfully"})
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm/clause"
+)
+
+// cacheLookupBatch bounds the number of hashes per cache query, below SQLite's variable limit
+const cacheLookupBatch = 500
+
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// embedTexts embeds texts with the configured provider, reusing cached embeddings of
+// identical text under the same model and embedding the rest in concurrent batches.
+// Every vector is checked against the provider's dimension. Texts that could not be
+// embedded get a nil vector; the first error is returned with the vectors that did succeed.
+func (h *Handler) embedTexts(ctx context.Context, texts []string) ([][]float64, error) {
+	return h.embedWithCache(ctx, texts, true)
+}
+
+// embedWithCache is embedTexts with control over cache reads. Without them every text is
+// embedded again and its cached vector replaced.
+func (h *Handler) embedWithCache(ctx context.Context, texts []string, readCache bool) ([][]float64, error) {
+	model := h.embeddingProvider.GetModelName()
+	vectors := make([][]float64, len(texts))
+
+	hashes := make([]string, len(texts))
+	positions := make(map[string][]int, len(texts)) // hash -> indexes of texts with it
+	for i, text := range texts {
+		hashes[i] = contentHash(text)
+		positions[hashes[i]] = append(positions[hashes[i]], i)
+	}
+
+	unique := make([]string, 0, len(positions))
+	for hash := range positions {
+		unique = append(unique, hash)
+	}
+	for start := 0; readCache && start < len(unique); start += cacheLookupBatch {
+		var cached []models.EmbeddingCache
+		h.db.Where("model = ? AND content_hash IN ?", model, unique[start:min(start+cacheLookupBatch, len(unique))]).Find(&cached)
+		for _, entry := range cached {
+			var vector []float64
+			if json.Unmarshal([]byte(entry.Vector), &vector) != nil ||
+				services.ValidateEmbedding(vector, h.embeddingProvider.GetDimension()) != nil {
+				continue
+			}
+			for _, i := range positions[entry.ContentHash] {
+				vectors[i] = vector
+			}
+		}
+	}
+
+	// Embed each distinct missing text once
+	var missing []string
+	var missingHashes []string
+	for i, text := range texts {
+		if vectors[i] != nil || positions[hashes[i]][0] != i {
+			continue
+		}
+		missing = append(missing, text)
+		missingHashes = append(missingHashes, hashes[i])
+	}
+	log.Info().Int("texts", len(texts)).Int("cached", len(texts)-len(missing)).Int("to_embed", len(missing)).Msg("Embedding texts")
+	if len(missing) == 0 {
+		return vectors, nil
+	}
+
+	embedded, err := services.EmbedAll(ctx, h.embeddingProvider, missing, h.cfg.EmbeddingBatch, h.cfg.EmbeddingWorkers)
+
+	var entries []models.EmbeddingCache
+	for j, vector := range embedded {
+		if vector == nil {
+			continue
+		}
+		// Providers check their own vectors, but nothing of the wrong size may reach the index
+		if invalid := services.ValidateEmbedding(vector, h.embeddingProvider.GetDimension()); invalid != nil {
+			if err == nil {
+				err = invalid
+			}
+			continue
+		}
+		for _, i := range positions[missingHashes[j]] {
+			vectors[i] = vector
+		}
+		vectorJSON, _ := json.Marshal(vector)
+		entries = append(entries, models.EmbeddingCache{
+			ContentHash: missingHashes[j],
+			Model:       model,
+			Dimension:   len(vector),
+			Vector:      string(vectorJSON),
+			CreatedAt:   time.Now(),
+		})
+	}
+	if len(entries) > 0 {
+		onConflict := clause.OnConflict{DoNothing: true}
+		if !readCache {
+			onConflict = clause.OnConflict{
+				Columns:   []clause.Column{{Name: "content_hash"}, {Name: "model"}},
+				DoUpdates: clause.AssignmentColumns([]string{"dimension", "vector", "created_at"}),
+			}
+		}
+		if cacheErr := h.db.Clauses(onConflict).CreateInBatches(entries, 100).Error; cacheErr != nil {
+			log.Warn().Err(cacheErr).Msg("Failed to cache embeddings")
+		}
+	}
+
+	return vectors, err
+}
+
+// ProbeEmbeddingDimension asks the embedding provider for its vector size so it is known
+// before the first upload, and logs it
+func (h *Handler) ProbeEmbeddingDimension(ctx context.Context) {
+	dim, err := services.ProbeDimension(h.withUsage(ctx, usageScope{Operation: OperationStartup}), h.embeddingProvider)
+	if err != nil {
+		log.Warn().Err(err).Str("embedding_model", h.embeddingProvider.GetModelName()).Msg("Failed to probe embedding dimension, it will be learned from the first embedding")
+		return
+	}
+	log.Info().Str("embedding_model", h.embeddingProvider.GetModelName()).Int("dimension", dim).Msg("Embedding model ready")
+}
@@ -0,0 +1,455 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	maxContentLength = 12000 // Limit the content of a single LLM call to ~12k characters to avoid Cloudflare blocking
+	maxSlideAttempts = 3     // Generations per slide, including repairs, before falling back to the outline
+	neighbourSlides  = 2     // Slide titles shown on each side of the slide being written
+
+	defaultInstructorStyle = "friendly, conversational level instruction targeted at a general audience"
+
+	// tableInstruction asks for a data slide when the source content holds tables
+	tableInstruction = "\n\nThe source content includes tables. If this slide presents their data, fill the 'table' field with the columns and rows it needs, copying the numbers exactly, and use the \"data\" layout, or \"comparison\" when the table compares items side by side. Never invent numbers."
+)
+
+// readPrompt loads a system prompt from the prompts directory
+func (h *Handler) readPrompt(name string) string {
+	prompt, err := os.ReadFile(filepath.Join(h.cfg.PromptsDir, name))
+	if err != nil {
+		log.Warn().Err(err).Str("prompt", name).Msg("Failed to read prompt")
+	}
+	return string(prompt)
+}
+
+// languageInstruction returns the prompt suffix that enforces a non-English course language
+func languageInstruction(language string) string {
+	languageMap := map[string]string{
+		"indonesian": "Indonesian (Bahasa Indonesia)",
+		"thai":       "Thai",
+		"german":     "German",
+	}
+	langName, ok := languageMap[language]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("\n\n**CRITICAL LANGUAGE REQUIREMENT:**\nYou MUST generate ALL course content in %s language ONLY.\nThis includes:\n- Course title and description\n- All module titles and learning objectives\n- All slide titles\n- All slide content\n- All instructor scripts\n- All quiz questions and options\n\nDo NOT use English anywhere in the course content. The ENTIRE course must be in %s.", langName, langName)
+}
+
+// buildSlidePrompt fills the slide prompt with the presentation style, instructor style
+// and language of the request
+func (h *Handler) buildSlidePrompt(req GenerateCourseRequest) string {
+	systemPromptStr := h.readPrompt("slide_gen.md")
+
+	// Apply presentation style guidelines
+	presentationStyle := req.PresentationStyle
+	if presentationStyle == "" {
+		presentationStyle = "balanced"
+	}
+
+	styleInstructions := map[string]string{
+		"minimal":  "MINIMAL & VISUAL STYLE:\n- Use VERY SHORT, punchy text (2-3 sentences max per slide)\n- Focus on bold statements and key takeaways\n- Emphasize visual impact with striking image prompts\n- Modern, clean design aesthetic\n- Generate vivid, eye-catching image prompts for modern stock photos",
+		"balanced": "BALANCED STYLE:\n- Use moderate amount of text (4-6 sentences per slide)\n- Mix of explanations and key points\n- Balance between text and visual elements\n- Professional yet accessible\n- Generate clear, relevant image prompts for professional stock photos",
+		"detailed": "DETAILED & PROFESSIONAL STYLE:\n- Use comprehensive, information-rich content with 5-8 bullet points per slide\n- Format content as clear bullet points (use '-' or '•' prefix)\n- Each bullet should be a complete, detailed point with specific information\n- Include specific examples, data points, and thorough coverage\n- Professional corporate presentation aesthetic with substantial on-screen text\n- Information-dense slides suitable for detailed handouts\n- Generate businesslike, professional image prompts for corporate stock photos",
+		"fun":      "FUN & ENTERTAINING STYLE:\n- Use MINIMAL text with playful, engaging language (2-4 sentences)\n- Emphasize entertainment value and engagement\n- Light, fun tone throughout\n- Use creative, unexpected angles\n- Generate playful, colorful, dynamic image prompts for fun stock photos",
+	}
+
+	if styleGuide, ok := styleInstructions[presentationStyle]; ok {
+		systemPromptStr += "\n\n" + styleGuide
+	}
+
+	instructorPrompt := req.InstructorPrompt
+	if instructorPrompt == "" {
+		instructorPrompt = defaultInstructorStyle
+	}
+	systemPromptStr = strings.ReplaceAll(systemPromptStr, "{instructor_style}", instructorPrompt)
+
+	return systemPromptStr + languageInstruction(req.language())
+}
+
+// selectSourceChunks picks the chunks most relevant to query, limited to maxLen characters
+// and returned in document order. An empty chunkIDs means every chunk of the course.
+func (h *Handler) selectSourceChunks(ctx context.Context, courseID string, chunkIDs []string, query string, maxLen int) []models.Chunk {
+	var chunks []models.Chunk
+	q := h.db.Where("course_id = ?", courseID)
+	if len(chunkIDs) > 0 {
+		q = q.Where("id IN ?", chunkIDs)
+	}
+	q.Order("chunk_num ASC").Find(&chunks)
+
+	totalLength := 0
+	for _, chunk := range chunks {
+		totalLength += len(chunk.Content)
+	}
+	if totalLength <= maxLen {
+		return chunks
+	}
+
+	// Rank by similarity to the query, falling back to document order without embeddings
+	order := make([]int, len(chunks))
+	for i := range order {
+		order[i] = i
+	}
+	if queryEmbedding, err := h.embeddingProvider.Embed(ctx, query); err != nil {
+		log.Warn().Err(err).Msg("Failed to embed slide query, using document order")
+	} else {
+		ids := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			ids[i] = chunk.ID
+		}
+		var embeddings []models.Embedding
+		// Vectors of another embedding model aren't comparable with the query's
+		h.db.Where("chunk_id IN ? AND model = ?", ids, h.embeddingProvider.GetModelName()).Find(&embeddings)
+
+		scores := make(map[string]float64, len(embeddings))
+		for _, emb := range embeddings {
+			var vector []float64
+			json.Unmarshal([]byte(emb.Vector), &vector)
+			scores[emb.ChunkID] = services.CosineSimilarity(queryEmbedding, vector)
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return scores[chunks[order[a]].ID] > scores[chunks[order[b]].ID]
+		})
+	}
+
+	var picked []int
+	length := 0
+	for _, idx := range order {
+		if length+len(chunks[idx].Content) > maxLen && len(picked) > 0 {
+			continue
+		}
+		picked = append(picked, idx)
+		length += len(chunks[idx].Content)
+	}
+	sort.Ints(picked)
+
+	selected := make([]models.Chunk, len(picked))
+	for i, idx := range picked {
+		selected[i] = chunks[idx]
+	}
+	return selected
+}
+
+// expandSlide writes the full content of one outline slide, with its module, the
+// neighbouring slides and the most relevant source chunks as context
+func (h *Handler) expandSlide(ctx context.Context, req GenerateCourseRequest, outline *CourseOutlineContent, planned []plannedSlide, index int) (*GeneratedSlide, error) {
+	current := planned[index]
+	module := outline.Modules[current.ModuleIndex]
+
+	query := current.Slide.Title + "\n" + strings.Join(current.Slide.KeyPoints, "\n")
+	source, sourceChunkIDs, hasTables := sourceContent(h.selectSourceChunks(ctx, req.CourseID, module.SourceChunkIDs, query, maxContentLength))
+
+	var prompt strings.Builder
+	prompt.WriteString(fmt.Sprintf("Course: %s\n", outline.Title))
+	if outline.Description != "" {
+		prompt.WriteString(fmt.Sprintf("Course description: %s\n", outline.Description))
+	}
+	prompt.WriteString(fmt.Sprintf("\nModule %d of %d: %s\n", current.ModuleIndex+1, len(outline.Modules), module.Title))
+	if len(module.LearningObjectives) > 0 {
+		prompt.WriteString("Learning objectives:\n")
+		for _, objective := range module.LearningObjectives {
+			prompt.WriteString(fmt.Sprintf("- %s\n", objective))
+		}
+	}
+
+	prompt.WriteString("\nSurrounding slides:\n")
+	for i := max(0, index-neighbourSlides); i <= min(len(planned)-1, index+neighbourSlides); i++ {
+		marker := ""
+		if i == index {
+			marker = "  <-- WRITE THIS SLIDE"
+		}
+		prompt.WriteString(fmt.Sprintf("%d. %s%s\n", i+1, planned[i].Slide.Title, marker))
+	}
+
+	prompt.WriteString(fmt.Sprintf("\nWrite slide %d of %d: \"%s\"\n", index+1, len(planned), current.Slide.Title))
+	if len(current.Slide.KeyPoints) > 0 {
+		prompt.WriteString("Key points to cover:\n")
+		for _, point := range current.Slide.KeyPoints {
+			prompt.WriteString(fmt.Sprintf("- %s\n", point))
+		}
+	}
+	if index == 0 {
+		prompt.WriteString("This is the course title slide - use the \"title\" layout.\n")
+	}
+
+	prompt.WriteString(fmt.Sprintf("\nSource content:\n%s", source))
+	prompt.WriteString("\n\nCRITICAL: You MUST include the 'instructor_script' field with 3-5 paragraphs of presentation content.")
+	if hasTables {
+		prompt.WriteString(tableInstruction)
+	}
+	if req.GenerateQuestions {
+		prompt.WriteString("\n\nIMPORTANT: Include a 'question' field. The question MUST be a JSON object (not a string) with this exact structure:\n{\n  \"question\": \"Question text here?\",\n  \"options\": [\"Option 1\", \"Option 2\", \"Option 3\", \"Option 4\"],\n  \"correct_answer\": 0\n}\nDo NOT use a string for the question field. It must be a JSON object.")
+	}
+
+	data, err := services.GenerateValidated(ctx, h.aiProvider, services.StructuredRequest{
+		Prompt:       prompt.String(),
+		SystemPrompt: h.buildSlidePrompt(req),
+		Output:       slideSchema(req.GenerateQuestions, hasTables),
+		Check:        slideChecker(source),
+		Attempts:     maxSlideAttempts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var slide GeneratedSlide
+	if err := json.Unmarshal(data, &slide); err != nil {
+		return nil, fmt.Errorf("failed to parse generated slide: %w", err)
+	}
+	slide.SourceChunkIDs = sourceChunkIDs
+	return &slide, nil
+}
+
+// sourceContent joins the content of the chunks a slide is written from, reporting
+// whether any of them is a table
+func sourceContent(chunks []models.Chunk) (string, []string, bool) {
+	var source strings.Builder
+	ids := make([]string, 0, len(chunks))
+	hasTables := false
+	for _, chunk := range chunks {
+		source.WriteString(chunk.Content)
+		source.WriteString("\n\n")
+		ids = append(ids, chunk.ID)
+		hasTables = hasTables || chunk.Kind == services.ChunkKindTable
+	}
+	return source.String(), ids, hasTables
+}
+
+// outlineFallbackSlide turns an outline slide into a plain slide when generation keeps failing
+func outlineFallbackSlide(slide OutlineSlide) *GeneratedSlide {
+	var content strings.Builder
+	for _, point := range slide.KeyPoints {
+		content.WriteString(fmt.Sprintf("- %s\n", point))
+	}
+	return &GeneratedSlide{
+		Title:   slide.Title,
+		Content: strings.TrimSpace(content.String()),
+	}
+}
+
+// truncateText cuts text to at most maxLen bytes without splitting a UTF-8 character
+func truncateText(text string, maxLen int) string {
+	if len(text) <= maxLen {
+		return text
+	}
+	for maxLen > 0 && !utf8.RuneStart(text[maxLen]) {
+		maxLen--
+	}
+	return text[:maxLen]
+}
+
+// applyOutline stores the course metadata of the outline and clears the previous slides.
+// The previous slides stay available through the course's revisions.
+func (h *Handler) applyOutline(courseID string, outline *CourseOutlineContent) {
+	if err := preserveUnrecordedSlides(h.db, courseID); err != nil {
+		log.Error().Err(err).Msg("Failed to record existing slides as a revision")
+	}
+
+	if err := h.db.Model(&models.Course{}).Where("id = ?", courseID).Updates(map[string]interface{}{
+		"title":       outline.Title,
+		"description": outline.Description,
+		"num_slides":  len(outline.slides()),
+		"updated_at":  time.Now(),
+	}).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to update course")
+	}
+
+	deleteSlides(h.db, "course_id = ?", courseID)
+}
+
+// deleteSlides removes the slides matching the conditions together with their questions
+// and source links
+func deleteSlides(db *gorm.DB, query string, args ...interface{}) {
+	var slideIDs []string
+	db.Model(&models.Slide{}).Where(query, args...).Pluck("id", &slideIDs)
+	if len(slideIDs) == 0 {
+		return
+	}
+	db.Where("slide_id IN ?", slideIDs).Delete(&models.Question{})
+	db.Where("slide_id IN ?", slideIDs).Delete(&models.SlideSource{})
+	db.Where("id IN ?", slideIDs).Delete(&models.Slide{})
+}
+
+// prepareSlide fills in the number, layout and theme of a slide, returning the template
+// the slide was matched to
+func prepareSlide(req GenerateCourseRequest, slide *GeneratedSlide, index int) services.SlideTemplate {
+	// Fix slide numbering - ensure it starts from 1
+	if slide.SlideNumber == 0 {
+		slide.SlideNumber = index + 1
+	}
+
+	// Determine slide template and theme based on content
+	hasData := slide.Table != nil && slide.Table.markdown() != ""
+	isTitle := slide.SlideNumber == 1 || (strings.ToLower(slide.Layout) == "title" && !hasData)
+	hasImage := req.GenerateImages && slide.ImagePrompt != ""
+	template := services.GetSlideTemplate(slide.SlideNumber, slide.Title, slide.Content, isTitle, hasImage, hasData)
+
+	// Apply template to slide if not already set; a table needs a layout that shows it
+	if slide.Layout == "" || (hasData && !isTitle && slide.Layout != "data" && slide.Layout != "comparison") {
+		slide.Layout = template.Layout
+	}
+	if slide.Theme == "" {
+		slide.Theme = template.Theme
+	}
+
+	return template
+}
+
+// markdown writes the table as a Markdown table after its caption, with every row cut or
+// padded to the columns. It is empty for a nil table or one without rows.
+func (t *GeneratedTable) markdown() string {
+	if t == nil || len(t.Columns) == 0 {
+		return ""
+	}
+	cell := func(text string) string {
+		return strings.Join(strings.Fields(text), " ")
+	}
+
+	header := make([]string, len(t.Columns))
+	for i, column := range t.Columns {
+		header[i] = cell(column)
+	}
+	rows := [][]string{header}
+	for _, row := range t.Rows {
+		cells := make([]string, len(t.Columns))
+		empty := true
+		for i := range cells {
+			if i < len(row) {
+				cells[i] = cell(row[i])
+				empty = empty && cells[i] == ""
+			}
+		}
+		if !empty {
+			rows = append(rows, cells)
+		}
+	}
+	if len(rows) == 1 {
+		return ""
+	}
+
+	table := services.MarkdownTable(rows)
+	if caption := cell(t.Caption); caption != "" {
+		return caption + "\n\n" + table
+	}
+	return table
+}
+
+// slideImage fetches the image of a slide when image generation is enabled
+func (h *Handler) slideImage(ctx context.Context, req GenerateCourseRequest, slide *GeneratedSlide, template services.SlideTemplate) string {
+	log.Info().
+		Int("slide", slide.SlideNumber).
+		Bool("req_generate_images", req.GenerateImages).
+		Str("image_prompt", slide.ImagePrompt).
+		Bool("will_generate_image", req.GenerateImages && slide.ImagePrompt != "").
+		Msg("Image generation check")
+
+	if !req.GenerateImages || slide.ImagePrompt == "" {
+		return ""
+	}
+
+	// Enhance the image prompt based on template
+	enhancedPrompt := services.GetImagePromptEnhanced(slide.ImagePrompt, template)
+
+	// Use the new intelligent image fetching
+	imageURL, err := services.GetImageForSlide(ctx, enhancedPrompt, req.UseWebImages, req.UseDalle, h.images)
+	if err != nil {
+		log.Warn().Err(err).Int("slide", slide.SlideNumber).Msg("Failed to get image")
+		return ""
+	}
+
+	log.Info().Str("url", imageURL).Int("slide", slide.SlideNumber).Msg("Image obtained for slide")
+	return imageURL
+}
+
+// slideVoiceover generates the voiceover of a slide when voiceover generation is enabled
+func (h *Handler) slideVoiceover(ctx context.Context, req GenerateCourseRequest, slide *GeneratedSlide) string {
+	if !req.GenerateVoiceover || slide.InstructorScript == "" || h.voiceover == nil {
+		return ""
+	}
+
+	audioURL, err := h.voiceover.GenerateVoiceover(ctx, slide.InstructorScript, req.CourseID, req.language(), slide.SlideNumber)
+	if err != nil {
+		log.Warn().Err(err).Int("slide", slide.SlideNumber).Msg("Failed to generate voiceover")
+		return ""
+	}
+	return audioURL
+}
+
+// saveQuestion stores the parsed question of a slide
+func (h *Handler) saveQuestion(slideID string, question *GeneratedQuestion) {
+	optionsJSON, _ := json.Marshal(question.Options)
+	questionModel := &models.Question{
+		ID:            uuid.New().String(),
+		SlideID:       slideID,
+		Question:      question.Question,
+		Options:       string(optionsJSON),
+		CorrectAnswer: question.CorrectAnswer,
+		CreatedAt:     time.Now(),
+	}
+	if err := h.db.Create(questionModel).Error; err != nil {
+		log.Warn().Err(err).Msg("Failed to save question")
+	}
+}
+
+// buildSlide fetches media for one generated slide and stores it with its question.
+// It is idempotent per slide number so an interrupted job can safely redo the slide.
+func (h *Handler) buildSlide(ctx context.Context, req GenerateCourseRequest, slide GeneratedSlide, index int) error {
+	template := prepareSlide(req, &slide, index)
+	imageURL := h.slideImage(ctx, req, &slide, template)
+	audioURL := h.slideVoiceover(ctx, req, &slide)
+	if err := ctx.Err(); err != nil {
+		// Media was cut short - leave the slide for the resumed job to redo
+		return err
+	}
+
+	// Drop anything left over from an interrupted attempt at this slide
+	deleteSlides(h.db, "course_id = ? AND slide_number = ?", req.CourseID, slide.SlideNumber)
+
+	slideID := uuid.New().String()
+	slideModel := &models.Slide{
+		ID:               slideID,
+		CourseID:         req.CourseID,
+		SlideNumber:      slide.SlideNumber,
+		Title:            slide.Title,
+		Content:          slide.Content,
+		InstructorScript: slide.InstructorScript,
+		ImagePrompt:      slide.ImagePrompt,
+		ImageURL:         imageURL,
+		AudioURL:         audioURL,
+		Layout:           slide.Layout,
+		Table:            slide.Table.markdown(),
+		Theme:            slide.Theme,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	if err := h.db.Create(slideModel).Error; err != nil {
+		return fmt.Errorf("failed to save slide: %w", err)
+	}
+
+	// Save question if it exists and was successfully parsed
+	if slide.Question != nil {
+		h.saveQuestion(slideID, slide.Question)
+	}
+
+	if err := replaceSlideSources(h.db, req.CourseID, slideID, slide.SourceChunkIDs); err != nil {
+		log.Warn().Err(err).Str("slide_id", slideID).Msg("Failed to save slide sources")
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -24,43 +25,213 @@ type Handler struct {
 	cfg               *config.Config
 	aiProvider        services.AIProvider
 	embeddingProvider services.EmbeddingProvider
+	images            services.ImageProvider     // nil when images can't be generated
+	voiceover         services.VoiceoverProvider // nil when voiceovers can't be generated
+	jobQueue          chan string
+	jobEvents         *jobBroker
+	runningJobs       *runningJobs
+	vectors           *vectorIndexes
+	lexical           *lexicalIndexes
+	prices            services.PriceTable
+	extractors        *services.ExtractorRegistry
+	ocr               *services.OCR // nil when OCR is off
 }
 
-func New(db *gorm.DB, cfg *config.Config) *Handler {
-	var aiProvider services.AIProvider
-	if cfg.ModelProvider == "openai" {
-		aiProvider = services.NewAIProvider("openai", cfg.OpenAIAPIKey, cfg.OpenAIModel)
-	} else {
-		aiProvider = services.NewAIProvider("anthropic", cfg.AnthropicAPIKey, cfg.AnthropicModel)
+// newAIProvider creates a configured provider, with the given model or the provider's
+// configured one
+func newAIProvider(cfg *config.Config, provider, model string) services.AIProvider {
+	switch provider {
+	case "openai":
+		if model == "" {
+			model = cfg.OpenAIModel
+		}
+		return services.NewAIProvider("openai", cfg.OpenAIAPIKey, model, cfg.OpenAIBaseURL)
+	case "ollama":
+		if model == "" {
+			model = cfg.OllamaModel
+		}
+		return services.NewAIProvider("ollama", "", model, cfg.OllamaHost)
+	case "fake":
+		return services.NewAIProvider("fake", "", "", "")
+	default:
+		if model == "" {
+			model = cfg.AnthropicModel
+		}
+		return services.NewAIProvider("anthropic", cfg.AnthropicAPIKey, model, "")
+	}
+}
+
+// newAIProviderChain creates MODEL_PROVIDER, wrapped in a fallback chain when
+// MODEL_FALLBACKS lists other providers ("provider" or "provider:model", comma separated)
+func newAIProviderChain(cfg *config.Config) services.AIProvider {
+	primary := newAIProvider(cfg, cfg.ModelProvider, "")
+	if strings.TrimSpace(cfg.ModelFallbacks) == "" {
+		return primary
+	}
+
+	providers := []services.AIProvider{primary}
+	for _, entry := range strings.Split(cfg.ModelFallbacks, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, model, _ := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "anthropic" && name != "openai" && name != "ollama" && name != "fake" {
+			log.Warn().Str("provider", name).Msg("Ignoring unknown fallback provider")
+			continue
+		}
+		providers = append(providers, newAIProvider(cfg, name, strings.TrimSpace(model)))
+	}
+	log.Info().Str("primary", cfg.ModelProvider).Str("fallbacks", cfg.ModelFallbacks).Msg("Model fallback chain configured")
+	return services.NewFallbackProvider(providers, cfg.CircuitFailures, cfg.CircuitCooldown)
+}
+
+// newMediaProviders creates the image and voiceover generators: fakes for the fake model,
+// OpenAI's when there is an OpenAI key, none otherwise
+func newMediaProviders(cfg *config.Config) (services.ImageProvider, services.VoiceoverProvider) {
+	switch {
+	case cfg.ModelProvider == "fake":
+		return &services.FakeImages{}, &services.FakeVoiceover{AudioDir: cfg.AudioDir}
+	case cfg.OpenAIAPIKey != "":
+		return &services.DalleImages{APIKey: cfg.OpenAIAPIKey}, &services.OpenAIVoiceover{APIKey: cfg.OpenAIAPIKey, AudioDir: cfg.AudioDir}
+	default:
+		return nil, nil
 	}
+}
+
+// newOCR creates the OCR engine and page renderer: fakes for OCR_ENGINE=fake, Tesseract
+// and pdftoppm when they are installed, none otherwise. Without pdftoppm only images are
+// recognized.
+func newOCR(cfg *config.Config) *services.OCR {
+	switch cfg.OCREngine {
+	case "fake":
+		return &services.OCR{Engine: &services.FakeOCR{}, Renderer: &services.FakePageRenderer{}, MaxPages: cfg.OCRMaxPages}
+	case "tesseract":
+		engine, err := services.NewTesseract(cfg.TesseractPath, cfg.OCRLanguages)
+		if err != nil {
+			log.Warn().Err(err).Msg("OCR disabled: scanned pages and images can't be read")
+			return nil
+		}
+		ocr := &services.OCR{Engine: engine, MaxPages: cfg.OCRMaxPages}
+		if renderer, err := services.NewPdftoppm(cfg.PdftoppmPath, cfg.OCRDPI); err != nil {
+			log.Warn().Err(err).Msg("OCR of scanned PDF pages disabled")
+		} else {
+			ocr.Renderer = renderer
+		}
+		return ocr
+	case "", "none":
+		return nil
+	default:
+		log.Warn().Str("engine", cfg.OCREngine).Msg("Unknown OCR engine, OCR disabled")
+		return nil
+	}
+}
+
+func New(db *gorm.DB, cfg *config.Config) *Handler {
+	aiProvider := newAIProviderChain(cfg)
 
 	embeddingProvider := services.NewEmbeddingProvider(
 		cfg.EmbeddingProvider,
 		cfg.OpenAIAPIKey,
 		cfg.EmbeddingModel,
 		cfg.OllamaHost,
+		cfg.OpenAIBaseURL,
+		cfg.EmbeddingDims,
 	)
 
+	images, voiceover := newMediaProviders(cfg)
+
+	prices, err := services.LoadPriceTable(cfg.PriceTableFile)
+	if err != nil {
+		log.Warn().Err(err).Str("file", cfg.PriceTableFile).Msg("Using default prices")
+	}
+
+	extractors := services.DefaultExtractors()
+	ocr := newOCR(cfg)
+	if ocr != nil {
+		ocr.RegisterImages(extractors)
+	}
+
 	return &Handler{
 		db:                db,
 		cfg:               cfg,
 		aiProvider:        aiProvider,
 		embeddingProvider: embeddingProvider,
+		images:            images,
+		voiceover:         voiceover,
+		jobQueue:          make(chan string, jobQueueSize),
+		jobEvents:         newJobBroker(),
+		runningJobs:       newRunningJobs(),
+		vectors:           newVectorIndexes(cfg.VectorIndex, cfg.VectorIndexDir),
+		lexical:           newLexicalIndexes(),
+		prices:            prices,
+		extractors:        extractors,
+		ocr:               ocr,
 	}
 }
 
 func (h *Handler) Health(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"status":             "ok",
-		"model_provider":     h.cfg.ModelProvider,
-		"embedding_provider": h.cfg.EmbeddingProvider,
-	})
+	health := gin.H{
+		"status":              "ok",
+		"model_provider":      h.cfg.ModelProvider,
+		"embedding_provider":  h.cfg.EmbeddingProvider,
+		"embedding_model":     h.embeddingProvider.GetModelName(),
+		"embedding_dimension": h.embeddingProvider.GetDimension(),
+	}
+	if chain, ok := h.aiProvider.(*services.FallbackProvider); ok {
+		health["providers"] = chain.Status()
+	}
+	health["ocr_engine"] = "none"
+	if h.ocr != nil {
+		health["ocr_engine"] = h.ocr.Engine.GetEngineName()
+	}
+	c.JSON(http.StatusOK, health)
 }
 
 type UploadResponse struct {
-	CourseID string `json:"course_id"`
-	PDFName  string `json:"pdf_name"`
-	Message  string `json:"message"`
+	CourseID string                    `json:"course_id"`
+	PDFName  string                    `json:"pdf_name"` // name of the uploaded file, whatever its type
+	MimeType string                    `json:"mime_type"`
+	Chunking services.ChunkOptions     `json:"chunking"`
+	Report   services.ExtractionReport `json:"extraction_report"`
+	Message  string                    `json:"message"`
+}
+
+// supportedFormats names the formats that can be uploaded, for error messages
+func (h *Handler) supportedFormats() string {
+	if h.ocr != nil {
+		return "PDF, Word (DOCX), PowerPoint (PPTX), EPUB, HTML, Markdown, plain text and PNG or JPEG images"
+	}
+	return "PDF, Word (DOCX), PowerPoint (PPTX), EPUB, HTML, Markdown and plain text"
+}
+
+// chunkOptions reads the chunk_size, chunk_overlap and chunk_unit form fields of an
+// upload, defaulting to CHUNK_SIZE, CHUNK_OVERLAP and CHUNK_UNIT
+func (h *Handler) chunkOptions(c *gin.Context) (services.ChunkOptions, error) {
+	opts := services.ChunkOptions{Size: h.cfg.ChunkSize, Overlap: h.cfg.ChunkOverlap, Unit: h.cfg.ChunkUnit}
+	if opts.Size == 0 {
+		opts = services.DefaultChunkOptions()
+	}
+	if opts.Unit == "" {
+		opts.Unit = services.ChunkUnitChars
+	}
+
+	for field, value := range map[string]*int{"chunk_size": &opts.Size, "chunk_overlap": &opts.Overlap} {
+		raw := c.PostForm(field)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be a whole number", field)
+		}
+		*value = parsed
+	}
+	if unit := c.PostForm("chunk_unit"); unit != "" {
+		opts.Unit = strings.ToLower(unit)
+	}
+	return opts, opts.Validate()
 }
 
 func (h *Handler) UploadPDF(c *gin.Context) {
@@ -70,13 +241,14 @@ func (h *Handler) UploadPDF(c *gin.Context) {
 		return
 	}
 
-	if !strings.HasSuffix(strings.ToLower(file.Filename), ".pdf") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Only PDF files are allowed"})
+	if file.Size > h.cfg.MaxUploadSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File size exceeds 50MB limit"})
 		return
 	}
 
-	if file.Size > h.cfg.MaxUploadSize {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File size exceeds 50MB limit"})
+	chunking, err := h.chunkOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -97,7 +269,7 @@ func (h *Handler) UploadPDF(c *gin.Context) {
 		}
 	}
 
-	uploadDir := "./storage/uploads"
+	uploadDir := h.cfg.UploadDir
 	os.MkdirAll(uploadDir, 0755)
 
 	sourceFileID := uuid.New().String()
@@ -108,14 +280,60 @@ func (h *Handler) UploadPDF(c *gin.Context) {
 		return
 	}
 
-	text, err := services.ExtractTextFromPDF(filepath)
+	// The type is sniffed from the content; the file name may say anything
+	doc, err := h.extractors.Extract(filepath)
+	mimeType := doc.MimeType
+	if errors.Is(err, services.ErrUnsupportedType) {
+		os.Remove(filepath)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":     fmt.Sprintf("Unsupported file type %s. Supported formats: %s", mimeType, h.supportedFormats()),
+			"mime_type": mimeType,
+		})
+		return
+	}
+	if errors.Is(err, services.ErrArchiveTooLarge) {
+		os.Remove(filepath)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "The document expands beyond the size limit once decompressed", "mime_type": mimeType})
+		return
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to extract text")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extract text from PDF"})
+		// A damaged or malformed document, not a server fault
+		log.Warn().Err(err).Str("mime_type", mimeType).Msg("Failed to extract text")
+		os.Remove(filepath)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to extract text from file", "mime_type": mimeType})
 		return
 	}
 
-	chunks := services.ChunkText(text)
+	// Images, and pages without a text layer, are read by OCR instead
+	if h.ocr != nil {
+		if err := h.ocr.Recognize(c.Request.Context(), filepath, doc); err != nil {
+			log.Warn().Err(err).Str("course_id", courseID).Msg("Some pages could not be recognized")
+		}
+	}
+
+	if len(doc.Report.FailedPages) > 0 || len(doc.Report.ScannedPages) > 0 {
+		log.Warn().
+			Str("course_id", courseID).
+			Ints("failed_pages", doc.Report.FailedPages).
+			Ints("scanned_pages", doc.Report.ScannedPages).
+			Ints("ocr_pages", doc.Report.OCRPages).
+			Msg("Some pages could not be extracted")
+	}
+
+	chunks := services.ChunkPages(doc.Pages, chunking)
+	if len(chunks) == 0 {
+		os.Remove(filepath)
+		message := "No text could be extracted from the file"
+		if h.ocr == nil {
+			message += ". Scanned documents and images need OCR, see OCR_ENGINE"
+		}
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":             message,
+			"mime_type":         mimeType,
+			"extraction_report": doc.Report,
+		})
+		return
+	}
 
 	// Create course record only if this is a new course
 	if isNewCourse {
@@ -134,64 +352,124 @@ func (h *Handler) UploadPDF(c *gin.Context) {
 
 	// Create source file record
 	sourceFile := &models.SourceFile{
-		ID:        sourceFileID,
-		CourseID:  courseID,
-		Filename:  file.Filename,
-		FilePath:  filepath,
-		FileSize:  file.Size,
-		CreatedAt: time.Now(),
-	}
+		ID:           sourceFileID,
+		CourseID:     courseID,
+		Filename:     file.Filename,
+		FilePath:     filepath,
+		FileSize:     file.Size,
+		MimeType:     mimeType,
+		ChunkSize:    chunking.Size,
+		ChunkOverlap: chunking.Overlap,
+		ChunkUnit:    chunking.Unit,
+		Title:        doc.Info.Title,
+		Author:       doc.Info.Author,
+		CreatedAt:    time.Now(),
+	}
+	if len(doc.Outline) > 0 {
+		outlineJSON, _ := json.Marshal(doc.Outline)
+		sourceFile.OutlineJSON = string(outlineJSON)
+	}
+	reportJSON, _ := json.Marshal(doc.Report)
+	sourceFile.ReportJSON = string(reportJSON)
 	if err := h.db.Create(sourceFile).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to create source file record")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create source file record"})
 		return
 	}
 
+	// Load the course's vector index before adding to it, so a persisted index is
+	// extended rather than rebuilt. Whatever gets embedded is indexed, even if the
+	// client leaves halfway.
+	if _, err := h.courseIndex(courseID); err != nil {
+		log.Warn().Err(err).Str("course_id", courseID).Msg("Failed to load vector index")
+	}
+	chunkModels := make([]models.Chunk, len(chunks))
+	texts := make([]string, len(chunks))
 	for i, chunk := range chunks {
-		chunkID := uuid.New().String()
-		chunkModel := &models.Chunk{
-			ID:           chunkID,
+		chunkModels[i] = models.Chunk{
+			ID:           uuid.New().String(),
 			CourseID:     courseID,
 			SourceFileID: sourceFileID,
-			Content:      chunk,
+			Content:      chunk.Content,
 			ChunkNum:     i,
+			PageNum:      chunk.PageStart,
+			PageEnd:      chunk.PageEnd,
+			HeadingPath:  chunk.HeadingPath(),
+			Kind:         chunk.Kind,
+			Caption:      chunk.Caption,
+			TableCSV:     chunk.CSV(),
 			CreatedAt:    time.Now(),
 		}
-		if err := h.db.Create(chunkModel).Error; err != nil {
-			log.Warn().Err(err).Int("chunk", i).Msg("Failed to save chunk")
-			continue
+		if chunk.Recognized {
+			confidence := chunk.Confidence
+			chunkModels[i].OCRConfidence = &confidence
+		}
+		texts[i] = chunk.Content
+	}
+	if len(chunkModels) > 0 {
+		if err := h.db.CreateInBatches(chunkModels, 100).Error; err != nil {
+			log.Error().Err(err).Msg("Failed to save chunks")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunks"})
+			return
 		}
+	}
 
-		embedding, err := h.embeddingProvider.Embed(chunk)
-		if err != nil {
-			log.Warn().Err(err).Int("chunk", i).Msg("Failed to generate embedding")
+	chunkTexts := make(map[string]string, len(chunkModels))
+	for _, chunk := range chunkModels {
+		chunkTexts[chunk.ID] = chunk.Content
+	}
+	h.indexChunkText(courseID, chunkTexts)
+
+	// Embedding calls stop as soon as the client disconnects
+	ctx := h.withUsage(c.Request.Context(), usageScope{CourseID: courseID, UserID: requestUser(c), Operation: OperationUpload})
+	vectors, err := h.embedTexts(ctx, texts)
+	if err != nil {
+		log.Warn().Err(err).Str("course_id", courseID).Msg("Some chunks could not be embedded")
+	}
+
+	indexed := make(map[string][]float64, len(chunkModels))
+	var embeddingModels []models.Embedding
+	for i, vector := range vectors {
+		if vector == nil {
 			continue
 		}
-
-		vectorJSON, _ := json.Marshal(embedding)
-		embeddingModel := &models.Embedding{
+		vectorJSON, _ := json.Marshal(vector)
+		embeddingModels = append(embeddingModels, models.Embedding{
 			ID:        uuid.New().String(),
-			ChunkID:   chunkID,
+			ChunkID:   chunkModels[i].ID,
 			Vector:    string(vectorJSON),
-			Dimension: h.embeddingProvider.GetDimension(),
+			Dimension: len(vector),
 			Model:     h.embeddingProvider.GetModelName(),
 			CreatedAt: time.Now(),
+		})
+		indexed[chunkModels[i].ID] = vector
+	}
+	if len(embeddingModels) > 0 {
+		if err := h.db.CreateInBatches(embeddingModels, 100).Error; err != nil {
+			log.Error().Err(err).Msg("Failed to save embeddings")
+			indexed = nil
 		}
-		if err := h.db.Create(embeddingModel).Error; err != nil {
-			log.Warn().Err(err).Msg("Failed to save embedding")
-		}
+	}
+	h.indexEmbeddings(courseID, indexed)
+
+	if ctx.Err() != nil {
+		log.Warn().Str("course_id", courseID).Int("chunks_embedded", len(indexed)).Msg("Upload cancelled by client")
+		return
 	}
 
 	c.JSON(http.StatusOK, UploadResponse{
 		CourseID: courseID,
 		PDFName:  file.Filename,
-		Message:  fmt.Sprintf("PDF uploaded and processed into %d chunks", len(chunks)),
+		MimeType: mimeType,
+		Chunking: chunking,
+		Report:   doc.Report,
+		Message:  fmt.Sprintf("File uploaded and processed into %d chunks", len(chunks)),
 	})
 }
 
 type GenerateCourseRequest struct {
 	CourseID           string `json:"course_id" binding:"required"`
-	NumSlides          int    `json:"num_slides" binding:"required,min=3,max=50"`
+	NumSlides          int    `json:"num_slides" binding:"omitempty,min=3,max=50"`
 	PresentationStyle  string `json:"presentation_style"`
 	InstructorPrompt   string `json:"instructor_prompt"`
 	GenerateImages     bool   `json:"generate_images"`
@@ -200,36 +478,58 @@ type GenerateCourseRequest struct {
 	GenerateVoiceover  bool   `json:"generate_voiceover"`
 	GenerateQuestions  bool   `json:"generate_questions"`
 	Language           string `json:"language"`
+	UseOutline         bool   `json:"use_outline"` // Expand the approved course outline instead of planning a new one
 }
 
-type GenerateCourseResponse struct {
-	CourseID string                   `json:"course_id"`
-	Course   GeneratedCourseStructure `json:"course"`
+// outlineRequest returns the outline settings of a generation request
+func (r GenerateCourseRequest) outlineRequest() OutlineRequest {
+	return OutlineRequest{
+		NumSlides:         r.NumSlides,
+		PresentationStyle: r.PresentationStyle,
+		InstructorPrompt:  r.InstructorPrompt,
+		Language:          r.Language,
+	}
 }
 
-type GeneratedCourseStructure struct {
-	Title       string          `json:"title"`
-	Description string          `json:"description"`
-	Slides      []GeneratedSlide `json:"slides"`
+// language returns the requested content language, defaulting to English
+func (r GenerateCourseRequest) language() string {
+	if r.Language == "" {
+		return "english"
+	}
+	return r.Language
+}
+
+type GenerateCourseResponse struct {
+	JobID    string `json:"job_id"`
+	CourseID string `json:"course_id"`
+	Status   string `json:"status"`
 }
 
+// GeneratedSlide is one slide as the model writes it, validated against slideSchema
 type GeneratedSlide struct {
-	SlideNumber      int                     `json:"slide_number"`
-	Title            string                  `json:"title"`
-	Content          string                  `json:"content"`
-	InstructorScript string                  `json:"instructor_script,omitempty"`
-	ImagePrompt      string                  `json:"image_prompt,omitempty"`
-	Layout           string                  `json:"layout,omitempty"`
-	Theme            string                  `json:"theme,omitempty"`
-	Question         json.RawMessage         `json:"question,omitempty"` // Use RawMessage to handle inconsistent format
-	ParsedQuestion   *GeneratedQuestion      `json:"-"`                  // Parsed question data
+	SlideNumber      int                `json:"slide_number"`
+	Title            string             `json:"title"`
+	Content          string             `json:"content"`
+	InstructorScript string             `json:"instructor_script,omitempty"`
+	ImagePrompt      string             `json:"image_prompt,omitempty"`
+	Layout           string             `json:"layout,omitempty"`
+	Theme            string             `json:"theme,omitempty"`
+	Question         *GeneratedQuestion `json:"question,omitempty"`
+	Table            *GeneratedTable    `json:"table,omitempty"`
+	SourceChunkIDs   []string           `json:"-"` // Chunks the slide was written from
+}
+
+// GeneratedTable is the source data a slide presents
+type GeneratedTable struct {
+	Caption string     `json:"caption,omitempty"`
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
 }
 
 type GeneratedQuestion struct {
-	Question            string      `json:"question"`
-	Options             []string    `json:"options"`
-	CorrectAnswerRaw    interface{} `json:"correct_answer"` // Can be int or string
-	CorrectAnswerParsed int         `json:"-"`              // Parsed index
+	Question      string   `json:"question"`
+	Options       []string `json:"options"`
+	CorrectAnswer int      `json:"correct_answer"` // index of the correct option
 }
 
 func (h *Handler) GenerateCourse(c *gin.Context) {
@@ -239,332 +539,58 @@ func (h *Handler) GenerateCourse(c *gin.Context) {
 		return
 	}
 
-	var chunks []models.Chunk
-	if err := h.db.Where("course_id = ?", req.CourseID).Order("chunk_num ASC").Find(&chunks).Error; err != nil {
+	var chunkCount int64
+	if err := h.db.Model(&models.Chunk{}).Where("course_id = ?", req.CourseID).Count(&chunkCount).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
 		return
 	}
 
-	if len(chunks) == 0 {
+	if chunkCount == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "No content found for this course"})
 		return
 	}
 
-	contentBuilder := strings.Builder{}
-	const maxContentLength = 12000 // Limit total content to ~12k characters to avoid Cloudflare blocking
-	const maxChunks = 5             // Limit to 5 chunks maximum
-	for i, chunk := range chunks {
-		if i >= maxChunks {
-			break
-		}
-		// Check if adding this chunk would exceed the limit
-		if contentBuilder.Len()+len(chunk.Content) > maxContentLength {
-			log.Info().Int("chunks_used", i).Int("total_length", contentBuilder.Len()).Msg("Reached content length limit")
-			break
-		}
-		contentBuilder.WriteString(chunk.Content)
-		contentBuilder.WriteString("\n\n")
-	}
-
-	log.Info().
-		Int("total_content_length", contentBuilder.Len()).
-		Bool("generate_images", req.GenerateImages).
-		Bool("use_web_images", req.UseWebImages).
-		Bool("use_dalle", req.UseDalle).
-		Bool("generate_voiceover", req.GenerateVoiceover).
-		Bool("generate_questions", req.GenerateQuestions).
-		Msg("Content prepared for course generation")
-
-	systemPrompt, _ := os.ReadFile("./api/prompts/syllabus_gen.md")
-	systemPromptStr := string(systemPrompt)
-	systemPromptStr = strings.ReplaceAll(systemPromptStr, "{num_slides}", fmt.Sprintf("%d", req.NumSlides))
-
-	// Apply presentation style guidelines
-	presentationStyle := req.PresentationStyle
-	if presentationStyle == "" {
-		presentationStyle = "balanced"
-	}
-
-	styleInstructions := map[string]string{
-		"minimal": "MINIMAL & VISUAL STYLE:\n- Use VERY SHORT, punchy text (2-3 sentences max per slide)\n- Focus on bold statements and key takeaways\n- Emphasize visual impact with striking image prompts\n- Modern, clean design aesthetic\n- Generate vivid, eye-catching image prompts for modern stock photos",
-		"balanced": "BALANCED STYLE:\n- Use moderate amount of text (4-6 sentences per slide)\n- Mix of explanations and key points\n- Balance between text and visual elements\n- Professional yet accessible\n- Generate clear, relevant image prompts for professional stock photos",
-		"detailed": "DETAILED & PROFESSIONAL STYLE:\n- Use comprehensive, information-rich content with 5-8 bullet points per slide\n- Format content as clear bullet points (use '-' or '•' prefix)\n- Each bullet should be a complete, detailed point with specific information\n- Include specific examples, data points, and thorough coverage\n- Professional corporate presentation aesthetic with substantial on-screen text\n- Information-dense slides suitable for detailed handouts\n- Generate businesslike, professional image prompts for corporate stock photos",
-		"fun": "FUN & ENTERTAINING STYLE:\n- Use MINIMAL text with playful, engaging language (2-4 sentences)\n- Emphasize entertainment value and engagement\n- Light, fun tone throughout\n- Use creative, unexpected angles\n- Generate playful, colorful, dynamic image prompts for fun stock photos",
-	}
-
-	if styleGuide, ok := styleInstructions[presentationStyle]; ok {
-		systemPromptStr += "\n\n" + styleGuide
-	}
-
-	instructorPrompt := req.InstructorPrompt
-	if instructorPrompt == "" {
-		instructorPrompt = "friendly, conversational level instruction targeted at a general audience"
-	}
-	systemPromptStr = strings.ReplaceAll(systemPromptStr, "{instructor_style}", instructorPrompt)
-
-	// Determine language for content generation
-	language := req.Language
-	if language == "" {
-		language = "english"
+	if h.hasActiveJob(req.CourseID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A generation job is already in progress for this course"})
+		return
 	}
 
-	// Add language instruction to system prompt (stronger enforcement)
-	if language != "english" {
-		languageMap := map[string]string{
-			"indonesian": "Indonesian (Bahasa Indonesia)",
-			"thai":       "Thai",
-			"german":     "German",
-		}
-		if langName, ok := languageMap[language]; ok {
-			languageInstruction := fmt.Sprintf("\n\n**CRITICAL LANGUAGE REQUIREMENT:**\nYou MUST generate ALL course content in %s language ONLY.\nThis includes:\n- Course title and description\n- All slide titles\n- All slide content\n- All instructor scripts\n- All quiz questions and options\n\nDo NOT use English anywhere in the course content. The ENTIRE course must be in %s.", langName, langName)
-			systemPromptStr += languageInstruction
+	if req.UseOutline {
+		var outline models.CourseOutline
+		if err := h.db.Where("course_id = ?", req.CourseID).First(&outline).Error; err != nil || outline.Status != models.OutlineStatusApproved {
+			c.JSON(http.StatusConflict, gin.H{"error": "The course outline must be approved before generating slides"})
+			return
 		}
+	} else if req.NumSlides == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "num_slides is required when not generating from an outline"})
+		return
 	}
 
-	userPrompt := fmt.Sprintf("Generate a JSON course with %d slides from this content:\n\n%s", req.NumSlides, contentBuilder.String())
-	userPrompt += "\n\nCRITICAL: You MUST include the 'instructor_script' field for EVERY slide with 3-5 paragraphs of presentation content."
-	if req.GenerateQuestions {
-		userPrompt += "\n\nIMPORTANT: Include a 'question' field for EVERY slide. The question MUST be a JSON object (not a string) with this exact structure:\n{\n  \"question\": \"Question text here?\",\n  \"options\": [\"Option 1\", \"Option 2\", \"Option 3\", \"Option 4\"],\n  \"correct_answer\": 0\n}\nDo NOT use a string for the question field. It must be a JSON object."
-	}
-
-	response, err := h.aiProvider.GenerateJSON(userPrompt, systemPromptStr)
+	estimate, err := h.estimateCourse(req)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to generate course")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate course"})
+		log.Error().Err(err).Str("course_id", req.CourseID).Msg("Failed to estimate course cost")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to estimate cost"})
 		return
 	}
-
-	response = strings.TrimPrefix(response, "```json")
-	response = strings.TrimPrefix(response, "```")
-	response = strings.TrimSuffix(response, "```")
-	response = strings.TrimSpace(response)
-
-	// Log first 500 chars of response to debug
-	log.Info().Str("response_preview", response[:min(500, len(response))]).Msg("AI response received")
-
-	var courseStructure GeneratedCourseStructure
-
-	// Try to parse the response - handle multiple formats
-	var wrappedResponse struct {
-		Course GeneratedCourseStructure `json:"course"`
-	}
-
-	// Also handle array format {"course":[...]}
-	var arrayResponse struct {
-		Course []GeneratedSlide `json:"course"`
+	if !h.preflight(c, req.CourseID, estimate) {
+		return
 	}
 
-	// First try wrapped format (OpenAI) - {"course":{"title":"","slides":[...]}}
-	if err := json.Unmarshal([]byte(response), &wrappedResponse); err == nil {
-		log.Info().
-			Int("wrapped_slides_count", len(wrappedResponse.Course.Slides)).
-			Str("wrapped_title", wrappedResponse.Course.Title).
-			Msg("Successfully unmarshaled to wrapped format")
-
-		if len(wrappedResponse.Course.Slides) > 0 {
-			courseStructure = wrappedResponse.Course
-			log.Info().Msg("Parsed wrapped course structure (OpenAI format)")
-		} else {
-			log.Warn().Msg("Wrapped structure parsed but no slides found, trying other formats")
-			// Try array format {"course":[...]}
-			if err := json.Unmarshal([]byte(response), &arrayResponse); err == nil && len(arrayResponse.Course) > 0 {
-				courseStructure.Slides = arrayResponse.Course
-				log.Info().
-					Int("array_slides_count", len(arrayResponse.Course)).
-					Msg("Parsed array format")
-			} else {
-				// Try direct format
-				if err := json.Unmarshal([]byte(response), &courseStructure); err != nil {
-					log.Error().Err(err).Str("response", response).Msg("Failed to parse course JSON in all formats")
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse generated course"})
-					return
-				}
-				log.Info().
-					Int("direct_slides_count", len(courseStructure.Slides)).
-					Str("direct_title", courseStructure.Title).
-					Msg("Parsed direct course structure")
-			}
-		}
-	} else {
-		log.Warn().Err(err).Msg("Failed to parse wrapped format, trying other formats")
-		// Try array format {"course":[...]}
-		if err := json.Unmarshal([]byte(response), &arrayResponse); err == nil && len(arrayResponse.Course) > 0 {
-			courseStructure.Slides = arrayResponse.Course
-			log.Info().
-				Int("array_slides_count", len(arrayResponse.Course)).
-				Msg("Parsed array format")
-		} else {
-			// Fall back to direct parsing (for Anthropic)
-			if err := json.Unmarshal([]byte(response), &courseStructure); err != nil {
-				log.Error().Err(err).Str("response", response).Msg("Failed to parse course JSON")
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse generated course"})
-				return
-			}
-			log.Info().
-				Int("direct_slides_count", len(courseStructure.Slides)).
-				Str("direct_title", courseStructure.Title).
-				Msg("Parsed direct course structure (Anthropic format)")
-		}
+	job, err := h.enqueueJob(req.CourseID, requestUser(c), models.JobKindCourse, req)
+	if errors.Is(err, errJobActive) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A generation job is already in progress for this course"})
+		return
 	}
-
-	// Debug log to see what was parsed
-	if len(courseStructure.Slides) > 0 {
-		log.Info().
-			Int("total_slides", len(courseStructure.Slides)).
-			Str("first_slide_title", courseStructure.Slides[0].Title).
-			Int("first_slide_number", courseStructure.Slides[0].SlideNumber).
-			Int("content_length", len(courseStructure.Slides[0].Content)).
-			Msg("Parsed course structure")
-	} else {
-		log.Warn().Msg("No slides in parsed structure")
-	}
-
-	if err := h.db.Model(&models.Course{}).Where("id = ?", req.CourseID).Updates(map[string]interface{}{
-		"title":       courseStructure.Title,
-		"description": courseStructure.Description,
-		"num_slides":  len(courseStructure.Slides),
-		"updated_at":  time.Now(),
-	}).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to update course")
-	}
-
-	h.db.Where("course_id = ?", req.CourseID).Delete(&models.Slide{})
-
-	for i, slide := range courseStructure.Slides {
-		// Parse question if it exists
-		if len(slide.Question) > 0 {
-			var parsedQ GeneratedQuestion
-			if err := json.Unmarshal(slide.Question, &parsedQ); err != nil {
-				log.Warn().Err(err).Int("slide", i+1).Str("question_raw", string(slide.Question)).Msg("Failed to parse question, skipping")
-			} else {
-				// Convert correct_answer to index
-				switch v := parsedQ.CorrectAnswerRaw.(type) {
-				case float64:
-					// Already a number
-					parsedQ.CorrectAnswerParsed = int(v)
-				case string:
-					// Try to parse as number first
-					if idx, err := strconv.Atoi(v); err == nil {
-						parsedQ.CorrectAnswerParsed = idx
-					} else {
-						// It's a text answer - find matching option
-						foundIndex := -1
-						for optIdx, opt := range parsedQ.Options {
-							if strings.TrimSpace(strings.ToLower(opt)) == strings.TrimSpace(strings.ToLower(v)) {
-								foundIndex = optIdx
-								break
-							}
-						}
-						if foundIndex >= 0 {
-							parsedQ.CorrectAnswerParsed = foundIndex
-						} else {
-							log.Warn().
-								Str("correct_answer_text", v).
-								Int("slide", i+1).
-								Msg("Could not match correct_answer text to any option, defaulting to 0")
-							parsedQ.CorrectAnswerParsed = 0
-						}
-					}
-				default:
-					log.Warn().Int("slide", i+1).Msg("Unknown correct_answer type, defaulting to 0")
-					parsedQ.CorrectAnswerParsed = 0
-				}
-				slide.ParsedQuestion = &parsedQ
-			}
-		}
-
-		// Fix slide numbering - ensure it starts from 1
-		if slide.SlideNumber == 0 {
-			slide.SlideNumber = i + 1
-		}
-
-		// Determine slide template and theme based on content
-		isTitle := slide.SlideNumber == 1 || strings.ToLower(slide.Layout) == "title"
-		hasImage := req.GenerateImages && slide.ImagePrompt != ""
-		template := services.GetSlideTemplate(slide.SlideNumber, slide.Title, slide.Content, isTitle, hasImage)
-
-		// Apply template to slide if not already set
-		if slide.Layout == "" {
-			slide.Layout = template.Layout
-		}
-		if slide.Theme == "" {
-			slide.Theme = template.Theme
-		}
-
-		// Generate image if prompt exists and image generation is enabled
-		var imageURL string
-		log.Info().
-			Int("slide", slide.SlideNumber).
-			Bool("req_generate_images", req.GenerateImages).
-			Str("image_prompt", slide.ImagePrompt).
-			Bool("will_generate_image", req.GenerateImages && slide.ImagePrompt != "").
-			Msg("Image generation check")
-
-		if req.GenerateImages && slide.ImagePrompt != "" {
-			// Enhance the image prompt based on template
-			enhancedPrompt := services.GetImagePromptEnhanced(slide.ImagePrompt, template)
-
-			// Use the new intelligent image fetching
-			var err error
-			imageURL, err = services.GetImageForSlide(enhancedPrompt, req.UseWebImages, req.UseDalle, h.cfg.OpenAIAPIKey)
-			if err != nil {
-				log.Warn().Err(err).Int("slide", slide.SlideNumber).Msg("Failed to get image")
-			} else {
-				log.Info().Str("url", imageURL).Int("slide", slide.SlideNumber).Msg("Image obtained for slide")
-			}
-		}
-
-		// Generate voiceover if instructor script exists and voiceover generation is enabled
-		var audioURL string
-		if req.GenerateVoiceover && slide.InstructorScript != "" && h.cfg.OpenAIAPIKey != "" {
-			generatedAudioURL, err := services.GenerateVoiceover(h.cfg.OpenAIAPIKey, slide.InstructorScript, req.CourseID, language, slide.SlideNumber)
-			if err != nil {
-				log.Warn().Err(err).Int("slide", slide.SlideNumber).Msg("Failed to generate voiceover")
-			} else {
-				audioURL = generatedAudioURL
-			}
-		}
-
-		slideID := uuid.New().String()
-		slideModel := &models.Slide{
-			ID:               slideID,
-			CourseID:         req.CourseID,
-			SlideNumber:      slide.SlideNumber,
-			Title:            slide.Title,
-			Content:          slide.Content,
-			InstructorScript: slide.InstructorScript,
-			ImagePrompt:      slide.ImagePrompt,
-			ImageURL:         imageURL,
-			AudioURL:         audioURL,
-			Layout:           slide.Layout,
-			Theme:            slide.Theme,
-			CreatedAt:        time.Now(),
-			UpdatedAt:        time.Now(),
-		}
-		if err := h.db.Create(slideModel).Error; err != nil {
-			log.Warn().Err(err).Msg("Failed to save slide")
-		}
-
-		// Save question if it exists and was successfully parsed
-		if slide.ParsedQuestion != nil {
-			optionsJSON, _ := json.Marshal(slide.ParsedQuestion.Options)
-			questionModel := &models.Question{
-				ID:            uuid.New().String(),
-				SlideID:       slideID,
-				Question:      slide.ParsedQuestion.Question,
-				Options:       string(optionsJSON),
-				CorrectAnswer: slide.ParsedQuestion.CorrectAnswerParsed,
-				CreatedAt:     time.Now(),
-			}
-			if err := h.db.Create(questionModel).Error; err != nil {
-				log.Warn().Err(err).Msg("Failed to save question")
-			}
-		}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to enqueue generation job")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start course generation"})
+		return
 	}
 
-	c.JSON(http.StatusOK, GenerateCourseResponse{
+	c.JSON(http.StatusAccepted, GenerateCourseResponse{
+		JobID:    job.ID,
 		CourseID: req.CourseID,
-		Course:   courseStructure,
+		Status:   job.Status,
 	})
 }
 
@@ -604,16 +630,35 @@ func (h *Handler) GetSourceFiles(c *gin.Context) {
 		return
 	}
 
+	for i := range files {
+		decodeSourceFile(&files[i])
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"course_id": courseID,
 		"files":     files,
 	})
 }
 
+// decodeSourceFile fills in the outline and extraction report of a file for responses
+func decodeSourceFile(file *models.SourceFile) {
+	if file.OutlineJSON != "" {
+		file.Outline = json.RawMessage(file.OutlineJSON)
+	}
+	if file.ReportJSON != "" {
+		file.Report = json.RawMessage(file.ReportJSON)
+	}
+}
+
 func (h *Handler) DeleteSourceFile(c *gin.Context) {
 	courseID := c.Param("courseId")
 	fileID := c.Param("fileId")
 
+	// A running job still reads the file's chunks and may be about to write the course
+	if h.respondActiveJob(c, courseID) {
+		return
+	}
+
 	// Get the source file
 	var sourceFile models.SourceFile
 	if err := h.db.Where("id = ? AND course_id = ?", fileID, courseID).First(&sourceFile).Error; err != nil {
@@ -625,10 +670,15 @@ func (h *Handler) DeleteSourceFile(c *gin.Context) {
 	var chunks []models.Chunk
 	h.db.Where("source_file_id = ?", fileID).Find(&chunks)
 
-	for _, chunk := range chunks {
+	chunkIDs := make([]string, len(chunks))
+	for i, chunk := range chunks {
 		// Delete embeddings for this chunk
 		h.db.Where("chunk_id = ?", chunk.ID).Delete(&models.Embedding{})
+		h.db.Where("chunk_id = ?", chunk.ID).Delete(&models.SlideSource{})
+		chunkIDs[i] = chunk.ID
 	}
+	h.unindexChunks(courseID, chunkIDs)
+	h.unindexChunkText(courseID, chunkIDs)
 
 	// Delete chunks
 	h.db.Where("source_file_id = ?", fileID).Delete(&models.Chunk{})
@@ -650,9 +700,15 @@ func (h *Handler) DeleteSourceFile(c *gin.Context) {
 
 	if len(remainingFiles) == 0 {
 		// Delete the entire course and all related data
-		h.db.Where("course_id = ?", courseID).Delete(&models.Slide{})
+		deleteSlides(h.db, "course_id = ?", courseID)
+		h.db.Where("course_id = ?", courseID).Delete(&models.SlideSource{})
+		h.db.Where("course_id = ?", courseID).Delete(&models.CourseRevision{})
+		h.db.Where("course_id = ?", courseID).Delete(&models.CourseOutline{})
+		h.db.Where("course_id = ?", courseID).Delete(&models.GenerationJob{})
 		h.db.Where("course_id = ?", courseID).Delete(&models.ChatMessage{})
+		h.db.Where("course_id = ?", courseID).Delete(&models.ChatSession{})
 		h.db.Delete(&models.Course{}, "id = ?", courseID)
+		h.dropCourseIndex(courseID)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -661,16 +717,6 @@ func (h *Handler) DeleteSourceFile(c *gin.Context) {
 	})
 }
 
-type ChatRequest struct {
-	CourseID string `json:"course_id" binding:"required"`
-	Question string `json:"question" binding:"required"`
-}
-
-type ChatResponse struct {
-	Answer    string   `json:"answer"`
-	Citations []string `json:"citations"`
-}
-
 func (h *Handler) GetQuestions(c *gin.Context) {
 	courseID := c.Param("courseId")
 
@@ -680,13 +726,6 @@ func (h *Handler) GetQuestions(c *gin.Context) {
 		return
 	}
 
-	type QuestionResponse struct {
-		SlideID       string   `json:"slide_id"`
-		Question      string   `json:"question"`
-		Options       []string `json:"options"`
-		CorrectAnswer int      `json:"correct_answer"`
-	}
-
 	var responses []QuestionResponse
 	for _, slide := range slides {
 		var question models.Question
@@ -707,87 +746,3 @@ func (h *Handler) GetQuestions(c *gin.Context) {
 		"questions": responses,
 	})
 }
-
-func (h *Handler) ChatAsk(c *gin.Context) {
-	var req ChatRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	queryEmbedding, err := h.embeddingProvider.Embed(req.Question)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to embed question"})
-		return
-	}
-
-	var chunks []models.Chunk
-	var embeddings []models.Embedding
-
-	h.db.Where("course_id = ?", req.CourseID).Find(&chunks)
-	h.db.Joins("JOIN chunks ON embeddings.chunk_id = chunks.id").
-		Where("chunks.course_id = ?", req.CourseID).
-		Find(&embeddings)
-
-	type ChunkWithScore struct {
-		Chunk models.Chunk
-		Score float64
-	}
-	var scoredChunks []ChunkWithScore
-
-	for _, emb := range embeddings {
-		var vector []float64
-		json.Unmarshal([]byte(emb.Vector), &vector)
-
-		score := services.CosineSimilarity(queryEmbedding, vector)
-
-		for _, chunk := range chunks {
-			if chunk.ID == emb.ChunkID {
-				scoredChunks = append(scoredChunks, ChunkWithScore{
-					Chunk: chunk,
-					Score: score,
-				})
-				break
-			}
-		}
-	}
-
-	topK := 6
-	if len(scoredChunks) < topK {
-		topK = len(scoredChunks)
-	}
-
-	for i := 0; i < len(scoredChunks); i++ {
-		for j := i + 1; j < len(scoredChunks); j++ {
-			if scoredChunks[j].Score > scoredChunks[i].Score {
-				scoredChunks[i], scoredChunks[j] = scoredChunks[j], scoredChunks[i]
-			}
-		}
-	}
-
-	topChunks := scoredChunks[:topK]
-
-	contextBuilder := strings.Builder{}
-	citations := []string{}
-	for i, sc := range topChunks {
-		contextBuilder.WriteString(fmt.Sprintf("[Chunk %d] %s\n\n", i+1, sc.Chunk.Content))
-		citations = append(citations, fmt.Sprintf("Chunk %d (similarity: %.2f)", i+1, sc.Score))
-	}
-
-	systemPromptBytes, _ := os.ReadFile("./api/prompts/answer_grounded.md")
-	systemPrompt := string(systemPromptBytes)
-	systemPrompt = strings.ReplaceAll(systemPrompt, "{context}", contextBuilder.String())
-	systemPrompt = strings.ReplaceAll(systemPrompt, "{question}", req.Question)
-
-	answer, err := h.aiProvider.GenerateText(req.Question, systemPrompt)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to generate answer")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate answer"})
-		return
-	}
-
-	c.JSON(http.StatusOK, ChatResponse{
-		Answer:    answer,
-		Citations: citations,
-	})
-}
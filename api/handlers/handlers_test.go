@@ -0,0 +1,943 @@
+package handlers_test
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/local/elearn/api/config"
+	"github.com/local/elearn/api/db"
+	"github.com/local/elearn/api/handlers"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	// Failed jobs and requests are reported by the tests themselves
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// The pages of the uploaded test document, each about one topic
+var testPages = []string{
+	"Photosynthesis is the process plants use to turn light into chemical energy. " +
+		"Chlorophyll in the leaves absorbs sunlight, and the plant combines carbon dioxide from the air with water from the soil. " +
+		"The products of photosynthesis are glucose, which stores the energy, and oxygen, which the plant releases into the air. " +
+		"The light dependent reactions take place in the thylakoid membranes, while the Calvin cycle builds sugar in the stroma. " +
+		"Without photosynthesis there would be no oxygen in the atmosphere and no food at the bottom of most food chains.",
+	"Cellular respiration releases the energy stored in glucose so cells can use it. " +
+		"Glycolysis splits glucose in the cytoplasm, the Krebs cycle continues in the mitochondria, and the electron transport chain makes most of the ATP. " +
+		"Respiration consumes oxygen and produces carbon dioxide and water, the reverse of photosynthesis. " +
+		"When oxygen is scarce, cells fall back on fermentation, which yields far less ATP and produces lactic acid or ethanol.",
+	"An ecosystem is a community of living organisms together with the physical environment they live in. " +
+		"Producers such as plants capture energy, consumers eat producers or other consumers, and decomposers return nutrients to the soil. " +
+		"Energy flows through an ecosystem in one direction and is lost as heat at every step, so food chains rarely have more than five levels. " +
+		"Nutrients like carbon and nitrogen, on the other hand, are recycled again and again.",
+}
+
+// testServer runs the API on the fake providers with its own database and storage
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server, _ := testServerDB(t)
+	return server
+}
+
+// testServerDB is testServer that also returns the database, for tests that set up
+// state the API can't reach
+func testServerDB(t *testing.T) (*httptest.Server, *gorm.DB) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		ModelProvider:     "fake",
+		EmbeddingProvider: "fake",
+		OCREngine:         "fake",
+		DBPath:            filepath.Join(dir, "elearn.db"),
+		UploadDir:         filepath.Join(dir, "uploads"),
+		AudioDir:          filepath.Join(dir, "audio"),
+		PromptsDir:        "../prompts",
+		MaxUploadSize:     50 << 20,
+		JobWorkers:        1,
+		JobTimeout:        time.Minute,
+		VectorIndex:       "hnsw",
+		VectorIndexDir:    filepath.Join(dir, "indexes"),
+		RetrievalStrategy: "hybrid",
+		RetrievalTopK:     4,
+		EmbeddingBatch:    16,
+		EmbeddingWorkers:  2,
+		BudgetPeriod:      "month",
+		CircuitFailures:   5,
+		CircuitCooldown:   time.Minute,
+	}
+
+	database, err := db.Init(cfg.DBPath)
+	if err != nil {
+		t.Fatalf("failed to initialize database: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := handlers.New(database, cfg)
+	h.ProbeEmbeddingDimension(ctx)
+	h.StartJobWorkers(ctx, cfg.JobWorkers)
+
+	router := gin.New()
+	h.RegisterRoutes(router)
+	server := httptest.NewServer(router)
+	t.Cleanup(func() {
+		server.Close()
+		cancel()
+		if sqlDB, err := database.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return server, database
+}
+
+// testPDF builds a PDF with one page per text, in the standard Helvetica font
+func testPDF(pages []string) []byte {
+	var objects []string
+	pageRefs := make([]string, len(pages))
+	// 1: catalog, 2: page tree, 3: font, then a page and its content stream per page
+	for i := range pages {
+		pageRefs[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(pageRefs, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	)
+	escaper := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+	for i, text := range pages {
+		var stream strings.Builder
+		stream.WriteString("BT /F1 11 Tf 14 TL 50 780 Td\n")
+		for _, line := range wrapWords(text, 90) {
+			fmt.Fprintf(&stream, "(%s) Tj T*\n", escaper.Replace(line))
+		}
+		stream.WriteString("ET")
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", stream.Len(), stream.String()),
+		)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
+
+func wrapWords(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// doJSON sends a request with an optional JSON body and decodes the JSON response into out
+func doJSON(t *testing.T, server *httptest.Server, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to marshal request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, server.URL+path, reader)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: failed to read response: %v", method, path, err)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: invalid JSON response %q: %v", method, path, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// postFile uploads a file, to an existing course when fields has a course_id, and decodes
+// the JSON response
+func postFile(t *testing.T, server *httptest.Server, name string, content []byte, fields map[string]string) (int, map[string]interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatalf("failed to create form: %v", err)
+	}
+	part.Write(content)
+	form.Close()
+
+	resp, err := server.Client().Post(server.URL+"/api/upload", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("upload: invalid response: %v", err)
+	}
+	return resp.StatusCode, response
+}
+
+// upload posts a document as a new course and returns the course ID
+func upload(t *testing.T, server *httptest.Server, name string, content []byte) string {
+	t.Helper()
+	status, response := postFile(t, server, name, content, nil)
+	courseID, _ := response["course_id"].(string)
+	if status != http.StatusOK || courseID == "" {
+		t.Fatalf("upload: status %d, response %v", status, response)
+	}
+	return courseID
+}
+
+// waitForJob polls a generation job until it finishes
+func waitForJob(t *testing.T, server *httptest.Server, jobID string) models.GenerationJob {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var job models.GenerationJob
+		if status := doJSON(t, server, "GET", "/api/jobs/"+jobID, nil, &job); status != http.StatusOK {
+			t.Fatalf("get job: status %d", status)
+		}
+		if job.IsTerminal() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s after 30s (step %q)", jobID, job.Status, job.Step)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCourseEndToEnd(t *testing.T) {
+	server := testServer(t)
+
+	courseID := upload(t, server, "biology.pdf", testPDF(testPages))
+
+	var files struct {
+		Files []models.SourceFile `json:"files"`
+	}
+	doJSON(t, server, "GET", "/api/files/"+courseID, nil, &files)
+	if len(files.Files) != 1 || files.Files[0].Filename != "biology.pdf" {
+		t.Fatalf("expected the uploaded file, got %+v", files.Files)
+	}
+
+	// Generate
+	const numSlides = 5
+	var started handlers.GenerateCourseResponse
+	status := doJSON(t, server, "POST", "/api/course/generate", handlers.GenerateCourseRequest{
+		CourseID:          courseID,
+		NumSlides:         numSlides,
+		GenerateImages:    true,
+		UseDalle:          true,
+		GenerateVoiceover: true,
+		GenerateQuestions: true,
+	}, &started)
+	if status != http.StatusAccepted {
+		t.Fatalf("generate: status %d", status)
+	}
+	if job := waitForJob(t, server, started.JobID); job.Status != models.JobStatusSucceeded {
+		t.Fatalf("generation %s: %s", job.Status, job.Error)
+	} else if job.FailedSlides != 0 {
+		t.Errorf("expected every slide to be generated, %d fell back to the outline", job.FailedSlides)
+	}
+
+	// Slides
+	var slides struct {
+		Slides []models.Slide `json:"slides"`
+	}
+	doJSON(t, server, "GET", "/api/slides/"+courseID, nil, &slides)
+	if len(slides.Slides) != numSlides {
+		t.Fatalf("expected %d slides, got %d", numSlides, len(slides.Slides))
+	}
+	for i, slide := range slides.Slides {
+		if slide.SlideNumber != i+1 {
+			t.Errorf("slide %d: numbered %d", i+1, slide.SlideNumber)
+		}
+		if slide.Title == "" || slide.Content == "" || slide.InstructorScript == "" {
+			t.Errorf("slide %d: missing title, content or script: %+v", i+1, slide)
+		}
+		if !strings.HasPrefix(slide.ImageURL, "data:image/svg+xml") {
+			t.Errorf("slide %d: expected a placeholder image, got %q", i+1, slide.ImageURL)
+		}
+	}
+
+	// The voiceover is served as an MP3
+	audioURL := slides.Slides[0].AudioURL
+	if audioURL == "" {
+		t.Fatal("slide 1 has no voiceover")
+	}
+	resp, err := server.Client().Get(server.URL + audioURL)
+	if err != nil {
+		t.Fatalf("get audio: %v", err)
+	}
+	audio, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(audio) < 4 || audio[0] != 0xFF || audio[1]&0xE0 != 0xE0 {
+		t.Errorf("audio: status %d, %d bytes, not an MP3", resp.StatusCode, len(audio))
+	}
+
+	// Questions
+	var questions struct {
+		Questions []handlers.QuestionResponse `json:"questions"`
+	}
+	doJSON(t, server, "GET", "/api/questions/"+courseID, nil, &questions)
+	if len(questions.Questions) != numSlides {
+		t.Fatalf("expected a question per slide, got %d", len(questions.Questions))
+	}
+	for _, q := range questions.Questions {
+		if q.Question == "" || len(q.Options) != 4 || q.CorrectAnswer < 0 || q.CorrectAnswer > 3 {
+			t.Errorf("invalid question %+v", q)
+		}
+	}
+
+	// Chat
+	var answer handlers.ChatResponse
+	status = doJSON(t, server, "POST", "/api/chat/ask", handlers.ChatRequest{
+		CourseID: courseID,
+		Question: "What does cellular respiration produce?",
+	}, &answer)
+	if status != http.StatusOK {
+		t.Fatalf("chat: status %d", status)
+	}
+	if answer.Answer == "" || answer.SessionID == "" {
+		t.Fatalf("chat: empty answer or session: %+v", answer)
+	}
+	if len(answer.Citations) == 0 {
+		t.Fatal("chat: expected citations")
+	}
+	if snippet := answer.Citations[0].Snippet; !strings.Contains(strings.ToLower(snippet), "respiration") {
+		t.Errorf("chat: expected the passage on respiration to be cited, got %q", snippet)
+	}
+
+	// A follow-up in the same session, streamed
+	events := streamChat(t, server, handlers.ChatRequest{
+		CourseID:  courseID,
+		SessionID: answer.SessionID,
+		Question:  "And what happens when oxygen is scarce?",
+	})
+	var streamed strings.Builder
+	for _, event := range events {
+		if event.Name == "error" {
+			t.Fatalf("chat stream: %s", event.Data)
+		}
+		if event.Name == "token" {
+			var token struct {
+				Text string `json:"text"`
+			}
+			json.Unmarshal([]byte(event.Data), &token)
+			streamed.WriteString(token.Text)
+		}
+	}
+	if len(events) == 0 || events[len(events)-1].Name != "done" {
+		t.Fatalf("chat stream: expected a final done event, got %+v", events)
+	}
+	var done handlers.ChatResponse
+	json.Unmarshal([]byte(events[len(events)-1].Data), &done)
+	if done.Answer == "" || done.Answer != streamed.String() {
+		t.Errorf("chat stream: answer %q does not match the streamed tokens %q", done.Answer, streamed.String())
+	}
+
+	var messages struct {
+		Messages []models.ChatMessage `json:"messages"`
+	}
+	doJSON(t, server, "GET", "/api/chat/sessions/"+answer.SessionID+"/messages", nil, &messages)
+	if len(messages.Messages) != 4 {
+		t.Errorf("expected 2 questions and 2 answers in the session, got %d messages", len(messages.Messages))
+	}
+
+	// Every provider call was recorded against the course
+	var usage struct {
+		Total      handlers.UsageTotals      `json:"total"`
+		Operations []handlers.OperationUsage `json:"operations"`
+	}
+	doJSON(t, server, "GET", "/api/usage/courses/"+courseID, nil, &usage)
+	operations := make(map[string]bool)
+	for _, op := range usage.Operations {
+		operations[op.Operation] = true
+	}
+	for _, op := range []string{handlers.OperationUpload, models.JobKindCourse, handlers.OperationChat} {
+		if !operations[op] {
+			t.Errorf("no usage recorded for %s, got %+v", op, usage.Operations)
+		}
+	}
+	if usage.Total.Images != numSlides {
+		t.Errorf("expected %d images in the usage ledger, got %d", numSlides, usage.Total.Images)
+	}
+}
+
+func TestSlideEditsWaitForJobs(t *testing.T) {
+	server, database := testServerDB(t)
+	courseID := upload(t, server, "biology.pdf", testPDF(testPages))
+
+	var started handlers.GenerateCourseResponse
+	doJSON(t, server, "POST", "/api/course/generate", handlers.GenerateCourseRequest{CourseID: courseID, NumSlides: 3}, &started)
+	waitForJob(t, server, started.JobID)
+	var slides struct {
+		Slides []models.Slide `json:"slides"`
+	}
+	doJSON(t, server, "GET", "/api/slides/"+courseID, nil, &slides)
+	if len(slides.Slides) != 3 {
+		t.Fatalf("expected 3 slides, got %d", len(slides.Slides))
+	}
+	slide := "/api/slides/" + courseID + "/" + slides.Slides[1].ID
+
+	// A job no worker picks up stays queued
+	if err := database.Create(&models.GenerationJob{ID: "queued", CourseID: courseID, Kind: models.JobKindCourse, Status: models.JobStatusQueued}).Error; err != nil {
+		t.Fatal(err)
+	}
+	title := "Edited"
+	requests := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"PUT", slide, handlers.UpdateSlideRequest{Title: &title}},
+		{"POST", "/api/slides/" + courseID, handlers.InsertSlideRequest{Position: 1, Title: title}},
+		{"DELETE", slide, nil},
+		{"POST", "/api/slides/" + courseID + "/reorder", handlers.ReorderSlidesRequest{SlideIDs: []string{slides.Slides[2].ID, slides.Slides[1].ID, slides.Slides[0].ID}}},
+		{"POST", slide + "/regenerate", handlers.RegenerateSlideRequest{}},
+	}
+	for _, r := range requests {
+		if status := doJSON(t, server, r.method, r.path, r.body, nil); status != http.StatusConflict {
+			t.Errorf("%s %s: expected 409 during a job, got %d", r.method, r.path, status)
+		}
+	}
+
+	database.Model(&models.GenerationJob{}).Where("id = ?", "queued").Update("status", models.JobStatusCanceled)
+	if status := doJSON(t, server, "PUT", slide, handlers.UpdateSlideRequest{Title: &title}, nil); status != http.StatusOK {
+		t.Errorf("expected the edit to succeed once the job is over, got %d", status)
+	}
+
+	// Deleting the slide takes its source links along
+	var sources int64
+	database.Model(&models.SlideSource{}).Where("slide_id = ?", slides.Slides[1].ID).Count(&sources)
+	if sources == 0 {
+		t.Fatal("expected the generated slide to have sources")
+	}
+	if status := doJSON(t, server, "DELETE", slide, nil, nil); status != http.StatusOK {
+		t.Fatalf("delete: status %d", status)
+	}
+	database.Model(&models.SlideSource{}).Where("slide_id = ?", slides.Slides[1].ID).Count(&sources)
+	if sources != 0 {
+		t.Errorf("expected the slide's %d source links to be deleted", sources)
+	}
+}
+
+func TestOneActiveJobPerCourse(t *testing.T) {
+	server, database := testServerDB(t)
+	courseID := upload(t, server, "biology.pdf", testPDF(testPages))
+
+	// Requests racing past the API's check still can't both create a job
+	if err := database.Create(&models.GenerationJob{ID: "first", CourseID: courseID, Kind: models.JobKindCourse, Status: models.JobStatusQueued}).Error; err != nil {
+		t.Fatal(err)
+	}
+	err := database.Create(&models.GenerationJob{ID: "second", CourseID: courseID, Kind: models.JobKindOutline, Status: models.JobStatusRunning}).Error
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("expected a second active job to be refused, got %v", err)
+	}
+	status := doJSON(t, server, "POST", "/api/course/generate", handlers.GenerateCourseRequest{CourseID: courseID, NumSlides: 3}, nil)
+	if status != http.StatusConflict {
+		t.Errorf("expected 409 while a job is queued, got %d", status)
+	}
+
+	// Finished jobs don't count
+	database.Model(&models.GenerationJob{}).Where("id = ?", "first").Update("status", models.JobStatusFailed)
+	var started handlers.GenerateCourseResponse
+	if status := doJSON(t, server, "POST", "/api/course/generate", handlers.GenerateCourseRequest{CourseID: courseID, NumSlides: 3}, &started); status != http.StatusAccepted {
+		t.Fatalf("generate: status %d", status)
+	}
+	if job := waitForJob(t, server, started.JobID); job.Status != models.JobStatusSucceeded {
+		t.Errorf("generation %s: %s", job.Status, job.Error)
+	}
+}
+
+func TestDeletingLastFileRemovesCourse(t *testing.T) {
+	server, database := testServerDB(t)
+	courseID := upload(t, server, "biology.pdf", testPDF(testPages))
+
+	var started handlers.GenerateCourseResponse
+	doJSON(t, server, "POST", "/api/course/generate", handlers.GenerateCourseRequest{CourseID: courseID, NumSlides: 3}, &started)
+	if job := waitForJob(t, server, started.JobID); job.Status != models.JobStatusSucceeded {
+		t.Fatalf("generation %s: %s", job.Status, job.Error)
+	}
+	var slide models.Slide
+	database.Where("course_id = ?", courseID).First(&slide)
+	database.Create(&models.Question{ID: "question", SlideID: slide.ID, Question: "What do plants make?"})
+	database.Create(&models.CourseOutline{ID: "outline", CourseID: courseID, Status: models.OutlineStatusDraft})
+	var files struct {
+		Files []models.SourceFile `json:"files"`
+	}
+	doJSON(t, server, "GET", "/api/files/"+courseID, nil, &files)
+	path := "/api/files/" + courseID + "/" + files.Files[0].ID
+
+	tables := map[string]interface{}{
+		"slides":        &models.Slide{},
+		"questions":     &models.Question{},
+		"slide sources": &models.SlideSource{},
+		"revisions":     &models.CourseRevision{},
+		"outlines":      &models.CourseOutline{},
+		"jobs":          &models.GenerationJob{},
+	}
+	for name, model := range tables {
+		var count int64
+		database.Model(model).Count(&count)
+		if count == 0 {
+			t.Fatalf("expected the generated course to have %s", name)
+		}
+	}
+
+	// A job no worker picks up stays queued
+	database.Create(&models.GenerationJob{ID: "queued", CourseID: courseID, Kind: models.JobKindCourse, Status: models.JobStatusQueued})
+	if status := doJSON(t, server, "DELETE", path, nil, nil); status != http.StatusConflict {
+		t.Errorf("expected 409 during a job, got %d", status)
+	}
+
+	database.Model(&models.GenerationJob{}).Where("id = ?", "queued").Update("status", models.JobStatusCanceled)
+	if status := doJSON(t, server, "DELETE", path, nil, nil); status != http.StatusOK {
+		t.Fatalf("delete: status %d", status)
+	}
+	for name, model := range tables {
+		var count int64
+		database.Model(model).Count(&count)
+		if count != 0 {
+			t.Errorf("expected the course's %s to be deleted, %d remain", name, count)
+		}
+	}
+	if status := doJSON(t, server, "GET", "/api/course/"+courseID, nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected the course to be gone, got %d", status)
+	}
+}
+
+func TestZeroCourseBudgetBlocksSpending(t *testing.T) {
+	server, database := testServerDB(t)
+	courseID := upload(t, server, "biology.pdf", testPDF(testPages))
+
+	zero := 0.0
+	var resp struct {
+		Budgets []handlers.BudgetStatus `json:"budgets"`
+	}
+	if status := doJSON(t, server, "PUT", "/api/course/"+courseID+"/budget", handlers.SetCourseBudgetRequest{BudgetUSD: &zero}, &resp); status != http.StatusOK {
+		t.Fatalf("set budget: status %d", status)
+	}
+	if len(resp.Budgets) != 1 || resp.Budgets[0].Scope != handlers.BudgetScopeCourse || resp.Budgets[0].Limit != 0 {
+		t.Fatalf("expected a zero course budget, got %+v", resp.Budgets)
+	}
+
+	// The fake providers are free, so record some earlier spending
+	database.Create(&models.UsageRecord{ID: "spent", CourseID: courseID, Operation: "chat", Kind: "text", Cost: 0.01, CreatedAt: time.Now()})
+	status := doJSON(t, server, "POST", "/api/chat/ask", handlers.ChatRequest{CourseID: courseID, Question: "What is photosynthesis?"}, nil)
+	if status != http.StatusPaymentRequired {
+		t.Errorf("expected 402 from a course with a zero budget, got %d", status)
+	}
+}
+
+func TestFakeGenerationIsDeterministic(t *testing.T) {
+	generate := func() []models.Slide {
+		server := testServer(t)
+		courseID := upload(t, server, "biology.pdf", testPDF(testPages))
+
+		var started handlers.GenerateCourseResponse
+		doJSON(t, server, "POST", "/api/course/generate", handlers.GenerateCourseRequest{CourseID: courseID, NumSlides: 4}, &started)
+		if job := waitForJob(t, server, started.JobID); job.Status != models.JobStatusSucceeded {
+			t.Fatalf("generation %s: %s", job.Status, job.Error)
+		}
+
+		var slides struct {
+			Slides []models.Slide `json:"slides"`
+		}
+		doJSON(t, server, "GET", "/api/slides/"+courseID, nil, &slides)
+		return slides.Slides
+	}
+
+	first, second := generate(), generate()
+	if len(first) != len(second) {
+		t.Fatalf("got %d slides, then %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i].Title != second[i].Title || first[i].Content != second[i].Content {
+			t.Errorf("slide %d differs between runs: %q / %q", i+1, first[i].Title, second[i].Title)
+		}
+	}
+}
+
+func TestUploadRejectsUnsupportedFiles(t *testing.T) {
+	server := testServer(t)
+
+	// A zip that is neither an Office document nor an EPUB, whatever its name says
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	entry, _ := w.Create("data.csv")
+	entry.Write([]byte("a,b\n1,2\n"))
+	w.Close()
+
+	status, body := postFile(t, server, "handout.docx", archive.Bytes(), nil)
+	if status != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for a plain zip, got %d", status)
+	}
+	if body["mime_type"] != "application/zip" {
+		t.Errorf("expected the sniffed type in the error, got %v", body)
+	}
+}
+
+func TestUploadDocumentFormats(t *testing.T) {
+	server := testServer(t)
+
+	docx := func() []byte {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		entry, _ := w.Create("word/document.xml")
+		entry.Write([]byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+			`<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Fermentation</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>Yeast ferments sugar into ethanol and carbon dioxide when oxygen is missing.</w:t></w:r></w:p>` +
+			`</w:body></w:document>`))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		content  []byte
+		mimeType string
+		question string
+		snippet  string
+		section  string
+	}{
+		{"fermentation.docx", docx(), services.MIMEDOCX, "What does yeast ferment?", "ethanol", "Fermentation"},
+		// Named like a PDF, sniffed as Markdown
+		{"glossary.pdf", []byte("# Glossary\n\n- **Enzyme**: a protein that speeds up reactions.\n"), services.MIMEMarkdown, "What is an enzyme?", "speeds up reactions", "Glossary"},
+		{"osmosis.html", []byte("<!DOCTYPE html><html><body><h1>Osmosis</h1><p>Water moves across a membrane toward higher solute concentration.</p></body></html>"), services.MIMEHTML, "Where does water move in osmosis?", "solute concentration", "Osmosis"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := postFile(t, server, tt.name, tt.content, nil)
+			if status != http.StatusOK || body["mime_type"] != tt.mimeType {
+				t.Fatalf("upload: status %d, response %v", status, body)
+			}
+			courseID := body["course_id"].(string)
+
+			var files struct {
+				Files []models.SourceFile `json:"files"`
+			}
+			doJSON(t, server, "GET", "/api/files/"+courseID, nil, &files)
+			if len(files.Files) != 1 || files.Files[0].MimeType != tt.mimeType {
+				t.Fatalf("expected the file stored as %s, got %+v", tt.mimeType, files.Files)
+			}
+
+			var answer handlers.ChatResponse
+			doJSON(t, server, "POST", "/api/chat/ask", handlers.ChatRequest{CourseID: courseID, Question: tt.question}, &answer)
+			if len(answer.Citations) == 0 || !strings.Contains(answer.Citations[0].Snippet, tt.snippet) {
+				t.Fatalf("expected the document to be cited, got %+v", answer.Citations)
+			}
+			if answer.Citations[0].Section != tt.section {
+				t.Errorf("expected the citation in section %q, got %q", tt.section, answer.Citations[0].Section)
+			}
+		})
+	}
+}
+
+func TestUploadRejectsZipBombs(t *testing.T) {
+	server := testServer(t)
+
+	// A few hundred kilobytes that decompress to more than a single entry may hold
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	entry, _ := w.Create("word/document.xml")
+	entry.Write([]byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>`))
+	entry.Write(bytes.Repeat([]byte(" "), 65<<20))
+	entry.Write([]byte(`</w:body></w:document>`))
+	w.Close()
+
+	status, body := postFile(t, server, "bomb.docx", buf.Bytes(), nil)
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a zip bomb, got %d: %v", status, body)
+	}
+}
+
+func TestUploadRejectsDamagedDocuments(t *testing.T) {
+	server := testServer(t)
+
+	// A PDF cut off after its header
+	status, body := postFile(t, server, "broken.pdf", []byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog"), nil)
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a damaged PDF, got %d: %v", status, body)
+	}
+	if body["error"] != "Failed to extract text from file" || body["mime_type"] != "application/pdf" {
+		t.Errorf("expected an extraction error for a PDF, got %v", body)
+	}
+}
+
+func TestUploadReportsEmptyPages(t *testing.T) {
+	server := testServer(t)
+	courseID := upload(t, server, "handout.pdf", testPDF([]string{"Diffusion moves particles from high to low concentration.", ""}))
+
+	var files struct {
+		Files []struct {
+			models.SourceFile
+			Report services.ExtractionReport `json:"extraction_report"`
+		} `json:"files"`
+	}
+	doJSON(t, server, "GET", "/api/files/"+courseID, nil, &files)
+	if len(files.Files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files.Files))
+	}
+	report := files.Files[0].Report
+	if report.Pages != 2 || len(report.EmptyPages) != 1 || report.EmptyPages[0] != 2 || len(report.FailedPages) != 0 {
+		t.Errorf("unexpected extraction report: %+v", report)
+	}
+	// The empty page went through OCR
+	if len(report.OCRPages) != 1 || report.OCRPages[0] != 2 {
+		t.Errorf("expected page 2 recognized by OCR, got %+v", report)
+	}
+}
+
+// testJPEG encodes a small JPEG carrying text in a comment, which the fake OCR engine
+// reads back as the image's text
+func testJPEG(t *testing.T, text string) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	data := encoded.Bytes()
+	comment := []byte{0xFF, 0xFE, byte((len(text) + 2) >> 8), byte(len(text) + 2)}
+	comment = append(comment, text...)
+	// The comment goes right after the start of image marker
+	return append(append(append([]byte(nil), data[:2]...), comment...), data[2:]...)
+}
+
+func TestUploadRecognizesImages(t *testing.T) {
+	server := testServer(t)
+	board := testJPEG(t, "Whiteboard notes\n\nMitochondria release energy from glucose during respiration.")
+
+	status, body := postFile(t, server, "whiteboard.jpg", board, nil)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, response %v", status, body)
+	}
+	if body["mime_type"] != "image/jpeg" {
+		t.Errorf("expected image/jpeg, got %v", body["mime_type"])
+	}
+
+	var answer handlers.ChatResponse
+	doJSON(t, server, "POST", "/api/chat/ask", handlers.ChatRequest{CourseID: body["course_id"].(string), Question: "What do mitochondria do?"}, &answer)
+	if len(answer.Citations) == 0 || !strings.Contains(answer.Citations[0].Snippet, "Mitochondria") {
+		t.Fatalf("expected the image to be cited, got %+v", answer.Citations)
+	}
+	if confidence := answer.Citations[0].OCRConfidence; confidence == nil || *confidence <= 0 || *confidence > 1 {
+		t.Errorf("expected the OCR confidence on the citation, got %v", confidence)
+	}
+
+	var health map[string]interface{}
+	doJSON(t, server, "GET", "/api/health", nil, &health)
+	if health["ocr_engine"] != "fake" {
+		t.Errorf("expected the fake OCR engine, got %v", health["ocr_engine"])
+	}
+}
+
+func TestUploadRejectsFilesWithoutText(t *testing.T) {
+	server := testServer(t)
+
+	status, body := postFile(t, server, "blank.txt", []byte("  \n\n \t\n"), nil)
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a file without text, got %d: %v", status, body)
+	}
+	if _, ok := body["course_id"]; ok {
+		t.Errorf("expected no course for a file without text, got %v", body)
+	}
+}
+
+func TestUploadChunkOptions(t *testing.T) {
+	server := testServer(t)
+	notes := []byte(strings.Repeat("Mitosis divides one cell into two identical cells. ", 30))
+
+	status, body := postFile(t, server, "notes.txt", notes, map[string]string{"chunk_size": "100", "chunk_overlap": "100", "chunk_unit": "tokens"})
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an overlap as large as the chunks, got %d: %v", status, body)
+	}
+
+	status, body = postFile(t, server, "notes.txt", notes, map[string]string{"chunk_size": "100", "chunk_overlap": "20", "chunk_unit": "tokens"})
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d, response %v", status, body)
+	}
+	if chunking, _ := body["chunking"].(map[string]interface{}); chunking["size"] != 100.0 || chunking["unit"] != "tokens" {
+		t.Errorf("expected the requested chunking in the response, got %v", body["chunking"])
+	}
+	// About 380 tokens in chunks of at most 100
+	if message, _ := body["message"].(string); !strings.Contains(message, "into 5 chunks") {
+		t.Errorf("unexpected chunk count: %v", message)
+	}
+
+	var files struct {
+		Files []models.SourceFile `json:"files"`
+	}
+	doJSON(t, server, "GET", "/api/files/"+body["course_id"].(string), nil, &files)
+	if len(files.Files) != 1 || files.Files[0].ChunkSize != 100 || files.Files[0].ChunkOverlap != 20 || files.Files[0].ChunkUnit != "tokens" {
+		t.Errorf("expected the chunking stored with the file, got %+v", files.Files)
+	}
+}
+
+func TestTablesBecomeDataSlides(t *testing.T) {
+	server := testServer(t)
+	notes := []byte(`# Enzymes
+
+Enzymes speed up reactions in living cells. Each enzyme works best at its own temperature,
+and heat beyond it changes the enzyme's shape so it stops working.
+
+Table 2: Optimum temperatures
+
+| Enzyme | Source | Optimum |
+| --- | --- | --- |
+| Amylase | Saliva | 37 |
+| Taq polymerase | Hot springs | 72 |
+| Pepsin | Stomach | 40 |
+
+Fig. 1: An enzyme binding its substrate
+`)
+	courseID := upload(t, server, "enzymes.md", notes)
+
+	var answer handlers.ChatResponse
+	doJSON(t, server, "POST", "/api/chat/ask", handlers.ChatRequest{CourseID: courseID, Question: "What is the optimum temperature of Taq polymerase?"}, &answer)
+	if len(answer.Citations) == 0 || !strings.Contains(answer.Citations[0].Snippet, "| Taq polymerase | Hot springs | 72 |") {
+		t.Errorf("expected the table to be cited with its rows, got %+v", answer.Citations)
+	}
+
+	var started handlers.GenerateCourseResponse
+	doJSON(t, server, "POST", "/api/course/generate", handlers.GenerateCourseRequest{CourseID: courseID, NumSlides: 3}, &started)
+	if job := waitForJob(t, server, started.JobID); job.Status != models.JobStatusSucceeded || job.FailedSlides != 0 {
+		t.Fatalf("generation %s with %d failed slides: %s", job.Status, job.FailedSlides, job.Error)
+	}
+
+	var slides struct {
+		Slides []models.Slide `json:"slides"`
+	}
+	doJSON(t, server, "GET", "/api/slides/"+courseID, nil, &slides)
+	if len(slides.Slides) != 3 {
+		t.Fatalf("expected 3 slides, got %d", len(slides.Slides))
+	}
+	if slides.Slides[0].Layout != "title" {
+		t.Errorf("expected the title slide to keep its layout, got %q", slides.Slides[0].Layout)
+	}
+	for _, slide := range slides.Slides[1:] {
+		if slide.Layout != "data" || !strings.Contains(slide.Table, "| --- |") {
+			t.Errorf("expected a data slide with a table, got layout %q and table %q", slide.Layout, slide.Table)
+		}
+	}
+
+	// Editing the table is recorded in the revision diff
+	table := "Table 2: Optimum temperatures\n\n| Enzyme | Optimum |\n| --- | --- |\n| Amylase | 37 |"
+	var updated handlers.SlideResponse
+	doJSON(t, server, "PUT", "/api/slides/"+courseID+"/"+slides.Slides[1].ID, handlers.UpdateSlideRequest{Table: &table}, &updated)
+	if updated.Slide.Table != table {
+		t.Errorf("expected the edited table, got %q", updated.Slide.Table)
+	}
+	var diff struct {
+		Slides []handlers.SlideDiff `json:"slides"`
+	}
+	doJSON(t, server, "GET", "/api/course/"+courseID+"/revisions/diff?from=1&to=2", nil, &diff)
+	if len(diff.Slides) != 3 || diff.Slides[1].Status != "modified" || strings.Join(diff.Slides[1].Changes, ",") != "table" {
+		t.Errorf("expected the table change in the diff, got %+v", diff.Slides)
+	}
+}
+
+func TestHealthReportsFakeProviders(t *testing.T) {
+	server := testServer(t)
+
+	var health map[string]interface{}
+	doJSON(t, server, "GET", "/api/health", nil, &health)
+	if health["model_provider"] != "fake" || health["embedding_model"] != services.NewFakeEmbedding(0).GetModelName() {
+		t.Errorf("unexpected health %v", health)
+	}
+}
+
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+// streamChat asks a question on the streaming endpoint and collects its events
+func streamChat(t *testing.T, server *httptest.Server, req handlers.ChatRequest) []sseEvent {
+	t.Helper()
+	data, _ := json.Marshal(req)
+	resp, err := server.Client().Post(server.URL+"/api/chat/ask/stream", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("chat stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("chat stream: status %d", resp.StatusCode)
+	}
+
+	var events []sseEvent
+	var event sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event.Name = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			event.Data = strings.TrimPrefix(line, "data:")
+		case line == "" && event.Name != "":
+			events = append(events, event)
+			event = sseEvent{}
+		}
+	}
+	return events
+}
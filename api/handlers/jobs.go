@@ -0,0 +1,573 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	jobQueueSize         = 100
+	jobKeepAliveInterval = 15 * time.Second
+	jobRequeueInterval   = time.Minute // how often queued jobs that didn't fit the queue are retried
+)
+
+var (
+	errJobCanceled = errors.New("job canceled")
+	errJobTimeout  = errors.New("job deadline exceeded")
+	errJobActive   = errors.New("a job is already queued or running for the course")
+)
+
+// runningJobs holds the cancel functions of the jobs the workers are executing
+type runningJobs struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{cancels: make(map[string]context.CancelCauseFunc)}
+}
+
+// add registers a job, reporting false when a worker is already executing it
+func (r *runningJobs) add(jobID string, cancel context.CancelCauseFunc) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cancels[jobID]; ok {
+		return false
+	}
+	r.cancels[jobID] = cancel
+	return true
+}
+
+func (r *runningJobs) remove(jobID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cancels, jobID)
+}
+
+// cancel stops a running job, reporting false if no worker is executing it
+func (r *runningJobs) cancel(jobID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cancel, ok := r.cancels[jobID]
+	if ok {
+		cancel(errJobCanceled)
+	}
+	return ok
+}
+
+// jobBroker fans out job updates to the SSE streams watching them
+type jobBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan models.GenerationJob]struct{}
+}
+
+func newJobBroker() *jobBroker {
+	return &jobBroker{subs: make(map[string]map[chan models.GenerationJob]struct{})}
+}
+
+func (b *jobBroker) subscribe(jobID string) chan models.GenerationJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan models.GenerationJob, 16)
+	if b.subs[jobID] == nil {
+		b.subs[jobID] = make(map[chan models.GenerationJob]struct{})
+	}
+	b.subs[jobID][ch] = struct{}{}
+	return ch
+}
+
+func (b *jobBroker) unsubscribe(jobID string, ch chan models.GenerationJob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs[jobID], ch)
+	if len(b.subs[jobID]) == 0 {
+		delete(b.subs, jobID)
+	}
+}
+
+// publish never blocks the worker; slow subscribers catch up on the next keep-alive reload
+func (b *jobBroker) publish(job models.GenerationJob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs[job.ID] {
+		select {
+		case ch <- job:
+		default:
+		}
+	}
+}
+
+// StartJobWorkers launches the generation workers and re-queues jobs that were
+// queued or running when the server last stopped. Cancelling ctx interrupts the
+// running jobs, which stay resumable.
+func (h *Handler) StartJobWorkers(ctx context.Context, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case jobID := <-h.jobQueue:
+					h.runJob(ctx, jobID)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		// Jobs interrupted by the last shutdown resume; after that, the sweep picks up
+		// the queued jobs that didn't fit in the queue
+		h.requeueJobs(ctx, models.JobStatusQueued, models.JobStatusRunning)
+		ticker := time.NewTicker(jobRequeueInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.requeueJobs(ctx, models.JobStatusQueued)
+			}
+		}
+	}()
+}
+
+// requeueJobs hands the jobs with the given statuses to the workers, oldest first, until
+// the queue is full. A job handed over twice only runs once.
+func (h *Handler) requeueJobs(ctx context.Context, statuses ...string) {
+	var pending []models.GenerationJob
+	if err := h.db.Select("id").Where("status IN ?", statuses).
+		Order("created_at ASC").Find(&pending).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load pending generation jobs")
+		return
+	}
+	for _, job := range pending {
+		if ctx.Err() != nil || !h.scheduleJob(job.ID) {
+			return
+		}
+	}
+}
+
+// scheduleJob hands a job to the workers without blocking, reporting false when the
+// queue is full. The job then stays queued in the database for the requeue sweep.
+func (h *Handler) scheduleJob(jobID string) bool {
+	select {
+	case h.jobQueue <- jobID:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueJob persists a new job of the given kind and hands it to the workers. userID is
+// who started it, empty without authentication. It fails with errJobActive when the
+// course already has a queued or running job.
+func (h *Handler) enqueueJob(courseID, userID, kind string, req interface{}) (*models.GenerationJob, error) {
+	job, err := h.createJob(courseID, userID, kind, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !h.scheduleJob(job.ID) {
+		log.Warn().Str("job_id", job.ID).Msg("Job queue is full, the job waits for the requeue sweep")
+	}
+	return job, nil
+}
+
+// createJob persists a new queued job without scheduling it. The database allows one
+// queued or running job per course, so concurrent requests can't both start one; the
+// loser gets errJobActive.
+func (h *Handler) createJob(courseID, userID, kind string, req interface{}) (*models.GenerationJob, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	job := &models.GenerationJob{
+		ID:        uuid.New().String(),
+		CourseID:  courseID,
+		UserID:    userID,
+		Kind:      kind,
+		Status:    models.JobStatusQueued,
+		Step:      "queued",
+		Message:   "Waiting for a worker",
+		Request:   string(reqJSON),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := h.db.Create(job).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, errJobActive
+		}
+		return nil, fmt.Errorf("failed to create job: %w", err)
+	}
+	return job, nil
+}
+
+// saveJob persists the job state and notifies any stream watching it. A job that ended
+// meanwhile, e.g. canceled while its worker was picking it up, is left as it is and its
+// run is stopped.
+func (h *Handler) saveJob(job *models.GenerationJob) {
+	job.UpdatedAt = time.Now()
+	result := h.db.Model(&models.GenerationJob{}).
+		Where("id = ? AND status NOT IN ?", job.ID, []string{models.JobStatusCanceled, models.JobStatusFailed, models.JobStatusSucceeded}).
+		Select("*").
+		Updates(job)
+	if result.Error != nil {
+		log.Error().Err(result.Error).Str("job_id", job.ID).Msg("Failed to save job")
+	} else if result.RowsAffected == 0 {
+		log.Info().Str("job_id", job.ID).Msg("Generation job already ended, stopping it")
+		h.runningJobs.cancel(job.ID)
+		return
+	}
+	h.jobEvents.publish(*job)
+}
+
+func (h *Handler) failJob(job *models.GenerationJob, err error) {
+	log.Error().Err(err).Str("job_id", job.ID).Str("step", job.Step).Msg("Generation job failed")
+
+	now := time.Now()
+	job.Status = models.JobStatusFailed
+	job.Error = err.Error()
+	job.Message = "Course generation failed"
+	if job.Kind == models.JobKindReembed {
+		job.Message = "Re-embedding failed"
+	}
+	job.FinishedAt = &now
+	h.saveJob(job)
+}
+
+func (h *Handler) finishJob(job *models.GenerationJob, message string) {
+	now := time.Now()
+	job.Status = models.JobStatusSucceeded
+	job.Step = "done"
+	job.Message = message
+	job.FinishedAt = &now
+	h.saveJob(job)
+
+	log.Info().Str("job_id", job.ID).Str("kind", job.Kind).Str("course_id", job.CourseID).Msg(message)
+}
+
+// stopJob records why a job ended early: cancelled by the user, past its deadline,
+// interrupted by a shutdown (left running so it resumes on restart) or failed
+func (h *Handler) stopJob(ctx context.Context, job *models.GenerationJob, err error) {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, errJobCanceled):
+		now := time.Now()
+		job.Status = models.JobStatusCanceled
+		job.Message = "Generation canceled"
+		job.FinishedAt = &now
+		h.saveJob(job)
+		log.Info().Str("job_id", job.ID).Str("step", job.Step).Msg("Generation job canceled")
+	case errors.Is(cause, errJobTimeout):
+		h.failJob(job, fmt.Errorf("job did not finish within %s", h.cfg.JobTimeout))
+	case ctx.Err() != nil:
+		job.Message = "Interrupted by server shutdown, will resume"
+		h.saveJob(job)
+		log.Info().Str("job_id", job.ID).Msg("Generation job interrupted by shutdown")
+	default:
+		h.failJob(job, err)
+	}
+}
+
+// runJob executes (or resumes) a job. Progress is saved after every step, so a
+// restart continues from the last completed slide.
+func (h *Handler) runJob(ctx context.Context, jobID string) {
+	// Register before loading so a cancel request can never miss the job
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if !h.runningJobs.add(jobID, cancel) {
+		// Handed to the workers twice by the requeue sweep
+		return
+	}
+	defer h.runningJobs.remove(jobID)
+
+	if h.cfg.JobTimeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeoutCause(ctx, h.cfg.JobTimeout, errJobTimeout)
+		defer stop()
+	}
+
+	var job models.GenerationJob
+	if err := h.db.Where("id = ?", jobID).First(&job).Error; err != nil {
+		log.Error().Err(err).Str("job_id", jobID).Msg("Generation job not found")
+		return
+	}
+	if job.IsTerminal() {
+		return
+	}
+	ctx = h.withUsage(ctx, usageScope{CourseID: job.CourseID, UserID: job.UserID, Operation: job.Kind, JobID: job.ID})
+
+	now := time.Now()
+	job.Status = models.JobStatusRunning
+	job.Attempts++
+	if job.StartedAt == nil {
+		job.StartedAt = &now
+	}
+
+	switch job.Kind {
+	case models.JobKindOutline:
+		h.runOutlineJob(ctx, &job)
+	case models.JobKindReembed:
+		h.runReembedJob(ctx, &job)
+	default:
+		h.runCourseJob(ctx, &job)
+	}
+}
+
+// progressReporter returns a callback that publishes step messages of a running job
+func (h *Handler) progressReporter(job *models.GenerationJob) func(string) {
+	return func(message string) {
+		job.Message = message
+		h.saveJob(job)
+	}
+}
+
+func (h *Handler) runOutlineJob(ctx context.Context, job *models.GenerationJob) {
+	var req OutlineRequest
+	if err := json.Unmarshal([]byte(job.Request), &req); err != nil {
+		h.failJob(job, fmt.Errorf("invalid job request: %w", err))
+		return
+	}
+
+	job.Step = "outline"
+	job.Message = "Reading the course material"
+	h.saveJob(job)
+
+	outline, err := h.buildOutline(ctx, job.CourseID, req, h.progressReporter(job))
+	if err != nil {
+		h.stopJob(ctx, job, err)
+		return
+	}
+
+	if _, err := h.saveOutline(job.CourseID, outline, models.OutlineStatusDraft); err != nil {
+		h.failJob(job, err)
+		return
+	}
+
+	h.finishJob(job, fmt.Sprintf("Outline planned with %d modules and %d slides", len(outline.Modules), len(outline.slides())))
+}
+
+func (h *Handler) runCourseJob(ctx context.Context, job *models.GenerationJob) {
+	var req GenerateCourseRequest
+	if err := json.Unmarshal([]byte(job.Request), &req); err != nil {
+		h.failJob(job, fmt.Errorf("invalid job request: %w", err))
+		return
+	}
+
+	var outline CourseOutlineContent
+	if job.Structure == "" {
+		job.Step = "outline"
+		if req.UseOutline {
+			stored, content, err := h.loadOutline(req.CourseID)
+			if err != nil {
+				h.failJob(job, fmt.Errorf("failed to load outline: %w", err))
+				return
+			}
+			if stored.Status != models.OutlineStatusApproved {
+				h.failJob(job, fmt.Errorf("course outline is not approved"))
+				return
+			}
+			outline = *content
+		} else {
+			job.Message = "Reading the course material"
+			h.saveJob(job)
+
+			built, err := h.buildOutline(ctx, req.CourseID, req.outlineRequest(), h.progressReporter(job))
+			if err != nil {
+				h.stopJob(ctx, job, err)
+				return
+			}
+			// Keep the outline the slides came from so instructors can edit and regenerate
+			if _, err := h.saveOutline(req.CourseID, built, models.OutlineStatusApproved); err != nil {
+				log.Warn().Err(err).Msg("Failed to save generated outline")
+			}
+			outline = *built
+		}
+
+		if len(outline.slides()) == 0 {
+			h.failJob(job, fmt.Errorf("outline has no slides"))
+			return
+		}
+
+		h.applyOutline(req.CourseID, &outline)
+
+		structureJSON, err := json.Marshal(outline)
+		if err != nil {
+			h.failJob(job, fmt.Errorf("failed to encode outline: %w", err))
+			return
+		}
+		job.Structure = string(structureJSON)
+		job.Total = len(outline.slides()) + 1
+		job.Progress = 1
+	} else if err := json.Unmarshal([]byte(job.Structure), &outline); err != nil {
+		h.failJob(job, fmt.Errorf("invalid saved outline: %w", err))
+		return
+	}
+
+	planned := outline.slides()
+	job.Step = "slides"
+	for i := job.CompletedSlides; i < len(planned); i++ {
+		if err := ctx.Err(); err != nil {
+			h.stopJob(ctx, job, err)
+			return
+		}
+
+		job.Message = fmt.Sprintf("Writing slide %d of %d", i+1, len(planned))
+		h.saveJob(job)
+
+		slide, err := h.expandSlide(ctx, req, &outline, planned, i)
+		if ctx.Err() != nil {
+			h.stopJob(ctx, job, ctx.Err())
+			return
+		}
+		if errors.As(err, new(*services.BudgetError)) {
+			// Every further slide would be refused too
+			h.failJob(job, err)
+			return
+		}
+		if err != nil {
+			// One bad response must not sink the course - keep the outline version of the slide
+			log.Warn().Err(err).Int("slide", i+1).Msg("Falling back to outline for slide")
+			slide = outlineFallbackSlide(planned[i].Slide)
+			job.FailedSlides++
+		}
+		slide.SlideNumber = i + 1
+
+		if err := h.buildSlide(ctx, req, *slide, i); err != nil {
+			h.stopJob(ctx, job, err)
+			return
+		}
+
+		job.CompletedSlides = i + 1
+		job.Progress = job.CompletedSlides + 1
+	}
+
+	// A resumed job may have recorded its revision before the restart
+	var recorded int64
+	h.db.Model(&models.CourseRevision{}).Where("job_id = ?", job.ID).Count(&recorded)
+	if recorded == 0 {
+		if _, err := recordRevision(h.db, job.CourseID, models.RevisionReasonGeneration, job.ID, 0); err != nil {
+			h.failJob(job, err)
+			return
+		}
+	}
+
+	message := fmt.Sprintf("Course generated with %d slides", len(planned))
+	if job.FailedSlides > 0 {
+		message += fmt.Sprintf(" (%d taken from the outline after generation failed)", job.FailedSlides)
+	}
+	h.finishJob(job, message)
+}
+
+func (h *Handler) GetJob(c *gin.Context) {
+	jobID := c.Param("id")
+
+	var job models.GenerationJob
+	if err := h.db.Where("id = ?", jobID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// CancelJob stops a queued or running job. Slides finished before the cancel are kept.
+func (h *Handler) CancelJob(c *gin.Context) {
+	jobID := c.Param("id")
+
+	var job models.GenerationJob
+	if err := h.db.Where("id = ?", jobID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if job.IsTerminal() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Job already %s", job.Status)})
+		return
+	}
+
+	if !h.runningJobs.cancel(jobID) {
+		// Not being executed (still queued, or waiting to resume) - mark it so the worker skips it
+		now := time.Now()
+		result := h.db.Model(&models.GenerationJob{}).
+			Where("id = ? AND status IN ?", jobID, []string{models.JobStatusQueued, models.JobStatusRunning}).
+			Updates(map[string]interface{}{
+				"status":      models.JobStatusCanceled,
+				"message":     "Generation canceled",
+				"finished_at": &now,
+				"updated_at":  now,
+			})
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+			return
+		}
+		h.db.Where("id = ?", jobID).First(&job)
+		h.jobEvents.publish(job)
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// StreamJob reports job progress as server-sent "progress" events until the job finishes
+func (h *Handler) StreamJob(c *gin.Context) {
+	jobID := c.Param("id")
+
+	// Subscribe before loading so no update can slip in between
+	updates := h.jobEvents.subscribe(jobID)
+	defer h.jobEvents.unsubscribe(jobID, updates)
+
+	var job models.GenerationJob
+	if err := h.db.Where("id = ?", jobID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.SSEvent("progress", job)
+	c.Writer.Flush()
+	if job.IsTerminal() {
+		return
+	}
+
+	ticker := time.NewTicker(jobKeepAliveInterval)
+	defer ticker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case update := <-updates:
+			c.SSEvent("progress", update)
+			return !update.IsTerminal()
+		case <-ticker.C:
+			if err := h.db.Where("id = ?", jobID).First(&job).Error; err != nil {
+				return false
+			}
+			c.SSEvent("progress", job)
+			return !job.IsTerminal()
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/local/elearn/api/models"
+)
+
+func TestSaveJobKeepsCancel(t *testing.T) {
+	database := testDB(t)
+	h := &Handler{db: database, jobEvents: newJobBroker(), runningJobs: newRunningJobs()}
+
+	job := models.GenerationJob{ID: "job", CourseID: "course", Kind: models.JobKindCourse, Status: models.JobStatusQueued}
+	if err := database.Create(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker registers and loads the queued job just after a cancel found it not running
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	h.runningJobs.add(job.ID, cancel)
+	database.Model(&models.GenerationJob{}).Where("id = ?", job.ID).Update("status", models.JobStatusCanceled)
+
+	job.Status = models.JobStatusRunning
+	h.saveJob(&job)
+
+	var stored models.GenerationJob
+	database.First(&stored, "id = ?", job.ID)
+	if stored.Status != models.JobStatusCanceled {
+		t.Errorf("expected the cancel to stick, got %s", stored.Status)
+	}
+	if !errors.Is(context.Cause(ctx), errJobCanceled) {
+		t.Errorf("expected the run to be canceled, got %v", context.Cause(ctx))
+	}
+}
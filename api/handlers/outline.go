@@ -0,0 +1,703 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	maxSummaryConcurrency = 3  // Parallel summarization calls during the map step
+	maxOutlineSlides      = 50 // Same upper bound as num_slides on generation requests
+)
+
+// OutlineRequest configures the generation of a course outline
+type OutlineRequest struct {
+	NumSlides         int    `json:"num_slides" binding:"required,min=3,max=50"`
+	PresentationStyle string `json:"presentation_style"`
+	InstructorPrompt  string `json:"instructor_prompt"`
+	Language          string `json:"language"`
+}
+
+// CourseOutlineContent is the editable body of a course outline
+type CourseOutlineContent struct {
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Modules     []OutlineModule `json:"modules" binding:"required,min=1,dive"`
+}
+
+type OutlineModule struct {
+	Title              string         `json:"title" binding:"required"`
+	Summary            string         `json:"summary,omitempty"`
+	LearningObjectives []string       `json:"learning_objectives"`
+	Slides             []OutlineSlide `json:"slides" binding:"required,min=1,dive"`
+	SourceChunkIDs     []string       `json:"source_chunk_ids,omitempty"` // Chunks the module was planned from
+}
+
+type OutlineSlide struct {
+	Title     string   `json:"title" binding:"required"`
+	KeyPoints []string `json:"key_points,omitempty"`
+}
+
+type OutlineResponse struct {
+	ID          string          `json:"id"`
+	CourseID    string          `json:"course_id"`
+	Status      string          `json:"status"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Modules     []OutlineModule `json:"modules"`
+	NumSlides   int             `json:"num_slides"`
+	ApprovedAt  *time.Time      `json:"approved_at,omitempty"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// plannedSlide is one slide of an outline together with the module it belongs to
+type plannedSlide struct {
+	ModuleIndex int
+	Slide       OutlineSlide
+}
+
+// slides flattens the outline into course order
+func (o *CourseOutlineContent) slides() []plannedSlide {
+	var planned []plannedSlide
+	for i, module := range o.Modules {
+		for _, slide := range module.Slides {
+			planned = append(planned, plannedSlide{ModuleIndex: i, Slide: slide})
+		}
+	}
+	return planned
+}
+
+// sourcePart is a run of consecutive chunks from one source file that fits in a single LLM call
+type sourcePart struct {
+	FileName string
+	ChunkIDs []string
+	Content  string
+	Summary  string
+}
+
+// outlineSection is one section of the document-wide outline built in the reduce step
+type outlineSection struct {
+	Title     string `json:"title"`
+	Summary   string `json:"summary"`
+	Parts     []int  `json:"parts"` // 1-based indices of the source parts covered by this section
+	NumSlides int    `json:"-"`
+}
+
+type sectionOutline struct {
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	Sections    []outlineSection `json:"sections"`
+}
+
+func toOutlineResponse(outline *models.CourseOutline) (*OutlineResponse, error) {
+	var modules []OutlineModule
+	if err := json.Unmarshal([]byte(outline.Modules), &modules); err != nil {
+		return nil, fmt.Errorf("invalid outline modules: %w", err)
+	}
+
+	content := CourseOutlineContent{Modules: modules}
+	return &OutlineResponse{
+		ID:          outline.ID,
+		CourseID:    outline.CourseID,
+		Status:      outline.Status,
+		Title:       outline.Title,
+		Description: outline.Description,
+		Modules:     modules,
+		NumSlides:   len(content.slides()),
+		ApprovedAt:  outline.ApprovedAt,
+		UpdatedAt:   outline.UpdatedAt,
+	}, nil
+}
+
+// loadOutline returns the stored outline of a course in its editable form
+func (h *Handler) loadOutline(courseID string) (*models.CourseOutline, *CourseOutlineContent, error) {
+	var outline models.CourseOutline
+	if err := h.db.Where("course_id = ?", courseID).First(&outline).Error; err != nil {
+		return nil, nil, err
+	}
+
+	content := &CourseOutlineContent{Title: outline.Title, Description: outline.Description}
+	if err := json.Unmarshal([]byte(outline.Modules), &content.Modules); err != nil {
+		return nil, nil, fmt.Errorf("invalid outline modules: %w", err)
+	}
+	return &outline, content, nil
+}
+
+// saveOutline replaces the outline of a course
+func (h *Handler) saveOutline(courseID string, content *CourseOutlineContent, status string) (*models.CourseOutline, error) {
+	modulesJSON, err := json.Marshal(content.Modules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode modules: %w", err)
+	}
+
+	var outline models.CourseOutline
+	err = h.db.Where("course_id = ?", courseID).First(&outline).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		outline = models.CourseOutline{
+			ID:        uuid.New().String(),
+			CourseID:  courseID,
+			CreatedAt: time.Now(),
+		}
+	}
+
+	outline.Status = status
+	outline.Title = content.Title
+	outline.Description = content.Description
+	outline.Modules = string(modulesJSON)
+	outline.ApprovedAt = nil
+	if status == models.OutlineStatusApproved {
+		now := time.Now()
+		outline.ApprovedAt = &now
+	}
+	outline.UpdatedAt = time.Now()
+
+	if err := h.db.Save(&outline).Error; err != nil {
+		return nil, fmt.Errorf("failed to save outline: %w", err)
+	}
+	return &outline, nil
+}
+
+// buildOutline plans a course over every source file: summarize each part (map), group the
+// parts into modules (reduce), share NumSlides across modules proportionally to their size,
+// then plan learning objectives and slide titles for each module.
+func (h *Handler) buildOutline(ctx context.Context, courseID string, req OutlineRequest, report func(string)) (*CourseOutlineContent, error) {
+	parts, err := h.loadSourceParts(courseID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no content found for this course")
+	}
+
+	totalLength := 0
+	for _, part := range parts {
+		totalLength += len(part.Content)
+	}
+	log.Info().
+		Int("total_content_length", totalLength).
+		Int("parts", len(parts)).
+		Int("num_slides", req.NumSlides).
+		Msg("Content prepared for outline generation")
+
+	var sections *sectionOutline
+	if len(parts) == 1 {
+		// Everything fits in one call - no need to summarize first
+		sections = &sectionOutline{Sections: []outlineSection{{Parts: []int{1}}}}
+	} else {
+		if err := h.summarizeParts(ctx, parts, report); err != nil {
+			return nil, err
+		}
+
+		report("Grouping the material into modules")
+		sections, err = h.reduceOutline(ctx, parts, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	weights := make([]int, len(sections.Sections))
+	for i, section := range sections.Sections {
+		for _, p := range section.Parts {
+			weights[i] += len(parts[p-1].Content)
+		}
+	}
+	allocation := services.AllocateSlides(weights, req.NumSlides)
+
+	outline := &CourseOutlineContent{
+		Title:       sections.Title,
+		Description: sections.Description,
+	}
+	for i := range sections.Sections {
+		sections.Sections[i].NumSlides = allocation[i]
+		if allocation[i] == 0 {
+			log.Warn().Int("section", i+1).Msg("No slides allocated to section, skipping")
+			continue
+		}
+
+		report(fmt.Sprintf("Planning module %d of %d", i+1, len(sections.Sections)))
+		module, err := h.planModule(ctx, req, sections, i, parts)
+		if err != nil {
+			return nil, fmt.Errorf("module %d: %w", i+1, err)
+		}
+		outline.Modules = append(outline.Modules, *module)
+	}
+
+	if outline.Title == "" && len(outline.Modules) > 0 {
+		outline.Title = outline.Modules[0].Title
+	}
+
+	log.Info().
+		Int("modules", len(outline.Modules)).
+		Int("slides", len(outline.slides())).
+		Str("title", outline.Title).
+		Msg("Built course outline")
+
+	return outline, nil
+}
+
+// loadSourceParts reads every chunk of the course, file by file in upload order, and packs
+// consecutive chunks into parts that fit in a single LLM call
+func (h *Handler) loadSourceParts(courseID string) ([]sourcePart, error) {
+	var files []models.SourceFile
+	if err := h.db.Where("course_id = ?", courseID).Order("created_at ASC").Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("failed to retrieve files: %w", err)
+	}
+
+	var chunks []models.Chunk
+	if err := h.db.Where("course_id = ?", courseID).Order("chunk_num ASC").Find(&chunks).Error; err != nil {
+		return nil, fmt.Errorf("failed to retrieve chunks: %w", err)
+	}
+
+	// Legacy chunks without a source file come first
+	fileOrder := []string{""}
+	fileNames := map[string]string{}
+	for _, f := range files {
+		fileOrder = append(fileOrder, f.ID)
+		fileNames[f.ID] = f.Filename
+	}
+
+	chunksByFile := map[string][]models.Chunk{}
+	for _, chunk := range chunks {
+		chunksByFile[chunk.SourceFileID] = append(chunksByFile[chunk.SourceFileID], chunk)
+	}
+
+	var parts []sourcePart
+	for _, fileID := range fileOrder {
+		fileChunks := chunksByFile[fileID]
+		texts := make([]string, len(fileChunks))
+		for i, chunk := range fileChunks {
+			texts[i] = chunk.Content
+		}
+
+		for _, group := range services.GroupTexts(texts, maxContentLength) {
+			part := sourcePart{FileName: fileNames[fileID]}
+			var content strings.Builder
+			for _, idx := range group {
+				part.ChunkIDs = append(part.ChunkIDs, fileChunks[idx].ID)
+				content.WriteString(fileChunks[idx].Content)
+				content.WriteString("\n\n")
+			}
+			part.Content = content.String()
+			parts = append(parts, part)
+		}
+	}
+
+	return parts, nil
+}
+
+// summarizeParts is the map step: it summarizes every part with bounded concurrency.
+// A part whose summary fails falls back to a truncated excerpt of its text.
+// Only cancellation of ctx makes it fail.
+func (h *Handler) summarizeParts(ctx context.Context, parts []sourcePart, report func(string)) error {
+	systemPrompt := h.readPrompt("chunk_summary.md")
+
+	var mu sync.Mutex
+	done := 0
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxSummaryConcurrency)
+
+	for i := range parts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			summary, err := h.aiProvider.GenerateText(ctx, parts[i].Content, systemPrompt)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil || strings.TrimSpace(summary) == "" {
+				log.Warn().Err(err).Int("part", i+1).Msg("Failed to summarize part, using excerpt")
+				summary = truncateText(parts[i].Content, 1500)
+			}
+			parts[i].Summary = strings.TrimSpace(summary)
+
+			mu.Lock()
+			done++
+			report(fmt.Sprintf("Summarized part %d of %d", done, len(parts)))
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// reduceOutline is the reduce step: it groups the part summaries into course sections.
+// When the summaries themselves are too long for one call they are merged in rounds first.
+func (h *Handler) reduceOutline(ctx context.Context, parts []sourcePart, req OutlineRequest) (*sectionOutline, error) {
+	type summaryNode struct {
+		Text  string
+		Parts []int
+	}
+
+	nodes := make([]summaryNode, len(parts))
+	for i, part := range parts {
+		label := fmt.Sprintf("Part %d", i+1)
+		if part.FileName != "" {
+			label += fmt.Sprintf(" (%s)", part.FileName)
+		}
+		nodes[i] = summaryNode{Text: fmt.Sprintf("[%s]\n%s", label, part.Summary), Parts: []int{i + 1}}
+	}
+
+	summaryPrompt := h.readPrompt("chunk_summary.md")
+	for round := 1; ; round++ {
+		texts := make([]string, len(nodes))
+		totalLength := 0
+		for i, node := range nodes {
+			texts[i] = node.Text
+			totalLength += len(node.Text)
+		}
+		if totalLength <= maxContentLength || len(nodes) == 1 {
+			break
+		}
+
+		groups := services.GroupTexts(texts, maxContentLength)
+		if len(groups) == len(nodes) {
+			// Nothing can be merged any further
+			break
+		}
+
+		log.Info().Int("round", round).Int("nodes", len(nodes)).Int("groups", len(groups)).Msg("Merging summaries")
+		merged := make([]summaryNode, 0, len(groups))
+		for _, group := range groups {
+			var combined strings.Builder
+			var covered []int
+			for _, idx := range group {
+				combined.WriteString(nodes[idx].Text)
+				combined.WriteString("\n\n")
+				covered = append(covered, nodes[idx].Parts...)
+			}
+
+			summary, err := h.aiProvider.GenerateText(ctx, combined.String(), summaryPrompt)
+			if err != nil {
+				return nil, fmt.Errorf("failed to merge summaries: %w", err)
+			}
+			merged = append(merged, summaryNode{
+				Text:  fmt.Sprintf("[Parts %d-%d]\n%s", covered[0], covered[len(covered)-1], strings.TrimSpace(summary)),
+				Parts: covered,
+			})
+		}
+		nodes = merged
+	}
+
+	var summaries strings.Builder
+	for i, node := range nodes {
+		summaries.WriteString(fmt.Sprintf("[Part %d]\n%s\n\n", i+1, node.Text))
+	}
+
+	maxSections := min(len(nodes), max(1, req.NumSlides/2))
+	systemPrompt := h.readPrompt("outline_reduce.md")
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{max_sections}", fmt.Sprintf("%d", maxSections))
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{num_parts}", fmt.Sprintf("%d", len(nodes)))
+	systemPrompt += languageInstruction(req.Language)
+
+	data, err := services.GenerateValidated(ctx, h.aiProvider, services.StructuredRequest{
+		Prompt:       summaries.String(),
+		SystemPrompt: systemPrompt,
+		Output:       sectionOutlineSchema(maxSections, len(nodes)),
+	})
+	var invalid *services.ValidationError
+	if err != nil && !errors.As(err, &invalid) {
+		return nil, fmt.Errorf("failed to generate outline: %w", err)
+	}
+
+	var outline sectionOutline
+	if err == nil {
+		err = json.Unmarshal(data, &outline)
+	}
+	if err != nil || len(outline.Sections) == 0 {
+		log.Warn().Err(err).Msg("No valid outline generated, using one section per part")
+		outline.Sections = nil
+		for i := range nodes {
+			outline.Sections = append(outline.Sections, outlineSection{Parts: []int{i + 1}})
+		}
+	}
+
+	// Map the outline's parts back to source parts and make sure every part is covered exactly once
+	covered := make([]bool, len(parts))
+	var sections []outlineSection
+	for _, section := range outline.Sections {
+		var sourceParts []int
+		for _, p := range section.Parts {
+			if p < 1 || p > len(nodes) {
+				continue
+			}
+			for _, sp := range nodes[p-1].Parts {
+				if !covered[sp-1] {
+					covered[sp-1] = true
+					sourceParts = append(sourceParts, sp)
+				}
+			}
+		}
+		if len(sourceParts) == 0 {
+			continue
+		}
+		section.Parts = sourceParts
+		sections = append(sections, section)
+	}
+	if len(sections) == 0 {
+		sections = []outlineSection{{}}
+	}
+	for i, ok := range covered {
+		if !ok {
+			log.Warn().Int("part", i+1).Msg("Outline skipped a part, adding it to the last section")
+			sections[len(sections)-1].Parts = append(sections[len(sections)-1].Parts, i+1)
+		}
+	}
+	outline.Sections = sections
+
+	log.Info().Int("sections", len(outline.Sections)).Str("title", outline.Title).Msg("Reduced course sections")
+	return &outline, nil
+}
+
+// planModule asks the model for the learning objectives and slide plan of one section
+func (h *Handler) planModule(ctx context.Context, req OutlineRequest, outline *sectionOutline, sectionIdx int, parts []sourcePart) (*OutlineModule, error) {
+	section := outline.Sections[sectionIdx]
+
+	// Use the raw text when it fits, otherwise the part summaries
+	var raw, summaries strings.Builder
+	var chunkIDs []string
+	for _, p := range section.Parts {
+		raw.WriteString(parts[p-1].Content)
+		summaries.WriteString(parts[p-1].Summary)
+		summaries.WriteString("\n\n")
+		chunkIDs = append(chunkIDs, parts[p-1].ChunkIDs...)
+	}
+	content := raw.String()
+	if len(content) > maxContentLength {
+		content = truncateText(summaries.String(), maxContentLength)
+	}
+
+	instructorPrompt := req.InstructorPrompt
+	if instructorPrompt == "" {
+		instructorPrompt = defaultInstructorStyle
+	}
+
+	systemPrompt := h.readPrompt("module_plan.md")
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{num_slides}", fmt.Sprintf("%d", section.NumSlides))
+	systemPrompt = strings.ReplaceAll(systemPrompt, "{instructor_style}", instructorPrompt)
+	systemPrompt += languageInstruction(req.Language)
+
+	userPrompt := fmt.Sprintf("Plan %d slides for this module from its source content:\n\n%s", section.NumSlides, content)
+	if len(outline.Sections) > 1 {
+		var outlineText strings.Builder
+		for i, s := range outline.Sections {
+			outlineText.WriteString(fmt.Sprintf("%d. %s - %s\n", i+1, s.Title, s.Summary))
+		}
+		userPrompt += fmt.Sprintf("\n\nThis is module %d of %d of the course \"%s\". The full course outline is:\n%s\nOnly cover the topics of module %d (\"%s\").",
+			sectionIdx+1, len(outline.Sections), outline.Title, outlineText.String(), sectionIdx+1, section.Title)
+	}
+	if sectionIdx == 0 {
+		userPrompt += "\n\nThe first slide is the course title slide."
+	} else {
+		userPrompt += "\n\nDo NOT start with a course title or introduction slide - continue from the previous module."
+	}
+
+	data, err := services.GenerateValidated(ctx, h.aiProvider, services.StructuredRequest{
+		Prompt:       userPrompt,
+		SystemPrompt: systemPrompt,
+		Output:       modulePlanSchema(section.NumSlides),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan module: %w", err)
+	}
+
+	var plan struct {
+		Title              string         `json:"title"`
+		LearningObjectives []string       `json:"learning_objectives"`
+		Slides             []OutlineSlide `json:"slides"`
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse module plan: %w", err)
+	}
+	slides := plan.Slides
+
+	title := section.Title
+	if title == "" {
+		title = plan.Title
+	}
+	if title == "" {
+		title = slides[0].Title
+	}
+
+	return &OutlineModule{
+		Title:              title,
+		Summary:            section.Summary,
+		LearningObjectives: plan.LearningObjectives,
+		Slides:             slides,
+		SourceChunkIDs:     chunkIDs,
+	}, nil
+}
+
+// hasActiveJob reports whether a generation job is queued or running for the course
+func (h *Handler) hasActiveJob(courseID string) bool {
+	var activeJobs int64
+	h.db.Model(&models.GenerationJob{}).
+		Where("course_id = ? AND status IN ?", courseID, []string{models.JobStatusQueued, models.JobStatusRunning}).
+		Count(&activeJobs)
+	return activeJobs > 0
+}
+
+// respondActiveJob answers 409 when a job is queued or running for the course, which
+// would overwrite the slides the request changes. It reports whether it responded.
+func (h *Handler) respondActiveJob(c *gin.Context, courseID string) bool {
+	if !h.hasActiveJob(courseID) {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "A generation job is already running for this course"})
+	return true
+}
+
+// GenerateOutline starts an outline job for the course; the result is a draft outline
+func (h *Handler) GenerateOutline(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var req OutlineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var chunkCount int64
+	if err := h.db.Model(&models.Chunk{}).Where("course_id = ?", courseID).Count(&chunkCount).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chunks"})
+		return
+	}
+
+	if chunkCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No content found for this course"})
+		return
+	}
+
+	if h.hasActiveJob(courseID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A generation job is already in progress for this course"})
+		return
+	}
+
+	estimate := &CostEstimate{}
+	if err := h.estimateOutline(estimate, courseID, req.NumSlides); err != nil {
+		log.Error().Err(err).Str("course_id", courseID).Msg("Failed to estimate outline cost")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to estimate cost"})
+		return
+	}
+	if !h.preflight(c, courseID, estimate) {
+		return
+	}
+
+	job, err := h.enqueueJob(courseID, requestUser(c), models.JobKindOutline, req)
+	if errors.Is(err, errJobActive) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A generation job is already in progress for this course"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to enqueue outline job")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start outline generation"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, GenerateCourseResponse{
+		JobID:    job.ID,
+		CourseID: courseID,
+		Status:   job.Status,
+	})
+}
+
+func (h *Handler) GetOutline(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var outline models.CourseOutline
+	if err := h.db.Where("course_id = ?", courseID).First(&outline).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Outline not found"})
+		return
+	}
+
+	response, err := toOutlineResponse(&outline)
+	if err != nil {
+		log.Error().Err(err).Str("course_id", courseID).Msg("Failed to decode outline")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read outline"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateOutline replaces the outline with an instructor-edited version; it must be approved again
+func (h *Handler) UpdateOutline(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var content CourseOutlineContent
+	if err := c.ShouldBindJSON(&content); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if n := len(content.slides()); n > maxOutlineSlides {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Outline has %d slides, the maximum is %d", n, maxOutlineSlides)})
+		return
+	}
+
+	var course models.Course
+	if err := h.db.Where("id = ?", courseID).First(&course).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+
+	outline, err := h.saveOutline(courseID, &content, models.OutlineStatusDraft)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save outline")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save outline"})
+		return
+	}
+
+	response, _ := toOutlineResponse(outline)
+	c.JSON(http.StatusOK, response)
+}
+
+// ApproveOutline marks the outline as ready for slide generation
+func (h *Handler) ApproveOutline(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var outline models.CourseOutline
+	if err := h.db.Where("course_id = ?", courseID).First(&outline).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Outline not found"})
+		return
+	}
+
+	now := time.Now()
+	outline.Status = models.OutlineStatusApproved
+	outline.ApprovedAt = &now
+	outline.UpdatedAt = now
+	if err := h.db.Save(&outline).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve outline"})
+		return
+	}
+
+	response, _ := toOutlineResponse(&outline)
+	c.JSON(http.StatusOK, response)
+}
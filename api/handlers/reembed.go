@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm/clause"
+)
+
+// reembedBatch is the number of chunks loaded and embedded per progress step
+const reembedBatch = 200
+
+// errEmbeddingModel means a course has embeddings from a model other than the configured one
+var errEmbeddingModel = errors.New("course embeddings were made with a different embedding model")
+
+// ReembedRequest asks for a course (or, without course_id, every course) to be embedded
+// again with the configured embedding model
+type ReembedRequest struct {
+	CourseID string `json:"course_id"`
+	Force    bool   `json:"force"` // re-embed chunks that already use the configured model too
+}
+
+// CourseEmbeddingStatus counts a course's embeddings per model
+type CourseEmbeddingStatus struct {
+	CourseID string           `json:"course_id"`
+	Chunks   int64            `json:"chunks"`
+	Models   map[string]int64 `json:"models"` // model -> embeddings
+	Stale    int64            `json:"stale"`  // embeddings from another model
+	Missing  int64            `json:"missing"`
+}
+
+// NeedsReembed reports whether the course has chunks without a current embedding
+func (s CourseEmbeddingStatus) NeedsReembed() bool {
+	return s.Stale > 0 || s.Missing > 0
+}
+
+// embeddingStatus counts the embeddings of every course with chunks, or of one course
+func (h *Handler) embeddingStatus(courseID string) ([]CourseEmbeddingStatus, error) {
+	model := h.embeddingProvider.GetModelName()
+
+	var chunkCounts []struct {
+		CourseID string
+		Count    int64
+	}
+	q := h.db.Model(&models.Chunk{}).Select("course_id, COUNT(*) AS count").Group("course_id")
+	if courseID != "" {
+		q = q.Where("course_id = ?", courseID)
+	}
+	if err := q.Scan(&chunkCounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to count chunks: %w", err)
+	}
+
+	var modelCounts []struct {
+		CourseID string
+		Model    string
+		Count    int64
+	}
+	q = h.db.Model(&models.Embedding{}).
+		Select("chunks.course_id AS course_id, embeddings.model AS model, COUNT(*) AS count").
+		Joins("JOIN chunks ON embeddings.chunk_id = chunks.id").
+		Group("chunks.course_id, embeddings.model")
+	if courseID != "" {
+		q = q.Where("chunks.course_id = ?", courseID)
+	}
+	if err := q.Scan(&modelCounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to count embeddings: %w", err)
+	}
+
+	statuses := make([]CourseEmbeddingStatus, len(chunkCounts))
+	byCourse := make(map[string]*CourseEmbeddingStatus, len(chunkCounts))
+	for i, count := range chunkCounts {
+		statuses[i] = CourseEmbeddingStatus{CourseID: count.CourseID, Chunks: count.Count, Models: make(map[string]int64)}
+		byCourse[count.CourseID] = &statuses[i]
+	}
+	for _, count := range modelCounts {
+		status, ok := byCourse[count.CourseID]
+		if !ok {
+			continue
+		}
+		status.Models[count.Model] = count.Count
+		if count.Model != model {
+			status.Stale += count.Count
+		}
+	}
+	for i := range statuses {
+		var embedded int64
+		for _, count := range statuses[i].Models {
+			embedded += count
+		}
+		statuses[i].Missing = statuses[i].Chunks - embedded
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].CourseID < statuses[j].CourseID })
+	return statuses, nil
+}
+
+// checkEmbeddingModel returns errEmbeddingModel when some of the course's embeddings
+// were made with another model, whose vectors can't be compared with the query's
+func (h *Handler) checkEmbeddingModel(courseID string) error {
+	model := h.embeddingProvider.GetModelName()
+
+	var stale []string
+	if err := h.db.Model(&models.Embedding{}).
+		Joins("JOIN chunks ON embeddings.chunk_id = chunks.id").
+		Where("chunks.course_id = ? AND embeddings.model <> ?", courseID, model).
+		Distinct().Pluck("embeddings.model", &stale).Error; err != nil {
+		return fmt.Errorf("failed to check embedding models: %w", err)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	sort.Strings(stale)
+	return fmt.Errorf("%w (%s, configured model is %s); re-embed the course first", errEmbeddingModel, strings.Join(stale, ", "), model)
+}
+
+// CheckEmbeddingModels logs the courses whose embeddings don't match the configured
+// embedding model, so a changed EMBEDDING_MODEL is noticed at startup
+func (h *Handler) CheckEmbeddingModels() {
+	statuses, err := h.embeddingStatus("")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check embedding models")
+		return
+	}
+
+	stale := 0
+	for _, status := range statuses {
+		if status.Stale == 0 {
+			continue
+		}
+		stale++
+		event := log.Warn().Str("course_id", status.CourseID).Int64("stale", status.Stale)
+		for model, count := range status.Models {
+			event = event.Int64(model, count)
+		}
+		event.Msg("Course has embeddings from another model")
+	}
+	if stale > 0 {
+		log.Warn().
+			Int("courses", stale).
+			Str("embedding_model", h.embeddingProvider.GetModelName()).
+			Msg("Embeddings don't match the configured model; chat is disabled for these courses until they are re-embedded (POST /api/admin/reembed or -reembed all)")
+	}
+}
+
+// reembedCourses lists the courses a re-embed request applies to
+func (h *Handler) reembedCourses(req ReembedRequest) ([]string, error) {
+	statuses, err := h.embeddingStatus(req.CourseID)
+	if err != nil {
+		return nil, err
+	}
+	var courseIDs []string
+	for _, status := range statuses {
+		if req.Force || status.NeedsReembed() {
+			courseIDs = append(courseIDs, status.CourseID)
+		}
+	}
+	return courseIDs, nil
+}
+
+// ReembedResponse lists the jobs started by a re-embed request
+type ReembedResponse struct {
+	Model   string                   `json:"model"`
+	Jobs    []GenerateCourseResponse `json:"jobs"`
+	Skipped []string                 `json:"skipped,omitempty"` // courses with another job in progress
+}
+
+// GetEmbeddingStatus reports which embedding models each course's chunks were embedded with
+func (h *Handler) GetEmbeddingStatus(c *gin.Context) {
+	statuses, err := h.embeddingStatus(c.Query("course_id"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load embedding status")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load embedding status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"model":   h.embeddingProvider.GetModelName(),
+		"courses": statuses,
+	})
+}
+
+// Reembed starts background jobs that embed a course, or every course needing it, with the
+// configured model. Progress is reported through the job endpoints.
+func (h *Handler) Reembed(c *gin.Context) {
+	var req ReembedRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	courseIDs, err := h.reembedCourses(req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list courses to re-embed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load embedding status"})
+		return
+	}
+	if req.CourseID != "" && len(courseIDs) == 0 {
+		var chunkCount int64
+		h.db.Model(&models.Chunk{}).Where("course_id = ?", req.CourseID).Count(&chunkCount)
+		if chunkCount == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No content found for this course"})
+			return
+		}
+	}
+
+	resp := ReembedResponse{Model: h.embeddingProvider.GetModelName(), Jobs: []GenerateCourseResponse{}}
+	for _, courseID := range courseIDs {
+		if h.hasActiveJob(courseID) {
+			resp.Skipped = append(resp.Skipped, courseID)
+			continue
+		}
+		job, err := h.enqueueJob(courseID, requestUser(c), models.JobKindReembed, req)
+		if errors.Is(err, errJobActive) {
+			resp.Skipped = append(resp.Skipped, courseID)
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Str("course_id", courseID).Msg("Failed to enqueue re-embed job")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start re-embedding"})
+			return
+		}
+		resp.Jobs = append(resp.Jobs, GenerateCourseResponse{JobID: job.ID, CourseID: courseID, Status: job.Status})
+	}
+
+	if req.CourseID != "" && len(resp.Skipped) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A generation job is already in progress for this course"})
+		return
+	}
+	c.JSON(http.StatusAccepted, resp)
+}
+
+// ReembedNow re-embeds a course, or every course needing it when courseID is "all", in
+// the calling goroutine. It backs the -reembed command line flag.
+func (h *Handler) ReembedNow(ctx context.Context, courseID string, force bool) error {
+	req := ReembedRequest{Force: force}
+	if courseID != "all" {
+		req.CourseID = courseID
+	}
+
+	courseIDs, err := h.reembedCourses(req)
+	if err != nil {
+		return err
+	}
+	log.Info().Int("courses", len(courseIDs)).Str("model", h.embeddingProvider.GetModelName()).Msg("Re-embedding courses")
+
+	failed := 0
+	for _, id := range courseIDs {
+		if h.hasActiveJob(id) {
+			log.Warn().Str("course_id", id).Msg("Skipping course with a job in progress")
+			failed++
+			continue
+		}
+		job, err := h.createJob(id, "", models.JobKindReembed, req)
+		if errors.Is(err, errJobActive) {
+			log.Warn().Str("course_id", id).Msg("Skipping course with a job in progress")
+			failed++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		h.runJob(ctx, job.ID)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		h.db.Where("id = ?", job.ID).First(job)
+		if job.Status != models.JobStatusSucceeded {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d courses were not re-embedded", failed, len(courseIDs))
+	}
+	return nil
+}
+
+// runReembedJob replaces the embeddings of a course's chunks with ones from the configured
+// model, a batch at a time. Chunks already embedded with the model are skipped (with force,
+// those embedded since the job started), so an interrupted job resumes where it stopped.
+// Forced jobs also bypass the embedding cache, replacing its vectors.
+func (h *Handler) runReembedJob(ctx context.Context, job *models.GenerationJob) {
+	var req ReembedRequest
+	if err := json.Unmarshal([]byte(job.Request), &req); err != nil {
+		h.failJob(job, fmt.Errorf("invalid job request: %w", err))
+		return
+	}
+	model := h.embeddingProvider.GetModelName()
+
+	current := h.db.Model(&models.Embedding{}).Select("chunk_id").Where("model = ?", model)
+	if req.Force {
+		current = current.Where("created_at >= ?", *job.StartedAt)
+	}
+	var chunkIDs []string
+	if err := h.db.Model(&models.Chunk{}).
+		Where("course_id = ? AND id NOT IN (?)", job.CourseID, current).
+		Order("chunk_num ASC").Pluck("id", &chunkIDs).Error; err != nil {
+		h.failJob(job, fmt.Errorf("failed to load chunks: %w", err))
+		return
+	}
+
+	job.Step = "embeddings"
+	job.Total = job.Progress + len(chunkIDs)
+	job.Message = fmt.Sprintf("Embedding %d chunks with %s", len(chunkIDs), model)
+	h.saveJob(job)
+
+	failed := 0
+	for start := 0; start < len(chunkIDs); start += reembedBatch {
+		var chunks []models.Chunk
+		h.db.Where("id IN ?", chunkIDs[start:min(start+reembedBatch, len(chunkIDs))]).Find(&chunks)
+
+		texts := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			texts[i] = chunk.Content
+		}
+		vectors, err := h.embedWithCache(ctx, texts, !req.Force)
+		if ctx.Err() != nil {
+			h.stopJob(ctx, job, err)
+			return
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("job_id", job.ID).Msg("Some chunks could not be re-embedded")
+		}
+
+		var embeddings []models.Embedding
+		for i, vector := range vectors {
+			if vector == nil {
+				failed++
+				continue
+			}
+			vectorJSON, _ := json.Marshal(vector)
+			embeddings = append(embeddings, models.Embedding{
+				ID:        uuid.New().String(),
+				ChunkID:   chunks[i].ID,
+				Vector:    string(vectorJSON),
+				Dimension: len(vector),
+				Model:     model,
+				CreatedAt: time.Now(),
+			})
+		}
+		if len(embeddings) > 0 {
+			if err := h.db.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "chunk_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"vector", "dimension", "model", "created_at"}),
+			}).CreateInBatches(embeddings, 100).Error; err != nil {
+				h.failJob(job, fmt.Errorf("failed to save embeddings: %w", err))
+				return
+			}
+		}
+
+		job.Progress += len(chunks)
+		job.Message = fmt.Sprintf("Embedded %d of %d chunks", job.Progress, job.Total)
+		h.saveJob(job)
+	}
+
+	// The index holds the old model's vectors; rebuild it from the new ones
+	h.dropCourseIndex(job.CourseID)
+	if _, err := h.courseIndex(job.CourseID); err != nil {
+		log.Warn().Err(err).Str("course_id", job.CourseID).Msg("Failed to rebuild vector index")
+	}
+
+	if failed > 0 {
+		h.failJob(job, fmt.Errorf("%d chunks could not be embedded, run the job again to retry them", failed))
+		return
+	}
+	h.finishJob(job, fmt.Sprintf("Re-embedded %d chunks with %s", job.Total, model))
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// Retrieval strategies
+const (
+	RetrievalSemantic = "semantic" // embedding similarity only
+	RetrievalLexical  = "lexical"  // BM25 full-text only
+	RetrievalHybrid   = "hybrid"   // both, merged by reciprocal-rank fusion
+)
+
+const (
+	defaultTopK     = 6
+	maxTopK         = 50
+	candidateFactor = 4   // fused and MMR candidates per requested chunk
+	mmrLambda       = 0.7 // relevance vs diversity in the MMR pass
+)
+
+// RetrievalOptions selects how chunks are retrieved for a question
+type RetrievalOptions struct {
+	Strategy string `json:"strategy"` // semantic, lexical or hybrid (default from RETRIEVAL_STRATEGY)
+	TopK     int    `json:"top_k"`    // chunks to return (default from RETRIEVAL_TOP_K)
+	MMR      bool   `json:"mmr"`      // diversify the results with maximal marginal relevance
+}
+
+// scoredChunk is a retrieved chunk with its retrieval score
+type scoredChunk struct {
+	Chunk models.Chunk
+	Score float64
+}
+
+// lexicalIndexes keeps one BM25 index per course in memory, built from the chunks the
+// first time the course is searched. Rebuilding is cheap, so nothing is persisted.
+type lexicalIndexes struct {
+	mu      sync.Mutex
+	indexes map[string]*services.BM25Index
+}
+
+func newLexicalIndexes() *lexicalIndexes {
+	return &lexicalIndexes{indexes: make(map[string]*services.BM25Index)}
+}
+
+// lexicalIndex returns the BM25 index of a course
+func (h *Handler) lexicalIndex(courseID string) (*services.BM25Index, error) {
+	h.lexical.mu.Lock()
+	defer h.lexical.mu.Unlock()
+
+	if index, ok := h.lexical.indexes[courseID]; ok {
+		return index, nil
+	}
+
+	index := services.NewBM25Index()
+	var batch []models.Chunk
+	err := h.db.Where("course_id = ?", courseID).
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for _, chunk := range batch {
+				index.Add(chunk.ID, chunk.Content)
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chunks: %w", err)
+	}
+
+	h.lexical.indexes[courseID] = index
+	return index, nil
+}
+
+// indexChunkText adds new chunks to the BM25 index of a course, if it is loaded
+func (h *Handler) indexChunkText(courseID string, texts map[string]string) {
+	h.lexical.mu.Lock()
+	defer h.lexical.mu.Unlock()
+
+	index, ok := h.lexical.indexes[courseID]
+	if !ok {
+		return // built with these chunks on first use
+	}
+	for id, text := range texts {
+		index.Add(id, text)
+	}
+}
+
+// unindexChunkText removes chunks from the BM25 index of a course, if it is loaded
+func (h *Handler) unindexChunkText(courseID string, chunkIDs []string) {
+	h.lexical.mu.Lock()
+	defer h.lexical.mu.Unlock()
+
+	if index, ok := h.lexical.indexes[courseID]; ok {
+		for _, id := range chunkIDs {
+			index.Remove(id)
+		}
+	}
+}
+
+// retrievalOptions fills in the defaults of per-request options
+func (h *Handler) retrievalOptions(opts RetrievalOptions) (RetrievalOptions, error) {
+	if opts.Strategy == "" {
+		opts.Strategy = h.cfg.RetrievalStrategy
+	}
+	opts.Strategy = strings.ToLower(opts.Strategy)
+	switch opts.Strategy {
+	case "":
+		opts.Strategy = RetrievalHybrid
+	case RetrievalSemantic, RetrievalLexical, RetrievalHybrid:
+	default:
+		return opts, fmt.Errorf("unknown retrieval strategy %q (use semantic, lexical or hybrid)", opts.Strategy)
+	}
+
+	if opts.TopK == 0 {
+		opts.TopK = h.cfg.RetrievalTopK
+	}
+	if opts.TopK <= 0 {
+		opts.TopK = defaultTopK
+	}
+	if opts.TopK > maxTopK {
+		return opts, fmt.Errorf("top_k must be at most %d", maxTopK)
+	}
+	return opts, nil
+}
+
+// retrieveChunks finds the chunks of a course most relevant to the query. Hybrid retrieval
+// falls back to lexical results when the query can't be embedded.
+func (h *Handler) retrieveChunks(ctx context.Context, courseID, query string, opts RetrievalOptions) ([]scoredChunk, error) {
+	pool := opts.TopK
+	if opts.Strategy == RetrievalHybrid || opts.MMR {
+		pool = opts.TopK * candidateFactor
+	}
+
+	var queryEmbedding []float64
+	if opts.Strategy != RetrievalLexical || opts.MMR {
+		embedding, err := h.embeddingProvider.Embed(ctx, query)
+		switch {
+		case err == nil:
+			queryEmbedding = embedding
+		case opts.Strategy == RetrievalSemantic || ctx.Err() != nil:
+			return nil, fmt.Errorf("failed to embed question: %w", err)
+		default:
+			log.Warn().Err(err).Msg("Failed to embed question, using lexical retrieval only")
+		}
+	}
+
+	var semantic, lexical []services.Match
+	if opts.Strategy != RetrievalLexical && queryEmbedding != nil {
+		matches, err := h.searchChunks(courseID, queryEmbedding, pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search course material: %w", err)
+		}
+		semantic = matches
+	}
+	if opts.Strategy != RetrievalSemantic {
+		index, err := h.lexicalIndex(courseID)
+		if err != nil {
+			return nil, err
+		}
+		lexical = index.Search(query, pool)
+	}
+
+	var ranked []services.Match
+	switch {
+	case semantic != nil && lexical != nil:
+		ranked = services.ReciprocalRankFusion(semantic, lexical)
+	case semantic != nil:
+		ranked = semantic
+	default:
+		ranked = lexical
+	}
+	if len(ranked) > pool {
+		ranked = ranked[:pool]
+	}
+
+	if opts.MMR && queryEmbedding != nil {
+		ranked = services.MaximalMarginalRelevance(ranked, h.chunkVectors(ranked), queryEmbedding, mmrLambda, opts.TopK)
+	}
+	if len(ranked) > opts.TopK {
+		ranked = ranked[:opts.TopK]
+	}
+
+	ids := make([]string, len(ranked))
+	for i, match := range ranked {
+		ids[i] = match.ID
+	}
+	var found []models.Chunk
+	h.db.Where("id IN ?", ids).Find(&found)
+	chunkByID := make(map[string]models.Chunk, len(found))
+	for _, chunk := range found {
+		chunkByID[chunk.ID] = chunk
+	}
+
+	results := make([]scoredChunk, 0, len(ranked))
+	for _, match := range ranked {
+		if chunk, ok := chunkByID[match.ID]; ok {
+			results = append(results, scoredChunk{Chunk: chunk, Score: match.Score})
+		}
+	}
+	return results, nil
+}
+
+// chunkVectors loads the embeddings of the matched chunks
+func (h *Handler) chunkVectors(matches []services.Match) map[string][]float64 {
+	ids := make([]string, len(matches))
+	for i, match := range matches {
+		ids[i] = match.ID
+	}
+	var embeddings []models.Embedding
+	h.db.Where("chunk_id IN ?", ids).Find(&embeddings)
+
+	vectors := make(map[string][]float64, len(embeddings))
+	for _, emb := range embeddings {
+		var vector []float64
+		if json.Unmarshal([]byte(emb.Vector), &vector) == nil {
+			vectors[emb.ChunkID] = vector
+		}
+	}
+	return vectors
+}
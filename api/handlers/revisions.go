@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// RevisionSnapshot is the course state stored in a revision
+type RevisionSnapshot struct {
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Slides      []SlideResponse `json:"slides"`
+}
+
+type RevisionResponse struct {
+	models.CourseRevision
+	Snapshot RevisionSnapshot `json:"snapshot"`
+}
+
+// SlideDiff describes how one slide changed between two revisions
+type SlideDiff struct {
+	Status     string         `json:"status"` // added, removed, modified, moved, unchanged
+	SlideID    string         `json:"slide_id"`
+	FromNumber int            `json:"from_number,omitempty"`
+	ToNumber   int            `json:"to_number,omitempty"`
+	Changes    []string       `json:"changes,omitempty"` // names of the fields that differ
+	From       *SlideResponse `json:"from,omitempty"`
+	To         *SlideResponse `json:"to,omitempty"`
+}
+
+var errNoSuchRevision = errors.New("revision not found")
+
+// loadSnapshot reads the current slides and questions of a course
+func loadSnapshot(tx *gorm.DB, courseID string) (*RevisionSnapshot, error) {
+	var course models.Course
+	if err := tx.Where("id = ?", courseID).First(&course).Error; err != nil {
+		return nil, err
+	}
+
+	var slides []models.Slide
+	if err := tx.Where("course_id = ?", courseID).Order("slide_number ASC").Find(&slides).Error; err != nil {
+		return nil, err
+	}
+
+	slideIDs := make([]string, len(slides))
+	for i, slide := range slides {
+		slideIDs[i] = slide.ID
+	}
+	var questions []models.Question
+	if len(slideIDs) > 0 {
+		if err := tx.Where("slide_id IN ?", slideIDs).Find(&questions).Error; err != nil {
+			return nil, err
+		}
+	}
+	questionBySlide := make(map[string]models.Question, len(questions))
+	for _, q := range questions {
+		questionBySlide[q.SlideID] = q
+	}
+	sourcesBySlide, err := slideSourceIDs(tx, slideIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &RevisionSnapshot{
+		Title:       course.Title,
+		Description: course.Description,
+		Slides:      make([]SlideResponse, 0, len(slides)),
+	}
+	for _, slide := range slides {
+		entry := SlideResponse{Slide: slide, SourceChunkIDs: sourcesBySlide[slide.ID]}
+		if q, ok := questionBySlide[slide.ID]; ok {
+			var options []string
+			json.Unmarshal([]byte(q.Options), &options)
+			entry.Question = &QuestionResponse{
+				SlideID:       slide.ID,
+				Question:      q.Question,
+				Options:       options,
+				CorrectAnswer: q.CorrectAnswer,
+			}
+		}
+		snapshot.Slides = append(snapshot.Slides, entry)
+	}
+
+	return snapshot, nil
+}
+
+// recordRevision snapshots the current state of a course as its next revision.
+// Pass the transaction of the change being recorded so both commit together.
+func recordRevision(tx *gorm.DB, courseID, reason, jobID string, restoredFrom int) (*models.CourseRevision, error) {
+	snapshot, err := loadSnapshot(tx, courseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load course snapshot: %w", err)
+	}
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode course snapshot: %w", err)
+	}
+
+	var last int
+	if err := tx.Model(&models.CourseRevision{}).Where("course_id = ?", courseID).
+		Select("COALESCE(MAX(number), 0)").Scan(&last).Error; err != nil {
+		return nil, err
+	}
+
+	revision := &models.CourseRevision{
+		ID:           uuid.New().String(),
+		CourseID:     courseID,
+		Number:       last + 1,
+		Reason:       reason,
+		JobID:        jobID,
+		RestoredFrom: restoredFrom,
+		Title:        snapshot.Title,
+		NumSlides:    len(snapshot.Slides),
+		Snapshot:     string(snapshotJSON),
+		CreatedAt:    time.Now(),
+	}
+	if err := tx.Create(revision).Error; err != nil {
+		return nil, fmt.Errorf("failed to save revision: %w", err)
+	}
+	return revision, nil
+}
+
+// preserveUnrecordedSlides records the current slides as an import revision when the
+// course has slides but no history yet, so a regeneration never loses them
+func preserveUnrecordedSlides(tx *gorm.DB, courseID string) error {
+	var revisions, slides int64
+	tx.Model(&models.CourseRevision{}).Where("course_id = ?", courseID).Count(&revisions)
+	if revisions > 0 {
+		return nil
+	}
+	tx.Model(&models.Slide{}).Where("course_id = ?", courseID).Count(&slides)
+	if slides == 0 {
+		return nil
+	}
+	_, err := recordRevision(tx, courseID, models.RevisionReasonImport, "", 0)
+	return err
+}
+
+func loadRevision(db *gorm.DB, courseID string, number int) (*models.CourseRevision, *RevisionSnapshot, error) {
+	var revision models.CourseRevision
+	if err := db.Where("course_id = ? AND number = ?", courseID, number).First(&revision).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errNoSuchRevision
+		}
+		return nil, nil, err
+	}
+
+	var snapshot RevisionSnapshot
+	if err := json.Unmarshal([]byte(revision.Snapshot), &snapshot); err != nil {
+		return nil, nil, fmt.Errorf("invalid revision snapshot: %w", err)
+	}
+	return &revision, &snapshot, nil
+}
+
+// revisionNumberParam parses a revision number from a path or query value
+func revisionNumberParam(value string) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		return 0, fmt.Errorf("invalid revision number %q", value)
+	}
+	return number, nil
+}
+
+// diffSlides compares two revisions slide by slide. Slides are matched by ID, so
+// edits and moves are tracked; regenerated slides (which get new IDs) are then
+// paired by position.
+func diffSlides(from, to []SlideResponse) []SlideDiff {
+	toByID := make(map[string]int, len(to))
+	for i, s := range to {
+		toByID[s.Slide.ID] = i
+	}
+
+	matchedTo := make([]bool, len(to))
+	var unmatchedFrom []int
+	diffs := make([]SlideDiff, 0, len(to))
+
+	for i := range from {
+		j, ok := toByID[from[i].Slide.ID]
+		if !ok {
+			unmatchedFrom = append(unmatchedFrom, i)
+			continue
+		}
+		matchedTo[j] = true
+		diffs = append(diffs, compareSlides(&from[i], &to[j]))
+	}
+
+	toByNumber := make(map[int]int)
+	for j, s := range to {
+		if !matchedTo[j] {
+			toByNumber[s.Slide.SlideNumber] = j
+		}
+	}
+	for _, i := range unmatchedFrom {
+		if j, ok := toByNumber[from[i].Slide.SlideNumber]; ok {
+			matchedTo[j] = true
+			delete(toByNumber, from[i].Slide.SlideNumber)
+			diffs = append(diffs, compareSlides(&from[i], &to[j]))
+			continue
+		}
+		diffs = append(diffs, SlideDiff{
+			Status:     "removed",
+			SlideID:    from[i].Slide.ID,
+			FromNumber: from[i].Slide.SlideNumber,
+			From:       &from[i],
+		})
+	}
+	for j := range to {
+		if !matchedTo[j] {
+			diffs = append(diffs, SlideDiff{
+				Status:   "added",
+				SlideID:  to[j].Slide.ID,
+				ToNumber: to[j].Slide.SlideNumber,
+				To:       &to[j],
+			})
+		}
+	}
+
+	// Order by position in the newer revision, removed slides by their old position
+	position := func(d SlideDiff) int {
+		if d.ToNumber > 0 {
+			return d.ToNumber
+		}
+		return d.FromNumber
+	}
+	for i := 1; i < len(diffs); i++ {
+		for j := i; j > 0 && position(diffs[j]) < position(diffs[j-1]); j-- {
+			diffs[j], diffs[j-1] = diffs[j-1], diffs[j]
+		}
+	}
+
+	return diffs
+}
+
+func compareSlides(from, to *SlideResponse) SlideDiff {
+	a, b := from.Slide, to.Slide
+	var changes []string
+	if a.Title != b.Title {
+		changes = append(changes, "title")
+	}
+	if a.Content != b.Content {
+		changes = append(changes, "content")
+	}
+	if a.InstructorScript != b.InstructorScript {
+		changes = append(changes, "instructor_script")
+	}
+	if a.ImagePrompt != b.ImagePrompt || a.ImageURL != b.ImageURL {
+		changes = append(changes, "image")
+	}
+	if a.AudioURL != b.AudioURL {
+		changes = append(changes, "audio")
+	}
+	if a.Table != b.Table {
+		changes = append(changes, "table")
+	}
+	if a.Layout != b.Layout || a.Theme != b.Theme {
+		changes = append(changes, "design")
+	}
+	if !sameQuestion(from.Question, to.Question) {
+		changes = append(changes, "question")
+	}
+
+	diff := SlideDiff{
+		SlideID:    b.ID,
+		FromNumber: a.SlideNumber,
+		ToNumber:   b.SlideNumber,
+		Changes:    changes,
+	}
+	switch {
+	case len(changes) > 0:
+		diff.Status = "modified"
+		diff.From, diff.To = from, to
+	case a.SlideNumber != b.SlideNumber:
+		diff.Status = "moved"
+	default:
+		diff.Status = "unchanged"
+	}
+	return diff
+}
+
+func sameQuestion(a, b *QuestionResponse) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if a.Question != b.Question || a.CorrectAnswer != b.CorrectAnswer || len(a.Options) != len(b.Options) {
+		return false
+	}
+	for i := range a.Options {
+		if a.Options[i] != b.Options[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ListRevisions returns the revision history of a course, newest first
+func (h *Handler) ListRevisions(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var revisions []models.CourseRevision
+	if err := h.db.Where("course_id = ?", courseID).Order("number DESC").Find(&revisions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve revisions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"course_id": courseID,
+		"revisions": revisions,
+	})
+}
+
+func (h *Handler) GetRevision(c *gin.Context) {
+	courseID := c.Param("courseId")
+	number, err := revisionNumberParam(c.Param("number"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	revision, snapshot, err := loadRevision(h.db, courseID, number)
+	if errors.Is(err, errNoSuchRevision) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load revision"})
+		return
+	}
+
+	c.JSON(http.StatusOK, RevisionResponse{CourseRevision: *revision, Snapshot: *snapshot})
+}
+
+// DiffRevisions compares two revisions (?from=N&to=M) slide by slide
+func (h *Handler) DiffRevisions(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	fromNumber, err := revisionNumberParam(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	toNumber, err := revisionNumberParam(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, from, err := loadRevision(h.db, courseID, fromNumber)
+	if err == nil {
+		_, to, toErr := loadRevision(h.db, courseID, toNumber)
+		if toErr == nil {
+			c.JSON(http.StatusOK, gin.H{
+				"course_id":     courseID,
+				"from":          fromNumber,
+				"to":            toNumber,
+				"title_changed": from.Title != to.Title,
+				"slides":        diffSlides(from.Slides, to.Slides),
+			})
+			return
+		}
+		err = toErr
+	}
+
+	if errors.Is(err, errNoSuchRevision) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load revision"})
+}
+
+// RestoreRevision makes an older revision current again. The restore is itself
+// recorded as a new revision, so nothing in the history is lost.
+func (h *Handler) RestoreRevision(c *gin.Context) {
+	courseID := c.Param("courseId")
+	number, err := revisionNumberParam(c.Param("number"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if h.respondActiveJob(c, courseID) {
+		return
+	}
+
+	_, snapshot, err := loadRevision(h.db, courseID, number)
+	if errors.Is(err, errNoSuchRevision) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load revision"})
+		return
+	}
+
+	var revision *models.CourseRevision
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := preserveUnrecordedSlides(tx, courseID); err != nil {
+			return err
+		}
+
+		deleteSlides(tx, "course_id = ?", courseID)
+
+		for _, entry := range snapshot.Slides {
+			slide := entry.Slide
+			slide.UpdatedAt = time.Now()
+			if err := tx.Create(&slide).Error; err != nil {
+				return err
+			}
+			if err := replaceSlideSources(tx, courseID, slide.ID, entry.SourceChunkIDs); err != nil {
+				return err
+			}
+			if q := entry.Question; q != nil {
+				if err := h.replaceQuestion(tx, slide.ID, &SlideQuestionInput{
+					Question:      q.Question,
+					Options:       q.Options,
+					CorrectAnswer: q.CorrectAnswer,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.Model(&models.Course{}).Where("id = ?", courseID).Updates(map[string]interface{}{
+			"title":       snapshot.Title,
+			"description": snapshot.Description,
+			"num_slides":  len(snapshot.Slides),
+			"updated_at":  time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		revision, err = recordRevision(tx, courseID, models.RevisionReasonRestore, "", number)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("course_id", courseID).Int("revision", number).Msg("Failed to restore revision")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore revision"})
+		return
+	}
+
+	c.JSON(http.StatusOK, revision)
+}
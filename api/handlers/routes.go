@@ -0,0 +1,55 @@
+package handlers
+
+import "github.com/gin-gonic/gin"
+
+// RegisterRoutes adds the API routes and the audio files to the router
+func (h *Handler) RegisterRoutes(router *gin.Engine) {
+	// Health check
+	router.GET("/api/health", h.Health)
+
+	// Serve static audio files
+	router.Static("/audio", h.cfg.AudioDir)
+
+	// API routes
+	api := router.Group("/api")
+	{
+		api.POST("/upload", h.UploadPDF)
+		api.POST("/course/generate", h.GenerateCourse)
+		api.POST("/course/estimate", h.EstimateCourse)
+		api.PUT("/course/:courseId/budget", h.SetCourseBudget)
+		api.GET("/course/:courseId", h.GetCourse)
+		api.POST("/course/:courseId/outline", h.GenerateOutline)
+		api.GET("/course/:courseId/outline", h.GetOutline)
+		api.PUT("/course/:courseId/outline", h.UpdateOutline)
+		api.POST("/course/:courseId/outline/approve", h.ApproveOutline)
+		api.GET("/jobs/:id", h.GetJob)
+		api.GET("/jobs/:id/events", h.StreamJob)
+		api.POST("/jobs/:id/cancel", h.CancelJob)
+		api.GET("/course/:courseId/revisions", h.ListRevisions)
+		api.GET("/course/:courseId/revisions/diff", h.DiffRevisions)
+		api.GET("/course/:courseId/revisions/:number", h.GetRevision)
+		api.POST("/course/:courseId/revisions/:number/restore", h.RestoreRevision)
+		api.GET("/slides/:courseId", h.GetSlides)
+		api.POST("/slides/:courseId", h.InsertSlide)
+		api.POST("/slides/:courseId/reorder", h.ReorderSlides)
+		api.PUT("/slides/:courseId/:slideId", h.UpdateSlide)
+		api.DELETE("/slides/:courseId/:slideId", h.DeleteSlide)
+		api.POST("/slides/:courseId/:slideId/regenerate", h.RegenerateSlide)
+		api.GET("/files/:courseId", h.GetSourceFiles)
+		api.DELETE("/files/:courseId/:fileId", h.DeleteSourceFile)
+		api.GET("/questions/:courseId", h.GetQuestions)
+		api.POST("/chat/ask", h.ChatAsk)
+		api.POST("/chat/ask/stream", h.ChatAskStream)
+		api.POST("/chat/sessions", h.CreateChatSession)
+		api.GET("/chat/sessions", h.ListChatSessions)
+		api.GET("/chat/sessions/:sessionId/messages", h.GetChatMessages)
+		api.DELETE("/chat/sessions/:sessionId", h.DeleteChatSession)
+		api.GET("/admin/embeddings", h.GetEmbeddingStatus)
+		api.POST("/admin/reembed", h.Reembed)
+		api.GET("/usage/courses", h.GetCoursesUsage)
+		api.GET("/usage/courses/:courseId", h.GetCourseUsage)
+		api.GET("/usage/daily", h.GetDailyUsage)
+		api.GET("/usage/providers", h.GetProviderUsage)
+		api.GET("/usage/budgets", h.GetBudgets)
+	}
+}
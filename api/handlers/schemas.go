@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/local/elearn/api/services"
+)
+
+// questionOptions is the number of answer options of every generated question
+const questionOptions = 4
+
+func nonEmptyString(description string) *services.JSONSchema {
+	return &services.JSONSchema{Type: "string", Description: description, MinLength: services.Ptr(1)}
+}
+
+func stringList(description string, minItems int) *services.JSONSchema {
+	return &services.JSONSchema{
+		Type:        "array",
+		Description: description,
+		Items:       nonEmptyString(""),
+		MinItems:    services.Ptr(minItems),
+	}
+}
+
+// questionSchema describes a multiple choice question with exactly four options
+func questionSchema() *services.JSONSchema {
+	return &services.JSONSchema{
+		Type:        "object",
+		Description: "A multiple choice question testing the slide's key concept",
+		Properties: map[string]*services.JSONSchema{
+			"question": nonEmptyString("The question text"),
+			"options": {
+				Type:        "array",
+				Description: "Exactly 4 distinct answer options",
+				Items:       nonEmptyString(""),
+				MinItems:    services.Ptr(questionOptions),
+				MaxItems:    services.Ptr(questionOptions),
+			},
+			"correct_answer": {
+				Type:        "integer",
+				Description: "Index (0-3) of the correct option",
+				Minimum:     services.Ptr(0.0),
+				Maximum:     services.Ptr(float64(questionOptions - 1)),
+			},
+		},
+		Required: []string{"question", "options", "correct_answer"},
+	}
+}
+
+// tableSchema describes the source data a slide presents as a table
+func tableSchema() *services.JSONSchema {
+	return &services.JSONSchema{
+		Type:        "object",
+		Description: "Only when the slide presents data from a source table: the rows it needs, with the numbers copied exactly",
+		Properties: map[string]*services.JSONSchema{
+			"caption": {Type: "string", Description: "What the table shows, e.g. the source table's caption"},
+			"columns": stringList("Column headers", 2),
+			"rows": {
+				Type:        "array",
+				Description: "Rows of cells, one cell per column",
+				MinItems:    services.Ptr(1),
+				Items:       &services.JSONSchema{Type: "array", Items: &services.JSONSchema{Type: "string"}},
+			},
+		},
+		Required: []string{"columns", "rows"},
+	}
+}
+
+// slideSchema describes one generated slide. The question is required when questions
+// were requested and left out of the schema otherwise; the table is only offered when the
+// source content holds tables.
+func slideSchema(withQuestion, withTable bool) services.StructuredOutput {
+	schema := &services.JSONSchema{
+		Type: "object",
+		Properties: map[string]*services.JSONSchema{
+			"title":             nonEmptyString("Slide title, close to the planned title"),
+			"content":           nonEmptyString("Concise content shown on the slide"),
+			"instructor_script": nonEmptyString("What the instructor says while presenting the slide, 3-5 paragraphs"),
+			"image_prompt":      {Type: "string", Description: "Description of a relevant professional image"},
+			"layout":            {Type: "string", Enum: services.SlideLayouts},
+			"theme":             {Type: "string", Enum: services.SlideThemes},
+		},
+		Required: []string{"title", "content", "instructor_script"},
+	}
+	if withQuestion {
+		schema.Properties["question"] = questionSchema()
+		schema.Required = append(schema.Required, "question")
+	}
+	if withTable {
+		schema.Properties["table"] = tableSchema()
+	}
+	return services.StructuredOutput{
+		Name:        "course_slide",
+		Description: "One slide of the course with its instructor script",
+		Schema:      schema,
+	}
+}
+
+// checkSlide applies the rules of a slide the schema can't express
+func checkSlide(data []byte) []string {
+	var slide GeneratedSlide
+	if err := json.Unmarshal(data, &slide); err != nil {
+		return []string{err.Error()}
+	}
+	if slide.Question == nil {
+		return nil
+	}
+
+	var problems []string
+	seen := make(map[string]int)
+	for i, option := range slide.Question.Options {
+		key := strings.ToLower(strings.TrimSpace(option))
+		if j, ok := seen[key]; ok {
+			problems = append(problems, fmt.Sprintf("question.options[%d]: same as option %d, options must be distinct", i, j))
+		}
+		seen[key] = i
+	}
+	return problems
+}
+
+// tableNumber matches the numbers of a table cell, e.g. "100", "3.5" or "1,200"
+var tableNumber = regexp.MustCompile(`\d+(?:,\d{3})*(?:\.\d+)?`)
+
+// slideChecker checks a slide like checkSlide, and also rejects table numbers that aren't
+// numbers of the source content, so data slides never show made up figures. Numbers are
+// compared whole: "5" doesn't pass because the source has "50".
+func slideChecker(source string) func(data []byte) []string {
+	sourceNumbers := make(map[string]bool)
+	for _, number := range tableNumber.FindAllString(source, -1) {
+		sourceNumbers[number] = true
+	}
+
+	return func(data []byte) []string {
+		problems := checkSlide(data)
+		var slide GeneratedSlide
+		if err := json.Unmarshal(data, &slide); err != nil || slide.Table == nil {
+			return problems
+		}
+
+		check := func(path, cell string) {
+			for _, number := range tableNumber.FindAllString(cell, -1) {
+				if !sourceNumbers[number] {
+					problems = append(problems, fmt.Sprintf("%s: %q is not in the source content, copy the numbers of the source tables exactly", path, number))
+					return
+				}
+			}
+		}
+		check("table.caption", slide.Table.Caption)
+		for i, column := range slide.Table.Columns {
+			check(fmt.Sprintf("table.columns[%d]", i), column)
+		}
+		for i, row := range slide.Table.Rows {
+			for j, cell := range row {
+				check(fmt.Sprintf("table.rows[%d][%d]", i, j), cell)
+			}
+		}
+		return problems
+	}
+}
+
+// modulePlanSchema describes the plan of one module with exactly numSlides slides
+func modulePlanSchema(numSlides int) services.StructuredOutput {
+	return services.StructuredOutput{
+		Name:        "module_plan",
+		Description: "The learning objectives and slide plan of one course module",
+		Schema: &services.JSONSchema{
+			Type: "object",
+			Properties: map[string]*services.JSONSchema{
+				"title":               nonEmptyString("Module title"),
+				"learning_objectives": stringList("What learners can do after the module", 1),
+				"slides": {
+					Type:        "array",
+					Description: fmt.Sprintf("Exactly %d slides in teaching order", numSlides),
+					MinItems:    services.Ptr(numSlides),
+					MaxItems:    services.Ptr(numSlides),
+					Items: &services.JSONSchema{
+						Type: "object",
+						Properties: map[string]*services.JSONSchema{
+							"title":      nonEmptyString("Slide title"),
+							"key_points": stringList("Points the slide covers", 1),
+						},
+						Required: []string{"title", "key_points"},
+					},
+				},
+			},
+			Required: []string{"learning_objectives", "slides"}, // the title falls back to the section's
+		},
+	}
+}
+
+// sectionOutlineSchema describes the document-wide outline grouping numParts source parts
+// into at most maxSections sections
+func sectionOutlineSchema(maxSections, numParts int) services.StructuredOutput {
+	return services.StructuredOutput{
+		Name:        "course_outline",
+		Description: "The course title and its sections, each covering consecutive source parts",
+		Schema: &services.JSONSchema{
+			Type: "object",
+			Properties: map[string]*services.JSONSchema{
+				"title":       nonEmptyString("Course title"),
+				"description": {Type: "string", Description: "One or two sentence course description"},
+				"sections": {
+					Type:     "array",
+					MinItems: services.Ptr(1),
+					MaxItems: services.Ptr(maxSections),
+					Items: &services.JSONSchema{
+						Type: "object",
+						Properties: map[string]*services.JSONSchema{
+							"title":   nonEmptyString("Section title"),
+							"summary": {Type: "string"},
+							"parts": {
+								Type:        "array",
+								Description: "1-based numbers of the source parts the section covers",
+								MinItems:    services.Ptr(1),
+								Items: &services.JSONSchema{
+									Type:    "integer",
+									Minimum: services.Ptr(1.0),
+									Maximum: services.Ptr(float64(numParts)),
+								},
+							},
+						},
+						Required: []string{"title", "parts"},
+					},
+				},
+			},
+			Required: []string{"title", "sections"},
+		},
+	}
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlideCheckerComparesWholeNumbers(t *testing.T) {
+	source := "Table 2: Optimum temperatures\n\n| Enzyme | Optimum |\n| --- | --- |\n| Pepsin | 50 |\n| Trypsin | 1,200.5 |"
+	check := slideChecker(source)
+
+	slide := func(rows string) []byte {
+		return []byte(`{"title":"Enzymes","content":"Optimum temperatures","instructor_script":"Each enzyme has its own.",` +
+			`"table":{"columns":["Enzyme","Optimum"],"rows":` + rows + `}}`)
+	}
+	if problems := check(slide(`[["Pepsin","50"],["Trypsin","1,200.5"]]`)); len(problems) != 0 {
+		t.Errorf("expected the source's numbers to pass, got %v", problems)
+	}
+
+	// "5" is part of "50" and "1,200.5", but not a number of the source
+	problems := check(slide(`[["Pepsin","5"]]`))
+	if len(problems) != 1 || !strings.Contains(problems[0], `table.rows[0][1]: "5"`) {
+		t.Errorf("expected the made up 5 to be rejected, got %v", problems)
+	}
+}
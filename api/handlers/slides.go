@@ -0,0 +1,632 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// SlideQuestionInput is a quiz question supplied by an instructor
+type SlideQuestionInput struct {
+	Question      string   `json:"question" binding:"required"`
+	Options       []string `json:"options" binding:"required,min=2"`
+	CorrectAnswer int      `json:"correct_answer" binding:"min=0"`
+}
+
+// UpdateSlideRequest holds the slide fields to change; omitted fields are left as they are
+type UpdateSlideRequest struct {
+	Title            *string             `json:"title"`
+	Content          *string             `json:"content"`
+	InstructorScript *string             `json:"instructor_script"`
+	ImagePrompt      *string             `json:"image_prompt"`
+	ImageURL         *string             `json:"image_url"`
+	Layout           *string             `json:"layout"`
+	Table            *string             `json:"table"` // Markdown table after an optional caption, "" to remove it
+	Theme            *string             `json:"theme"`
+	Question         *SlideQuestionInput `json:"question"`
+	RemoveQuestion   bool                `json:"remove_question"`
+}
+
+type InsertSlideRequest struct {
+	Position         int                 `json:"position" binding:"required,min=1"` // 1-based slide number the new slide takes
+	Title            string              `json:"title" binding:"required"`
+	Content          string              `json:"content"`
+	InstructorScript string              `json:"instructor_script"`
+	ImagePrompt      string              `json:"image_prompt"`
+	ImageURL         string              `json:"image_url"`
+	Layout           string              `json:"layout"`
+	Table            string              `json:"table"`
+	Theme            string              `json:"theme"`
+	Question         *SlideQuestionInput `json:"question"`
+}
+
+type ReorderSlidesRequest struct {
+	SlideIDs []string `json:"slide_ids" binding:"required,min=1"` // Every slide of the course in the new order
+}
+
+type RegenerateSlideRequest struct {
+	Instruction         string `json:"instruction"` // e.g. "make this simpler"
+	GenerateQuestion    bool   `json:"generate_question"`
+	RegenerateImage     bool   `json:"regenerate_image"`
+	RegenerateVoiceover bool   `json:"regenerate_voiceover"`
+}
+
+type SlideResponse struct {
+	Slide          models.Slide      `json:"slide"`
+	Question       *QuestionResponse `json:"question,omitempty"`
+	SourceChunkIDs []string          `json:"source_chunk_ids,omitempty"` // Chunks the slide was written from
+}
+
+type QuestionResponse struct {
+	SlideID       string   `json:"slide_id"`
+	Question      string   `json:"question"`
+	Options       []string `json:"options"`
+	CorrectAnswer int      `json:"correct_answer"`
+}
+
+func validateQuestionInput(q *SlideQuestionInput) error {
+	if q.CorrectAnswer >= len(q.Options) {
+		return fmt.Errorf("correct_answer must be between 0 and %d", len(q.Options)-1)
+	}
+	return nil
+}
+
+// replaceQuestion swaps the question of a slide for the given one (or none)
+func (h *Handler) replaceQuestion(tx *gorm.DB, slideID string, q *SlideQuestionInput) error {
+	if err := tx.Where("slide_id = ?", slideID).Delete(&models.Question{}).Error; err != nil {
+		return err
+	}
+	if q == nil {
+		return nil
+	}
+
+	optionsJSON, _ := json.Marshal(q.Options)
+	return tx.Create(&models.Question{
+		ID:            uuid.New().String(),
+		SlideID:       slideID,
+		Question:      q.Question,
+		Options:       string(optionsJSON),
+		CorrectAnswer: q.CorrectAnswer,
+		CreatedAt:     time.Now(),
+	}).Error
+}
+
+// replaceSlideSources links a slide to the chunks it was written from, replacing earlier links.
+// Chunks that no longer exist (their file was deleted) are skipped.
+func replaceSlideSources(tx *gorm.DB, courseID, slideID string, chunkIDs []string) error {
+	if err := tx.Where("slide_id = ?", slideID).Delete(&models.SlideSource{}).Error; err != nil {
+		return err
+	}
+	if len(chunkIDs) == 0 {
+		return nil
+	}
+
+	var existing []string
+	if err := tx.Model(&models.Chunk{}).Where("id IN ?", chunkIDs).Pluck("id", &existing).Error; err != nil {
+		return err
+	}
+	sources := make([]models.SlideSource, len(existing))
+	for i, chunkID := range existing {
+		sources[i] = models.SlideSource{SlideID: slideID, ChunkID: chunkID, CourseID: courseID}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	return tx.Create(&sources).Error
+}
+
+// slideSourceIDs returns the source chunk IDs of the given slides, keyed by slide ID
+func slideSourceIDs(tx *gorm.DB, slideIDs []string) (map[string][]string, error) {
+	var sources []models.SlideSource
+	if len(slideIDs) > 0 {
+		if err := tx.Where("slide_id IN ?", slideIDs).Order("chunk_id").Find(&sources).Error; err != nil {
+			return nil, err
+		}
+	}
+	bySlide := make(map[string][]string, len(slideIDs))
+	for _, source := range sources {
+		bySlide[source.SlideID] = append(bySlide[source.SlideID], source.ChunkID)
+	}
+	return bySlide, nil
+}
+
+// slideResponse loads a slide with its question and sources
+func (h *Handler) slideResponse(slideID string) (*SlideResponse, error) {
+	var slide models.Slide
+	if err := h.db.Where("id = ?", slideID).First(&slide).Error; err != nil {
+		return nil, err
+	}
+
+	response := &SlideResponse{Slide: slide}
+	var question models.Question
+	if err := h.db.Where("slide_id = ?", slideID).First(&question).Error; err == nil {
+		var options []string
+		json.Unmarshal([]byte(question.Options), &options)
+		response.Question = &QuestionResponse{
+			SlideID:       slideID,
+			Question:      question.Question,
+			Options:       options,
+			CorrectAnswer: question.CorrectAnswer,
+		}
+	}
+	if sources, err := slideSourceIDs(h.db, []string{slideID}); err == nil {
+		response.SourceChunkIDs = sources[slideID]
+	}
+	return response, nil
+}
+
+// renumberSlides assigns consecutive slide numbers in the given order and updates the course's slide count
+func renumberSlides(tx *gorm.DB, courseID string, slideIDs []string) error {
+	for i, id := range slideIDs {
+		if err := tx.Model(&models.Slide{}).Where("id = ?", id).Update("slide_number", i+1).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Model(&models.Course{}).Where("id = ?", courseID).Updates(map[string]interface{}{
+		"num_slides": len(slideIDs),
+		"updated_at": time.Now(),
+	}).Error
+}
+
+// orderedSlideIDs returns the IDs of the course's slides in presentation order
+func orderedSlideIDs(tx *gorm.DB, courseID string) ([]string, error) {
+	var ids []string
+	err := tx.Model(&models.Slide{}).Where("course_id = ?", courseID).Order("slide_number ASC").Pluck("id", &ids).Error
+	return ids, err
+}
+
+// UpdateSlide edits the fields of a single slide
+func (h *Handler) UpdateSlide(c *gin.Context) {
+	courseID := c.Param("courseId")
+	slideID := c.Param("slideId")
+
+	var req UpdateSlideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if h.respondActiveJob(c, courseID) {
+		return
+	}
+	if req.Question != nil {
+		if err := validateQuestionInput(req.Question); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var slide models.Slide
+	if err := h.db.Where("id = ? AND course_id = ?", slideID, courseID).First(&slide).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
+		return
+	}
+
+	if req.Title != nil {
+		slide.Title = *req.Title
+	}
+	if req.Content != nil {
+		slide.Content = *req.Content
+	}
+	if req.InstructorScript != nil {
+		slide.InstructorScript = *req.InstructorScript
+	}
+	if req.ImagePrompt != nil {
+		slide.ImagePrompt = *req.ImagePrompt
+	}
+	if req.ImageURL != nil {
+		slide.ImageURL = *req.ImageURL
+	}
+	if req.Layout != nil {
+		slide.Layout = *req.Layout
+	}
+	if req.Table != nil {
+		slide.Table = *req.Table
+	}
+	if req.Theme != nil {
+		slide.Theme = *req.Theme
+	}
+	slide.UpdatedAt = time.Now()
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := preserveUnrecordedSlides(tx, courseID); err != nil {
+			return err
+		}
+		if err := tx.Save(&slide).Error; err != nil {
+			return err
+		}
+		if req.Question != nil || req.RemoveQuestion {
+			if err := h.replaceQuestion(tx, slide.ID, req.Question); err != nil {
+				return err
+			}
+		}
+		_, err := recordRevision(tx, courseID, models.RevisionReasonEdit, "", 0)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("slide_id", slideID).Msg("Failed to update slide")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update slide"})
+		return
+	}
+
+	response, _ := h.slideResponse(slide.ID)
+	c.JSON(http.StatusOK, response)
+}
+
+// InsertSlide adds a new slide at the given position and shifts the following slides down
+func (h *Handler) InsertSlide(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var req InsertSlideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if h.respondActiveJob(c, courseID) {
+		return
+	}
+	if req.Question != nil {
+		if err := validateQuestionInput(req.Question); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var course models.Course
+	if err := h.db.Where("id = ?", courseID).First(&course).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+
+	slide := models.Slide{
+		ID:               uuid.New().String(),
+		CourseID:         courseID,
+		Title:            req.Title,
+		Content:          req.Content,
+		InstructorScript: req.InstructorScript,
+		ImagePrompt:      req.ImagePrompt,
+		ImageURL:         req.ImageURL,
+		Layout:           req.Layout,
+		Table:            req.Table,
+		Theme:            req.Theme,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := preserveUnrecordedSlides(tx, courseID); err != nil {
+			return err
+		}
+
+		ids, err := orderedSlideIDs(tx, courseID)
+		if err != nil {
+			return err
+		}
+
+		position := min(req.Position, len(ids)+1)
+		slide.SlideNumber = position
+		if err := tx.Create(&slide).Error; err != nil {
+			return err
+		}
+		if err := h.replaceQuestion(tx, slide.ID, req.Question); err != nil {
+			return err
+		}
+
+		ids = append(ids[:position-1], append([]string{slide.ID}, ids[position-1:]...)...)
+		if err := renumberSlides(tx, courseID, ids); err != nil {
+			return err
+		}
+		_, err = recordRevision(tx, courseID, models.RevisionReasonInsert, "", 0)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("course_id", courseID).Msg("Failed to insert slide")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert slide"})
+		return
+	}
+
+	response, _ := h.slideResponse(slide.ID)
+	c.JSON(http.StatusCreated, response)
+}
+
+// DeleteSlide removes a slide with its question and source links and closes the gap in
+// the numbering
+func (h *Handler) DeleteSlide(c *gin.Context) {
+	courseID := c.Param("courseId")
+	slideID := c.Param("slideId")
+
+	if h.respondActiveJob(c, courseID) {
+		return
+	}
+
+	var slide models.Slide
+	if err := h.db.Where("id = ? AND course_id = ?", slideID, courseID).First(&slide).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
+		return
+	}
+
+	var remaining []string
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := preserveUnrecordedSlides(tx, courseID); err != nil {
+			return err
+		}
+		if err := tx.Where("slide_id = ?", slideID).Delete(&models.Question{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("slide_id = ?", slideID).Delete(&models.SlideSource{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&slide).Error; err != nil {
+			return err
+		}
+
+		var err error
+		remaining, err = orderedSlideIDs(tx, courseID)
+		if err != nil {
+			return err
+		}
+		if err := renumberSlides(tx, courseID, remaining); err != nil {
+			return err
+		}
+		_, err = recordRevision(tx, courseID, models.RevisionReasonDelete, "", 0)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("slide_id", slideID).Msg("Failed to delete slide")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete slide"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "Slide deleted successfully",
+		"slides_remaining": len(remaining),
+	})
+}
+
+// ReorderSlides puts the course's slides in the given order and renumbers them
+func (h *Handler) ReorderSlides(c *gin.Context) {
+	courseID := c.Param("courseId")
+
+	var req ReorderSlidesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if h.respondActiveJob(c, courseID) {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		current, err := orderedSlideIDs(tx, courseID)
+		if err != nil {
+			return err
+		}
+
+		// The new order must be a permutation of the existing slides
+		known := make(map[string]bool, len(current))
+		for _, id := range current {
+			known[id] = true
+		}
+		if len(req.SlideIDs) != len(current) {
+			return errInvalidOrder
+		}
+		for _, id := range req.SlideIDs {
+			if !known[id] {
+				return errInvalidOrder
+			}
+			delete(known, id)
+		}
+
+		if err := preserveUnrecordedSlides(tx, courseID); err != nil {
+			return err
+		}
+		if err := renumberSlides(tx, courseID, req.SlideIDs); err != nil {
+			return err
+		}
+		_, err = recordRevision(tx, courseID, models.RevisionReasonReorder, "", 0)
+		return err
+	})
+	if errors.Is(err, errInvalidOrder) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "slide_ids must list every slide of the course exactly once"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("course_id", courseID).Msg("Failed to reorder slides")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reorder slides"})
+		return
+	}
+
+	var slides []models.Slide
+	h.db.Where("course_id = ?", courseID).Order("slide_number ASC").Find(&slides)
+	c.JSON(http.StatusOK, gin.H{
+		"course_id": courseID,
+		"slides":    slides,
+	})
+}
+
+var errInvalidOrder = errors.New("invalid slide order")
+
+// courseGenerationSettings returns the settings of the course's latest generation so
+// regenerated slides keep its style and language
+func (h *Handler) courseGenerationSettings(courseID string) GenerateCourseRequest {
+	settings := GenerateCourseRequest{CourseID: courseID}
+
+	var job models.GenerationJob
+	if err := h.db.Where("course_id = ? AND kind = ? AND status = ?", courseID, models.JobKindCourse, models.JobStatusSucceeded).
+		Order("created_at DESC").First(&job).Error; err == nil {
+		json.Unmarshal([]byte(job.Request), &settings)
+	}
+	return settings
+}
+
+// RegenerateSlide re-prompts the model for one slide, using the surrounding slides and the
+// most relevant source chunks as context plus an optional instruction from the instructor
+func (h *Handler) RegenerateSlide(c *gin.Context) {
+	courseID := c.Param("courseId")
+	slideID := c.Param("slideId")
+
+	var req RegenerateSlideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if h.respondActiveJob(c, courseID) {
+		return
+	}
+
+	var slide models.Slide
+	if err := h.db.Where("id = ? AND course_id = ?", slideID, courseID).First(&slide).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Slide not found"})
+		return
+	}
+
+	// Stop paying for the model call if the instructor navigates away
+	ctx := h.withUsage(c.Request.Context(), usageScope{CourseID: courseID, UserID: requestUser(c), Operation: OperationRegenerate})
+
+	var slides []models.Slide
+	h.db.Where("course_id = ?", courseID).Order("slide_number ASC").Find(&slides)
+
+	var course models.Course
+	h.db.Where("id = ?", courseID).First(&course)
+
+	var existingQuestion models.Question
+	hasQuestion := h.db.Where("slide_id = ?", slideID).First(&existingQuestion).Error == nil
+
+	settings := h.courseGenerationSettings(courseID)
+	settings.GenerateQuestions = req.GenerateQuestion || hasQuestion
+
+	var prompt strings.Builder
+	prompt.WriteString(fmt.Sprintf("Course: %s\n", course.Title))
+	if course.Description != "" {
+		prompt.WriteString(fmt.Sprintf("Course description: %s\n", course.Description))
+	}
+
+	prompt.WriteString("\nSurrounding slides:\n")
+	for _, s := range slides {
+		if s.SlideNumber < slide.SlideNumber-neighbourSlides || s.SlideNumber > slide.SlideNumber+neighbourSlides {
+			continue
+		}
+		if s.ID == slide.ID {
+			prompt.WriteString(fmt.Sprintf("%d. %s  <-- REWRITE THIS SLIDE\n", s.SlideNumber, s.Title))
+			continue
+		}
+		prompt.WriteString(fmt.Sprintf("%d. %s\n%s\n\n", s.SlideNumber, s.Title, truncateText(s.Content, 600)))
+	}
+
+	prompt.WriteString(fmt.Sprintf("\nCurrent version of slide %d of %d:\nTitle: %s\nContent:\n%s\n\nInstructor script:\n%s\n",
+		slide.SlideNumber, len(slides), slide.Title, slide.Content, slide.InstructorScript))
+	if req.Instruction != "" {
+		prompt.WriteString(fmt.Sprintf("\nINSTRUCTOR REQUEST - rewrite the slide accordingly: %s\n", req.Instruction))
+	} else {
+		prompt.WriteString("\nRewrite this slide with fresh, improved content on the same topic.\n")
+	}
+
+	source, sourceChunkIDs, hasTables := sourceContent(h.selectSourceChunks(ctx, courseID, nil, slide.Title+"\n"+slide.Content, maxContentLength))
+	prompt.WriteString(fmt.Sprintf("\nSource content:\n%s", source))
+	prompt.WriteString("\n\nCRITICAL: You MUST include the 'instructor_script' field with 3-5 paragraphs of presentation content.")
+	if hasTables {
+		prompt.WriteString(tableInstruction)
+	}
+	if settings.GenerateQuestions {
+		prompt.WriteString("\n\nIMPORTANT: Include a 'question' field. The question MUST be a JSON object (not a string) with this exact structure:\n{\n  \"question\": \"Question text here?\",\n  \"options\": [\"Option 1\", \"Option 2\", \"Option 3\", \"Option 4\"],\n  \"correct_answer\": 0\n}\nDo NOT use a string for the question field. It must be a JSON object.")
+	}
+
+	data, err := services.GenerateValidated(ctx, h.aiProvider, services.StructuredRequest{
+		Prompt:       prompt.String(),
+		SystemPrompt: h.buildSlidePrompt(settings),
+		Output:       slideSchema(settings.GenerateQuestions, hasTables),
+		Check:        slideChecker(source),
+		Attempts:     maxSlideAttempts,
+	})
+	if respondBudgetError(c, err) {
+		return
+	}
+	var invalid *services.ValidationError
+	if errors.As(err, &invalid) {
+		log.Error().Err(err).Str("slide_id", slideID).Msg("Regenerated slide failed validation")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The model did not return a valid slide", "details": invalid.Errors})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("slide_id", slideID).Msg("Failed to regenerate slide")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate slide"})
+		return
+	}
+
+	generated := &GeneratedSlide{}
+	if err := json.Unmarshal(data, generated); err != nil {
+		log.Error().Err(err).Str("slide_id", slideID).Msg("Failed to parse regenerated slide")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse regenerated slide"})
+		return
+	}
+
+	if req.RegenerateImage {
+		settings.GenerateImages = true
+		if !settings.UseWebImages && !settings.UseDalle {
+			settings.UseWebImages = true
+		}
+	}
+	settings.GenerateVoiceover = req.RegenerateVoiceover
+
+	generated.SlideNumber = slide.SlideNumber
+	template := prepareSlide(settings, generated, slide.SlideNumber-1)
+
+	slide.Title = generated.Title
+	slide.Content = generated.Content
+	slide.InstructorScript = generated.InstructorScript
+	slide.ImagePrompt = generated.ImagePrompt
+	slide.Layout = generated.Layout
+	slide.Table = generated.Table.markdown()
+	slide.Theme = generated.Theme
+	if req.RegenerateImage {
+		if imageURL := h.slideImage(ctx, settings, generated, template); imageURL != "" {
+			slide.ImageURL = imageURL
+		}
+	}
+	if req.RegenerateVoiceover {
+		if audioURL := h.slideVoiceover(ctx, settings, generated); audioURL != "" {
+			slide.AudioURL = audioURL
+		}
+	}
+	slide.UpdatedAt = time.Now()
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := preserveUnrecordedSlides(tx, courseID); err != nil {
+			return err
+		}
+		if err := tx.Save(&slide).Error; err != nil {
+			return err
+		}
+		if err := replaceSlideSources(tx, courseID, slide.ID, sourceChunkIDs); err != nil {
+			return err
+		}
+		if q := generated.Question; q != nil {
+			if err := h.replaceQuestion(tx, slide.ID, &SlideQuestionInput{
+				Question:      q.Question,
+				Options:       q.Options,
+				CorrectAnswer: q.CorrectAnswer,
+			}); err != nil {
+				return err
+			}
+		}
+		_, err := recordRevision(tx, courseID, models.RevisionReasonRegenerate, "", 0)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("slide_id", slideID).Msg("Failed to save regenerated slide")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save regenerated slide"})
+		return
+	}
+
+	result, _ := h.slideResponse(slide.ID)
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// Operations recorded in the usage ledger besides the job kinds
+const (
+	OperationUpload     = "upload"
+	OperationChat       = "chat"
+	OperationRegenerate = "regenerate_slide"
+	OperationStartup    = "startup"
+)
+
+// usageScope is what provider calls are recorded and budgeted against
+type usageScope struct {
+	CourseID  string
+	UserID    string
+	Operation string
+	JobID     string
+}
+
+// usageRecorder writes the provider calls made for one operation to the usage ledger and
+// holds them to the budgets of its course and user
+type usageRecorder struct {
+	usageScope
+	h *Handler
+}
+
+func (r *usageRecorder) RecordUsage(usage services.Usage) {
+	cost, priced := r.h.prices.Cost(usage)
+	if !priced && usage.Provider != "ollama" && usage.Provider != "fake" {
+		log.Debug().Str("model", usage.Model).Msg("No price for model, recording usage without cost")
+	}
+
+	record := models.UsageRecord{
+		ID:           uuid.New().String(),
+		CourseID:     r.CourseID,
+		Operation:    r.Operation,
+		UserID:       r.UserID,
+		JobID:        r.JobID,
+		Provider:     usage.Provider,
+		Model:        usage.Model,
+		Kind:         usage.Kind,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Images:       usage.Images,
+		Characters:   usage.Characters,
+		Estimated:    usage.Estimated,
+		Cost:         cost,
+		CreatedAt:    time.Now().UTC(), // days are grouped by the stored date
+	}
+	if err := r.h.db.Create(&record).Error; err != nil {
+		log.Warn().Err(err).Str("course_id", r.CourseID).Str("operation", r.Operation).Msg("Failed to record usage")
+	}
+}
+
+// withUsage returns a context whose provider calls are recorded and budgeted against the scope
+func (h *Handler) withUsage(ctx context.Context, scope usageScope) context.Context {
+	return services.WithUsageRecorder(ctx, &usageRecorder{usageScope: scope, h: h})
+}
+
+// UsageTotals sums a group of usage records
+type UsageTotals struct {
+	Calls          int64   `json:"calls"`
+	EstimatedCalls int64   `json:"estimated_calls"` // calls whose token counts were estimated
+	InputTokens    int64   `json:"input_tokens"`
+	OutputTokens   int64   `json:"output_tokens"`
+	Images         int64   `json:"images"`
+	Characters     int64   `json:"characters"`
+	Cost           float64 `json:"cost"` // USD
+}
+
+const usageTotalsSelect = "COUNT(*) AS calls, " +
+	"COALESCE(SUM(CASE WHEN estimated THEN 1 ELSE 0 END), 0) AS estimated_calls, " +
+	"COALESCE(SUM(input_tokens), 0) AS input_tokens, " +
+	"COALESCE(SUM(output_tokens), 0) AS output_tokens, " +
+	"COALESCE(SUM(images), 0) AS images, " +
+	"COALESCE(SUM(characters), 0) AS characters, " +
+	"COALESCE(SUM(cost), 0) AS cost"
+
+// CourseUsage is the spend of one course
+type CourseUsage struct {
+	CourseID string `json:"course_id"`
+	Title    string `json:"title,omitempty"`
+	UsageTotals
+}
+
+// OperationUsage is the spend of one kind of operation, e.g. course generation or chat
+type OperationUsage struct {
+	Operation string `json:"operation"`
+	UsageTotals
+}
+
+// ModelUsage is the spend on one provider's model
+type ModelUsage struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Kind     string `json:"kind"`
+	UsageTotals
+}
+
+// DailyUsage is the spend of one UTC day
+type DailyUsage struct {
+	Day string `json:"day"` // YYYY-MM-DD
+	UsageTotals
+}
+
+// usageQuery starts a ledger query limited by the optional ?from= and ?to= dates
+// (YYYY-MM-DD, inclusive) and ?course_id=
+func (h *Handler) usageQuery(c *gin.Context) (*gorm.DB, error) {
+	query := h.db.Model(&models.UsageRecord{})
+	if from := c.Query("from"); from != "" {
+		day, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return nil, fmt.Errorf("from must be a date (YYYY-MM-DD)")
+		}
+		query = query.Where("usage_records.created_at >= ?", day)
+	}
+	if to := c.Query("to"); to != "" {
+		day, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return nil, fmt.Errorf("to must be a date (YYYY-MM-DD)")
+		}
+		query = query.Where("usage_records.created_at < ?", day.AddDate(0, 0, 1))
+	}
+	if courseID := c.Query("course_id"); courseID != "" {
+		query = query.Where("usage_records.course_id = ?", courseID)
+	}
+	return query, nil
+}
+
+// GetCoursesUsage returns the spend of every course, most expensive first
+func (h *Handler) GetCoursesUsage(c *gin.Context) {
+	query, err := h.usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var courses []CourseUsage
+	if err := query.
+		Select("usage_records.course_id AS course_id, courses.title AS title, " + usageTotalsSelect).
+		Joins("LEFT JOIN courses ON courses.id = usage_records.course_id").
+		Where("usage_records.course_id <> ''").
+		Group("usage_records.course_id, courses.title").
+		Order("cost DESC").
+		Scan(&courses).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load course usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"courses": courses})
+}
+
+// GetCourseUsage returns a course's total spend broken down by operation and by model
+func (h *Handler) GetCourseUsage(c *gin.Context) {
+	courseID := c.Param("courseId")
+	query, err := h.usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query = query.Where("course_id = ?", courseID)
+
+	var total UsageTotals
+	var operations []OperationUsage
+	var byModel []ModelUsage
+	err = query.Session(&gorm.Session{}).Select(usageTotalsSelect).Scan(&total).Error
+	if err == nil {
+		err = query.Session(&gorm.Session{}).Select("operation, " + usageTotalsSelect).
+			Group("operation").Order("cost DESC").Scan(&operations).Error
+	}
+	if err == nil {
+		err = query.Session(&gorm.Session{}).Select("provider, model, kind, " + usageTotalsSelect).
+			Group("provider, model, kind").Order("cost DESC").Scan(&byModel).Error
+	}
+	if err != nil {
+		log.Error().Err(err).Str("course_id", courseID).Msg("Failed to load course usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"course_id":  courseID,
+		"total":      total,
+		"operations": operations,
+		"models":     byModel,
+	})
+}
+
+// GetDailyUsage returns the spend per day, oldest first
+func (h *Handler) GetDailyUsage(c *gin.Context) {
+	query, err := h.usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var days []DailyUsage
+	if err := query.
+		Select("substr(created_at, 1, 10) AS day, " + usageTotalsSelect).
+		Group("day").
+		Order("day ASC").
+		Scan(&days).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load daily usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"days": days})
+}
+
+// GetProviderUsage returns the spend per provider and model, most expensive first
+func (h *Handler) GetProviderUsage(c *gin.Context) {
+	query, err := h.usageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var providers []ModelUsage
+	if err := query.
+		Select("provider, model, kind, " + usageTotalsSelect).
+		Group("provider, model, kind").
+		Order("cost DESC").
+		Scan(&providers).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to load provider usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// vectorIndexes keeps one vector index per course in memory, loading it from disk (or
+// building it from the stored embeddings) the first time the course is searched
+type vectorIndexes struct {
+	mu     sync.Mutex
+	kind   string // "hnsw" or "flat"
+	dir    string // where indexes are persisted; empty keeps them in memory only
+	stores map[string]services.VectorStore
+}
+
+func newVectorIndexes(kind, dir string) *vectorIndexes {
+	if strings.ToLower(kind) == "flat" {
+		kind = "flat"
+	} else {
+		kind = "hnsw"
+	}
+	return &vectorIndexes{
+		kind:   kind,
+		dir:    dir,
+		stores: make(map[string]services.VectorStore),
+	}
+}
+
+// persistent reports whether indexes are kept on disk. Flat indexes are cheap to rebuild.
+func (v *vectorIndexes) persistent() bool {
+	return v.kind == "hnsw" && v.dir != ""
+}
+
+func (v *vectorIndexes) path(courseID string) string {
+	return filepath.Join(v.dir, courseID+".hnsw")
+}
+
+// courseIndex returns the index of a course. An index on disk is used only when it holds
+// as many vectors as the database, so one left behind by a crash is rebuilt.
+func (h *Handler) courseIndex(courseID string) (services.VectorStore, error) {
+	v := h.vectors
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if store, ok := v.stores[courseID]; ok {
+		return store, nil
+	}
+
+	var count int64
+	if err := h.db.Model(&models.Embedding{}).
+		Joins("JOIN chunks ON embeddings.chunk_id = chunks.id").
+		Where("chunks.course_id = ? AND embeddings.model = ?", courseID, h.embeddingProvider.GetModelName()).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+
+	if v.persistent() {
+		stored, err := services.LoadHNSWIndex(v.path(courseID))
+		switch {
+		case err == nil && int64(stored.Len()) == count:
+			v.stores[courseID] = stored
+			return stored, nil
+		case err == nil:
+			log.Warn().Str("course_id", courseID).Int("indexed", stored.Len()).Int64("embeddings", count).Msg("Vector index is out of date, rebuilding")
+		case !errors.Is(err, os.ErrNotExist):
+			log.Warn().Err(err).Str("course_id", courseID).Msg("Failed to load vector index, rebuilding")
+		}
+	}
+
+	store, err := h.buildIndex(courseID)
+	if err != nil {
+		return nil, err
+	}
+	v.stores[courseID] = store
+	v.save(courseID, store)
+	return store, nil
+}
+
+// buildIndex creates a course's index from the embeddings in the database that were made
+// with the configured model
+func (h *Handler) buildIndex(courseID string) (services.VectorStore, error) {
+	store := services.NewVectorStore(h.vectors.kind)
+
+	var batch []models.Embedding
+	err := h.db.Joins("JOIN chunks ON embeddings.chunk_id = chunks.id").
+		Where("chunks.course_id = ? AND embeddings.model = ?", courseID, h.embeddingProvider.GetModelName()).
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			for _, emb := range batch {
+				var vector []float64
+				if err := json.Unmarshal([]byte(emb.Vector), &vector); err != nil {
+					log.Warn().Err(err).Str("chunk_id", emb.ChunkID).Msg("Skipping unreadable embedding")
+					continue
+				}
+				if err := store.Add(emb.ChunkID, vector); err != nil {
+					log.Warn().Err(err).Str("chunk_id", emb.ChunkID).Msg("Skipping embedding")
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embeddings: %w", err)
+	}
+
+	log.Info().Str("course_id", courseID).Int("vectors", store.Len()).Str("kind", h.vectors.kind).Msg("Built vector index")
+	return store, nil
+}
+
+// save persists an index when its kind supports it. Callers hold v.mu.
+func (v *vectorIndexes) save(courseID string, store services.VectorStore) {
+	persistent, ok := store.(services.PersistentVectorStore)
+	if !ok || !v.persistent() {
+		return
+	}
+	if err := persistent.Save(v.path(courseID)); err != nil {
+		log.Warn().Err(err).Str("course_id", courseID).Msg("Failed to save vector index")
+	}
+}
+
+// indexEmbeddings adds new chunk embeddings to a course's index
+func (h *Handler) indexEmbeddings(courseID string, vectors map[string][]float64) {
+	if len(vectors) == 0 {
+		return
+	}
+	store, err := h.courseIndex(courseID)
+	if err != nil {
+		log.Warn().Err(err).Str("course_id", courseID).Msg("Failed to load vector index")
+		return
+	}
+
+	h.vectors.mu.Lock()
+	defer h.vectors.mu.Unlock()
+	for chunkID, vector := range vectors {
+		// Re-adding a vector that a fresh build already loaded just replaces it
+		if err := store.Add(chunkID, vector); err != nil {
+			log.Warn().Err(err).Str("chunk_id", chunkID).Msg("Failed to index embedding")
+		}
+	}
+	h.vectors.save(courseID, store)
+}
+
+// unindexChunks removes chunks from a course's index
+func (h *Handler) unindexChunks(courseID string, chunkIDs []string) {
+	h.vectors.mu.Lock()
+	defer h.vectors.mu.Unlock()
+
+	store, ok := h.vectors.stores[courseID]
+	if !ok {
+		// Not loaded: drop the file so the next load rebuilds from the database
+		if h.vectors.persistent() {
+			os.Remove(h.vectors.path(courseID))
+		}
+		return
+	}
+	for _, id := range chunkIDs {
+		store.Remove(id)
+	}
+	h.vectors.save(courseID, store)
+}
+
+// dropCourseIndex forgets a course's vector and BM25 indexes, in memory and on disk
+func (h *Handler) dropCourseIndex(courseID string) {
+	h.lexical.mu.Lock()
+	delete(h.lexical.indexes, courseID)
+	h.lexical.mu.Unlock()
+
+	h.vectors.mu.Lock()
+	defer h.vectors.mu.Unlock()
+
+	delete(h.vectors.stores, courseID)
+	if h.vectors.persistent() {
+		os.Remove(h.vectors.path(courseID))
+	}
+}
+
+// searchChunks returns the IDs of the k chunks of a course most similar to the query vector
+func (h *Handler) searchChunks(courseID string, query []float64, k int) ([]services.Match, error) {
+	store, err := h.courseIndex(courseID)
+	if err != nil {
+		return nil, err
+	}
+	return store.Search(query, k)
+}
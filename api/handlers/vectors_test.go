@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/local/elearn/api/db"
+	"github.com/local/elearn/api/models"
+	"github.com/local/elearn/api/services"
+	"gorm.io/gorm"
+)
+
+// testDB opens a fresh database that is closed when the test ends
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	database, err := db.Init(filepath.Join(t.TempDir(), "elearn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := database.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return database
+}
+
+func TestCourseIndexRebuildsOutdatedIndex(t *testing.T) {
+	database := testDB(t)
+	embeddings := services.NewFakeEmbedding(8)
+	h := &Handler{
+		db:                database,
+		embeddingProvider: embeddings,
+		vectors:           newVectorIndexes("hnsw", t.TempDir()),
+	}
+
+	vector := []float64{1, 0, 0, 0, 0, 0, 0, 0}
+	database.Create(&models.Chunk{ID: "chunk", CourseID: "course", Content: "Cells divide."})
+	database.Create(&models.Embedding{ID: "embedding", ChunkID: "chunk", Vector: "[1,0,0,0,0,0,0,0]", Dimension: 8, Model: embeddings.GetModelName()})
+
+	// An index on disk holding as many vectors as the database is used as it is
+	stored := services.NewHNSWIndex(services.DefaultHNSWConfig())
+	stored.Add("from-disk", vector)
+	if err := stored.Save(h.vectors.path("course")); err != nil {
+		t.Fatal(err)
+	}
+	index, err := h.courseIndex("course")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := index.Search(vector, 1); len(matches) != 1 || matches[0].ID != "from-disk" {
+		t.Errorf("expected the index on disk, got %+v", matches)
+	}
+
+	// One left behind with another count is rebuilt from the embeddings, and saved
+	stored.Add("stale", []float64{0, 1, 0, 0, 0, 0, 0, 0})
+	stored.Save(h.vectors.path("course"))
+	delete(h.vectors.stores, "course")
+	index, err = h.courseIndex("course")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := index.Search(vector, 2); len(matches) != 1 || matches[0].ID != "chunk" {
+		t.Errorf("expected the rebuilt index, got %+v", matches)
+	}
+	if saved, err := services.LoadHNSWIndex(h.vectors.path("course")); err != nil || saved.Len() != 1 {
+		t.Errorf("expected the rebuilt index saved, got %v", err)
+	}
+}
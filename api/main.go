@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -15,6 +22,10 @@ import (
 )
 
 func main() {
+	reembed := flag.String("reembed", "", `re-embed a course ID, or "all" courses needing it, with the configured embedding model, then exit`)
+	reembedForce := flag.Bool("reembed-force", false, "with -reembed, also re-embed chunks that already use the configured model")
+	flag.Parse()
+
 	// Setup logger
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
 
@@ -46,28 +57,27 @@ func main() {
 		MaxAge:           12 * time.Hour,
 	}))
 
+	// Stopping the server cancels in-flight provider calls; interrupted jobs resume on restart
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize handlers
 	h := handlers.New(database, cfg)
+	h.ProbeEmbeddingDimension(ctx)
 
-	// Health check
-	router.GET("/api/health", h.Health)
-
-	// Serve static audio files
-	router.Static("/audio", "./storage/audio")
-
-	// API routes
-	api := router.Group("/api")
-	{
-		api.POST("/upload", h.UploadPDF)
-		api.POST("/course/generate", h.GenerateCourse)
-		api.GET("/course/:courseId", h.GetCourse)
-		api.GET("/slides/:courseId", h.GetSlides)
-		api.GET("/files/:courseId", h.GetSourceFiles)
-		api.DELETE("/files/:courseId/:fileId", h.DeleteSourceFile)
-		api.GET("/questions/:courseId", h.GetQuestions)
-		api.POST("/chat/ask", h.ChatAsk)
+	if *reembed != "" {
+		if err := h.ReembedNow(ctx, *reembed, *reembedForce); err != nil {
+			log.Fatal().Err(err).Msg("Re-embedding failed")
+		}
+		log.Info().Msg("Re-embedding finished")
+		return
 	}
 
+	h.CheckEmbeddingModels()
+	h.StartJobWorkers(ctx, cfg.JobWorkers)
+
+	h.RegisterRoutes(router)
+
 	// Start server
 	addr := fmt.Sprintf(":%s", cfg.Port)
 	log.Info().
@@ -76,7 +86,23 @@ func main() {
 		Str("embedding_provider", cfg.EmbeddingProvider).
 		Msg("Starting eLearning API server")
 
-	if err := router.Run(addr); err != nil {
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Info().Msg("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal().Err(err).Msg("Failed to start server")
 	}
+	<-shutdownDone
 }
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
@@ -13,18 +14,30 @@ type Course struct {
 	Description string    `json:"description"`
 	PDFName     string    `json:"pdf_name"` // Deprecated: use SourceFiles instead
 	NumSlides   int       `json:"num_slides"`
+	BudgetUSD   *float64  `json:"budget_usd,omitempty"` // spending limit overriding BUDGET_COURSE_USD, 0 blocks spending
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 // SourceFile represents a PDF file uploaded for a course (supports multiple files per course)
 type SourceFile struct {
-	ID        string    `gorm:"primaryKey" json:"id"`
-	CourseID  string    `gorm:"index" json:"course_id"`
-	Filename  string    `json:"filename"`
-	FilePath  string    `json:"file_path"`
-	FileSize  int64     `json:"file_size"`
-	CreatedAt time.Time `json:"created_at"`
+	ID           string    `gorm:"primaryKey" json:"id"`
+	CourseID     string    `gorm:"index" json:"course_id"`
+	Filename     string    `json:"filename"`
+	FilePath     string    `json:"file_path"`
+	FileSize     int64     `json:"file_size"`
+	MimeType     string    `json:"mime_type"`  // sniffed from the content, see services.DetectMIMEType
+	ChunkSize    int       `json:"chunk_size"` // chunking the file was split with, see services.ChunkOptions
+	ChunkOverlap int       `json:"chunk_overlap"`
+	ChunkUnit    string    `json:"chunk_unit"`
+	Title        string    `json:"title,omitempty"` // from the document's own metadata
+	Author       string    `json:"author,omitempty"`
+	OutlineJSON  string    `json:"-"` // JSON-encoded bookmarks, see services.OutlineEntry
+	ReportJSON   string    `json:"-"` // JSON-encoded services.ExtractionReport
+	CreatedAt    time.Time `json:"created_at"`
+
+	Outline json.RawMessage `gorm:"-" json:"outline,omitempty"`           // Decoded from OutlineJSON for responses
+	Report  json.RawMessage `gorm:"-" json:"extraction_report,omitempty"` // Decoded from ReportJSON for responses
 }
 
 // Slide represents a single slide in a course
@@ -38,7 +51,8 @@ type Slide struct {
 	ImagePrompt      string    `json:"image_prompt,omitempty"`
 	ImageURL         string    `json:"image_url,omitempty"`
 	AudioURL         string    `json:"audio_url,omitempty"` // URL to TTS audio file
-	Layout           string    `json:"layout,omitempty"`    // "default", "title", "quote", "highlight", "comparison"
+	Layout           string    `json:"layout,omitempty"`    // "default", "title", "quote", "highlight", "comparison", "data"
+	Table            string    `json:"table,omitempty"`     // Markdown table of the source data the slide presents, after its caption
 	Theme            string    `json:"theme,omitempty"`     // "blue", "green", "purple", "orange", "gradient"
 	CreatedAt        time.Time `json:"created_at"`
 	UpdatedAt        time.Time `json:"updated_at"`
@@ -46,13 +60,36 @@ type Slide struct {
 
 // Chunk represents a text chunk from a PDF with metadata
 type Chunk struct {
-	ID           string    `gorm:"primaryKey" json:"id"`
-	CourseID     string    `gorm:"index" json:"course_id"`
-	SourceFileID string    `gorm:"index" json:"source_file_id,omitempty"` // Which file this chunk came from
-	Content      string    `json:"content"`
-	ChunkNum     int       `json:"chunk_num"`
-	PageNum      int       `json:"page_num,omitempty"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID            string    `gorm:"primaryKey" json:"id"`
+	CourseID      string    `gorm:"index" json:"course_id"`
+	SourceFileID  string    `gorm:"index" json:"source_file_id,omitempty"` // Which file this chunk came from
+	Content       string    `json:"content"`
+	ChunkNum      int       `json:"chunk_num"`
+	PageNum       int       `json:"page_num,omitempty"`          // First page the chunk was taken from
+	PageEnd       int       `json:"page_end,omitempty"`          // Last page, when the chunk spans pages
+	HeadingPath   string    `json:"heading_path,omitempty"`      // Headings of the section the chunk starts in, e.g. "Cells > Organelles"
+	Kind          string    `gorm:"index" json:"kind,omitempty"` // "text", "table" or "figure"
+	Caption       string    `json:"caption,omitempty"`           // Caption of a table or figure
+	TableCSV      string    `json:"table_csv,omitempty"`         // Rows of a table, header first
+	OCRConfidence *float64  `json:"ocr_confidence,omitempty"`    // Lowest OCR confidence (0-1) of the pages it was recognized from, nil for text read from the document
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// EmbeddingCache stores embeddings by content, so identical text is never embedded twice
+// with the same model
+type EmbeddingCache struct {
+	ContentHash string    `gorm:"primaryKey" json:"content_hash"` // SHA-256 of the text
+	Model       string    `gorm:"primaryKey" json:"model"`
+	Dimension   int       `json:"dimension"`
+	Vector      string    `json:"-"` // JSON-encoded float array
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// SlideSource links a generated slide to a source chunk it was written from
+type SlideSource struct {
+	SlideID  string `gorm:"primaryKey" json:"slide_id"`
+	ChunkID  string `gorm:"primaryKey;index" json:"chunk_id"`
+	CourseID string `gorm:"index" json:"course_id"`
 }
 
 // Embedding represents a vector embedding for a chunk
@@ -65,14 +102,49 @@ type Embedding struct {
 	CreatedAt  time.Time `json:"created_at"`
 }
 
-// ChatMessage represents a chat interaction
-type ChatMessage struct {
+// ChatSession is one learner's conversation about a course
+type ChatSession struct {
 	ID        string    `gorm:"primaryKey" json:"id"`
 	CourseID  string    `gorm:"index" json:"course_id"`
-	Role      string    `json:"role"` // user, assistant
-	Content   string    `json:"content"`
-	Citations []string  `gorm:"-" json:"citations,omitempty"` // Not stored, just for response
+	LearnerID string    `gorm:"index" json:"learner_id"`
+	Title     string    `json:"title"` // first question, shortened
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Citation points a chat answer at the source material it was grounded in
+type Citation struct {
+	Number        int             `json:"number"` // [n] marker used in the answer
+	ChunkID       string          `json:"chunk_id"`
+	SourceFileID  string          `json:"source_file_id,omitempty"`
+	FileName      string          `json:"file_name,omitempty"`
+	PageStart     int             `json:"page_start,omitempty"`
+	PageEnd       int             `json:"page_end,omitempty"`
+	Section       string          `json:"section,omitempty"`        // Heading path of the chunk
+	OCRConfidence *float64        `json:"ocr_confidence,omitempty"` // Set when the chunk was recognized by OCR
+	Snippet       string          `json:"snippet"`
+	Score         float64         `json:"score"`            // Retrieval score, cosine similarity for semantic search
+	Slides        []CitationSlide `json:"slides,omitempty"` // Slides that cover this chunk
+}
+
+// CitationSlide identifies a slide covering a cited chunk
+type CitationSlide struct {
+	ID          string `json:"id"`
+	SlideNumber int    `json:"slide_number"`
+	Title       string `json:"title"`
+}
+
+// ChatMessage represents a chat interaction
+type ChatMessage struct {
+	ID            string     `gorm:"primaryKey" json:"id"`
+	CourseID      string     `gorm:"index" json:"course_id"`
+	SessionID     string     `gorm:"index" json:"session_id"`
+	Role          string     `json:"role"` // user, assistant
+	Content       string     `json:"content"`
+	SearchQuery   string     `json:"search_query,omitempty"`       // standalone query used for retrieval (user messages)
+	CitationsJSON string     `json:"-"`                            // JSON-encoded citations (assistant messages)
+	Citations     []Citation `gorm:"-" json:"citations,omitempty"` // Decoded from CitationsJSON for responses
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
 // Question represents a quiz question for a slide
@@ -85,6 +157,118 @@ type Question struct {
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// Course outline states
+const (
+	OutlineStatusDraft    = "draft"
+	OutlineStatusApproved = "approved"
+)
+
+// CourseOutline is the editable plan (modules, learning objectives, slide titles)
+// that course slides are generated from
+type CourseOutline struct {
+	ID          string     `gorm:"primaryKey" json:"id"`
+	CourseID    string     `gorm:"uniqueIndex" json:"course_id"`
+	Status      string     `json:"status"` // draft, approved
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Modules     string     `json:"modules"` // JSON-encoded array of modules
+	ApprovedAt  *time.Time `json:"approved_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// Generation job kinds
+const (
+	JobKindOutline = "outline"
+	JobKindCourse  = "course"
+	JobKindReembed = "reembed" // embed a course's chunks again with the configured model
+)
+
+// Generation job states
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusFailed    = "failed"
+	JobStatusSucceeded = "succeeded"
+	JobStatusCanceled  = "canceled"
+)
+
+// GenerationJob tracks an asynchronous course generation run so it can be
+// polled, streamed and resumed after a server restart
+type GenerationJob struct {
+	ID              string     `gorm:"primaryKey" json:"id"`
+	CourseID        string     `gorm:"index" json:"course_id"`
+	UserID          string     `json:"user_id,omitempty"`   // who started the job, for per-user budgets
+	Kind            string     `json:"kind"`                // outline, course, reembed
+	Status          string     `gorm:"index" json:"status"` // queued, running, failed, succeeded, canceled
+	Step            string     `json:"step"`                // current pipeline step, e.g. "outline", "slides"
+	Progress        int        `json:"progress"`            // completed steps
+	Total           int        `json:"total"`               // total steps (known once the outline exists)
+	Message         string     `json:"message,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	Request         string     `json:"-"` // JSON-encoded generation request
+	Structure       string     `json:"-"` // JSON-encoded outline the slides are expanded from, saved so resumes skip the outline step
+	CompletedSlides int        `json:"completed_slides"`
+	FailedSlides    int        `json:"failed_slides"` // slides that fell back to their outline after failed generation
+	Attempts        int        `json:"attempts"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// IsTerminal reports whether the job has finished, successfully or not
+func (j *GenerationJob) IsTerminal() bool {
+	return j.Status == JobStatusFailed || j.Status == JobStatusSucceeded || j.Status == JobStatusCanceled
+}
+
+// Course revision reasons
+const (
+	RevisionReasonImport     = "import" // slides that existed before revisions were recorded
+	RevisionReasonGeneration = "generation"
+	RevisionReasonEdit       = "edit"
+	RevisionReasonInsert     = "insert"
+	RevisionReasonDelete     = "delete"
+	RevisionReasonReorder    = "reorder"
+	RevisionReasonRegenerate = "regenerate"
+	RevisionReasonRestore    = "restore"
+)
+
+// CourseRevision is an immutable snapshot of a course's slides and questions,
+// recorded after every generation or manual change
+type CourseRevision struct {
+	ID           string    `gorm:"primaryKey" json:"id"`
+	CourseID     string    `gorm:"uniqueIndex:idx_course_revision" json:"course_id"`
+	Number       int       `gorm:"uniqueIndex:idx_course_revision" json:"number"` // 1-based, increasing per course
+	Reason       string    `json:"reason"`                                        // generation, edit, insert, delete, reorder, regenerate, restore
+	JobID        string    `json:"job_id,omitempty"`                              // generation job that produced the revision
+	RestoredFrom int       `json:"restored_from,omitempty"`                       // revision number a restore copied
+	Title        string    `json:"title"`
+	NumSlides    int       `json:"num_slides"`
+	Snapshot     string    `json:"-"` // JSON-encoded course, slides and questions
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// UsageRecord is one provider call in the usage ledger: the tokens, images or speech
+// characters it consumed and what they cost at the configured prices
+type UsageRecord struct {
+	ID           string    `gorm:"primaryKey" json:"id"`
+	CourseID     string    `gorm:"index" json:"course_id,omitempty"` // empty for calls outside a course
+	Operation    string    `gorm:"index" json:"operation"`           // upload, outline, course, reembed, regenerate_slide, chat
+	UserID       string    `gorm:"index" json:"user_id,omitempty"`
+	JobID        string    `json:"job_id,omitempty"`
+	Provider     string    `json:"provider"`
+	Model        string    `json:"model"`
+	Kind         string    `json:"kind"` // text, embedding, image, speech
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	Images       int       `json:"images"`
+	Characters   int       `json:"characters"`
+	Estimated    bool      `json:"estimated"` // token counts estimated from text length
+	Cost         float64   `json:"cost"`      // USD
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
+
 // AutoMigrate runs all migrations
 func AutoMigrate(db *gorm.DB) error {
 	return db.AutoMigrate(
@@ -93,7 +277,14 @@ func AutoMigrate(db *gorm.DB) error {
 		&Slide{},
 		&Chunk{},
 		&Embedding{},
+		&EmbeddingCache{},
+		&SlideSource{},
+		&ChatSession{},
 		&ChatMessage{},
 		&Question{},
+		&GenerationJob{},
+		&CourseOutline{},
+		&CourseRevision{},
+		&UsageRecord{},
 	)
 }
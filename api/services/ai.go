@@ -2,18 +2,22 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // AIProvider is the interface for AI model providers
 type AIProvider interface {
-	GenerateText(prompt string, systemPrompt string) (string, error)
-	GenerateJSON(prompt string, systemPrompt string) (string, error)
+	GenerateText(ctx context.Context, prompt string, systemPrompt string) (string, error)
+	GenerateJSON(ctx context.Context, prompt string, systemPrompt string) (string, error)
+	// StreamText is GenerateText delivered incrementally through onToken
+	StreamText(ctx context.Context, prompt string, systemPrompt string, onToken TokenHandler) (string, error)
 	GetProviderName() string
 }
 
@@ -23,13 +27,32 @@ type AnthropicProvider struct {
 	Model  string
 }
 
-// OpenAIProvider implements OpenAI
+// OpenAIProvider implements OpenAI and any server with an OpenAI-compatible
+// chat completions API (vLLM, llama.cpp, LM Studio, ...)
 type OpenAIProvider struct {
-	APIKey string
-	Model  string
+	APIKey  string
+	Model   string
+	BaseURL string // e.g. http://localhost:8000/v1; defaults to the OpenAI API
+}
+
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// sleepContext waits for d, returning early with the context's error if it is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
-func NewAIProvider(provider, apiKey, model string) AIProvider {
+// NewAIProvider creates the provider for the given name. baseURL is the OpenAI-compatible
+// API root for "openai" and the Ollama host for "ollama"; it is ignored for Anthropic.
+func NewAIProvider(provider, apiKey, model, baseURL string) AIProvider {
 	switch strings.ToLower(provider) {
 	case "anthropic":
 		return &AnthropicProvider{
@@ -38,9 +61,17 @@ func NewAIProvider(provider, apiKey, model string) AIProvider {
 		}
 	case "openai":
 		return &OpenAIProvider{
-			APIKey: apiKey,
-			Model:  model,
+			APIKey:  apiKey,
+			Model:   model,
+			BaseURL: baseURL,
+		}
+	case "ollama":
+		return &OllamaProvider{
+			Host:  baseURL,
+			Model: model,
 		}
+	case "fake":
+		return &FakeProvider{}
 	default:
 		return &AnthropicProvider{
 			APIKey: apiKey,
@@ -53,35 +84,70 @@ func (a *AnthropicProvider) GetProviderName() string {
 	return "anthropic"
 }
 
-func (a *AnthropicProvider) GenerateText(prompt string, systemPrompt string) (string, error) {
-	url := "https://api.anthropic.com/v1/messages"
+// APIError is an error response from a provider's HTTP API
+type APIError struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // how long the provider asked callers to wait, 0 if it didn't say
+}
 
-	reqBody := map[string]interface{}{
-		"model":      a.Model,
-		"max_tokens": 16384,
-		"system":     systemPrompt,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error (%d): %s", e.StatusCode, e.Message)
+}
+
+// Retryable reports whether the request may succeed if sent again: rate limits, overload
+// (Anthropic's 529) and server errors
+func (e *APIError) Retryable() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, 529:
+		return true
 	}
+	return e.StatusCode >= 500
+}
 
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+// newAPIError builds the error of a failed response, reading its Retry-After header
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
 	}
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
 	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(at))
+	}
+	return 0
+}
+
+const (
+	maxRequestAttempts = 3
+	// maxRetryAfter is the longest Retry-After worth waiting for; beyond it the error is
+	// returned so a fallback provider can take over
+	maxRetryAfter = 30 * time.Second
+)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", a.APIKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+// sendWithRetry sends a JSON request and returns the response once it succeeds. Network
+// errors and retryable API errors are retried with exponential backoff, waiting at least
+// as long as a Retry-After header asks. The request is rebuilt for every attempt so its
+// body can be sent again.
+func sendWithRetry(ctx context.Context, url string, jsonData []byte, headers map[string]string) (*http.Response, error) {
+	// Use longer timeout for course generation which can take several minutes
+	return sendWithRetryTimeout(ctx, 5*time.Minute, url, jsonData, headers)
+}
 
-	// Use longer timeout with retry logic
+// sendWithRetryTimeout is sendWithRetry with its own timeout per attempt
+func sendWithRetryTimeout(ctx context.Context, timeout time.Duration, url string, jsonData []byte, headers map[string]string) (*http.Response, error) {
 	client := &http.Client{
-		Timeout: 5 * time.Minute,
+		Timeout: timeout,
 		Transport: &http.Transport{
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
@@ -89,152 +155,206 @@ func (a *AnthropicProvider) GenerateText(prompt string, systemPrompt string) (st
 		},
 	}
 
-	// Retry logic for transient network errors
-	var resp *http.Response
 	var lastErr error
-	maxRetries := 3
-	for attempt := 0; attempt < maxRetries; attempt++ {
+	var retryAfter time.Duration
+	for attempt := 0; attempt < maxRequestAttempts; attempt++ {
 		if attempt > 0 {
-			backoff := time.Duration(1<<uint(attempt)) * time.Second
-			time.Sleep(backoff)
+			// Exponential backoff: 2s, 4s
+			backoff := max(time.Duration(1<<uint(attempt))*time.Second, retryAfter)
+			if err := sleepContext(ctx, backoff); err != nil {
+				return nil, err
+			}
 		}
 
-		resp, err = client.Do(req)
-		if err == nil {
-			break
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
 		}
-		lastErr = err
-	}
-
-	if err != nil {
-		return "", fmt.Errorf("failed to send request after %d attempts: %w", maxRetries, lastErr)
-	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("failed to send request: %w", err)
+			retryAfter = 0
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, string(body))
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		apiErr := newAPIError(resp, body)
+		if !apiErr.Retryable() || apiErr.RetryAfter > maxRetryAfter {
+			return nil, apiErr
+		}
+		lastErr = apiErr
+		retryAfter = apiErr.RetryAfter
 	}
+	return nil, fmt.Errorf("request failed after %d attempts: %w", maxRequestAttempts, lastErr)
+}
 
-	var result struct {
-		Content []struct {
-			Text string `json:"text"`
-		} `json:"content"`
+// postJSON sends a JSON request with retries and returns the body of a successful response
+func postJSON(ctx context.Context, url string, reqBody interface{}, headers map[string]string) ([]byte, error) {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
+	resp, err := sendWithRetry(ctx, url, jsonData, headers)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if len(result.Content) == 0 {
-		return "", fmt.Errorf("no content in response")
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
-
-	return result.Content[0].Text, nil
+	return body, nil
 }
 
-// GenerateJSON is the same as GenerateText for Anthropic (no special JSON mode)
-func (a *AnthropicProvider) GenerateJSON(prompt string, systemPrompt string) (string, error) {
-	return a.GenerateText(prompt, systemPrompt)
+// anthropicContent is one content block of a Messages API response
+type anthropicContent struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
 }
 
-func (o *OpenAIProvider) GetProviderName() string {
-	return "openai"
+// anthropicUsage is the token count of a Messages API response or stream event
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
 }
 
-func (o *OpenAIProvider) GenerateText(prompt string, systemPrompt string) (string, error) {
-	url := "https://api.openai.com/v1/chat/completions"
+// messages calls the Messages API with the given extra request fields and returns the content blocks
+func (a *AnthropicProvider) messages(ctx context.Context, prompt, systemPrompt string, extra map[string]interface{}) ([]anthropicContent, error) {
+	if err := checkTextUsage(ctx, a.GetProviderName(), a.Model, prompt, systemPrompt); err != nil {
+		return nil, err
+	}
 
-	// GenerateText is for non-JSON responses (like chatbot answers)
 	reqBody := map[string]interface{}{
-		"model": o.Model,
+		"model":      a.Model,
+		"max_tokens": 16384,
+		"system":     systemPrompt,
 		"messages": []map[string]string{
-			{"role": "system", "content": systemPrompt},
 			{"role": "user", "content": prompt},
 		},
-		"max_tokens": 16384,
 	}
-
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+	for k, v := range extra {
+		reqBody[k] = v
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	body, err := postJSON(ctx, "https://api.anthropic.com/v1/messages", reqBody, map[string]string{
+		"x-api-key":         a.APIKey,
+		"anthropic-version": "2023-06-01",
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.APIKey))
-
-	// Use longer timeout with retry logic
-	client := &http.Client{
-		Timeout: 5 * time.Minute,
-		Transport: &http.Transport{
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+	var result struct {
+		Content []anthropicContent `json:"content"`
+		Usage   anthropicUsage     `json:"usage"`
 	}
-
-	// Retry logic for transient network errors
-	var resp *http.Response
-	var lastErr error
-	maxRetries := 3
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			backoff := time.Duration(1<<uint(attempt)) * time.Second
-			time.Sleep(backoff)
-		}
-
-		resp, err = client.Do(req)
-		if err == nil {
-			break
-		}
-		lastErr = err
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
+	var output strings.Builder
+	for _, block := range result.Content {
+		output.WriteString(block.Text)
+		output.Write(block.Input)
+	}
+	recordTextUsage(ctx, a.GetProviderName(), a.Model, result.Usage.InputTokens, result.Usage.OutputTokens, prompt, systemPrompt, output.String())
+	if len(result.Content) == 0 {
+		return nil, fmt.Errorf("no content in response")
+	}
+	return result.Content, nil
+}
 
+func (a *AnthropicProvider) GenerateText(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	content, err := a.messages(ctx, prompt, systemPrompt, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request after %d attempts: %w", maxRetries, lastErr)
+		return "", err
 	}
-	defer resp.Body.Close()
+	return content[0].Text, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// GenerateJSON is the same as GenerateText for Anthropic (no special JSON mode)
+func (a *AnthropicProvider) GenerateJSON(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	return a.GenerateText(ctx, prompt, systemPrompt)
+}
+
+// GenerateStructured forces a call to a tool whose input schema is the output schema, so
+// Claude answers with arguments that follow it
+func (a *AnthropicProvider) GenerateStructured(ctx context.Context, prompt string, systemPrompt string, output StructuredOutput) (string, error) {
+	content, err := a.messages(ctx, prompt, systemPrompt, map[string]interface{}{
+		"tools": []map[string]interface{}{{
+			"name":         output.Name,
+			"description":  output.Description,
+			"input_schema": output.Schema,
+		}},
+		"tool_choice": map[string]string{"type": "tool", "name": output.Name},
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return "", err
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, string(body))
+	for _, block := range content {
+		if block.Type == "tool_use" && block.Name == output.Name {
+			return string(block.Input), nil
+		}
 	}
+	return "", fmt.Errorf("no %s tool call in response", output.Name)
+}
 
-	var result struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
+func (o *OpenAIProvider) GetProviderName() string {
+	return "openai"
+}
 
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", fmt.Errorf("failed to parse response: %w", err)
+// endpoint returns the URL of an API path under the configured base URL
+func (o *OpenAIProvider) endpoint(path string) string {
+	baseURL := o.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
 	}
+	return strings.TrimSuffix(baseURL, "/") + path
+}
 
-	if len(result.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
+// authHeaders returns the authorization header; local servers usually run without a key
+func (o *OpenAIProvider) authHeaders() map[string]string {
+	if o.APIKey == "" {
+		return nil
 	}
+	return map[string]string{"Authorization": fmt.Sprintf("Bearer %s", o.APIKey)}
+}
 
-	return result.Choices[0].Message.Content, nil
+// openAIUsage is the token count of a chat completion; streams send it in their last chunk
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
 }
 
-// GenerateJSON is for JSON-formatted responses (like course generation)
-func (o *OpenAIProvider) GenerateJSON(prompt string, systemPrompt string) (string, error) {
-	url := "https://api.openai.com/v1/chat/completions"
+// recordUsage reports a completion's usage, estimated when the server didn't include it
+func (o *OpenAIProvider) recordUsage(ctx context.Context, usage *openAIUsage, prompt, systemPrompt, output string) {
+	if usage == nil {
+		usage = &openAIUsage{}
+	}
+	recordTextUsage(ctx, o.GetProviderName(), o.Model, usage.PromptTokens, usage.CompletionTokens, prompt, systemPrompt, output)
+}
+
+// chatCompletion calls the chat completions API, constraining the answer with the given
+// response format when it is not nil
+func (o *OpenAIProvider) chatCompletion(ctx context.Context, prompt, systemPrompt string, responseFormat interface{}) (string, error) {
+	if err := checkTextUsage(ctx, o.GetProviderName(), o.Model, prompt, systemPrompt); err != nil {
+		return "", err
+	}
 
 	reqBody := map[string]interface{}{
 		"model": o.Model,
@@ -243,64 +363,14 @@ func (o *OpenAIProvider) GenerateJSON(prompt string, systemPrompt string) (strin
 			{"role": "user", "content": prompt},
 		},
 		"max_tokens": 16384,
-		"response_format": map[string]string{
-			"type": "json_object",
-		},
 	}
-
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+	if responseFormat != nil {
+		reqBody["response_format"] = responseFormat
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	body, err := postJSON(ctx, o.endpoint("/chat/completions"), reqBody, o.authHeaders())
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.APIKey))
-
-	// Use longer timeout for course generation which can take several minutes
-	client := &http.Client{
-		Timeout: 5 * time.Minute,
-		Transport: &http.Transport{
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-	}
-
-	// Retry logic for transient network errors
-	var resp *http.Response
-	var lastErr error
-	maxRetries := 3
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			// Exponential backoff: 2s, 4s
-			backoff := time.Duration(1<<uint(attempt)) * time.Second
-			time.Sleep(backoff)
-		}
-
-		resp, err = client.Do(req)
-		if err == nil {
-			break
-		}
-		lastErr = err
-	}
-
-	if err != nil {
-		return "", fmt.Errorf("failed to send request after %d attempts: %w", maxRetries, lastErr)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, string(body))
+		return "", err
 	}
 
 	var result struct {
@@ -309,6 +379,7 @@ func (o *OpenAIProvider) GenerateJSON(prompt string, systemPrompt string) (strin
 				Content string `json:"content"`
 			} `json:"message"`
 		} `json:"choices"`
+		Usage *openAIUsage `json:"usage"`
 	}
 
 	if err := json.Unmarshal(body, &result); err != nil {
@@ -319,5 +390,31 @@ func (o *OpenAIProvider) GenerateJSON(prompt string, systemPrompt string) (strin
 		return "", fmt.Errorf("no choices in response")
 	}
 
-	return result.Choices[0].Message.Content, nil
+	content := result.Choices[0].Message.Content
+	o.recordUsage(ctx, result.Usage, prompt, systemPrompt, content)
+	return content, nil
+}
+
+// GenerateText is for non-JSON responses (like chatbot answers)
+func (o *OpenAIProvider) GenerateText(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	return o.chatCompletion(ctx, prompt, systemPrompt, nil)
+}
+
+// GenerateJSON is for JSON-formatted responses (like course generation)
+func (o *OpenAIProvider) GenerateJSON(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	return o.chatCompletion(ctx, prompt, systemPrompt, map[string]string{"type": "json_object"})
+}
+
+// GenerateStructured uses a json_schema response format. The schema isn't strict, since
+// strict mode requires every property, so the answer is still validated by the caller.
+func (o *OpenAIProvider) GenerateStructured(ctx context.Context, prompt string, systemPrompt string, output StructuredOutput) (string, error) {
+	return o.chatCompletion(ctx, prompt, systemPrompt, map[string]interface{}{
+		"type": "json_schema",
+		"json_schema": map[string]interface{}{
+			"name":        output.Name,
+			"description": output.Description,
+			"schema":      output.Schema,
+			"strict":      false,
+		},
+	})
 }
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters: k1 controls term frequency saturation, b length normalisation
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// BM25Index is an in-memory full-text index ranking documents with Okapi BM25. Exact
+// terms such as acronyms, formula names and section numbers that embeddings blur
+// together match here.
+type BM25Index struct {
+	mu       sync.RWMutex
+	docs     map[string]map[string]int // document ID -> term frequencies
+	lengths  map[string]int            // document ID -> number of terms
+	postings map[string]map[string]int // term -> document ID -> frequency
+	totalLen int
+}
+
+func NewBM25Index() *BM25Index {
+	return &BM25Index{
+		docs:     make(map[string]map[string]int),
+		lengths:  make(map[string]int),
+		postings: make(map[string]map[string]int),
+	}
+}
+
+// Tokenize lowercases text and splits it into words and numbers. Dotted numbers such as
+// section "3.2.1" stay one token, and words joined by hyphens also yield their parts.
+func Tokenize(text string) []string {
+	var tokens []string
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '-'
+	})
+	for _, field := range fields {
+		field = strings.Trim(field, ".-")
+		if field == "" {
+			continue
+		}
+		if isDottedNumber(field) {
+			tokens = append(tokens, field)
+			continue
+		}
+
+		parts := strings.FieldsFunc(field, func(r rune) bool { return r == '.' || r == '-' })
+		tokens = append(tokens, parts...)
+		if len(parts) > 1 && strings.Contains(field, "-") && !strings.Contains(field, ".") {
+			tokens = append(tokens, strings.Join(parts, "-"))
+		}
+	}
+	return tokens
+}
+
+func isDottedNumber(s string) bool {
+	if !strings.Contains(s, ".") {
+		return false
+	}
+	for _, r := range s {
+		if r != '.' && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Add indexes a document, replacing any earlier version with the same ID
+func (x *BM25Index) Add(id, text string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.remove(id)
+
+	terms := make(map[string]int)
+	tokens := Tokenize(text)
+	for _, token := range tokens {
+		terms[token]++
+	}
+	x.docs[id] = terms
+	x.lengths[id] = len(tokens)
+	x.totalLen += len(tokens)
+	for term, freq := range terms {
+		if x.postings[term] == nil {
+			x.postings[term] = make(map[string]int)
+		}
+		x.postings[term][id] = freq
+	}
+}
+
+func (x *BM25Index) Remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+}
+
+func (x *BM25Index) remove(id string) {
+	terms, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for term := range terms {
+		delete(x.postings[term], id)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	x.totalLen -= x.lengths[id]
+	delete(x.docs, id)
+	delete(x.lengths, id)
+}
+
+func (x *BM25Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// Search returns the k documents scoring highest for the query, best first. Documents
+// sharing no term with the query are not returned.
+func (x *BM25Index) Search(query string, k int) []Match {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	if len(x.docs) == 0 || k <= 0 {
+		return nil
+	}
+
+	n := float64(len(x.docs))
+	avgLen := float64(x.totalLen) / n
+	scores := make(map[string]float64)
+
+	seen := make(map[string]bool)
+	for _, term := range Tokenize(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+
+		postings := x.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, freq := range postings {
+			tf := float64(freq)
+			norm := tf + bm25K1*(1-bm25B+bm25B*float64(x.lengths[id])/avgLen)
+			scores[id] += idf * tf * (bm25K1 + 1) / norm
+		}
+	}
+
+	matches := make([]Match, 0, len(scores))
+	for id, score := range scores {
+		matches = append(matches, Match{ID: id, Score: score})
+	}
+	sortMatches(matches)
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches
+}
+
+// sortMatches orders matches by descending score, breaking ties by ID for stable results
+func sortMatches(matches []Match) {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].ID < matches[j].ID
+	})
+}
@@ -0,0 +1,538 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Default chunking, see ChunkOptions
+const (
+	ChunkSize    = 1000 // characters per chunk
+	ChunkOverlap = 200  // overlap between chunks
+)
+
+// Chunk size units
+const (
+	ChunkUnitChars  = "chars"
+	ChunkUnitTokens = "tokens" // estimated, see EstimateTokens
+)
+
+// maxChunkTokens keeps chunks within what embedding models accept
+const maxChunkTokens = 8000
+
+// HeadingPathSeparator joins the headings of a chunk's heading path
+const HeadingPathSeparator = " > "
+
+// Kinds of chunks
+const (
+	ChunkKindText   = "text"   // paragraphs, lists and code
+	ChunkKindTable  = "table"  // a table, or a run of its rows, with its caption
+	ChunkKindFigure = "figure" // the caption of a figure
+)
+
+// ChunkOptions sets how large chunks are and how much of the previous chunk of the same
+// section each one repeats
+type ChunkOptions struct {
+	Size    int    `json:"size"`
+	Overlap int    `json:"overlap"`
+	Unit    string `json:"unit"` // chars or tokens
+}
+
+// DefaultChunkOptions returns chunks of ChunkSize characters overlapping by ChunkOverlap
+func DefaultChunkOptions() ChunkOptions {
+	return ChunkOptions{Size: ChunkSize, Overlap: ChunkOverlap, Unit: ChunkUnitChars}
+}
+
+// Validate checks the unit and that the overlap is smaller than the chunks
+func (o ChunkOptions) Validate() error {
+	maxSize := maxChunkTokens
+	switch o.Unit {
+	case ChunkUnitTokens:
+	case ChunkUnitChars:
+		maxSize = maxChunkTokens * 4
+	default:
+		return fmt.Errorf("unknown chunk unit %q (use chars or tokens)", o.Unit)
+	}
+	if o.Size <= 0 || o.Size > maxSize {
+		return fmt.Errorf("chunk size must be between 1 and %d %s", maxSize, o.Unit)
+	}
+	if o.Overlap < 0 || o.Overlap >= o.Size {
+		return fmt.Errorf("chunk overlap must be at least 0 and smaller than the chunk size")
+	}
+	return nil
+}
+
+// measure returns the length of text in the options' unit
+func (o ChunkOptions) measure(text string) int {
+	if o.Unit == ChunkUnitTokens {
+		return EstimateTokens(text)
+	}
+	return utf8.RuneCountInString(text)
+}
+
+// TextChunk is a chunk of document text with the pages it was taken from. Tables and
+// figures get chunks of their own, holding the caption and, for tables, the rows.
+type TextChunk struct {
+	Kind      string
+	Content   string
+	PageStart int
+	PageEnd   int
+	Headings  []string   // headings of the section the chunk starts in, outermost first
+	Caption   string     // caption of a table or figure
+	Table     [][]string // rows of a table chunk, header first
+	// Recognized is set when some of the chunk's text was recognized by OCR, and
+	// Confidence is then the lowest OCR confidence of its recognized pages
+	Recognized bool
+	Confidence float64
+}
+
+// HeadingPath joins the chunk's headings, e.g. "Cells > Organelles"
+func (c TextChunk) HeadingPath() string {
+	return strings.Join(c.Headings, HeadingPathSeparator)
+}
+
+// CSV returns the rows of a table chunk as CSV, "" for other chunks
+func (c TextChunk) CSV() string {
+	if len(c.Table) == 0 {
+		return ""
+	}
+	return tableCSV(c.Table)
+}
+
+// Kinds of document blocks
+const (
+	blockParagraph = iota
+	blockHeading
+	blockListItem
+	blockTable
+	blockCode
+	blockFigure
+)
+
+// docBlock is a heading, paragraph, list item, table, code block or figure of a page
+type docBlock struct {
+	kind    int
+	level   int // heading level
+	text    string
+	page    int
+	caption string // of a table or figure
+}
+
+var (
+	headingLine  = regexp.MustCompile(`^(#{1,6})\s+(.*\S)`)
+	listItemLine = regexp.MustCompile(`^\s*([-*+•]|\d{1,3}[.)])\s+\S`)
+)
+
+// splitBlocks splits pages into blocks at blank lines, headings, list items, tables and
+// code fences. The lines of a paragraph or list item are joined, undoing hard wrapping.
+func splitBlocks(pages []PageText) []docBlock {
+	var blocks []docBlock
+	for _, page := range pages {
+		var current *docBlock
+		var lines []string
+		end := func() {
+			if current == nil {
+				return
+			}
+			sep := " "
+			if current.kind == blockTable || current.kind == blockCode {
+				sep = "\n"
+			}
+			current.text = strings.Join(lines, sep)
+			if strings.TrimSpace(current.text) != "" {
+				blocks = append(blocks, *current)
+			}
+			current, lines = nil, nil
+		}
+		start := func(kind int) {
+			end()
+			current = &docBlock{kind: kind, page: page.Number}
+		}
+
+		for _, line := range strings.Split(page.Text, "\n") {
+			line = strings.TrimRight(line, " \t\r")
+			trimmed := strings.TrimSpace(line)
+
+			if current != nil && current.kind == blockCode {
+				lines = append(lines, line)
+				if strings.HasPrefix(trimmed, "```") {
+					end()
+				}
+				continue
+			}
+
+			switch {
+			case trimmed == "":
+				end()
+			case strings.HasPrefix(trimmed, "```"):
+				start(blockCode)
+				lines = append(lines, line)
+			case headingLine.MatchString(trimmed):
+				start(blockHeading)
+				current.level = len(headingLine.FindStringSubmatch(trimmed)[1])
+				lines = append(lines, trimmed)
+				end()
+			case listItemLine.MatchString(line):
+				start(blockListItem)
+				lines = append(lines, trimmed)
+			case strings.HasPrefix(trimmed, "|"):
+				if current == nil || current.kind != blockTable {
+					start(blockTable)
+				}
+				lines = append(lines, trimmed)
+			default:
+				if current == nil || current.kind == blockTable {
+					start(blockParagraph)
+				}
+				lines = append(lines, trimmed)
+			}
+		}
+		end()
+	}
+	return attachCaptions(blocks)
+}
+
+// attachCaptions turns figure captions and Markdown images into figures, and moves table
+// captions into the table they describe. A table caption belongs to the table right
+// after it, or else to the table right before it.
+func attachCaptions(blocks []docBlock) []docBlock {
+	isTableCaption := func(i int) bool {
+		return i >= 0 && i < len(blocks) && blocks[i].kind == blockParagraph && tableCaption.MatchString(blocks[i].text)
+	}
+	isTable := func(i int) bool {
+		return i >= 0 && i < len(blocks) && blocks[i].kind == blockTable
+	}
+
+	var out []docBlock
+	for i := 0; i < len(blocks); i++ {
+		block := blocks[i]
+		switch {
+		case block.kind == blockTable:
+			if isTableCaption(i - 1) {
+				block.caption = blocks[i-1].text
+				out = out[:len(out)-1]
+			} else if isTableCaption(i+1) && !isTable(i+2) {
+				block.caption = blocks[i+1].text
+				i++
+			}
+		case block.kind == blockParagraph && figureCaption.MatchString(block.text):
+			block.kind = blockFigure
+			block.caption = block.text
+		case block.kind == blockParagraph && markdownImage.MatchString(block.text):
+			alt := strings.TrimSpace(markdownImage.FindStringSubmatch(block.text)[1])
+			if alt == "" {
+				continue // decoration, nothing to cite
+			}
+			// A caption right below the image describes it better than its alt text
+			if i+1 < len(blocks) && blocks[i+1].kind == blockParagraph && figureCaption.MatchString(blocks[i+1].text) {
+				continue
+			}
+			block.kind = blockFigure
+			block.caption = alt
+		}
+		out = append(out, block)
+	}
+	return out
+}
+
+// chunkPiece is a part of a block small enough to fit in a chunk
+type chunkPiece struct {
+	text string
+	sep  string // joins the piece to the one before it
+	page int
+}
+
+// splitBlock splits a block that doesn't fit in a chunk: tables and code between lines,
+// other text between sentences, then between words
+func (o ChunkOptions) splitBlock(block docBlock) []chunkPiece {
+	if o.measure(block.text) <= o.Size {
+		return []chunkPiece{{text: block.text, sep: "\n\n", page: block.page}}
+	}
+
+	var parts []string
+	sep := " "
+	if block.kind == blockTable || block.kind == blockCode {
+		parts = strings.Split(block.text, "\n")
+		sep = "\n"
+	} else {
+		parts = splitSentences(block.text)
+	}
+
+	var pieces []chunkPiece
+	add := func(text, pieceSep string) {
+		if len(pieces) == 0 {
+			pieceSep = "\n\n"
+		}
+		pieces = append(pieces, chunkPiece{text: text, sep: pieceSep, page: block.page})
+	}
+	for _, part := range parts {
+		if o.measure(part) <= o.Size {
+			add(part, sep)
+			continue
+		}
+		for i, word := range o.splitWords(part) {
+			if i == 0 {
+				add(word, sep)
+			} else {
+				add(word, " ")
+			}
+		}
+	}
+	return pieces
+}
+
+// splitWords splits text that is too long for a chunk into runs of whole words, cutting
+// only words that are longer than a chunk themselves
+func (o ChunkOptions) splitWords(text string) []string {
+	var parts []string
+	var current strings.Builder
+	for _, word := range strings.Fields(text) {
+		if current.Len() > 0 && o.measure(current.String()+" "+word) > o.Size {
+			parts = append(parts, current.String())
+			current.Reset()
+		}
+		for o.measure(word) > o.Size {
+			if current.Len() > 0 {
+				parts = append(parts, current.String())
+				current.Reset()
+			}
+			cut := o.fit(word)
+			parts = append(parts, word[:cut])
+			word = word[cut:]
+		}
+		if current.Len() > 0 {
+			current.WriteString(" ")
+		}
+		current.WriteString(word)
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
+
+// fit returns the byte length of the longest prefix of text that fits in a chunk, at
+// least one rune
+func (o ChunkOptions) fit(text string) int {
+	limit := o.Size
+	if o.Unit == ChunkUnitTokens {
+		limit = o.Size * 4 // EstimateTokens counts four bytes per token
+	}
+	length, count := 0, 0
+	for i, r := range text {
+		size := utf8.RuneLen(r)
+		if o.Unit == ChunkUnitTokens {
+			count = i + size
+		} else {
+			count++
+		}
+		if count > limit && length > 0 {
+			break
+		}
+		length = i + size
+	}
+	return length
+}
+
+// splitSentences splits text after sentence-ending punctuation followed by a space and a
+// capital letter, digit or opening quote, so most abbreviations and decimals stay whole
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	runes := []rune(text)
+	offset := 0 // byte offset of runes[i]
+	for i := 0; i < len(runes)-2; i++ {
+		r := runes[i]
+		offset += utf8.RuneLen(r)
+		if r != '.' && r != '!' && r != '?' && r != '…' {
+			continue
+		}
+		if !unicode.IsSpace(runes[i+1]) {
+			continue
+		}
+		next := runes[i+2]
+		if unicode.IsUpper(next) || unicode.IsDigit(next) || strings.ContainsRune("\"'“‘([", next) {
+			if sentence := strings.TrimSpace(text[start:offset]); sentence != "" {
+				sentences = append(sentences, sentence)
+			}
+			start = offset
+		}
+	}
+	if rest := strings.TrimSpace(text[start:]); rest != "" {
+		sentences = append(sentences, rest)
+	}
+	return sentences
+}
+
+// ChunkText splits text into overlapping chunks with the default options, see ChunkPages
+func ChunkText(text string) []string {
+	chunks := []string{}
+	for _, chunk := range ChunkPages([]PageText{{Number: 1, Text: text}}, DefaultChunkOptions()) {
+		chunks = append(chunks, chunk.Content)
+	}
+	return chunks
+}
+
+// ChunkPages splits the text of a document into chunks that follow its structure. A new
+// chunk starts at every heading, chunks are filled with whole paragraphs, list items and
+// table rows, and only paragraphs longer than a chunk are cut, between sentences where
+// possible. Within a section, each chunk repeats the last sentences of the previous one,
+// up to the overlap. Each chunk records the pages it was taken from and the headings of
+// the section it starts in, and the OCR confidence of recognized pages.
+func ChunkPages(pages []PageText, opts ChunkOptions) []TextChunk {
+	var chunks []TextChunk
+	recognized := make(map[int]float64) // OCR confidence by page
+	for _, page := range pages {
+		if page.Recognized {
+			recognized[page.Number] = page.Confidence
+		}
+	}
+	var headings []string // current heading path
+	var levels []int      // level of each heading in the path
+
+	var current []chunkPiece
+	var chunkHeadings []string // heading path of current
+	fresh := false             // whether current has more than the overlap of the previous chunk
+
+	content := func(pieces []chunkPiece) string {
+		var b strings.Builder
+		for i, piece := range pieces {
+			if i > 0 { // the separator of the first piece is dropped
+				b.WriteString(piece.sep)
+			}
+			b.WriteString(piece.text)
+		}
+		return b.String()
+	}
+	emit := func() {
+		if !fresh {
+			return
+		}
+		chunk := TextChunk{Kind: ChunkKindText, Content: content(current), PageStart: current[0].page, PageEnd: current[0].page, Headings: chunkHeadings}
+		for _, piece := range current {
+			chunk.PageStart = min(chunk.PageStart, piece.page)
+			chunk.PageEnd = max(chunk.PageEnd, piece.page)
+			if confidence, ok := recognized[piece.page]; ok && (!chunk.Recognized || confidence < chunk.Confidence) {
+				chunk.Recognized = true
+				chunk.Confidence = confidence
+			}
+		}
+		chunks = append(chunks, chunk)
+		fresh = false
+	}
+	// overlapTail keeps the last pieces of the chunk that fit in the overlap
+	overlapTail := func() []chunkPiece {
+		start := len(current)
+		for start > 1 && opts.measure(content(current[start-1:])) <= opts.Overlap {
+			start--
+		}
+		return append([]chunkPiece(nil), current[start:]...)
+	}
+
+	for _, block := range splitBlocks(pages) {
+		if block.kind == blockTable || block.kind == blockFigure {
+			// Tables and figures are chunks of their own, between the text around them
+			if !onlyHeadings(current) {
+				emit()
+				current = nil
+			}
+			for _, chunk := range opts.structuredChunks(block, headings) {
+				if confidence, ok := recognized[block.page]; ok {
+					chunk.Recognized, chunk.Confidence = true, confidence
+				}
+				chunks = append(chunks, chunk)
+			}
+			continue
+		}
+
+		if block.kind == blockHeading {
+			// A section starts a new chunk, unless nothing but headings came before it
+			if !onlyHeadings(current) {
+				emit()
+				current = nil
+			}
+			for len(levels) > 0 && levels[len(levels)-1] >= block.level {
+				levels = levels[:len(levels)-1]
+				headings = headings[:len(headings)-1]
+			}
+			levels = append(levels, block.level)
+			headings = append(headings, headingLine.FindStringSubmatch(block.text)[2])
+		}
+
+		for _, piece := range opts.splitBlock(block) {
+			if len(current) > 0 && opts.measure(content(current)+piece.sep+piece.text) > opts.Size {
+				emit()
+				current = overlapTail()
+				for len(current) > 0 && opts.measure(content(current)+piece.sep+piece.text) > opts.Size {
+					current = current[1:]
+				}
+			}
+			if onlyHeadings(current) {
+				chunkHeadings = append([]string(nil), headings...)
+			}
+			current = append(current, piece)
+			fresh = true
+		}
+	}
+	emit()
+	return chunks
+}
+
+// structuredChunks makes the chunks of a table or figure. A table too large for one chunk
+// is split between rows, and every part repeats the caption and the header row.
+func (o ChunkOptions) structuredChunks(block docBlock, headings []string) []TextChunk {
+	chunk := TextChunk{
+		PageStart: block.page,
+		PageEnd:   block.page,
+		Headings:  append([]string(nil), headings...),
+		Caption:   block.caption,
+	}
+	if block.kind == blockFigure {
+		chunk.Kind = ChunkKindFigure
+		chunk.Content = block.caption
+		return []TextChunk{chunk}
+	}
+
+	chunk.Kind = ChunkKindTable
+	rows := parseMarkdownTable(block.text)
+	if len(rows) == 0 {
+		return nil
+	}
+	render := func(rows [][]string) string {
+		if block.caption == "" {
+			return MarkdownTable(rows)
+		}
+		return block.caption + "\n\n" + MarkdownTable(rows)
+	}
+
+	header, body := rows[0], rows[1:]
+	var chunks []TextChunk
+	part := [][]string{header}
+	flush := func() {
+		chunk.Table = part
+		chunk.Content = render(part)
+		chunks = append(chunks, chunk)
+		part = [][]string{header}
+	}
+	for _, row := range body {
+		if len(part) > 1 && o.measure(render(append(part, row))) > o.Size {
+			flush()
+		}
+		part = append(part, row)
+	}
+	flush()
+	return chunks
+}
+
+// onlyHeadings reports whether pieces are all heading lines
+func onlyHeadings(pieces []chunkPiece) bool {
+	for _, piece := range pieces {
+		if !headingLine.MatchString(piece.text) {
+			return false
+		}
+	}
+	return true
+}
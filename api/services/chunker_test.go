@@ -0,0 +1,184 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChunkPagesFollowsHeadings(t *testing.T) {
+	pages := []PageText{
+		{Number: 1, Text: "# Cells\n\nCells are the basic unit of life.\n\n## Organelles\n\n- Nucleus holds DNA\n- Ribosomes make proteins"},
+		{Number: 2, Text: "| Organelle | Role |\n| --- | --- |\n| Ribosome | Makes proteins |\n\n# Tissues\n## Muscle\n\nMuscle tissue contracts."},
+	}
+	chunks := ChunkPages(pages, DefaultChunkOptions())
+
+	want := []struct {
+		kind       string
+		content    string
+		path       string
+		start, end int
+	}{
+		{ChunkKindText, "# Cells\n\nCells are the basic unit of life.", "Cells", 1, 1},
+		{ChunkKindText, "## Organelles\n\n- Nucleus holds DNA\n\n- Ribosomes make proteins", "Cells > Organelles", 1, 1},
+		// Tables are chunks of their own
+		{ChunkKindTable, "| Organelle | Role |\n| --- | --- |\n| Ribosome | Makes proteins |", "Cells > Organelles", 2, 2},
+		// A heading directly followed by another stays with it
+		{ChunkKindText, "# Tissues\n\n## Muscle\n\nMuscle tissue contracts.", "Tissues > Muscle", 2, 2},
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("expected %d chunks, got %d: %+v", len(want), len(chunks), chunks)
+	}
+	for i, w := range want {
+		c := chunks[i]
+		if c.Kind != w.kind || c.Content != w.content || c.HeadingPath() != w.path || c.PageStart != w.start || c.PageEnd != w.end {
+			t.Errorf("chunk %d: got %q (%q, pages %d-%d)\nwant %q (%q, pages %d-%d)",
+				i, c.Content, c.HeadingPath(), c.PageStart, c.PageEnd, w.content, w.path, w.start, w.end)
+		}
+	}
+}
+
+func TestChunkPagesTablesAndFigures(t *testing.T) {
+	text := strings.Join([]string{
+		"# Enzymes",
+		"Table 1: Activity by temperature",
+		"| Temperature (°C) | Activity (%) |\n| --- | --- |\n| 20 | 35 |\n| 37 | 100 |\n| 60 | 5 |",
+		"Enzymes denature when heated.",
+		"| Enzyme | Substrate |\n| --- | --- |\n| Amylase | Starch |",
+		"Table 2 - Enzymes and their substrates",
+		"Figure 3: The lock and key model",
+		"![Diagram of an active site](active-site.png)",
+		"![](divider.png)",
+	}, "\n\n")
+	chunks := ChunkPages([]PageText{{Number: 4, Text: text}}, DefaultChunkOptions())
+
+	want := []struct {
+		kind, content, caption string
+	}{
+		{ChunkKindTable, "Table 1: Activity by temperature\n\n| Temperature (°C) | Activity (%) |\n| --- | --- |\n| 20 | 35 |\n| 37 | 100 |\n| 60 | 5 |", "Table 1: Activity by temperature"},
+		// The heading waits for the section's first text
+		{ChunkKindText, "# Enzymes\n\nEnzymes denature when heated.", ""},
+		// A caption below the table
+		{ChunkKindTable, "Table 2 - Enzymes and their substrates\n\n| Enzyme | Substrate |\n| --- | --- |\n| Amylase | Starch |", "Table 2 - Enzymes and their substrates"},
+		{ChunkKindFigure, "Figure 3: The lock and key model", "Figure 3: The lock and key model"},
+		{ChunkKindFigure, "Diagram of an active site", "Diagram of an active site"},
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("expected %d chunks, got %d: %+v", len(want), len(chunks), chunks)
+	}
+	for i, w := range want {
+		c := chunks[i]
+		if c.Kind != w.kind || c.Content != w.content || c.Caption != w.caption || c.HeadingPath() != "Enzymes" || c.PageStart != 4 {
+			t.Errorf("chunk %d: got %s %q (caption %q, %q, page %d)\nwant %s %q (caption %q)",
+				i, c.Kind, c.Content, c.Caption, c.HeadingPath(), c.PageStart, w.kind, w.content, w.caption)
+		}
+	}
+	if want := "Temperature (°C),Activity (%)\n20,35\n37,100\n60,5\n"; chunks[0].CSV() != want {
+		t.Errorf("CSV: got %q, want %q", chunks[0].CSV(), want)
+	}
+}
+
+func TestChunkPagesSplitsLargeTablesBetweenRows(t *testing.T) {
+	rows := []string{"| Element | Symbol | Number |", "| --- | --- | --- |"}
+	for i := 1; i <= 30; i++ {
+		rows = append(rows, fmt.Sprintf("| Element %d | E%d | %d |", i, i, i))
+	}
+	text := "Table 4: Elements\n\n" + strings.Join(rows, "\n")
+	opts := ChunkOptions{Size: 200, Overlap: 50, Unit: ChunkUnitChars}
+	chunks := ChunkPages([]PageText{{Number: 1, Text: text}}, opts)
+	if len(chunks) < 3 {
+		t.Fatalf("expected the table to be split, got %d chunks", len(chunks))
+	}
+
+	seen := 0
+	for i, c := range chunks {
+		if c.Kind != ChunkKindTable || !strings.HasPrefix(c.Content, "Table 4: Elements\n\n| Element | Symbol | Number |") {
+			t.Errorf("chunk %d lacks the caption or header: %q", i, c.Content)
+		}
+		if n := len([]rune(c.Content)); n > opts.Size {
+			t.Errorf("chunk %d has %d characters, more than %d", i, n, opts.Size)
+		}
+		if len(c.Table) < 2 || c.Table[0][0] != "Element" {
+			t.Errorf("chunk %d: rows %v", i, c.Table)
+		}
+		seen += len(c.Table) - 1
+	}
+	// Rows are not repeated as overlap
+	if seen != 30 {
+		t.Errorf("expected the 30 rows once each, got %d", seen)
+	}
+}
+
+func TestChunkPagesSplitsLongParagraphsBetweenSentences(t *testing.T) {
+	var sentences []string
+	for i := 0; i < 12; i++ {
+		sentences = append(sentences, "Sentence number "+string(rune('A'+i))+" talks about photosynthesis in plants.")
+	}
+	// Hard-wrapped lines are joined back into one paragraph
+	text := "# Plants\n" + strings.Join(sentences[:6], "\n") + " " + strings.Join(sentences[6:], " ")
+
+	opts := ChunkOptions{Size: 200, Overlap: 60, Unit: ChunkUnitChars}
+	chunks := ChunkPages([]PageText{{Number: 1, Text: text}}, opts)
+	if len(chunks) < 3 {
+		t.Fatalf("expected the paragraph to be split, got %d chunks", len(chunks))
+	}
+	for i, c := range chunks {
+		if n := len([]rune(c.Content)); n > opts.Size {
+			t.Errorf("chunk %d has %d characters, more than %d", i, n, opts.Size)
+		}
+		if !strings.HasSuffix(c.Content, ".") {
+			t.Errorf("chunk %d ends mid-sentence: %q", i, c.Content)
+		}
+		if c.HeadingPath() != "Plants" {
+			t.Errorf("chunk %d: heading path %q", i, c.HeadingPath())
+		}
+		if i > 0 {
+			// The overlap repeats the last sentence of the previous chunk
+			prev := splitSentences(chunks[i-1].Content)
+			if !strings.HasPrefix(c.Content, prev[len(prev)-1]) {
+				t.Errorf("chunk %d doesn't start with the end of chunk %d: %q", i, i-1, c.Content)
+			}
+		}
+	}
+}
+
+func TestChunkPagesCountsTokens(t *testing.T) {
+	text := strings.Repeat("Enzymes speed up chemical reactions in cells. ", 40)
+	opts := ChunkOptions{Size: 50, Overlap: 0, Unit: ChunkUnitTokens}
+	chunks := ChunkPages([]PageText{{Number: 1, Text: text}}, opts)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i, c := range chunks {
+		if tokens := EstimateTokens(c.Content); tokens > opts.Size {
+			t.Errorf("chunk %d has %d tokens, more than %d", i, tokens, opts.Size)
+		}
+	}
+
+	// Words longer than a chunk are the only thing ever cut
+	long := strings.Repeat("x", 500)
+	chunks = ChunkPages([]PageText{{Number: 1, Text: long}}, opts)
+	if got := len(chunks); got != 3 || chunks[0].Content+chunks[1].Content+chunks[2].Content != long {
+		t.Errorf("expected the word cut into 3 chunks, got %d", got)
+	}
+}
+
+func TestChunkOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts  ChunkOptions
+		valid bool
+	}{
+		{DefaultChunkOptions(), true},
+		{ChunkOptions{Size: 512, Overlap: 64, Unit: ChunkUnitTokens}, true},
+		{ChunkOptions{Size: 512, Overlap: 512, Unit: ChunkUnitTokens}, false},
+		{ChunkOptions{Size: 0, Unit: ChunkUnitChars}, false},
+		{ChunkOptions{Size: 100, Overlap: -1, Unit: ChunkUnitChars}, false},
+		{ChunkOptions{Size: 100, Unit: "words"}, false},
+		{ChunkOptions{Size: maxChunkTokens + 1, Unit: ChunkUnitTokens}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: got %v, valid %v", tt.opts, err, tt.valid)
+		}
+	}
+}
@@ -2,90 +2,209 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 // EmbeddingProvider is the interface for embedding providers
 type EmbeddingProvider interface {
-	Embed(text string) ([]float64, error)
+	Embed(ctx context.Context, text string) ([]float64, error)
+	// EmbedBatch embeds several texts in one request, returning vectors in input order
+	EmbedBatch(ctx context.Context, texts []string) ([][]float64, error)
+	// GetDimension returns the vector size, or 0 until the first embedding reveals it
 	GetDimension() int
 	GetModelName() string
 }
 
-// OpenAIEmbedding implements OpenAI embeddings
+// OpenAIEmbedding implements OpenAI (or OpenAI-compatible) embeddings
 type OpenAIEmbedding struct {
-	APIKey    string
-	Model     string
-	Dimension int
+	APIKey     string
+	Model      string
+	Dimensions int    // requested vector size for models that can shorten theirs, 0 for the model's own
+	BaseURL    string // defaults to the OpenAI API
+	dimension  dimensionCache
 }
 
 // OllamaEmbedding implements Ollama local embeddings
 type OllamaEmbedding struct {
 	Host      string
 	Model     string
-	Dimension int
+	dimension dimensionCache
 }
 
-func NewEmbeddingProvider(provider, apiKey, model, ollamaHost string) EmbeddingProvider {
+// NewEmbeddingProvider creates an embedding provider. dimensions asks OpenAI models that
+// support it for shorter vectors; other providers ignore it. The vector size of a model
+// is learned from its first response, see ProbeDimension.
+func NewEmbeddingProvider(provider, apiKey, model, ollamaHost, openAIBaseURL string, dimensions int) EmbeddingProvider {
 	switch strings.ToLower(provider) {
 	case "openai":
-		dim := 1536
-		if model == "text-embedding-3-large" {
-			dim = 3072
-		}
-		return &OpenAIEmbedding{
-			APIKey:    apiKey,
-			Model:     model,
-			Dimension: dim,
+		e := &OpenAIEmbedding{
+			APIKey:     apiKey,
+			Model:      model,
+			Dimensions: dimensions,
+			BaseURL:    openAIBaseURL,
 		}
+		e.dimension.set(dimensions)
+		return e
 	case "ollama":
 		return &OllamaEmbedding{
-			Host:      ollamaHost,
-			Model:     model,
-			Dimension: 768, // nomic-embed-text dimension
+			Host:  ollamaHost,
+			Model: model,
 		}
+	case "fake":
+		return NewFakeEmbedding(dimensions)
 	default:
 		return &OpenAIEmbedding{
-			APIKey:    apiKey,
-			Model:     "text-embedding-3-small",
-			Dimension: 1536,
+			APIKey: apiKey,
+			Model:  "text-embedding-3-small",
 		}
 	}
 }
 
+// dimensionCache remembers the vector size of a provider's model, taken from the first
+// valid vector it returns, and rejects vectors of any other size
+type dimensionCache struct {
+	mu  sync.Mutex
+	dim int
+}
+
+func (d *dimensionCache) get() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dim
+}
+
+func (d *dimensionCache) set(dim int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dim = dim
+}
+
+// check validates vectors, learning the dimension from the first when it isn't known yet
+func (d *dimensionCache) check(vectors ...[]float64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, vector := range vectors {
+		if d.dim == 0 && len(vector) > 0 {
+			d.dim = len(vector)
+		}
+		if err := ValidateEmbedding(vector, d.dim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateEmbedding checks that a vector has the expected dimension (when dim > 0) and
+// holds finite, not all zero, values
+func ValidateEmbedding(vector []float64, dim int) error {
+	if len(vector) == 0 {
+		return fmt.Errorf("empty embedding")
+	}
+	if dim > 0 && len(vector) != dim {
+		return fmt.Errorf("embedding has %d dimensions, expected %d", len(vector), dim)
+	}
+	zero := true
+	for _, v := range vector {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("embedding contains non-finite values")
+		}
+		if v != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		return fmt.Errorf("embedding is all zeros")
+	}
+	return nil
+}
+
+// ProbeDimension returns the provider's vector size, embedding a short text to find it
+// when no embedding has been made yet
+func ProbeDimension(ctx context.Context, provider EmbeddingProvider) (int, error) {
+	if dim := provider.GetDimension(); dim > 0 {
+		return dim, nil
+	}
+	vector, err := provider.Embed(ctx, "dimension probe")
+	if err != nil {
+		return 0, err
+	}
+	return len(vector), nil
+}
+
 func (o *OpenAIEmbedding) GetDimension() int {
-	return o.Dimension
+	return o.dimension.get()
 }
 
+// GetModelName names the model, with the requested dimension when vectors are shortened,
+// since those can't be compared with the model's full-size vectors
 func (o *OpenAIEmbedding) GetModelName() string {
+	if o.Dimensions > 0 {
+		return fmt.Sprintf("%s@%d", o.Model, o.Dimensions)
+	}
 	return o.Model
 }
 
-func (o *OpenAIEmbedding) Embed(text string) ([]float64, error) {
-	url := "https://api.openai.com/v1/embeddings"
+func (o *OpenAIEmbedding) Embed(ctx context.Context, text string) ([]float64, error) {
+	vectors, err := o.embed(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+// EmbedBatch sends all texts as one array input
+func (o *OpenAIEmbedding) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	vectors, err := o.embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d inputs", len(vectors), len(texts))
+	}
+	return vectors, nil
+}
+
+// embed calls the embeddings endpoint with a string or an array of strings as input
+func (o *OpenAIEmbedding) embed(ctx context.Context, input interface{}) ([][]float64, error) {
+	baseURL := o.BaseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	url := strings.TrimSuffix(baseURL, "/") + "/embeddings"
 
 	reqBody := map[string]interface{}{
-		"input": text,
+		"input": input,
 		"model": o.Model,
 	}
+	if o.Dimensions > 0 {
+		reqBody["dimensions"] = o.Dimensions
+	}
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.APIKey))
+	if o.APIKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.APIKey))
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -105,30 +224,52 @@ func (o *OpenAIEmbedding) Embed(text string) ([]float64, error) {
 
 	var result struct {
 		Data []struct {
+			Index     int       `json:"index"`
 			Embedding []float64 `json:"embedding"`
 		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
 	}
 
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
+	switch input := input.(type) {
+	case string:
+		recordEmbeddingUsage(ctx, "openai", o.Model, result.Usage.PromptTokens, input)
+	case []string:
+		recordEmbeddingUsage(ctx, "openai", o.Model, result.Usage.PromptTokens, input...)
+	}
+
 	if len(result.Data) == 0 {
 		return nil, fmt.Errorf("no embedding data in response")
 	}
 
-	return result.Data[0].Embedding, nil
+	// The API documents data as ordered by index, but don't rely on it
+	vectors := make([][]float64, len(result.Data))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(vectors) || vectors[d.Index] != nil {
+			return nil, fmt.Errorf("unexpected embedding index %d in response", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	if err := o.dimension.check(vectors...); err != nil {
+		return nil, err
+	}
+	return vectors, nil
 }
 
 func (ol *OllamaEmbedding) GetDimension() int {
-	return ol.Dimension
+	return ol.dimension.get()
 }
 
 func (ol *OllamaEmbedding) GetModelName() string {
 	return ol.Model
 }
 
-func (ol *OllamaEmbedding) Embed(text string) ([]float64, error) {
+func (ol *OllamaEmbedding) Embed(ctx context.Context, text string) ([]float64, error) {
 	url := fmt.Sprintf("%s/api/embeddings", ol.Host)
 
 	reqBody := map[string]interface{}{
@@ -141,7 +282,7 @@ func (ol *OllamaEmbedding) Embed(text string) ([]float64, error) {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -171,10 +312,73 @@ func (ol *OllamaEmbedding) Embed(text string) ([]float64, error) {
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
+	recordEmbeddingUsage(ctx, "ollama", ol.Model, 0, text)
+	if err := ol.dimension.check(result.Embedding); err != nil {
+		return nil, err
+	}
 
 	return result.Embedding, nil
 }
 
+// EmbedBatch uses Ollama's /api/embed endpoint, which takes a list of inputs
+func (ol *OllamaEmbedding) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	url := fmt.Sprintf("%s/api/embed", ol.Host)
+
+	reqBody := map[string]interface{}{
+		"model": ol.Model,
+		"input": texts,
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Ollama error (%d): %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Embeddings      [][]float64 `json:"embeddings"`
+		PromptEvalCount int         `json:"prompt_eval_count"`
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	recordEmbeddingUsage(ctx, "ollama", ol.Model, result.PromptEvalCount, texts...)
+	if len(result.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("got %d embeddings for %d inputs", len(result.Embeddings), len(texts))
+	}
+	if err := ol.dimension.check(result.Embeddings...); err != nil {
+		return nil, err
+	}
+
+	return result.Embeddings, nil
+}
+
 // CosineSimilarity calculates the cosine similarity between two vectors
 func CosineSimilarity(a, b []float64) float64 {
 	if len(a) != len(b) {
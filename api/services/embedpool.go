@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// EmbedAll embeds texts in batches of batchSize, running up to concurrency batches at once.
+// When a batch fails its texts are retried one at a time, so a single text the model
+// rejects doesn't lose the rest. Texts that still fail get a nil vector and the first
+// error is returned alongside the vectors that did succeed.
+func EmbedAll(ctx context.Context, provider EmbeddingProvider, texts []string, batchSize, concurrency int) ([][]float64, error) {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	vectors := make([][]float64, len(texts))
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	sem := make(chan struct{}, concurrency)
+	for start := 0; start < len(texts); start += batchSize {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			fail(ctx.Err())
+			break
+		}
+
+		end := min(start+batchSize, len(texts))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			batch, err := provider.EmbedBatch(ctx, texts[start:end])
+			if err == nil {
+				copy(vectors[start:end], batch)
+				return
+			}
+			if ctx.Err() != nil {
+				fail(ctx.Err())
+				return
+			}
+
+			for i := start; i < end; i++ {
+				vector, err := provider.Embed(ctx, texts[i])
+				if err != nil {
+					fail(err)
+					if ctx.Err() != nil {
+						return
+					}
+					continue
+				}
+				vectors[i] = vector
+			}
+		}(start, end)
+	}
+
+	wg.Wait()
+	return vectors, firstErr
+}
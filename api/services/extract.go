@@ -0,0 +1,292 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// MIME types of the document formats that can be extracted
+const (
+	MIMEPDF      = "application/pdf"
+	MIMEDOCX     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	MIMEPPTX     = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	MIMEEPUB     = "application/epub+zip"
+	MIMEHTML     = "text/html"
+	MIMEMarkdown = "text/markdown"
+	MIMEText     = "text/plain"
+)
+
+// sniffLength is how much of a file content sniffing looks at
+const sniffLength = 4096
+
+// Limits on what a zip based document may expand to, so a small upload can't exhaust
+// memory once decompressed
+const (
+	maxZipEntrySize = 64 << 20  // one entry
+	maxZipSize      = 512 << 20 // every entry together
+)
+
+// ErrUnsupportedType is returned for files no extractor is registered for
+var ErrUnsupportedType = errors.New("unsupported file type")
+
+// ErrArchiveTooLarge is returned for zip based documents that expand beyond the size limits
+var ErrArchiveTooLarge = errors.New("archive expands beyond the size limit")
+
+// Extractor pulls the text out of a document, one PageText per page, slide or chapter.
+// Headings are written as Markdown headings and list items as "- " lines, whatever the
+// source format, so later steps can see the document's structure.
+type Extractor interface {
+	Extract(path string) ([]PageText, error)
+}
+
+// DocumentExtractor is implemented by extractors that also read a document's metadata and
+// report on the pages they could not read
+type DocumentExtractor interface {
+	ExtractDocument(path string) (*Document, error)
+}
+
+// DocumentInfo is the metadata a document declares about itself
+type DocumentInfo struct {
+	Title   string `json:"title,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// OutlineEntry is a bookmark of a document's outline
+type OutlineEntry struct {
+	Title string `json:"title"`
+	Level int    `json:"level"`          // 1 for top-level entries
+	Page  int    `json:"page,omitempty"` // page the entry points to, 0 if unknown
+}
+
+// ExtractionReport tells how much of a document could be read. Page numbers are 1-based.
+type ExtractionReport struct {
+	Pages            int   `json:"pages"`                        // pages, slides or chapters in the document
+	FailedPages      []int `json:"failed_pages,omitempty"`       // pages whose text could not be read
+	EmptyPages       []int `json:"empty_pages,omitempty"`        // pages without any text
+	ScannedPages     []int `json:"scanned_pages,omitempty"`      // pages that are images with little or no text, likely scans
+	MultiColumnPages []int `json:"multi_column_pages,omitempty"` // pages whose columns were put in reading order
+	TablePages       []int `json:"table_pages,omitempty"`        // pages with tables recognized from their layout
+	OCRPages         []int `json:"ocr_pages,omitempty"`          // pages whose text was recognized by OCR
+}
+
+// Document is an extracted document
+type Document struct {
+	MimeType string
+	Pages    []PageText
+	Info     DocumentInfo
+	Outline  []OutlineEntry
+	Report   ExtractionReport
+}
+
+// ExtractorFunc adapts a function to the Extractor interface
+type ExtractorFunc func(path string) ([]PageText, error)
+
+func (f ExtractorFunc) Extract(path string) ([]PageText, error) {
+	return f(path)
+}
+
+// ExtractorRegistry maps MIME types to the extractors that handle them
+type ExtractorRegistry struct {
+	extractors map[string]Extractor
+}
+
+func NewExtractorRegistry() *ExtractorRegistry {
+	return &ExtractorRegistry{extractors: make(map[string]Extractor)}
+}
+
+// DefaultExtractors returns a registry with the built-in extractors for PDF, DOCX, PPTX,
+// EPUB, HTML, Markdown and plain text
+func DefaultExtractors() *ExtractorRegistry {
+	r := NewExtractorRegistry()
+	r.Register(MIMEPDF, PDFExtractor{})
+	r.Register(MIMEDOCX, ExtractorFunc(ExtractDOCX))
+	r.Register(MIMEPPTX, ExtractorFunc(ExtractPPTX))
+	r.Register(MIMEEPUB, ExtractorFunc(ExtractEPUB))
+	r.Register(MIMEHTML, ExtractorFunc(ExtractHTML))
+	r.Register(MIMEMarkdown, ExtractorFunc(ExtractMarkdown))
+	r.Register(MIMEText, ExtractorFunc(ExtractMarkdown))
+	return r
+}
+
+// Register sets the extractor of a MIME type, replacing any earlier one
+func (r *ExtractorRegistry) Register(mimeType string, extractor Extractor) {
+	r.extractors[mimeType] = extractor
+}
+
+// Lookup returns the extractor of a MIME type
+func (r *ExtractorRegistry) Lookup(mimeType string) (Extractor, bool) {
+	extractor, ok := r.extractors[mimeType]
+	return extractor, ok
+}
+
+// Types lists the registered MIME types
+func (r *ExtractorRegistry) Types() []string {
+	types := make([]string, 0, len(r.extractors))
+	for mimeType := range r.extractors {
+		types = append(types, mimeType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Extract detects the type of a file from its content and extracts it with the registered
+// extractor. Files of other types fail with ErrUnsupportedType, along with a document
+// holding the detected type.
+func (r *ExtractorRegistry) Extract(path string) (*Document, error) {
+	mimeType, err := DetectMIMEType(path)
+	if err != nil {
+		return &Document{}, err
+	}
+	extractor, ok := r.Lookup(mimeType)
+	if !ok {
+		return &Document{MimeType: mimeType}, fmt.Errorf("%w: %s", ErrUnsupportedType, mimeType)
+	}
+
+	if documentExtractor, ok := extractor.(DocumentExtractor); ok {
+		doc, err := documentExtractor.ExtractDocument(path)
+		if doc == nil {
+			doc = &Document{}
+		}
+		doc.MimeType = mimeType
+		return doc, err
+	}
+	pages, err := extractor.Extract(path)
+	if err != nil {
+		return &Document{MimeType: mimeType}, err
+	}
+	return &Document{MimeType: mimeType, Pages: pages, Report: ExtractionReport{Pages: len(pages)}}, nil
+}
+
+// DetectMIMEType sniffs the type of a file from its content, ignoring its name. Office
+// documents and EPUBs are told apart from other zip files by their entries, and Markdown
+// from plain text by its syntax.
+func DetectMIMEType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	head = head[:n]
+
+	mimeType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	switch mimeType {
+	case "application/zip":
+		return sniffZip(path), nil
+	case "text/xml":
+		// XHTML documents start with an XML declaration
+		if bytes.Contains(bytes.ToLower(head), []byte("<html")) {
+			return MIMEHTML, nil
+		}
+	case MIMEText:
+		if looksLikeMarkdown(head) {
+			return MIMEMarkdown, nil
+		}
+	}
+	return mimeType, nil
+}
+
+// sniffZip tells the zip based formats apart by the entries they must contain
+func sniffZip(path string) string {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return "application/zip"
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		switch file.Name {
+		case "mimetype":
+			// The entry holds nothing but the type, anything larger isn't an EPUB
+			if file.UncompressedSize64 > sniffLength {
+				continue
+			}
+			if content, err := readZipFile(file); err == nil && strings.TrimSpace(string(content)) == MIMEEPUB {
+				return MIMEEPUB
+			}
+		case "word/document.xml":
+			return MIMEDOCX
+		case "ppt/presentation.xml":
+			return MIMEPPTX
+		}
+	}
+	return "application/zip"
+}
+
+var markdownSyntax = regexp.MustCompile(`(?m)^(#{1,6} \S|` + "```" + `|\s*[-*+] \S|\s*\d+\. \S|> )|\]\([^)]+\)|\*\*\S`)
+
+// looksLikeMarkdown reports whether text uses Markdown headings, lists, fences, quotes,
+// links or emphasis
+func looksLikeMarkdown(head []byte) bool {
+	return markdownSyntax.Match(head)
+}
+
+var frontMatter = regexp.MustCompile(`(?s)\A---\r?\n.*?\r?\n---\r?\n`)
+
+// ExtractMarkdown reads a Markdown or plain text file as a single page, without any YAML
+// front matter
+func ExtractMarkdown(path string) ([]PageText, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	text = frontMatter.ReplaceAllString(text, "")
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return []PageText{{Number: 1, Text: text}}, nil
+}
+
+// readZipFile reads one entry of a zip archive, failing with ErrArchiveTooLarge for
+// entries larger than maxZipEntrySize
+func readZipFile(file *zip.File) ([]byte, error) {
+	if file.UncompressedSize64 > maxZipEntrySize {
+		return nil, fmt.Errorf("%s: %w", file.Name, ErrArchiveTooLarge)
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// The declared size can lie, so the read is limited too
+	data, err := io.ReadAll(io.LimitReader(rc, maxZipEntrySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxZipEntrySize {
+		return nil, fmt.Errorf("%s: %w", file.Name, ErrArchiveTooLarge)
+	}
+	return data, nil
+}
+
+// zipEntries indexes the entries of a zip archive by name, failing with
+// ErrArchiveTooLarge when they expand to more than maxZipSize together
+func zipEntries(archive *zip.Reader) (map[string]*zip.File, error) {
+	entries := make(map[string]*zip.File, len(archive.File))
+	var total uint64
+	for _, file := range archive.File {
+		total += file.UncompressedSize64
+		if total > maxZipSize {
+			return nil, ErrArchiveTooLarge
+		}
+		entries[file.Name] = file
+	}
+	return entries, nil
+}
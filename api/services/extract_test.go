@@ -0,0 +1,238 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeZip writes a zip archive with the given entries, in order
+func writeZip(t *testing.T, name string, entries ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(entries); i += 2 {
+		w, err := archive.Create(entries[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entries[i+1]))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, name, buf.String())
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const docxDocument = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:body>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Cell Biology</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Cells are the </w:t></w:r><w:r><w:t>basic unit of life.</w:t></w:r></w:p>
+<w:p><w:pPr><w:numPr><w:ilvl w:val="0"/><w:numId w:val="1"/></w:numPr></w:pPr><w:r><w:t>Nucleus</w:t></w:r></w:p>
+<w:p><w:pPr><w:numPr><w:ilvl w:val="0"/><w:numId w:val="1"/></w:numPr></w:pPr><w:r><w:t>Mitochondria</w:t></w:r><w:r><w:br w:type="page"/></w:r></w:p>
+<w:p><w:pPr><w:pStyle w:val="Heading2"/></w:pPr><w:r><w:t>Organelles</w:t></w:r></w:p>
+<w:tbl>
+<w:tr><w:tc><w:p><w:r><w:t>Organelle</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Role</w:t></w:r></w:p></w:tc></w:tr>
+<w:tr><w:tc><w:p><w:r><w:t>Ribosome</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Makes proteins</w:t></w:r></w:p></w:tc></w:tr>
+</w:tbl>
+<w:p><w:r><w:delText>Removed text</w:delText></w:r></w:p>
+</w:body>
+</w:document>`
+
+func TestExtractDOCX(t *testing.T) {
+	path := writeZip(t, "handout.docx", "[Content_Types].xml", "<Types/>", "word/document.xml", docxDocument)
+
+	mimeType, err := DetectMIMEType(path)
+	if err != nil || mimeType != MIMEDOCX {
+		t.Fatalf("detected %q (%v), expected DOCX", mimeType, err)
+	}
+	pages, err := ExtractDOCX(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("expected 2 pages split at the page break, got %d: %+v", len(pages), pages)
+	}
+
+	want := "# Cell Biology\n\nCells are the basic unit of life.\n\n- Nucleus\n\n- Mitochondria"
+	if pages[0].Text != want {
+		t.Errorf("page 1:\n%q\nwant\n%q", pages[0].Text, want)
+	}
+	want = "## Organelles\n\n| Organelle | Role |\n| --- | --- |\n| Ribosome | Makes proteins |"
+	if pages[1].Text != want || pages[1].Number != 2 {
+		t.Errorf("page 2:\n%q\nwant\n%q", pages[1].Text, want)
+	}
+}
+
+func pptxSlide(title, body string) string {
+	return `<p:sld xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"><p:cSld><p:spTree>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="title"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>` + title + `</a:t></a:r></a:p></p:txBody></p:sp>
+<p:sp><p:nvSpPr><p:nvPr><p:ph idx="1"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>` + body + `</a:t></a:r></a:p></p:txBody></p:sp>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="sldNum"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>7</a:t></a:r></a:p></p:txBody></p:sp>
+</p:spTree></p:cSld></p:sld>`
+}
+
+func TestExtractPPTX(t *testing.T) {
+	const rels = `http://schemas.openxmlformats.org/officeDocument/2006/relationships`
+	path := writeZip(t, "deck.pptx",
+		"ppt/presentation.xml", `<p:presentation xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main" xmlns:r="`+rels+`">
+<p:sldIdLst><p:sldId id="256" r:id="rId3"/><p:sldId id="257" r:id="rId2"/></p:sldIdLst></p:presentation>`,
+		"ppt/_rels/presentation.xml.rels", `<Relationships><Relationship Id="rId2" Type="`+rels+`/slide" Target="slides/slide1.xml"/>
+<Relationship Id="rId3" Type="`+rels+`/slide" Target="slides/slide2.xml"/></Relationships>`,
+		// slide2.xml comes first in the presentation
+		"ppt/slides/slide1.xml", pptxSlide("Respiration", "Glucose is broken down"),
+		"ppt/slides/slide2.xml", pptxSlide("Photosynthesis", "Light becomes sugar"),
+		"ppt/slides/_rels/slide2.xml.rels", `<Relationships><Relationship Id="rId1" Type="`+rels+`/notesSlide" Target="../notesSlides/notesSlide1.xml"/></Relationships>`,
+		"ppt/notesSlides/notesSlide1.xml", `<p:notes xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"><p:cSld><p:spTree>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="sldImg"/></p:nvPr></p:nvSpPr></p:sp>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="body" idx="1"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>Mention chlorophyll.</a:t></a:r></a:p></p:txBody></p:sp>
+</p:spTree></p:cSld></p:notes>`,
+	)
+
+	if mimeType, _ := DetectMIMEType(path); mimeType != MIMEPPTX {
+		t.Fatalf("detected %q, expected PPTX", mimeType)
+	}
+	pages, err := ExtractPPTX(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("expected 2 slides, got %d", len(pages))
+	}
+	if want := "# Photosynthesis\n\nLight becomes sugar\n\nSpeaker notes:\nMention chlorophyll."; pages[0].Text != want {
+		t.Errorf("slide 1:\n%q\nwant\n%q", pages[0].Text, want)
+	}
+	if want := "# Respiration\n\nGlucose is broken down"; pages[1].Text != want {
+		t.Errorf("slide 2:\n%q\nwant\n%q", pages[1].Text, want)
+	}
+}
+
+func TestExtractHTML(t *testing.T) {
+	path := writeFile(t, "page", `<!DOCTYPE html><html><head><title>T</title><style>p{}</style></head>
+<body><nav><a href="/">Home</a></nav><h1>Ecosystems</h1><p>Energy <b>flows</b>
+one way.</p><ul><li>Producers</li><li>Consumers</li></ul>
+<table><caption>Levels</caption><tr><th>Level</th><th>Energy</th></tr><tr><td>1</td><td>100%</td></tr></table>
+<figure><img src="web.png" alt="A food web"><figcaption>Who eats whom</figcaption></figure>
+<figure><img src="pyramid.png" alt="An energy pyramid"></figure>
+<script>alert(1)</script></body></html>`)
+
+	if mimeType, _ := DetectMIMEType(path); mimeType != MIMEHTML {
+		t.Fatalf("detected %q, expected HTML", mimeType)
+	}
+	pages, err := ExtractHTML(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Captions are marked so they stay with their table or figure
+	want := "# Ecosystems\n\nEnergy flows one way.\n\n- Producers\n\n- Consumers\n\nTable: Levels\n\n| Level | Energy |\n| --- | --- |\n| 1 | 100% |" +
+		"\n\nFigure: Who eats whom\n\nFigure: An energy pyramid"
+	if len(pages) != 1 || pages[0].Text != want {
+		t.Errorf("got %+v\nwant %q", pages, want)
+	}
+}
+
+func TestExtractEPUB(t *testing.T) {
+	path := writeZip(t, "book.epub",
+		"mimetype", MIMEEPUB,
+		"META-INF/container.xml", `<container><rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`,
+		"OEBPS/content.opf", `<package><manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="c1" href="text/chapter%201.xhtml" media-type="application/xhtml+xml"/>
+<item id="c2" href="text/chapter2.xhtml" media-type="application/xhtml+xml"/>
+</manifest><spine><itemref idref="nav"/><itemref idref="c2"/><itemref idref="c1"/></spine></package>`,
+		"OEBPS/nav.xhtml", `<html><body><h1>Contents</h1></body></html>`,
+		"OEBPS/text/chapter 1.xhtml", `<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"><body><h1>One</h1><p>First.</p></body></html>`,
+		"OEBPS/text/chapter2.xhtml", `<html><body><h1>Two</h1><p>Second.</p></body></html>`,
+	)
+
+	if mimeType, _ := DetectMIMEType(path); mimeType != MIMEEPUB {
+		t.Fatalf("detected %q, expected EPUB", mimeType)
+	}
+	pages, err := ExtractEPUB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || pages[0].Text != "# Two\n\nSecond." || pages[1].Text != "# One\n\nFirst." {
+		t.Errorf("expected the chapters in spine order without the contents, got %+v", pages)
+	}
+}
+
+func TestDetectMIMETypeIgnoresExtension(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"notes.pdf", "# Week 1\n\nIntro to **cells**.\n", MIMEMarkdown},
+		{"notes.md", "Just a few plain sentences.\nNothing else.\n", MIMEText},
+		{"slides.docx", "%PDF-1.4\n", MIMEPDF},
+		{"archive.epub", "", MIMEText},
+	}
+	for _, tt := range tests {
+		path := writeFile(t, tt.name, tt.content)
+		if got, err := DetectMIMEType(path); err != nil || got != tt.want {
+			t.Errorf("%s: detected %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	zipPath := writeZip(t, "data.docx", "data.csv", "a,b\n")
+	doc, err := DefaultExtractors().Extract(zipPath)
+	if doc.MimeType != "application/zip" || !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected a plain zip to be unsupported, got %q, %v", doc.MimeType, err)
+	}
+}
+
+func TestExtractRefusesOversizedArchives(t *testing.T) {
+	padding := strings.Repeat(" ", maxZipEntrySize+1)
+
+	docx := writeZip(t, "bomb.docx", "word/document.xml", docxDocument+padding)
+	if _, err := ExtractDOCX(docx); !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("expected an oversized entry to be refused, got %v", err)
+	}
+
+	// Sniffing doesn't read an oversized mimetype entry
+	epub := writeZip(t, "bomb.epub", "mimetype", MIMEEPUB+padding)
+	if got, err := DetectMIMEType(epub); err != nil || got != "application/zip" {
+		t.Errorf("detected %q (%v), want application/zip", got, err)
+	}
+
+	// Entries that are small alone can still add up to too much
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for i := 0; i < maxZipSize/maxZipEntrySize+1; i++ {
+		w, err := archive.CreateRaw(&zip.FileHeader{Name: fmt.Sprintf("ppt/slides/slide%d.xml", i+1), Method: zip.Store, UncompressedSize64: maxZipEntrySize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("<p:sld/>"))
+	}
+	archive.Close()
+	pptx := writeFile(t, "bomb.pptx", buf.String())
+	if _, err := ExtractPPTX(pptx); !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("expected the archive to be refused, got %v", err)
+	}
+}
+
+func TestExtractMarkdownStripsFrontMatter(t *testing.T) {
+	path := writeFile(t, "notes.md", "---\ntitle: Notes\n---\n# Heading\r\n\r\nBody\r\n")
+	pages, err := ExtractMarkdown(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || pages[0].Text != "# Heading\n\nBody\n" {
+		t.Errorf("got %+v", pages)
+	}
+}
@@ -0,0 +1,454 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Names the fake providers report, in the usage ledger among other places
+const (
+	FakeModel            = "fake"
+	FakeEmbeddingModel   = "fake-hash"
+	FakeImageModel       = "fake-image"
+	FakeSpeechModel      = "fake-speech"
+	defaultFakeDimension = 256
+	fakeExcerptLength    = 400
+)
+
+// fallbackWords fill in generated text when a prompt has no usable words
+var fallbackWords = []string{"course", "lesson", "topic", "concept", "example", "practice"}
+
+// FakeProvider is an offline AIProvider for tests and demos. Answers are derived from the
+// prompt alone, so the same prompt always gets the same answer, and structured answers are
+// built from the requested schema so they always validate.
+type FakeProvider struct{}
+
+func (f *FakeProvider) GetProviderName() string {
+	return "fake"
+}
+
+// GenerateText answers with an excerpt of the prompt. When the system prompt holds numbered
+// sources, the answer cites the first one.
+func (f *FakeProvider) GenerateText(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	if err := checkTextUsage(ctx, "fake", FakeModel, prompt, systemPrompt); err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	text := excerpt(prompt, fakeExcerptLength)
+	if text == "" {
+		text = "No content."
+	}
+	if strings.Contains(systemPrompt, "[1]") {
+		text += " [1]"
+	}
+	recordTextUsage(ctx, "fake", FakeModel, 0, 0, prompt, systemPrompt, text)
+	return text, nil
+}
+
+func (f *FakeProvider) GenerateJSON(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	text, err := f.GenerateText(ctx, prompt, systemPrompt)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return string(data), nil
+}
+
+// GenerateStructured fills the output's schema with text taken from the prompt
+func (f *FakeProvider) GenerateStructured(ctx context.Context, prompt string, systemPrompt string, output StructuredOutput) (string, error) {
+	if err := checkTextUsage(ctx, "fake", FakeModel, prompt, systemPrompt); err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(fakeValue(output.Schema, output.Name, promptWords(prompt), 0))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s: %w", output.Name, err)
+	}
+	recordTextUsage(ctx, "fake", FakeModel, 0, 0, prompt, systemPrompt, string(data))
+	return string(data), nil
+}
+
+// StreamText delivers GenerateText's answer a word at a time
+func (f *FakeProvider) StreamText(ctx context.Context, prompt string, systemPrompt string, onToken TokenHandler) (string, error) {
+	text, err := f.GenerateText(ctx, prompt, systemPrompt)
+	if err != nil {
+		return "", err
+	}
+
+	var streamed strings.Builder
+	for _, token := range strings.SplitAfter(text, " ") {
+		if err := ctx.Err(); err != nil {
+			return streamed.String(), err
+		}
+		if err := onToken(token); err != nil {
+			return streamed.String(), err
+		}
+		streamed.WriteString(token)
+	}
+	return streamed.String(), nil
+}
+
+// fakeValue builds a value that satisfies schema. index is the value's position in the
+// array holding it, so array items differ from each other.
+func fakeValue(schema *JSONSchema, name string, words []string, index int) interface{} {
+	if schema == nil {
+		return nil
+	}
+
+	switch schema.Type {
+	case "object":
+		obj := make(map[string]interface{}, len(schema.Properties))
+		for prop, propSchema := range schema.Properties {
+			obj[prop] = fakeValue(propSchema, prop, words, index)
+		}
+		return obj
+
+	case "array":
+		n := 3
+		if schema.MinItems != nil && *schema.MinItems > n {
+			n = *schema.MinItems
+		}
+		if schema.MaxItems != nil && *schema.MaxItems < n {
+			n = *schema.MaxItems
+		}
+		items := make([]interface{}, n)
+		seen := make(map[string]bool, n)
+		for i := range items {
+			items[i] = fakeValue(schema.Items, name, words, i)
+			// Options and the like must be distinct
+			if s, ok := items[i].(string); ok && seen[strings.ToLower(s)] {
+				items[i] = fmt.Sprintf("%s %d", s, i+1)
+			}
+			if s, ok := items[i].(string); ok {
+				seen[strings.ToLower(s)] = true
+			}
+		}
+		return items
+
+	case "string":
+		if len(schema.Enum) > 0 {
+			return schema.Enum[0]
+		}
+		length := 14
+		if strings.Contains(name, "title") || strings.Contains(name, "name") {
+			length = 4
+		}
+		return phrase(words, int(hashWord(name))+index*length, length)
+
+	case "integer", "number":
+		value := 0.0
+		if schema.Minimum != nil {
+			value = *schema.Minimum
+		}
+		value += float64(index)
+		if schema.Maximum != nil && value > *schema.Maximum {
+			value = *schema.Maximum
+		}
+		if schema.Type == "integer" {
+			return int(value)
+		}
+		return value
+
+	case "boolean":
+		return false
+	}
+	return nil
+}
+
+// promptWords returns the words of a prompt that are worth repeating in generated text
+func promptWords(prompt string) []string {
+	var words []string
+	for _, word := range strings.FieldsFunc(prompt, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+	}) {
+		word = strings.Trim(word, "-")
+		if len([]rune(word)) >= 4 {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return fallbackWords
+	}
+	return words
+}
+
+// phrase joins length words starting at offset, wrapping around, capitalized
+func phrase(words []string, offset, length int) string {
+	if offset < 0 {
+		offset = -offset
+	}
+	picked := make([]string, length)
+	for i := range picked {
+		picked[i] = strings.ToLower(words[(offset+i)%len(words)])
+	}
+	text := strings.Join(picked, " ")
+	runes := []rune(text)
+	runes[0] = unicode.ToUpper(runes[0])
+	if length > 4 {
+		return string(runes) + "."
+	}
+	return string(runes)
+}
+
+// excerpt collapses whitespace and cuts text to at most maxLength characters, at the end
+// of a sentence when there is one
+func excerpt(text string, maxLength int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) <= maxLength {
+		return text
+	}
+	text = text[:maxLength]
+	if end := strings.LastIndexAny(text, ".!?"); end > maxLength/2 {
+		return text[:end+1]
+	}
+	if end := strings.LastIndex(text, " "); end > 0 {
+		text = text[:end]
+	}
+	return text + "..."
+}
+
+func hashWord(word string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(word))
+	return h.Sum32()
+}
+
+// FakeEmbedding is an offline EmbeddingProvider for tests and demos. Vectors hash each word
+// of the text into a fixed number of dimensions, so texts sharing words are close and the
+// same text always gets the same vector.
+type FakeEmbedding struct {
+	Dimensions int
+}
+
+// NewFakeEmbedding creates a fake embedding provider with vectors of the given size, or
+// 256 when it is 0
+func NewFakeEmbedding(dimensions int) *FakeEmbedding {
+	if dimensions <= 0 {
+		dimensions = defaultFakeDimension
+	}
+	return &FakeEmbedding{Dimensions: dimensions}
+}
+
+func (f *FakeEmbedding) GetDimension() int {
+	return f.Dimensions
+}
+
+func (f *FakeEmbedding) GetModelName() string {
+	return fmt.Sprintf("%s-%d", FakeEmbeddingModel, f.Dimensions)
+}
+
+func (f *FakeEmbedding) Embed(ctx context.Context, text string) ([]float64, error) {
+	vectors, err := f.EmbedBatch(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+func (f *FakeEmbedding) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float64, len(texts))
+	for i, text := range texts {
+		vectors[i] = f.vector(text)
+	}
+	recordEmbeddingUsage(ctx, "fake", f.GetModelName(), 0, texts...)
+	return vectors, nil
+}
+
+// vector hashes every word into a dimension, with a sign taken from the hash so unrelated
+// words cancel out rather than pile up, and normalizes the result
+func (f *FakeEmbedding) vector(text string) []float64 {
+	vector := make([]float64, f.Dimensions)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		h := hashWord(word)
+		if h&1 == 0 {
+			vector[(h>>1)%uint32(f.Dimensions)]++
+		} else {
+			vector[(h>>1)%uint32(f.Dimensions)]--
+		}
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	if norm == 0 {
+		// Texts without words still need a usable direction
+		vector[0] = 1
+		return vector
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
+
+// FakeImages is an offline ImageProvider that draws a placeholder SVG, colored by the prompt
+type FakeImages struct{}
+
+func (f *FakeImages) GetProviderName() string { return "fake" }
+func (f *FakeImages) GetModelName() string    { return FakeImageModel }
+
+// GenerateImage returns the placeholder as a data URL, so it displays without a server
+func (f *FakeImages) GenerateImage(ctx context.Context, prompt string) (string, error) {
+	if err := CheckUsage(ctx, Usage{Provider: "fake", Model: FakeImageModel, Kind: UsageImage, Images: 1}); err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	h := hashWord(prompt)
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="1280" height="720"><rect width="100%%" height="100%%" fill="#%06x"/></svg>`, h&0xffffff)
+	RecordUsage(ctx, Usage{Provider: "fake", Model: FakeImageModel, Kind: UsageImage, Images: 1})
+	return "data:image/svg+xml;charset=utf-8," + strings.NewReplacer("#", "%23", "<", "%3C", ">", "%3E", `"`, "'").Replace(svg), nil
+}
+
+// Silent MPEG-1 Layer III frames at 32 kbps, 48 kHz, mono: a frame is 96 bytes and plays
+// for 24ms, and an all-zero body decodes to silence
+var silentMP3Frame = append([]byte{0xFF, 0xFB, 0x14, 0xC0}, make([]byte, 92)...)
+
+const (
+	silentFrameSeconds = 1152.0 / 48000
+	fakeWordsPerSecond = 2.5 // a relaxed speaking pace
+)
+
+// FakeVoiceover is an offline VoiceoverProvider that saves silent MP3s as long as reading
+// the text out would take
+type FakeVoiceover struct {
+	AudioDir string
+}
+
+func (f *FakeVoiceover) GetProviderName() string { return "fake" }
+func (f *FakeVoiceover) GetModelName() string    { return FakeSpeechModel }
+
+func (f *FakeVoiceover) GenerateVoiceover(ctx context.Context, text, courseID, language string, slideNumber int) (string, error) {
+	usage := Usage{Provider: "fake", Model: FakeSpeechModel, Kind: UsageSpeech, Characters: len([]rune(text))}
+	if err := CheckUsage(ctx, usage); err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	RecordUsage(ctx, usage)
+
+	seconds := max(1, float64(len(strings.Fields(text)))/fakeWordsPerSecond)
+	frames := int(math.Ceil(seconds / silentFrameSeconds))
+	return saveAudio(f.AudioDir, courseID, slideNumber, bytes.NewReader(bytes.Repeat(silentMP3Frame, frames)))
+}
+
+// fakeOCRConfidence is the confidence FakeOCR gives all the text it recognizes
+const fakeOCRConfidence = 0.9
+
+// FakeOCR is an offline OCREngine for tests and demos. It can't read pixels, so it returns
+// the text an image carries in its metadata, a PNG text chunk or a JPEG comment, and
+// otherwise a phrase derived from the image's bytes.
+type FakeOCR struct{}
+
+func (f *FakeOCR) GetEngineName() string { return "fake" }
+
+func (f *FakeOCR) Recognize(ctx context.Context, imagePath string) (OCRResult, error) {
+	if err := ctx.Err(); err != nil {
+		return OCRResult{}, err
+	}
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return OCRResult{}, fmt.Errorf("failed to read image: %w", err)
+	}
+	text := imageComment(data)
+	if text == "" {
+		text = phrase(fallbackWords, int(hashWord(string(data))%uint32(len(fallbackWords))), 8)
+	}
+	return OCRResult{Text: text, Confidence: fakeOCRConfidence}, nil
+}
+
+// imageComment returns the first tEXt chunk of a PNG or the first comment of a JPEG
+func imageComment(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		for i := len(pngSignature); i+8 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			kind := string(data[i+4 : i+8])
+			if i+8+length > len(data) {
+				break
+			}
+			if kind == "tEXt" {
+				_, text, _ := bytes.Cut(data[i+8:i+8+length], []byte{0})
+				return string(text)
+			}
+			i += 12 + length // length, type, data and CRC
+		}
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+			marker := data[i+1]
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			if marker == 0xDA || i+2+length > len(data) { // the image data starts
+				break
+			}
+			if marker == 0xFE {
+				return string(data[i+4 : i+2+length])
+			}
+			i += 2 + length
+		}
+	}
+	return ""
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// FakePageRenderer is an offline PageRenderer that draws a blank PNG per page, whose text
+// chunk FakeOCR reads as the page's text
+type FakePageRenderer struct{}
+
+func (f *FakePageRenderer) RenderPage(ctx context.Context, pdfPath string, page int, dir string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		return "", fmt.Errorf("failed to encode page: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("page-%d.png", page))
+	text := fmt.Sprintf("Scanned page %d of %s.", page, filepath.Base(pdfPath))
+	return path, os.WriteFile(path, pngWithText(b.Bytes(), text), 0644)
+}
+
+// pngWithText adds a tEXt chunk holding text to a PNG, right after its header
+func pngWithText(data []byte, text string) []byte {
+	body := append([]byte("tEXtComment\x00"), text...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)-4))
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(body))
+
+	header := len(pngSignature) + 25 // the IHDR chunk always comes first and is 25 bytes
+	out := append([]byte(nil), data[:header]...)
+	out = append(out, chunk...)
+	return append(out, data[header:]...)
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestFakeStructuredOutputMatchesSchema(t *testing.T) {
+	output := StructuredOutput{
+		Name: "quiz",
+		Schema: &JSONSchema{
+			Type: "object",
+			Properties: map[string]*JSONSchema{
+				"title":  {Type: "string", MinLength: Ptr(1)},
+				"layout": {Type: "string", Enum: []string{"title", "default"}},
+				"questions": {
+					Type:     "array",
+					MinItems: Ptr(5),
+					MaxItems: Ptr(5),
+					Items: &JSONSchema{
+						Type: "object",
+						Properties: map[string]*JSONSchema{
+							"options": {Type: "array", MinItems: Ptr(4), MaxItems: Ptr(4), Items: &JSONSchema{Type: "string", MinLength: Ptr(1)}},
+							"answer":  {Type: "integer", Minimum: Ptr(0.0), Maximum: Ptr(3.0)},
+						},
+						Required: []string{"options", "answer"},
+					},
+				},
+			},
+			Required: []string{"title", "questions"},
+		},
+	}
+
+	provider := &FakeProvider{}
+	first, err := provider.GenerateStructured(context.Background(), "Plants turn sunlight into sugar", "", output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := output.Schema.Validate([]byte(first)); len(problems) > 0 {
+		t.Fatalf("fake output %s breaks its schema: %v", first, problems)
+	}
+	second, _ := provider.GenerateStructured(context.Background(), "Plants turn sunlight into sugar", "", output)
+	if first != second {
+		t.Errorf("same prompt, different output:\n%s\n%s", first, second)
+	}
+}
+
+func TestFakeEmbeddingIsDeterministicAndSimilarityAware(t *testing.T) {
+	embedding := NewFakeEmbedding(64)
+	ctx := context.Background()
+
+	vectors, err := embedding.EmbedBatch(ctx, []string{
+		"photosynthesis turns light into sugar",
+		"Photosynthesis turns light into sugar!",
+		"the stock market closed lower today",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		if len(v) != 64 {
+			t.Fatalf("expected 64 dimensions, got %d", len(v))
+		}
+	}
+
+	cosine := func(a, b []float64) float64 {
+		var dot, na, nb float64
+		for i := range a {
+			dot += a[i] * b[i]
+			na += a[i] * a[i]
+			nb += b[i] * b[i]
+		}
+		return dot / math.Sqrt(na*nb)
+	}
+	if same := cosine(vectors[0], vectors[1]); math.Abs(same-1) > 1e-9 {
+		t.Errorf("case and punctuation changed the vector: cosine %f", same)
+	}
+	if other := cosine(vectors[0], vectors[2]); other > 0.5 {
+		t.Errorf("unrelated texts are too close: cosine %f", other)
+	}
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"    // calls go through
+	CircuitOpen     = "open"      // calls are skipped until the cooldown ends
+	CircuitHalfOpen = "half_open" // one trial call decides whether to close again
+)
+
+// circuitBreaker stops calling a provider after repeated failures, then lets a single
+// trial call through once the cooldown has passed
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int // consecutive
+	openedAt  time.Time
+	probing   bool // a half-open trial call is in flight
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: max(1, threshold), cooldown: cooldown, state: CircuitClosed}
+}
+
+// allow reports whether a call may be made now
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// success closes the circuit
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = CircuitClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// failure counts a failed call, opening the circuit at the threshold or when the trial
+// call of a half-open circuit fails
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon ends a call that said nothing about the provider's health (e.g. cancelled)
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// ProviderStatus is the circuit breaker state of one provider in a fallback chain
+type ProviderStatus struct {
+	Provider string     `json:"provider"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`           // consecutive
+	RetryAt  *time.Time `json:"retry_at,omitempty"` // when an open circuit lets a trial call through
+}
+
+// FallbackProvider wraps an ordered list of providers. Each call goes to the first provider
+// whose circuit is closed; if it fails, the next one is tried. Rate limits and overload are
+// retried by each provider first, honoring Retry-After.
+type FallbackProvider struct {
+	providers []AIProvider
+	breakers  []*circuitBreaker
+}
+
+// NewFallbackProvider creates a fallback chain. A provider's circuit opens after threshold
+// consecutive failures and stays open for cooldown.
+func NewFallbackProvider(providers []AIProvider, threshold int, cooldown time.Duration) *FallbackProvider {
+	breakers := make([]*circuitBreaker, len(providers))
+	for i := range providers {
+		breakers[i] = newCircuitBreaker(threshold, cooldown)
+	}
+	return &FallbackProvider{providers: providers, breakers: breakers}
+}
+
+// GetProviderName returns the name of the primary provider
+func (f *FallbackProvider) GetProviderName() string {
+	return f.providers[0].GetProviderName()
+}
+
+// Status reports the circuit breaker state of every provider in order
+func (f *FallbackProvider) Status() []ProviderStatus {
+	statuses := make([]ProviderStatus, len(f.providers))
+	for i, provider := range f.providers {
+		b := f.breakers[i]
+		b.mu.Lock()
+		statuses[i] = ProviderStatus{Provider: provider.GetProviderName(), State: b.state, Failures: b.failures}
+		if b.state == CircuitOpen {
+			retryAt := b.openedAt.Add(b.cooldown)
+			statuses[i].RetryAt = &retryAt
+		}
+		b.mu.Unlock()
+	}
+	return statuses
+}
+
+// isProviderFailure reports whether an error says the provider is unhealthy: unreachable,
+// rate limited, overloaded, failing or refusing our credentials. Errors caused by the
+// request itself don't count against the provider.
+func isProviderFailure(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return apiErr.Retryable() || apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+}
+
+// finalError wraps an error that is counted against the provider but must not be retried
+// with the next one
+type finalError struct{ err error }
+
+func (e *finalError) Error() string { return e.err.Error() }
+func (e *finalError) Unwrap() error { return e.err }
+
+// call runs fn with each provider in turn until one succeeds. Cancellation and budget
+// refusals end the chain, since another provider can't help with either.
+func (f *FallbackProvider) call(ctx context.Context, fn func(provider AIProvider) error) error {
+	var failures []string
+	var lastErr error
+	for i, provider := range f.providers {
+		name := provider.GetProviderName()
+		breaker := f.breakers[i]
+		if !breaker.allow() {
+			failures = append(failures, name+": circuit open")
+			continue
+		}
+
+		err := fn(provider)
+		switch {
+		case err == nil:
+			breaker.success()
+			return nil
+		case ctx.Err() != nil:
+			breaker.abandon()
+			return ctx.Err()
+		case errors.As(err, new(*BudgetError)):
+			breaker.abandon()
+			return err
+		case isProviderFailure(err):
+			breaker.failure()
+		default:
+			// The provider answered; the request was at fault
+			breaker.success()
+		}
+
+		var final *finalError
+		if errors.As(err, &final) {
+			return final.err
+		}
+		if i < len(f.providers)-1 {
+			log.Warn().Err(err).Str("provider", name).Msg("Provider failed, falling back to the next one")
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return fmt.Errorf("no provider available (%s)", strings.Join(failures, "; "))
+	}
+	if len(failures) == 1 {
+		return lastErr
+	}
+	return fmt.Errorf("all providers failed (%s): %w", strings.Join(failures, "; "), lastErr)
+}
+
+func (f *FallbackProvider) GenerateText(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	var text string
+	err := f.call(ctx, func(provider AIProvider) (err error) {
+		text, err = provider.GenerateText(ctx, prompt, systemPrompt)
+		return err
+	})
+	return text, err
+}
+
+func (f *FallbackProvider) GenerateJSON(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	var text string
+	err := f.call(ctx, func(provider AIProvider) (err error) {
+		text, err = provider.GenerateJSON(ctx, prompt, systemPrompt)
+		return err
+	})
+	return text, err
+}
+
+// GenerateStructured uses each provider's structured output mode, or its JSON mode for
+// providers without one or whose server doesn't support it
+func (f *FallbackProvider) GenerateStructured(ctx context.Context, prompt string, systemPrompt string, output StructuredOutput) (string, error) {
+	var text string
+	err := f.call(ctx, func(provider AIProvider) (err error) {
+		if structured, ok := provider.(StructuredProvider); ok {
+			text, err = structured.GenerateStructured(ctx, prompt, systemPrompt, output)
+			if !structuredUnsupported(err) {
+				return err
+			}
+			log.Warn().Err(err).Str("provider", provider.GetProviderName()).Str("output", output.Name).Msg("Structured output unsupported, falling back to JSON mode")
+		}
+		text, err = provider.GenerateJSON(ctx, prompt, systemPrompt)
+		return err
+	})
+	return text, err
+}
+
+// StreamText falls back only while nothing has been streamed; once tokens have reached
+// the caller, a failure ends the answer
+func (f *FallbackProvider) StreamText(ctx context.Context, prompt string, systemPrompt string, onToken TokenHandler) (string, error) {
+	var text string
+	err := f.call(ctx, func(provider AIProvider) error {
+		started := false
+		var err error
+		text, err = provider.StreamText(ctx, prompt, systemPrompt, func(token string) error {
+			started = true
+			return onToken(token)
+		})
+		if err != nil && started {
+			return &finalError{err}
+		}
+		return err
+	})
+	return text, err
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+
+	// Opens at the threshold of consecutive failures
+	b.failure()
+	if !b.allow() || b.state != CircuitClosed {
+		t.Fatalf("expected the circuit closed after one failure, got %s", b.state)
+	}
+	b.failure()
+	if b.allow() || b.state != CircuitOpen {
+		t.Fatalf("expected the circuit open after two failures, got %s", b.state)
+	}
+
+	// Once the cooldown has passed, a single trial call goes through
+	b.openedAt = time.Now().Add(-time.Minute)
+	if !b.allow() || b.state != CircuitHalfOpen {
+		t.Fatalf("expected a trial call, got %s", b.state)
+	}
+	if b.allow() {
+		t.Error("expected only one trial call at a time")
+	}
+
+	// A failed trial opens the circuit again at once
+	b.failure()
+	if b.allow() || b.state != CircuitOpen {
+		t.Fatalf("expected the failed trial to open the circuit, got %s", b.state)
+	}
+
+	// An abandoned trial lets the next one through, a successful one closes the circuit
+	b.openedAt = time.Now().Add(-time.Minute)
+	b.allow()
+	b.abandon()
+	if !b.allow() || b.state != CircuitHalfOpen {
+		t.Fatalf("expected another trial after an abandoned one, got %s", b.state)
+	}
+	b.success()
+	if !b.allow() || b.state != CircuitClosed || b.failures != 0 {
+		t.Errorf("expected the circuit closed after a successful trial, got %s with %d failures", b.state, b.failures)
+	}
+}
+
+func TestFallbackProviderFailsOver(t *testing.T) {
+	unavailable := &APIError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"}
+	primary := &stubProvider{name: "claude", results: []stubResult{{err: unavailable}, {err: unavailable}}}
+	secondary := &stubProvider{name: "openai", results: []stubResult{{text: "first"}, {text: "second"}, {text: "third"}}}
+	chain := NewFallbackProvider([]AIProvider{primary, secondary}, 2, time.Minute)
+
+	for _, want := range []string{"first", "second", "third"} {
+		text, err := chain.GenerateText(context.Background(), "What is osmosis?", "")
+		if err != nil || text != want {
+			t.Fatalf("expected %q from the secondary provider, got %q, %v", want, text, err)
+		}
+	}
+	// The primary's circuit opened after two failures, so the third call skipped it
+	if len(primary.calls) != 2 {
+		t.Errorf("expected the open circuit to skip the primary, got %d calls", len(primary.calls))
+	}
+	status := chain.Status()
+	if status[0].State != CircuitOpen || status[0].RetryAt == nil || status[1].State != CircuitClosed {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// Errors caused by the request don't count against the provider or fail over
+	badRequest := &APIError{StatusCode: http.StatusBadRequest, Message: "prompt is too long"}
+	secondary.results = []stubResult{{err: badRequest}}
+	_, err := chain.GenerateText(context.Background(), "What is osmosis?", "")
+	if !errors.Is(err, badRequest) {
+		t.Errorf("expected the request error, got %v", err)
+	}
+	if status := chain.Status(); status[1].State != CircuitClosed || status[1].Failures != 0 {
+		t.Errorf("expected the request error not to count, got %+v", status[1])
+	}
+}
+
+func TestFallbackProviderStopsOnCancelAndBudget(t *testing.T) {
+	refused := &BudgetError{Scope: "course", Limit: 1, Spent: 1, Estimate: 0.01}
+	primary := &stubProvider{name: "claude", results: []stubResult{{err: refused}}}
+	secondary := &stubProvider{name: "openai"}
+	chain := NewFallbackProvider([]AIProvider{primary, secondary}, 1, time.Minute)
+
+	_, err := chain.GenerateText(context.Background(), "What is osmosis?", "")
+	if !errors.Is(err, refused) {
+		t.Errorf("expected the budget refusal, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	primary.results = []stubResult{{err: errors.New("connection reset")}}
+	_, err = chain.GenerateText(ctx, "What is osmosis?", "")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancel, got %v", err)
+	}
+
+	// Neither said anything about the provider's health, and another provider can't help
+	if len(secondary.calls) != 0 {
+		t.Errorf("expected no fallback, got %v", secondary.calls)
+	}
+	if status := chain.Status(); status[0].State != CircuitClosed || status[0].Failures != 0 {
+		t.Errorf("expected the primary's circuit untouched, got %+v", status[0])
+	}
+}
+
+func TestFallbackProviderStreamsFromOneProvider(t *testing.T) {
+	unavailable := &APIError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"}
+	primary := &stubProvider{name: "claude", results: []stubResult{{err: unavailable}, {text: "Osmosis moves", err: unavailable}}}
+	secondary := &stubProvider{name: "openai", results: []stubResult{{text: "Osmosis moves water."}}}
+	chain := NewFallbackProvider([]AIProvider{primary, secondary}, 5, time.Minute)
+
+	// Nothing was streamed yet, so the next provider answers
+	var tokens []string
+	onToken := func(token string) error {
+		tokens = append(tokens, token)
+		return nil
+	}
+	text, err := chain.StreamText(context.Background(), "What is osmosis?", "", onToken)
+	if err != nil || text != "Osmosis moves water." {
+		t.Fatalf("expected the secondary's answer, got %q, %v", text, err)
+	}
+
+	// Once tokens reached the caller, a failure ends the answer
+	tokens = nil
+	_, err = chain.StreamText(context.Background(), "What is osmosis?", "", onToken)
+	if !errors.Is(err, unavailable) {
+		t.Errorf("expected the primary's error, got %v", err)
+	}
+	if !reflect.DeepEqual(tokens, []string{"Osmosis moves"}) || len(secondary.calls) != 1 {
+		t.Errorf("expected no fallback after streaming %v, got %d secondary calls", tokens, len(secondary.calls))
+	}
+	if status := chain.Status(); status[0].Failures != 2 {
+		t.Errorf("expected both primary failures counted, got %+v", status[0])
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":     0,
+		"2":    2 * time.Second,
+		"1.5":  1500 * time.Millisecond,
+		"0":    0,
+		"-3":   0,
+		"soon": 0,
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+	}
+	for value, want := range tests {
+		if got := parseRetryAfter(value); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", value, got, want)
+		}
+	}
+
+	// HTTP dates count from now, to the second
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(at); got < 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %s, want about a minute", at, got)
+	}
+}
+
+func TestSendWithRetryGivesUpOnLongRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	// Waiting two minutes is left to the next provider in the chain
+	_, err := sendWithRetry(context.Background(), server.URL, []byte(`{}`), nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.RetryAfter != 2*time.Minute {
+		t.Fatalf("expected a rate limit error asking for two minutes, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected no retry, got %d calls", calls.Load())
+	}
+}
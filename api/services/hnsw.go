@@ -0,0 +1,435 @@
+package services
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HNSWConfig tunes the graph: higher values give better recall for more memory and slower inserts
+type HNSWConfig struct {
+	M              int // neighbours per node on the upper layers (twice this on layer 0)
+	EfConstruction int // candidate list size while inserting
+	EfSearch       int // candidate list size while searching
+}
+
+func DefaultHNSWConfig() HNSWConfig {
+	return HNSWConfig{M: 16, EfConstruction: 200, EfSearch: 64}
+}
+
+// HNSWIndex is a Hierarchical Navigable Small World graph (Malkov & Yashunin) for
+// approximate nearest-neighbour search by cosine similarity. Removed vectors are
+// tombstoned and skipped, and the graph is rebuilt once half of it is tombstones.
+type HNSWIndex struct {
+	mu       sync.RWMutex
+	cfg      HNSWConfig
+	dim      int
+	nodes    []hnswNode
+	ids      map[string]int32
+	entry    int32
+	maxLevel int
+	deleted  int
+	rng      *rand.Rand
+}
+
+// hnswNode fields are exported for gob
+type hnswNode struct {
+	ID      string
+	Vector  []float32
+	Friends [][]int32 // neighbours per layer, from layer 0 up to the node's level
+	Deleted bool
+}
+
+// hnswFile is the on-disk form of an index
+type hnswFile struct {
+	Version  int
+	Config   HNSWConfig
+	Dim      int
+	Nodes    []hnswNode
+	Entry    int32
+	MaxLevel int
+	Deleted  int
+}
+
+const hnswFileVersion = 1
+
+func NewHNSWIndex(cfg HNSWConfig) *HNSWIndex {
+	defaults := DefaultHNSWConfig()
+	if cfg.M <= 1 {
+		cfg.M = defaults.M
+	}
+	if cfg.EfConstruction <= 0 {
+		cfg.EfConstruction = defaults.EfConstruction
+	}
+	if cfg.EfSearch <= 0 {
+		cfg.EfSearch = defaults.EfSearch
+	}
+	return &HNSWIndex{
+		cfg:   cfg,
+		ids:   make(map[string]int32),
+		entry: -1,
+		rng:   rand.New(rand.NewSource(42)),
+	}
+}
+
+func (h *HNSWIndex) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.ids)
+}
+
+func (h *HNSWIndex) Add(id string, vector []float64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(vector) == 0 {
+		return fmt.Errorf("empty vector")
+	}
+	if h.dim != 0 && len(vector) != h.dim {
+		return fmt.Errorf("vector has %d dimensions, index has %d", len(vector), h.dim)
+	}
+	h.dim = len(vector)
+
+	if old, ok := h.ids[id]; ok {
+		h.tombstone(old)
+	}
+	h.insert(id, normalize(vector))
+	h.compactIfNeeded()
+	return nil
+}
+
+func (h *HNSWIndex) Remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if idx, ok := h.ids[id]; ok {
+		h.tombstone(idx)
+		h.compactIfNeeded()
+	}
+}
+
+func (h *HNSWIndex) Search(query []float64, k int) ([]Match, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.ids) == 0 || k <= 0 {
+		return nil, nil
+	}
+	if len(query) != h.dim {
+		return nil, fmt.Errorf("query has %d dimensions, index has %d", len(query), h.dim)
+	}
+
+	q := normalize(query)
+	ep := h.entry
+	for level := h.maxLevel; level > 0; level-- {
+		ep = h.greedyClosest(q, ep, level)
+	}
+
+	// Tombstones still route the search, so widen it to have k live results left
+	ef := max(h.cfg.EfSearch, k) * len(h.nodes) / len(h.ids)
+	candidates := h.searchLayer(q, []int32{ep}, ef, 0)
+
+	matches := make([]Match, 0, k)
+	for _, c := range candidates {
+		if h.nodes[c.node].Deleted {
+			continue
+		}
+		matches = append(matches, Match{ID: h.nodes[c.node].ID, Score: 1 - c.dist})
+		if len(matches) == k {
+			break
+		}
+	}
+	return matches, nil
+}
+
+// Save writes the index to path atomically
+func (h *HNSWIndex) Save(path string) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = gob.NewEncoder(tmp).Encode(hnswFile{
+		Version:  hnswFileVersion,
+		Config:   h.cfg,
+		Dim:      h.dim,
+		Nodes:    h.nodes,
+		Entry:    h.entry,
+		MaxLevel: h.maxLevel,
+		Deleted:  h.deleted,
+	})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadHNSWIndex reads an index written by Save
+func LoadHNSWIndex(path string) (*HNSWIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file hnswFile
+	if err := gob.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if file.Version != hnswFileVersion {
+		return nil, fmt.Errorf("unsupported index version %d", file.Version)
+	}
+
+	h := NewHNSWIndex(file.Config)
+	h.dim = file.Dim
+	h.nodes = file.Nodes
+	h.entry = file.Entry
+	h.maxLevel = file.MaxLevel
+	h.deleted = file.Deleted
+	for i, node := range h.nodes {
+		if !node.Deleted {
+			h.ids[node.ID] = int32(i)
+		}
+	}
+	return h, nil
+}
+
+func (h *HNSWIndex) distance(q []float32, node int32) float64 {
+	return 1 - dot(q, h.nodes[node].Vector)
+}
+
+// maxFriends is the neighbour limit of a layer
+func (h *HNSWIndex) maxFriends(level int) int {
+	if level == 0 {
+		return 2 * h.cfg.M
+	}
+	return h.cfg.M
+}
+
+func (h *HNSWIndex) randomLevel() int {
+	levelMult := 1 / math.Log(float64(h.cfg.M))
+	return int(math.Floor(-math.Log(1-h.rng.Float64()) * levelMult))
+}
+
+func (h *HNSWIndex) insert(id string, vector []float32) {
+	level := h.randomLevel()
+	idx := int32(len(h.nodes))
+	h.nodes = append(h.nodes, hnswNode{
+		ID:      id,
+		Vector:  vector,
+		Friends: make([][]int32, level+1),
+	})
+	h.ids[id] = idx
+
+	if h.entry < 0 {
+		h.entry = idx
+		h.maxLevel = level
+		return
+	}
+
+	ep := h.entry
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.greedyClosest(vector, ep, l)
+	}
+
+	entryPoints := []int32{ep}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		candidates := h.searchLayer(vector, entryPoints, h.cfg.EfConstruction, l)
+		friends := h.selectNeighbours(candidates, h.maxFriends(l))
+		h.nodes[idx].Friends[l] = friends
+		for _, friend := range friends {
+			h.link(friend, idx, l)
+		}
+
+		entryPoints = entryPoints[:0]
+		for _, c := range candidates {
+			entryPoints = append(entryPoints, c.node)
+		}
+	}
+
+	if level > h.maxLevel {
+		h.entry = idx
+		h.maxLevel = level
+	}
+}
+
+// link adds to as a neighbour of from, dropping from's furthest neighbour when over the
+// layer's limit. (Re-running the neighbour heuristic here costs more than it gains.)
+func (h *HNSWIndex) link(from, to int32, level int) {
+	friends := append(h.nodes[from].Friends[level], to)
+	if len(friends) > h.maxFriends(level) {
+		worst, worstDist := 0, -1.0
+		for i, f := range friends {
+			if d := 1 - dot(h.nodes[from].Vector, h.nodes[f].Vector); d > worstDist {
+				worst, worstDist = i, d
+			}
+		}
+		friends[worst] = friends[len(friends)-1]
+		friends = friends[:len(friends)-1]
+	}
+	h.nodes[from].Friends[level] = friends
+}
+
+// selectNeighbours picks up to m neighbours from candidates sorted by distance, preferring
+// ones that are not already closer to a picked neighbour than to the node itself, so the
+// graph keeps links between clusters
+func (h *HNSWIndex) selectNeighbours(candidates []hnswCandidate, m int) []int32 {
+	picked := make([]int32, 0, m)
+	var skipped []int32
+	for _, c := range candidates {
+		if len(picked) == m {
+			break
+		}
+		diverse := true
+		for _, p := range picked {
+			if 1-dot(h.nodes[c.node].Vector, h.nodes[p].Vector) < c.dist {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			picked = append(picked, c.node)
+		} else {
+			skipped = append(skipped, c.node)
+		}
+	}
+	for _, s := range skipped {
+		if len(picked) == m {
+			break
+		}
+		picked = append(picked, s)
+	}
+	return picked
+}
+
+// greedyClosest walks a layer towards the query from ep until no neighbour is closer
+func (h *HNSWIndex) greedyClosest(q []float32, ep int32, level int) int32 {
+	best := ep
+	bestDist := h.distance(q, ep)
+	for changed := true; changed; {
+		changed = false
+		for _, friend := range h.nodes[best].Friends[level] {
+			if d := h.distance(q, friend); d < bestDist {
+				best, bestDist = friend, d
+				changed = true
+			}
+		}
+	}
+	return best
+}
+
+// searchLayer returns up to ef nodes of a layer closest to the query, sorted by distance
+func (h *HNSWIndex) searchLayer(q []float32, entryPoints []int32, ef int, level int) []hnswCandidate {
+	visited := make(map[int32]bool, ef*4)
+	candidates := &hnswHeap{}       // closest first
+	results := &hnswHeap{max: true} // furthest first
+
+	for _, ep := range entryPoints {
+		if visited[ep] {
+			continue
+		}
+		visited[ep] = true
+		c := hnswCandidate{node: ep, dist: h.distance(q, ep)}
+		heap.Push(candidates, c)
+		heap.Push(results, c)
+	}
+
+	for candidates.Len() > 0 {
+		current := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && current.dist > results.items[0].dist {
+			break
+		}
+		for _, friend := range h.nodes[current.node].Friends[level] {
+			if visited[friend] {
+				continue
+			}
+			visited[friend] = true
+
+			d := h.distance(q, friend)
+			if results.Len() < ef || d < results.items[0].dist {
+				c := hnswCandidate{node: friend, dist: d}
+				heap.Push(candidates, c)
+				heap.Push(results, c)
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	sorted := make([]hnswCandidate, results.Len())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(results).(hnswCandidate)
+	}
+	return sorted
+}
+
+func (h *HNSWIndex) tombstone(idx int32) {
+	h.nodes[idx].Deleted = true
+	delete(h.ids, h.nodes[idx].ID)
+	h.deleted++
+}
+
+// compactIfNeeded rebuilds the graph from the live vectors once tombstones make up half of it
+func (h *HNSWIndex) compactIfNeeded() {
+	if h.deleted < 64 || h.deleted*2 < len(h.nodes) {
+		return
+	}
+
+	live := make([]hnswNode, 0, len(h.ids))
+	for _, node := range h.nodes {
+		if !node.Deleted {
+			live = append(live, node)
+		}
+	}
+
+	h.nodes = nil
+	h.ids = make(map[string]int32, len(live))
+	h.entry = -1
+	h.maxLevel = 0
+	h.deleted = 0
+	for _, node := range live {
+		h.insert(node.ID, node.Vector)
+	}
+}
+
+type hnswCandidate struct {
+	node int32
+	dist float64
+}
+
+// hnswHeap is a binary heap of candidates, ordered closest first or, with max, furthest first
+type hnswHeap struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (hp *hnswHeap) Len() int { return len(hp.items) }
+func (hp *hnswHeap) Less(i, j int) bool {
+	if hp.max {
+		return hp.items[i].dist > hp.items[j].dist
+	}
+	return hp.items[i].dist < hp.items[j].dist
+}
+func (hp *hnswHeap) Swap(i, j int)      { hp.items[i], hp.items[j] = hp.items[j], hp.items[i] }
+func (hp *hnswHeap) Push(x interface{}) { hp.items = append(hp.items, x.(hnswCandidate)) }
+func (hp *hnswHeap) Pop() interface{} {
+	last := hp.items[len(hp.items)-1]
+	hp.items = hp.items[:len(hp.items)-1]
+	return last
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func randomVector(rng *rand.Rand, dim int) []float64 {
+	vector := make([]float64, dim)
+	for i := range vector {
+		vector[i] = rng.NormFloat64()
+	}
+	return vector
+}
+
+// recall is the share of the exact top k that the index found, over the queries
+func recall(t *testing.T, index, exact VectorStore, queries [][]float64, k int) float64 {
+	t.Helper()
+	found, total := 0, 0
+	for _, query := range queries {
+		want, _ := exact.Search(query, k)
+		got, err := index.Search(query, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[string]bool, len(got))
+		for _, match := range got {
+			ids[match.ID] = true
+		}
+		for _, match := range want {
+			if ids[match.ID] {
+				found++
+			}
+		}
+		total += len(want)
+	}
+	return float64(found) / float64(total)
+}
+
+// testIndexes fills an HNSW index and a brute force store with the same random vectors
+func testIndexes(rng *rand.Rand, n, dim int) (*HNSWIndex, *BruteForceStore) {
+	index, exact := NewHNSWIndex(DefaultHNSWConfig()), NewBruteForceStore()
+	for i := 0; i < n; i++ {
+		id, vector := fmt.Sprintf("chunk-%d", i), randomVector(rng, dim)
+		index.Add(id, vector)
+		exact.Add(id, vector)
+	}
+	return index, exact
+}
+
+func TestHNSWRecallAfterRemovals(t *testing.T) {
+	const n, dim, k = 1000, 32, 10
+	rng := rand.New(rand.NewSource(1))
+	index, exact := testIndexes(rng, n, dim)
+	queries := make([][]float64, 50)
+	for i := range queries {
+		queries[i] = randomVector(rng, dim)
+	}
+	if r := recall(t, index, exact, queries, k); r < 0.95 {
+		t.Errorf("recall %.3f", r)
+	}
+
+	// Tombstones: removed vectors and the old versions of replaced ones are never found
+	for i := 0; i < 300; i++ {
+		index.Remove(fmt.Sprintf("chunk-%d", i))
+		exact.Remove(fmt.Sprintf("chunk-%d", i))
+	}
+	for i := 300; i < 400; i++ {
+		id, vector := fmt.Sprintf("chunk-%d", i), randomVector(rng, dim)
+		index.Add(id, vector)
+		exact.Add(id, vector)
+	}
+	if index.Len() != exact.Len() || index.deleted != 400 || len(index.nodes) != n+100 {
+		t.Fatalf("expected 400 tombstones among %d nodes, got %d among %d (%d live)", n+100, index.deleted, len(index.nodes), index.Len())
+	}
+	if r := recall(t, index, exact, queries, k); r < 0.95 {
+		t.Errorf("recall with tombstones %.3f", r)
+	}
+	for _, query := range queries {
+		matches, _ := index.Search(query, k)
+		for _, match := range matches {
+			if _, ok := exact.vectors[match.ID]; !ok {
+				t.Fatalf("found removed vector %s", match.ID)
+			}
+		}
+	}
+
+	// Once half the graph is tombstones it is rebuilt from the live vectors
+	for i := 400; i < 550; i++ {
+		index.Remove(fmt.Sprintf("chunk-%d", i))
+		exact.Remove(fmt.Sprintf("chunk-%d", i))
+	}
+	if index.deleted != 0 || len(index.nodes) != exact.Len() || index.Len() != exact.Len() {
+		t.Fatalf("expected a compacted graph of %d nodes, got %d with %d tombstones", exact.Len(), len(index.nodes), index.deleted)
+	}
+	if r := recall(t, index, exact, queries, k); r < 0.95 {
+		t.Errorf("recall after compaction %.3f", r)
+	}
+}
+
+func TestHNSWSaveAndLoad(t *testing.T) {
+	const dim = 16
+	rng := rand.New(rand.NewSource(2))
+	index, _ := testIndexes(rng, 200, dim)
+	for i := 0; i < 20; i++ {
+		index.Remove(fmt.Sprintf("chunk-%d", i))
+	}
+
+	path := filepath.Join(t.TempDir(), "indexes", "course.hnsw")
+	if err := index.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadHNSWIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 180 || loaded.deleted != index.deleted || !reflect.DeepEqual(loaded.ids, index.ids) {
+		t.Fatalf("expected 180 vectors and %d tombstones, got %d and %d", index.deleted, loaded.Len(), loaded.deleted)
+	}
+	for i := 0; i < 20; i++ {
+		query := randomVector(rng, dim)
+		want, _ := index.Search(query, 5)
+		got, _ := loaded.Search(query, 5)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("loaded index found %+v, want %+v", got, want)
+		}
+	}
+
+	// The loaded index keeps taking vectors of the same size only
+	if err := loaded.Add("chunk-new", randomVector(rng, dim)); err != nil || loaded.Len() != 181 {
+		t.Errorf("add after load: %v, %d vectors", err, loaded.Len())
+	}
+	if err := loaded.Add("chunk-wide", randomVector(rng, dim+1)); err == nil {
+		t.Error("expected a vector of another size to be refused")
+	}
+}
@@ -0,0 +1,329 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlText collects the text of an HTML document block by block
+type htmlText struct {
+	blocks  []string
+	current strings.Builder
+	prefix  string // heading or list marker of the current block
+}
+
+// flush ends the current block
+func (t *htmlText) flush() {
+	text := strings.Join(strings.Fields(t.current.String()), " ")
+	t.current.Reset()
+	if text == "" {
+		return
+	}
+	t.blocks = append(t.blocks, t.prefix+text)
+	t.prefix = ""
+}
+
+func (t *htmlText) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		t.current.WriteString(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			t.walk(c)
+		}
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Noscript, atom.Template, atom.Head, atom.Svg, atom.Iframe, atom.Nav:
+		return
+
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		t.flush()
+		t.prefix = strings.Repeat("#", int(n.Data[1]-'0')) + " "
+		t.walkChildren(n)
+		t.flush()
+		t.prefix = ""
+
+	case atom.Li:
+		t.flush()
+		t.prefix = "- "
+		t.walkChildren(n)
+		t.flush()
+		t.prefix = ""
+
+	case atom.Table:
+		t.flush()
+		table := &tableBuilder{}
+		t.walkTable(n, table)
+		if md := table.markdown(); md != "" {
+			t.blocks = append(t.blocks, strings.TrimSpace(md))
+		}
+
+	case atom.Pre:
+		t.flush()
+		var pre strings.Builder
+		collectText(n, &pre)
+		if text := strings.Trim(pre.String(), "\n"); strings.TrimSpace(text) != "" {
+			t.blocks = append(t.blocks, "```\n"+text+"\n```")
+		}
+
+	case atom.Br:
+		t.current.WriteString(" ")
+
+	case atom.Figcaption:
+		// Captions are marked as such, so they stay with their figure or table
+		t.flush()
+		var caption strings.Builder
+		collectText(n, &caption)
+		text := strings.Join(strings.Fields(caption.String()), " ")
+		switch {
+		case text == "" || figureCaption.MatchString(text) || tableCaption.MatchString(text):
+		case n.Parent != nil && findElement(n.Parent, atom.Table) != nil:
+			text = "Table: " + text
+		default:
+			text = "Figure: " + text
+		}
+		if text != "" {
+			t.blocks = append(t.blocks, text)
+		}
+
+	case atom.Img:
+		// A figure's image stands for the figure when it has no caption
+		parent := n.Parent
+		if parent != nil && parent.DataAtom == atom.Figure && findElement(parent, atom.Figcaption) == nil {
+			if alt := strings.Join(strings.Fields(htmlAttr(n, "alt")), " "); alt != "" {
+				t.flush()
+				t.blocks = append(t.blocks, "Figure: "+alt)
+			}
+		}
+
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Aside, atom.Main, atom.Header, atom.Footer,
+		atom.Blockquote, atom.Ul, atom.Ol, atom.Dl, atom.Dt, atom.Dd, atom.Figure,
+		atom.Hr, atom.Body, atom.Html, atom.Address, atom.Caption:
+		t.flush()
+		t.walkChildren(n)
+		t.flush()
+
+	default:
+		t.walkChildren(n)
+	}
+}
+
+func (t *htmlText) walkChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		t.walk(c)
+	}
+}
+
+// walkTable collects the rows of a table, leaving out nested tables' structure
+func (t *htmlText) walkTable(n *html.Node, table *tableBuilder) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Tr:
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					collectText(cell, &table.cell)
+					table.endCell()
+				}
+			}
+			table.endRow()
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			t.walkTable(c, table)
+		case atom.Caption:
+			var caption strings.Builder
+			collectText(c, &caption)
+			if text := strings.Join(strings.Fields(caption.String()), " "); text != "" {
+				if !tableCaption.MatchString(text) {
+					text = "Table: " + text
+				}
+				t.blocks = append(t.blocks, text)
+			}
+		}
+	}
+}
+
+// findElement returns the first element of a kind below n
+func findElement(n *html.Node, kind atom.Atom) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == kind {
+			return c
+		}
+		if found := findElement(c, kind); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// collectText appends all the text below n, skipping scripts and styles
+func collectText(n *html.Node, b *strings.Builder) {
+	if n.Type == html.TextNode {
+		b.WriteString(n.Data)
+		return
+	}
+	if n.Type == html.ElementNode && (n.DataAtom == atom.Script || n.DataAtom == atom.Style) {
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		collectText(c, b)
+		if c.Type == html.ElementNode && c.DataAtom == atom.Br {
+			b.WriteString("\n")
+		}
+	}
+}
+
+// htmlToText converts an HTML document to text with Markdown headings, lists and tables
+func htmlToText(r io.Reader) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", err
+	}
+	var t htmlText
+	t.walk(doc)
+	t.flush()
+	return strings.Join(t.blocks, "\n\n"), nil
+}
+
+// ExtractHTML extracts a web page as a single page, leaving out scripts, styles and
+// navigation
+func ExtractHTML(filepath string) ([]PageText, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open HTML: %w", err)
+	}
+	defer f.Close()
+
+	text, err := htmlToText(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return []PageText{{Number: 1, Text: text}}, nil
+}
+
+// ExtractEPUB extracts an e-book, one page per document of its reading order. The table
+// of contents document is left out.
+func ExtractEPUB(filepath string) ([]PageText, error) {
+	archive, err := zip.OpenReader(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB: %w", err)
+	}
+	defer archive.Close()
+	entries, err := zipEntries(&archive.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB: %w", err)
+	}
+
+	// The container names the package document, which lists the content in reading order
+	container, ok := entries["META-INF/container.xml"]
+	if !ok {
+		return nil, fmt.Errorf("failed to open EPUB: no META-INF/container.xml")
+	}
+	data, err := readZipFile(container)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EPUB: %w", err)
+	}
+	var containerDoc struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(data, &containerDoc); err != nil || len(containerDoc.Rootfiles) == 0 {
+		return nil, fmt.Errorf("failed to parse EPUB container: %v", err)
+	}
+	packagePath := containerDoc.Rootfiles[0].FullPath
+
+	packageFile, ok := entries[packagePath]
+	if !ok {
+		return nil, fmt.Errorf("failed to open EPUB: no package document %s", packagePath)
+	}
+	data, err = readZipFile(packageFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EPUB: %w", err)
+	}
+	var packageDoc struct {
+		Items []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"manifest>item"`
+		ItemRefs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := xml.Unmarshal(data, &packageDoc); err != nil {
+		return nil, fmt.Errorf("failed to parse EPUB package: %w", err)
+	}
+
+	type manifestItem struct {
+		href      string
+		mediaType string
+		nav       bool
+	}
+	items := make(map[string]manifestItem, len(packageDoc.Items))
+	for _, item := range packageDoc.Items {
+		href, err := url.PathUnescape(item.Href)
+		if err != nil {
+			href = item.Href
+		}
+		items[item.ID] = manifestItem{
+			href:      path.Join(path.Dir(packagePath), href),
+			mediaType: item.MediaType,
+			nav:       strings.Contains(item.Properties, "nav"),
+		}
+	}
+
+	var pages []PageText
+	for _, ref := range packageDoc.ItemRefs {
+		item, ok := items[ref.IDRef]
+		if !ok || item.nav || (item.mediaType != "application/xhtml+xml" && item.mediaType != MIMEHTML) {
+			continue
+		}
+		file, ok := entries[item.href]
+		if !ok {
+			continue
+		}
+		content, err := readZipFile(file)
+		if errors.Is(err, ErrArchiveTooLarge) {
+			return nil, fmt.Errorf("failed to read EPUB: %w", err)
+		}
+		if err != nil {
+			continue
+		}
+		text, err := htmlToText(bytes.NewReader(content))
+		if err != nil || strings.TrimSpace(text) == "" {
+			continue
+		}
+		pages = append(pages, PageText{Number: len(pages) + 1, Text: text})
+	}
+	return pages, nil
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,7 +21,7 @@ type ImageSearchResult struct {
 
 // SearchWebImages provides placeholder images using Picsum Photos (no API key needed)
 // For production, replace with a proper image search API like Pexels or Unsplash with your own API key
-func SearchWebImages(query string) (*ImageSearchResult, error) {
+func SearchWebImages(ctx context.Context, query string) (*ImageSearchResult, error) {
 	// Picsum Photos - Free placeholder images, no auth required
 	// Generates a random image with seed based on query for consistency
 	// Size: 1280x720 (16:9 aspect ratio, perfect for slides)
@@ -52,12 +53,34 @@ func hashString(s string) int {
 	return hash % 10000 // Limit to reasonable range
 }
 
+// ImageModel is the DALL-E model slide images are generated with
+const ImageModel = "dall-e-3"
+
+// ImageProvider generates slide images from a prompt, returning the image URL
+type ImageProvider interface {
+	GenerateImage(ctx context.Context, prompt string) (string, error)
+	GetProviderName() string
+	GetModelName() string
+}
+
+// DalleImages implements image generation with OpenAI's DALL-E
+type DalleImages struct {
+	APIKey string
+}
+
+func (d *DalleImages) GetProviderName() string { return "openai" }
+func (d *DalleImages) GetModelName() string    { return ImageModel }
+
 // GenerateImage generates an image using DALL-E
-func GenerateImage(apiKey, prompt string) (string, error) {
+func (d *DalleImages) GenerateImage(ctx context.Context, prompt string) (string, error) {
+	if err := CheckUsage(ctx, Usage{Provider: "openai", Model: ImageModel, Kind: UsageImage, Images: 1}); err != nil {
+		return "", err
+	}
+
 	url := "https://api.openai.com/v1/images/generations"
 
 	reqBody := map[string]interface{}{
-		"model":   "dall-e-3",
+		"model":   ImageModel,
 		"prompt":  prompt,
 		"n":       1,
 		"size":    "1024x1024",
@@ -69,13 +92,13 @@ func GenerateImage(apiKey, prompt string) (string, error) {
 		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", d.APIKey))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -106,14 +129,15 @@ func GenerateImage(apiKey, prompt string) (string, error) {
 	if len(result.Data) == 0 {
 		return "", fmt.Errorf("no image data in response")
 	}
+	RecordUsage(ctx, Usage{Provider: "openai", Model: ImageModel, Kind: UsageImage, Images: len(result.Data)})
 
 	return result.Data[0].URL, nil
 }
 
 // GetImageForSlide intelligently fetches an image based on preferences
 // useWebImages: try web search first
-// useDalle: use DALL-E as fallback or primary
-func GetImageForSlide(imagePrompt string, useWebImages bool, useDalle bool, apiKey string) (string, error) {
+// useDalle: generate one with images as fallback or primary; nil when none is configured
+func GetImageForSlide(ctx context.Context, imagePrompt string, useWebImages bool, useDalle bool, images ImageProvider) (string, error) {
 	if imagePrompt == "" {
 		return "", nil
 	}
@@ -127,7 +151,7 @@ func GetImageForSlide(imagePrompt string, useWebImages bool, useDalle bool, apiK
 		searchQuery := extractSearchTerms(imagePrompt)
 		log.Info().Str("search_query", searchQuery).Msg("Searching for web image")
 
-		result, webErr := SearchWebImages(searchQuery)
+		result, webErr := SearchWebImages(ctx, searchQuery)
 		if webErr == nil && result != nil {
 			imageURL = result.URL
 			log.Info().Str("url", imageURL).Str("author", result.Author).Msg("Found web image")
@@ -138,11 +162,11 @@ func GetImageForSlide(imagePrompt string, useWebImages bool, useDalle bool, apiK
 	}
 
 	// If web search failed or wasn't enabled, try DALL-E
-	if imageURL == "" && useDalle && apiKey != "" {
-		log.Info().Msg("Using DALL-E for image generation")
-		imageURL, err = GenerateImage(apiKey, imagePrompt)
+	if imageURL == "" && useDalle && images != nil && ctx.Err() == nil {
+		log.Info().Str("model", images.GetModelName()).Msg("Generating image")
+		imageURL, err = images.GenerateImage(ctx, imagePrompt)
 		if err != nil {
-			log.Warn().Err(err).Msg("DALL-E generation failed")
+			log.Warn().Err(err).Str("model", images.GetModelName()).Msg("Image generation failed")
 		}
 	}
 
@@ -0,0 +1,85 @@
+package services
+
+// GroupTexts packs consecutive texts into groups whose combined length stays within
+// maxChars. A single text longer than maxChars gets a group of its own.
+// The result holds the indices of the texts in each group.
+func GroupTexts(texts []string, maxChars int) [][]int {
+	var groups [][]int
+	var current []int
+	currentLen := 0
+
+	for i, text := range texts {
+		if len(current) > 0 && currentLen+len(text) > maxChars {
+			groups = append(groups, current)
+			current = nil
+			currentLen = 0
+		}
+		current = append(current, i)
+		currentLen += len(text)
+	}
+
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+
+	return groups
+}
+
+// AllocateSlides distributes total slides across sections proportionally to their
+// weights using the largest remainder method. Every section gets at least one
+// slide as long as there are enough slides to go around.
+func AllocateSlides(weights []int, total int) []int {
+	allocation := make([]int, len(weights))
+	if len(weights) == 0 || total <= 0 {
+		return allocation
+	}
+
+	remaining := total
+	if total >= len(weights) {
+		for i := range allocation {
+			allocation[i] = 1
+		}
+		remaining -= len(weights)
+	}
+
+	weightSum := 0
+	for _, w := range weights {
+		if w > 0 {
+			weightSum += w
+		}
+	}
+	if weightSum == 0 {
+		// No size information - spread evenly
+		for i := 0; i < remaining; i++ {
+			allocation[i%len(allocation)]++
+		}
+		return allocation
+	}
+
+	remainders := make([]float64, len(weights))
+	assigned := 0
+	for i, w := range weights {
+		if w < 0 {
+			w = 0
+		}
+		share := float64(remaining) * float64(w) / float64(weightSum)
+		allocation[i] += int(share)
+		assigned += int(share)
+		remainders[i] = share - float64(int(share))
+	}
+
+	// Hand out what is left to the largest remainders, earlier sections first on ties
+	for assigned < remaining {
+		best := 0
+		for i := range remainders {
+			if remainders[i] > remainders[best] {
+				best = i
+			}
+		}
+		allocation[best]++
+		remainders[best] = -1
+		assigned++
+	}
+
+	return allocation
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MIME types of the images that can be recognized
+const (
+	MIMEPNG  = "image/png"
+	MIMEJPEG = "image/jpeg"
+)
+
+// Defaults of the OCR tools
+const (
+	DefaultOCRLanguages = "eng"
+	DefaultOCRDPI       = 300
+	DefaultOCRTimeout   = 2 * time.Minute // per page or image
+)
+
+// OCRResult is the text recognized in an image
+type OCRResult struct {
+	Text       string
+	Confidence float64 // mean confidence of the recognized words, from 0 to 1
+}
+
+// OCREngine recognizes the text of images
+type OCREngine interface {
+	Recognize(ctx context.Context, imagePath string) (OCRResult, error)
+	GetEngineName() string
+}
+
+// PageRenderer renders a page of a PDF to an image in dir and returns the image's path
+type PageRenderer interface {
+	RenderPage(ctx context.Context, pdfPath string, page int, dir string) (string, error)
+}
+
+// Tesseract recognizes text with the tesseract command line tool
+type Tesseract struct {
+	Binary    string        // path of the tesseract binary, "tesseract" to look it up
+	Languages string        // tesseract language codes, e.g. "eng+deu"
+	Timeout   time.Duration // per image, 0 for none
+}
+
+// NewTesseract finds the tesseract binary, failing when it is not installed
+func NewTesseract(binary, languages string) (*Tesseract, error) {
+	if binary == "" {
+		binary = "tesseract"
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("tesseract not found: %w", err)
+	}
+	if languages == "" {
+		languages = DefaultOCRLanguages
+	}
+	return &Tesseract{Binary: path, Languages: languages, Timeout: DefaultOCRTimeout}, nil
+}
+
+func (t *Tesseract) GetEngineName() string {
+	return "tesseract"
+}
+
+// Recognize runs tesseract with TSV output, which gives the layout and the confidence of
+// every word
+func (t *Tesseract) Recognize(ctx context.Context, imagePath string) (OCRResult, error) {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+	output, err := runTool(ctx, t.Binary, imagePath, "stdout", "-l", t.Languages, "tsv")
+	if err != nil {
+		return OCRResult{}, err
+	}
+	return parseTesseractTSV(output)
+}
+
+// parseTesseractTSV rebuilds the text from tesseract's word boxes: words of a line are
+// joined by spaces, lines by newlines and paragraphs by blank lines
+func parseTesseractTSV(output []byte) (OCRResult, error) {
+	var b strings.Builder
+	var confidence float64
+	words := 0
+	lastBlock, lastParagraph, lastLine := -1, -1, -1
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	header := true
+	for scanner.Scan() {
+		if header {
+			// level page_num block_num par_num line_num word_num left top width height conf text
+			header = false
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 12 || fields[0] != "5" { // level 5 is a word
+			continue
+		}
+		text := strings.TrimSpace(fields[11])
+		conf, err := strconv.ParseFloat(fields[10], 64)
+		if text == "" || err != nil || conf < 0 {
+			continue
+		}
+		block, _ := strconv.Atoi(fields[2])
+		paragraph, _ := strconv.Atoi(fields[3])
+		line, _ := strconv.Atoi(fields[4])
+
+		switch {
+		case words == 0:
+		case block != lastBlock || paragraph != lastParagraph:
+			b.WriteString("\n\n")
+		case line != lastLine:
+			b.WriteString("\n")
+		default:
+			b.WriteString(" ")
+		}
+		b.WriteString(text)
+		lastBlock, lastParagraph, lastLine = block, paragraph, line
+		confidence += conf
+		words++
+	}
+	if err := scanner.Err(); err != nil {
+		return OCRResult{}, fmt.Errorf("failed to read tesseract output: %w", err)
+	}
+	if words == 0 {
+		return OCRResult{}, nil
+	}
+	return OCRResult{Text: b.String(), Confidence: confidence / float64(words) / 100}, nil
+}
+
+// Pdftoppm renders PDF pages to PNG images with poppler's pdftoppm
+type Pdftoppm struct {
+	Binary  string // path of the pdftoppm binary, "pdftoppm" to look it up
+	DPI     int
+	Timeout time.Duration // per page, 0 for none
+}
+
+// NewPdftoppm finds the pdftoppm binary, failing when it is not installed
+func NewPdftoppm(binary string, dpi int) (*Pdftoppm, error) {
+	if binary == "" {
+		binary = "pdftoppm"
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("pdftoppm not found: %w", err)
+	}
+	if dpi <= 0 {
+		dpi = DefaultOCRDPI
+	}
+	return &Pdftoppm{Binary: path, DPI: dpi, Timeout: DefaultOCRTimeout}, nil
+}
+
+func (p *Pdftoppm) RenderPage(ctx context.Context, pdfPath string, page int, dir string) (string, error) {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	prefix := filepath.Join(dir, fmt.Sprintf("page-%d", page))
+	number := strconv.Itoa(page)
+	if _, err := runTool(ctx, p.Binary, "-f", number, "-l", number, "-r", strconv.Itoa(p.DPI), "-png", "-singlefile", pdfPath, prefix); err != nil {
+		return "", err
+	}
+	return prefix + ".png", nil
+}
+
+// runTool runs a command line tool and returns what it wrote to stdout, or an error
+// holding what it wrote to stderr
+func runTool(ctx context.Context, binary string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(binary), ctx.Err())
+		}
+		return nil, fmt.Errorf("%s failed: %w: %s", filepath.Base(binary), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// OCR recognizes the text of images, and of the PDF pages that have no text layer
+type OCR struct {
+	Engine   OCREngine
+	Renderer PageRenderer // nil when PDF pages can't be rendered, then only images are read
+	MaxPages int          // PDF pages recognized per document, 0 for no limit
+}
+
+// RegisterImages registers extractors for PNG and JPEG images, whose text Recognize reads
+func (o *OCR) RegisterImages(r *ExtractorRegistry) {
+	r.Register(MIMEPNG, ImageExtractor{})
+	r.Register(MIMEJPEG, ImageExtractor{})
+}
+
+// Recognize runs the unread pages of an extracted document through the OCR engine: the
+// image itself for PNG and JPEG files, and the pages without text for PDFs
+func (o *OCR) Recognize(ctx context.Context, path string, doc *Document) error {
+	switch doc.MimeType {
+	case MIMEPDF:
+		return o.RecognizePages(ctx, path, doc)
+	case MIMEPNG, MIMEJPEG:
+		return o.recognizeImage(ctx, path, doc)
+	}
+	return nil
+}
+
+// RecognizePages runs the pages of an extracted PDF that failed, came out empty or look
+// scanned through the OCR engine, and adds their text to the document. A page that had a
+// little text gets the recognized text instead. Pages that can't be recognized are skipped
+// and their errors returned together.
+func (o *OCR) RecognizePages(ctx context.Context, pdfPath string, doc *Document) error {
+	if o.Renderer == nil {
+		return nil
+	}
+	pages := unreadPages(doc.Report)
+	if o.MaxPages > 0 && len(pages) > o.MaxPages {
+		pages = pages[:o.MaxPages]
+	}
+	if len(pages) == 0 {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "ocr-")
+	if err != nil {
+		return fmt.Errorf("failed to create OCR directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var errs []error
+	for _, number := range pages {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		image, err := o.Renderer.RenderPage(ctx, pdfPath, number, dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("page %d: %w", number, err))
+			continue
+		}
+		result, err := o.Engine.Recognize(ctx, image)
+		os.Remove(image)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("page %d: %w", number, err))
+			continue
+		}
+		if strings.TrimSpace(result.Text) == "" {
+			continue
+		}
+
+		page := PageText{Number: number, Text: result.Text, Recognized: true, Confidence: result.Confidence}
+		replaced := false
+		for i := range doc.Pages {
+			if doc.Pages[i].Number == number {
+				doc.Pages[i] = page
+				replaced = true
+			}
+		}
+		if !replaced {
+			doc.Pages = append(doc.Pages, page)
+		}
+		doc.Report.OCRPages = append(doc.Report.OCRPages, number)
+	}
+	sort.SliceStable(doc.Pages, func(i, j int) bool { return doc.Pages[i].Number < doc.Pages[j].Number })
+	return errors.Join(errs...)
+}
+
+// unreadPages lists the failed, empty and scanned pages of a report, in order
+func unreadPages(report ExtractionReport) []int {
+	seen := make(map[int]bool)
+	var pages []int
+	for _, list := range [][]int{report.FailedPages, report.EmptyPages, report.ScannedPages} {
+		for _, page := range list {
+			if !seen[page] {
+				seen[page] = true
+				pages = append(pages, page)
+			}
+		}
+	}
+	sort.Ints(pages)
+	return pages
+}
+
+// recognizeImage reads the text of an image, such as a photo of a whiteboard, as the only
+// page of its document
+func (o *OCR) recognizeImage(ctx context.Context, path string, doc *Document) error {
+	result, err := o.Engine.Recognize(ctx, path)
+	if err != nil {
+		return fmt.Errorf("failed to recognize image: %w", err)
+	}
+	if strings.TrimSpace(result.Text) == "" {
+		doc.Report.EmptyPages = []int{1}
+		return nil
+	}
+	doc.Pages = []PageText{{Number: 1, Text: result.Text, Recognized: true, Confidence: result.Confidence}}
+	doc.Report.OCRPages = []int{1}
+	return nil
+}
+
+// ImageExtractor accepts an image as a single scanned page; its text is left to
+// OCR.Recognize, which runs with the request's context
+type ImageExtractor struct{}
+
+func (e ImageExtractor) Extract(path string) ([]PageText, error) {
+	return nil, nil
+}
+
+func (e ImageExtractor) ExtractDocument(path string) (*Document, error) {
+	return &Document{Report: ExtractionReport{Pages: 1, ScannedPages: []int{1}}}, nil
+}
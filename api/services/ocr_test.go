@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTesseractTSV(t *testing.T) {
+	rows := []string{
+		"level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext",
+		"1\t1\t0\t0\t0\t0\t0\t0\t1200\t900\t-1\t",
+		"2\t1\t1\t0\t0\t0\t40\t30\t600\t80\t-1\t",
+		"5\t1\t1\t1\t1\t1\t40\t30\t120\t20\t96\tOsmosis",
+		"5\t1\t1\t1\t1\t2\t170\t30\t60\t20\t90\tmoves",
+		"5\t1\t1\t1\t2\t1\t40\t60\t80\t20\t94\twater.",
+		"5\t1\t1\t1\t2\t2\t130\t60\t10\t20\t-1\t ",
+		"5\t1\t2\t1\t1\t1\t40\t200\t90\t20\t80\tPressure",
+	}
+	result, err := parseTesseractTSV([]byte(strings.Join(rows, "\n") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Osmosis moves\nwater.\n\nPressure"; result.Text != want {
+		t.Errorf("got %q, want %q", result.Text, want)
+	}
+	if want := (96.0 + 90 + 94 + 80) / 4 / 100; math.Abs(result.Confidence-want) > 1e-9 {
+		t.Errorf("confidence %v, want %v", result.Confidence, want)
+	}
+
+	result, err = parseTesseractTSV([]byte(rows[0] + "\n" + rows[1] + "\n"))
+	if err != nil || result.Text != "" || result.Confidence != 0 {
+		t.Errorf("expected nothing from a blank image, got %+v, %v", result, err)
+	}
+}
+
+// failingRenderer fails on one page and renders the others with FakePageRenderer
+type failingRenderer struct {
+	page int
+}
+
+func (r failingRenderer) RenderPage(ctx context.Context, pdfPath string, page int, dir string) (string, error) {
+	if page == r.page {
+		return "", errors.New("render failed")
+	}
+	return (&FakePageRenderer{}).RenderPage(ctx, pdfPath, page, dir)
+}
+
+func TestOCRRecognizesUnreadPages(t *testing.T) {
+	page1 := pdfText([4]string{"50", "740", "10", "Diffusion needs no energy."})
+	scanned := "q 500 0 0 700 50 50 cm /Im1 Do Q"
+	path := writeFile(t, "scan.pdf", string(buildPDF([]string{page1, scanned, "", scanned}, "", "")))
+	doc, err := ExtractPDF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ocr := &OCR{Engine: &FakeOCR{}, Renderer: failingRenderer{page: 4}}
+	err = ocr.RecognizePages(context.Background(), path, doc)
+	if err == nil || !strings.Contains(err.Error(), "page 4") {
+		t.Errorf("expected the error of page 4, got %v", err)
+	}
+	if want := []int{2, 3}; !reflect.DeepEqual(doc.Report.OCRPages, want) {
+		t.Errorf("OCR pages %v, want %v", doc.Report.OCRPages, want)
+	}
+
+	want := []PageText{
+		{Number: 1, Text: "Diffusion needs no energy."},
+		{Number: 2, Text: "Scanned page 2 of scan.pdf.", Recognized: true, Confidence: fakeOCRConfidence},
+		{Number: 3, Text: "Scanned page 3 of scan.pdf.", Recognized: true, Confidence: fakeOCRConfidence},
+	}
+	if !reflect.DeepEqual(doc.Pages, want) {
+		t.Errorf("pages %+v\nwant %+v", doc.Pages, want)
+	}
+
+	// Chunks take the confidence of the recognized pages they contain
+	chunks := ChunkPages(doc.Pages, ChunkOptions{Size: 30, Overlap: 0, Unit: ChunkUnitChars})
+	if len(chunks) != 3 {
+		t.Fatalf("expected a chunk per page, got %+v", chunks)
+	}
+	if chunks[0].Recognized || !chunks[1].Recognized || chunks[1].Confidence != fakeOCRConfidence {
+		t.Errorf("unexpected chunk confidence: %+v", chunks)
+	}
+}
+
+func TestOCRReadsPNGText(t *testing.T) {
+	dir := t.TempDir()
+	image, err := (&FakePageRenderer{}).RenderPage(context.Background(), "board.pdf", 1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType, _ := DetectMIMEType(image); mimeType != MIMEPNG {
+		t.Fatalf("detected %s", mimeType)
+	}
+
+	ocr := &OCR{Engine: &FakeOCR{}}
+	registry := NewExtractorRegistry()
+	ocr.RegisterImages(registry)
+	doc, err := registry.Extract(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Pages) != 0 || !reflect.DeepEqual(doc.Report.ScannedPages, []int{1}) {
+		t.Fatalf("expected the image to wait for OCR, got %+v", doc)
+	}
+	// The engine runs with the caller's context
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ocr.Recognize(canceled, image, doc); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled upload to stop OCR, got %v", err)
+	}
+	if err := ocr.Recognize(context.Background(), image, doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Pages) != 1 || doc.Pages[0].Text != "Scanned page 1 of board.pdf." || !doc.Pages[0].Recognized {
+		t.Errorf("unexpected pages %+v", doc.Pages)
+	}
+	if !reflect.DeepEqual(doc.Report.OCRPages, []int{1}) {
+		t.Errorf("unexpected report %+v", doc.Report)
+	}
+}
@@ -0,0 +1,441 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// relationshipsNS is the namespace of the r:id attributes linking Office parts together
+const relationshipsNS = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+
+// tableBuilder collects the cells of a table and writes it as a Markdown table
+type tableBuilder struct {
+	rows [][]string
+	row  []string
+	cell strings.Builder
+}
+
+func (t *tableBuilder) endCell() {
+	t.row = append(t.row, strings.Join(strings.Fields(t.cell.String()), " "))
+	t.cell.Reset()
+}
+
+func (t *tableBuilder) endRow() {
+	if len(t.row) > 0 {
+		t.rows = append(t.rows, t.row)
+	}
+	t.row = nil
+}
+
+// markdown writes the table with its first row as the header
+func (t *tableBuilder) markdown() string {
+	if len(t.rows) == 0 {
+		return ""
+	}
+	columns := 0
+	for _, row := range t.rows {
+		columns = max(columns, len(row))
+	}
+
+	var b strings.Builder
+	for i, row := range t.rows {
+		cells := make([]string, columns)
+		for j := range cells {
+			if j < len(row) {
+				cells[j] = strings.ReplaceAll(row[j], "|", `\|`)
+			}
+		}
+		b.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString(strings.Repeat("| --- ", columns) + "|\n")
+		}
+	}
+	return b.String()
+}
+
+var headingStyle = regexp.MustCompile(`(?i)^heading ?([1-9])$`)
+
+// docxHeadingLevel returns the heading level of a Word paragraph style, or 0
+func docxHeadingLevel(style string) int {
+	if strings.EqualFold(style, "Title") {
+		return 1
+	}
+	if m := headingStyle.FindStringSubmatch(style); m != nil {
+		level, _ := strconv.Atoi(m[1])
+		return min(level, 6)
+	}
+	return 0
+}
+
+func xmlAttr(element xml.StartElement, local string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// ExtractDOCX extracts a Word document. Pages are split where Word last laid out a page
+// break, or at manual page breaks; headings, list items and tables keep their structure.
+func ExtractDOCX(filepath string) ([]PageText, error) {
+	archive, err := zip.OpenReader(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DOCX: %w", err)
+	}
+	defer archive.Close()
+
+	entries, err := zipEntries(&archive.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DOCX: %w", err)
+	}
+	document, ok := entries["word/document.xml"]
+	if !ok {
+		return nil, fmt.Errorf("failed to open DOCX: no word/document.xml")
+	}
+	data, err := readZipFile(document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DOCX: %w", err)
+	}
+	return parseDOCX(data)
+}
+
+func parseDOCX(data []byte) ([]PageText, error) {
+	var pages []PageText
+	var page, para strings.Builder
+	var tables []*tableBuilder
+	prefix := ""
+	inText := false
+	breakAfter := false
+	depth := 0 // paragraphs in text boxes are nested in the paragraph anchoring them
+
+	flushPage := func() {
+		if text := strings.TrimSpace(page.String()); text != "" {
+			pages = append(pages, PageText{Number: len(pages) + 1, Text: text})
+		}
+		page.Reset()
+	}
+	pageBreak := func() {
+		if strings.TrimSpace(para.String()) == "" {
+			flushPage()
+		} else {
+			breakAfter = true
+		}
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DOCX: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				depth++
+				if depth == 1 {
+					para.Reset()
+					prefix = ""
+				}
+			case "pStyle":
+				if level := docxHeadingLevel(xmlAttr(t, "val")); level > 0 {
+					prefix = strings.Repeat("#", level) + " "
+				}
+			case "numPr":
+				if prefix == "" {
+					prefix = "- "
+				}
+			case "t":
+				inText = true
+			case "tab":
+				para.WriteString("\t")
+			case "br", "cr":
+				if xmlAttr(t, "type") == "page" {
+					pageBreak()
+				} else {
+					para.WriteString(" ")
+				}
+			case "lastRenderedPageBreak":
+				pageBreak()
+			case "tbl":
+				tables = append(tables, &tableBuilder{})
+			}
+
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				depth--
+				if depth > 0 {
+					para.WriteString(" ")
+					continue
+				}
+				text := strings.TrimSpace(para.String())
+				para.Reset()
+				switch {
+				case len(tables) > 0:
+					tables[len(tables)-1].cell.WriteString(text + " ")
+				case text != "":
+					page.WriteString(prefix + text + "\n\n")
+				}
+				if breakAfter {
+					flushPage()
+					breakAfter = false
+				}
+			case "tc":
+				if len(tables) > 0 {
+					tables[len(tables)-1].endCell()
+				}
+			case "tr":
+				if len(tables) > 0 {
+					tables[len(tables)-1].endRow()
+				}
+			case "tbl":
+				if len(tables) > 0 {
+					table := tables[len(tables)-1]
+					tables = tables[:len(tables)-1]
+					if len(tables) > 0 {
+						// A nested table becomes part of the cell holding it
+						tables[len(tables)-1].cell.WriteString(table.markdown())
+					} else if md := table.markdown(); md != "" {
+						page.WriteString(md + "\n")
+					}
+				}
+			}
+
+		case xml.CharData:
+			if inText {
+				para.Write(t)
+			}
+		}
+	}
+	flushPage()
+	return pages, nil
+}
+
+// officeRelationships maps the relationship IDs of an Office part to the paths of the
+// parts they point to, and to the types of the relationships
+func officeRelationships(entries map[string]*zip.File, part string) (map[string]string, map[string]string) {
+	targets := make(map[string]string)
+	types := make(map[string]string)
+	relsFile, ok := entries[path.Join(path.Dir(part), "_rels", path.Base(part)+".rels")]
+	if !ok {
+		return targets, types
+	}
+	data, err := readZipFile(relsFile)
+	if err != nil {
+		return targets, types
+	}
+
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Type   string `xml:"Type,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := xml.Unmarshal(data, &rels); err != nil {
+		return targets, types
+	}
+	for _, rel := range rels.Relationships {
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join(path.Dir(part), target)
+		}
+		targets[rel.ID] = target
+		types[rel.ID] = rel.Type
+	}
+	return targets, types
+}
+
+// ExtractPPTX extracts a PowerPoint deck, one page per slide in presentation order: the
+// slide title as a heading, its text and tables, then its speaker notes
+func ExtractPPTX(filepath string) ([]PageText, error) {
+	archive, err := zip.OpenReader(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PPTX: %w", err)
+	}
+	defer archive.Close()
+	entries, err := zipEntries(&archive.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PPTX: %w", err)
+	}
+
+	presentation, ok := entries["ppt/presentation.xml"]
+	if !ok {
+		return nil, fmt.Errorf("failed to open PPTX: no ppt/presentation.xml")
+	}
+	data, err := readZipFile(presentation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PPTX: %w", err)
+	}
+
+	// The slide list references slides by relationship ID
+	var slideIDs []string
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PPTX: %w", err)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "sldId" {
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "id" && attr.Name.Space == relationshipsNS {
+					slideIDs = append(slideIDs, attr.Value)
+				}
+			}
+		}
+	}
+	targets, _ := officeRelationships(entries, "ppt/presentation.xml")
+
+	var pages []PageText
+	for i, id := range slideIDs {
+		slidePath := targets[id]
+		slideFile, ok := entries[slidePath]
+		if !ok {
+			continue
+		}
+		slideData, err := readZipFile(slideFile)
+		if errors.Is(err, ErrArchiveTooLarge) {
+			return nil, fmt.Errorf("failed to read PPTX: %w", err)
+		}
+		if err != nil {
+			continue
+		}
+		title, body := parsePPTXText(slideData)
+
+		var notes string
+		slideTargets, slideTypes := officeRelationships(entries, slidePath)
+		for relID, relType := range slideTypes {
+			if !strings.HasSuffix(relType, "/notesSlide") {
+				continue
+			}
+			if notesFile, ok := entries[slideTargets[relID]]; ok {
+				if notesData, err := readZipFile(notesFile); err == nil {
+					_, notes = parsePPTXText(notesData)
+				}
+			}
+		}
+
+		var text strings.Builder
+		if title != "" {
+			text.WriteString("# " + title + "\n\n")
+		}
+		if body != "" {
+			text.WriteString(body + "\n\n")
+		}
+		if notes != "" {
+			text.WriteString("Speaker notes:\n" + notes + "\n")
+		}
+		if strings.TrimSpace(text.String()) != "" {
+			pages = append(pages, PageText{Number: i + 1, Text: strings.TrimSpace(text.String())})
+		}
+	}
+	return pages, nil
+}
+
+// parsePPTXText returns the title and the remaining text of a slide or notes page. Slide
+// numbers, dates, footers and the slide thumbnail on notes pages are left out.
+func parsePPTXText(data []byte) (string, string) {
+	var titles, body []string
+	var para strings.Builder
+	var shapeParas []string
+	var tables []*tableBuilder
+	isTitle, skip, inText := false, false, false
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "sp":
+				shapeParas = nil
+				isTitle, skip = false, false
+			case "ph":
+				switch xmlAttr(t, "type") {
+				case "title", "ctrTitle":
+					isTitle = true
+				case "sldNum", "dt", "ftr", "hdr", "sldImg":
+					skip = true
+				}
+			case "p":
+				para.Reset()
+			case "t":
+				inText = true
+			case "br":
+				para.WriteString(" ")
+			case "tbl":
+				tables = append(tables, &tableBuilder{})
+			}
+
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text := strings.Join(strings.Fields(para.String()), " ")
+				switch {
+				case len(tables) > 0:
+					tables[len(tables)-1].cell.WriteString(text + " ")
+				case text != "":
+					shapeParas = append(shapeParas, text)
+				}
+			case "sp":
+				switch {
+				case skip:
+				case isTitle:
+					titles = append(titles, strings.Join(shapeParas, " "))
+				default:
+					body = append(body, shapeParas...)
+				}
+				shapeParas = nil
+			case "tc":
+				if len(tables) > 0 {
+					tables[len(tables)-1].endCell()
+				}
+			case "tr":
+				if len(tables) > 0 {
+					tables[len(tables)-1].endRow()
+				}
+			case "tbl":
+				if len(tables) > 0 {
+					table := tables[len(tables)-1]
+					tables = tables[:len(tables)-1]
+					if md := table.markdown(); md != "" {
+						body = append(body, "\n"+strings.TrimSpace(md))
+					}
+				}
+			}
+
+		case xml.CharData:
+			if inText {
+				para.Write(t)
+			}
+		}
+	}
+	return strings.Join(titles, " - "), strings.TrimSpace(strings.Join(body, "\n"))
+}
@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OllamaProvider implements a local model served by Ollama's chat API
+type OllamaProvider struct {
+	Host   string
+	Model  string
+	NumCtx int // context window in tokens; Ollama's own default truncates long course prompts
+}
+
+const defaultOllamaNumCtx = 16384
+
+func (ol *OllamaProvider) GetProviderName() string {
+	return "ollama"
+}
+
+type ollamaChatResponse struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	Error           string `json:"error"`
+	PromptEvalCount int    `json:"prompt_eval_count"` // token counts, in the final object
+	EvalCount       int    `json:"eval_count"`
+}
+
+// recordUsage reports the token counts of a chat; local models cost nothing but the
+// ledger still shows how much work they did
+func (ol *OllamaProvider) recordUsage(ctx context.Context, final ollamaChatResponse, prompt, systemPrompt, output string) {
+	recordTextUsage(ctx, ol.GetProviderName(), ol.Model, final.PromptEvalCount, final.EvalCount, prompt, systemPrompt, output)
+}
+
+// chat sends a request to /api/chat. format is "json" to force a JSON answer, a JSON
+// schema the answer must follow, or nil.
+func (ol *OllamaProvider) chat(ctx context.Context, prompt, systemPrompt string, format interface{}, stream bool) (*http.Response, error) {
+	if err := checkTextUsage(ctx, ol.GetProviderName(), ol.Model, prompt, systemPrompt); err != nil {
+		return nil, err
+	}
+
+	numCtx := ol.NumCtx
+	if numCtx == 0 {
+		numCtx = defaultOllamaNumCtx
+	}
+
+	reqBody := map[string]interface{}{
+		"model": ol.Model,
+		"messages": []map[string]string{
+			{"role": "system", "content": systemPrompt},
+			{"role": "user", "content": prompt},
+		},
+		"stream": stream,
+		"options": map[string]interface{}{
+			"num_ctx": numCtx,
+		},
+	}
+	if format != nil {
+		reqBody["format"] = format
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Local models can take a long time on large prompts, especially on CPU. A busy or
+	// restarting server is retried like the hosted providers, and a failed request comes
+	// back as an *APIError so the fallback chain can tell it from an outage.
+	url := fmt.Sprintf("%s/api/chat", strings.TrimSuffix(ol.Host, "/"))
+	return sendWithRetryTimeout(ctx, 15*time.Minute, url, jsonData, nil)
+}
+
+func (ol *OllamaProvider) generate(ctx context.Context, prompt, systemPrompt string, format interface{}) (string, error) {
+	resp, err := ol.chat(ctx, prompt, systemPrompt, format, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result ollamaChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("Ollama error: %s", result.Error)
+	}
+	ol.recordUsage(ctx, result, prompt, systemPrompt, result.Message.Content)
+	if result.Message.Content == "" {
+		return "", fmt.Errorf("no content in response")
+	}
+
+	return result.Message.Content, nil
+}
+
+func (ol *OllamaProvider) GenerateText(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	return ol.generate(ctx, prompt, systemPrompt, nil)
+}
+
+// GenerateJSON uses Ollama's JSON format mode, which constrains the output to valid JSON
+func (ol *OllamaProvider) GenerateJSON(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	return ol.generate(ctx, prompt, systemPrompt, "json")
+}
+
+// GenerateStructured passes the schema as Ollama's format, which constrains decoding to it
+func (ol *OllamaProvider) GenerateStructured(ctx context.Context, prompt string, systemPrompt string, output StructuredOutput) (string, error) {
+	return ol.generate(ctx, prompt, systemPrompt, output.Schema)
+}
+
+// StreamText reads Ollama's newline-delimited JSON stream, calling onToken for every
+// message fragment until the final "done" object
+func (ol *OllamaProvider) StreamText(ctx context.Context, prompt string, systemPrompt string, onToken TokenHandler) (string, error) {
+	resp, err := ol.chat(ctx, prompt, systemPrompt, nil, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var final ollamaChatResponse
+	defer func() {
+		ol.recordUsage(ctx, final, prompt, systemPrompt, text.String())
+	}()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk ollamaChatResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return text.String(), fmt.Errorf("failed to parse stream event: %w", err)
+		}
+		if chunk.Error != "" {
+			return text.String(), fmt.Errorf("Ollama error: %s", chunk.Error)
+		}
+		if chunk.Message.Content != "" {
+			text.WriteString(chunk.Message.Content)
+			if err := onToken(chunk.Message.Content); err != nil {
+				return text.String(), err
+			}
+		}
+		if chunk.Done {
+			final = chunk
+			return text.String(), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return text.String(), fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	return text.String(), fmt.Errorf("stream ended before the message was complete")
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOllamaRetriesUnavailableServer(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// Still loading the model
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"message":{"content":"Osmosis moves water."},"done":true}`))
+	}))
+	defer server.Close()
+
+	ollama := &OllamaProvider{Host: server.URL, Model: "llama3"}
+	text, err := ollama.GenerateText(context.Background(), "What is osmosis?", "")
+	if err != nil || text != "Osmosis moves water." || calls.Load() != 2 {
+		t.Errorf("expected the unavailable server to be retried, got %q, %v after %d calls", text, err, calls.Load())
+	}
+}
+
+func TestOllamaMissingModelIsNotAnOutage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"model \"nope\" not found, try pulling it first"}`))
+	}))
+	defer server.Close()
+
+	ollama := &OllamaProvider{Host: server.URL, Model: "nope"}
+	_, err := ollama.GenerateText(context.Background(), "What is osmosis?", "")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a 404 API error, got %v", err)
+	}
+	if isProviderFailure(err) {
+		t.Error("a missing model must not count against the provider")
+	}
+}
@@ -2,72 +2,905 @@ package services
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ledongthuc/pdf"
 )
 
+// PageText is the text of one page of a document, or one slide or chapter
+type PageText struct {
+	Number     int // 1-based page number
+	Text       string
+	Recognized bool    // whether the text was recognized by OCR rather than read
+	Confidence float64 // OCR confidence of recognized text, from 0 to 1
+}
+
 const (
-	ChunkSize    = 1000 // characters per chunk
-	ChunkOverlap = 200  // overlap between chunks
+	scannedPageChars = 20   // pages with an image and fewer letters than this are likely scans
+	headingSizeRatio = 1.25 // lines this much larger than the body text may be headings
+	maxHeadingWords  = 12
+	maxOutlineDepth  = 8
+	maxOutlineItems  = 5000
+	minTableRows     = 3 // lines of aligned cells, header included, that make a table
 )
 
-// ExtractTextFromPDF extracts all text from a PDF file
-func ExtractTextFromPDF(filepath string) (string, error) {
+// PDFExtractor extracts PDFs with their document info and outline. Each page's text is
+// put back in reading order from the positions of its glyphs, so multi-column layouts
+// read column by column, tables become Markdown tables, and bookmarks (or, without an
+// outline, larger fonts) become Markdown headings.
+type PDFExtractor struct{}
+
+func (PDFExtractor) Extract(path string) ([]PageText, error) {
+	doc, err := ExtractPDF(path)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Pages, nil
+}
+
+func (PDFExtractor) ExtractDocument(path string) (*Document, error) {
+	return ExtractPDF(path)
+}
+
+// ExtractPDF extracts the text, document info and outline of a PDF file. Pages that fail
+// to parse fall back to the plain text of their content stream; pages that still fail,
+// have no text or look scanned are listed in the report rather than failing the file.
+func ExtractPDF(filepath string) (doc *Document, err error) {
 	f, r, err := pdf.Open(filepath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open PDF: %w", err)
+		if f != nil {
+			f.Close()
+		}
+		return nil, fmt.Errorf("failed to open PDF: %w", err)
 	}
 	defer f.Close()
 
-	var textBuilder strings.Builder
-	totalPage := r.NumPage()
+	// The reader panics on some malformed files
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			doc, err = nil, fmt.Errorf("failed to read PDF: %v", recovered)
+		}
+	}()
 
-	for pageIndex := 1; pageIndex <= totalPage; pageIndex++ {
-		p := r.Page(pageIndex)
-		if p.V.IsNull() {
+	pageValues := pdfPages(r)
+	doc = &Document{
+		MimeType: MIMEPDF,
+		Info:     pdfInfo(r),
+		Outline:  pdfOutline(r, pageValues),
+		Report:   ExtractionReport{Pages: len(pageValues)},
+	}
+
+	layouts := make([]*pageLayout, len(pageValues))
+	var sizes []float64
+	for i, value := range pageValues {
+		layout, err := readPageLayout(pdf.Page{V: value})
+		if err != nil {
+			doc.Report.FailedPages = append(doc.Report.FailedPages, i+1)
 			continue
 		}
+		layouts[i] = layout
+		for _, line := range layout.lines {
+			for range strings.Fields(line.text()) {
+				sizes = append(sizes, line.size)
+			}
+		}
+	}
 
-		text, err := p.GetPlainText(nil)
-		if err != nil {
-			// Continue even if one page fails
+	headings := newHeadingFinder(doc.Outline, sizes, layouts)
+	for i, layout := range layouts {
+		if layout == nil {
 			continue
 		}
+		number := i + 1
+		text, multiColumn, tables := layout.render(headings.forPage(number))
+		if multiColumn {
+			doc.Report.MultiColumnPages = append(doc.Report.MultiColumnPages, number)
+		}
+		if tables > 0 {
+			doc.Report.TablePages = append(doc.Report.TablePages, number)
+		}
+
+		letters := 0
+		for _, r := range text {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				letters++
+			}
+		}
+		if letters == 0 {
+			doc.Report.EmptyPages = append(doc.Report.EmptyPages, number)
+		}
+		if layout.hasImages && letters < scannedPageChars {
+			doc.Report.ScannedPages = append(doc.Report.ScannedPages, number)
+		}
+		if strings.TrimSpace(text) != "" {
+			doc.Pages = append(doc.Pages, PageText{Number: number, Text: text})
+		}
+	}
+	return doc, nil
+}
 
-		textBuilder.WriteString(text)
+// ExtractPagesFromPDF extracts the text of every page of a PDF file, see ExtractPDF
+func ExtractPagesFromPDF(filepath string) ([]PageText, error) {
+	return PDFExtractor{}.Extract(filepath)
+}
+
+// ExtractTextFromPDF extracts all text from a PDF file
+func ExtractTextFromPDF(filepath string) (string, error) {
+	pages, err := ExtractPagesFromPDF(filepath)
+	if err != nil {
+		return "", err
+	}
+
+	var textBuilder strings.Builder
+	for _, page := range pages {
+		textBuilder.WriteString(page.Text)
 		textBuilder.WriteString("\n\n")
 	}
 
 	return textBuilder.String(), nil
 }
 
-// ChunkText splits text into overlapping chunks
-func ChunkText(text string) []string {
-	if len(text) == 0 {
-		return []string{}
+// pdfPages lists the page objects of a PDF in order, walking the page tree once. A node
+// listed again, by a broken or hostile tree, is skipped.
+func pdfPages(r *pdf.Reader) []pdf.Value {
+	var pages []pdf.Value
+	visited := make(map[string]bool)
+	var walk func(node pdf.Value, depth int)
+	walk = func(node pdf.Value, depth int) {
+		if depth > 32 || node.Kind() != pdf.Dict {
+			return
+		}
+		kids := node.Key("Kids")
+		if node.Key("Type").Name() != "Pages" && kids.Kind() != pdf.Array {
+			pages = append(pages, node)
+			return
+		}
+		key := node.String()
+		if visited[key] {
+			return
+		}
+		visited[key] = true
+		for i := 0; i < kids.Len(); i++ {
+			walk(kids.Index(i), depth+1)
+		}
+	}
+	walk(r.Trailer().Key("Root").Key("Pages"), 0)
+	return pages
+}
+
+// pdfInfo reads the title, author and subject of the document information dictionary
+func pdfInfo(r *pdf.Reader) DocumentInfo {
+	info := r.Trailer().Key("Info")
+	clean := func(key string) string {
+		return strings.Join(strings.Fields(info.Key(key).Text()), " ")
+	}
+	return DocumentInfo{Title: clean("Title"), Author: clean("Author"), Subject: clean("Subject")}
+}
+
+// pdfOutline flattens the bookmark tree, resolving the page each bookmark points to
+func pdfOutline(r *pdf.Reader, pageValues []pdf.Value) []OutlineEntry {
+	root := r.Trailer().Key("Root")
+	pageNumbers := make(map[string]int, len(pageValues))
+	for i, value := range pageValues {
+		pageNumbers[value.String()] = i + 1
+	}
+
+	// destPage resolves an explicit destination, a named one or a GoTo action to a page
+	destPage := func(item pdf.Value) int {
+		dest := item.Key("Dest")
+		if dest.IsNull() {
+			if action := item.Key("A"); action.Key("S").Name() == "GoTo" {
+				dest = action.Key("D")
+			}
+		}
+		if dest.Kind() == pdf.Name || dest.Kind() == pdf.String {
+			dest = namedDest(root, dest)
+		}
+		if dest.Kind() == pdf.Dict {
+			dest = dest.Key("D")
+		}
+		if dest.Kind() != pdf.Array || dest.Len() == 0 {
+			return 0
+		}
+		page := dest.Index(0)
+		if page.Kind() == pdf.Integer {
+			return int(page.Int64()) + 1
+		}
+		return pageNumbers[page.String()]
+	}
+
+	// Items are visited once, so a cycle of Next or First links ends the walk
+	var entries []OutlineEntry
+	visited := make(map[string]bool)
+	var walk func(node pdf.Value, level int)
+	walk = func(node pdf.Value, level int) {
+		if level > maxOutlineDepth {
+			return
+		}
+		for item := node.Key("First"); item.Kind() == pdf.Dict && len(visited) < maxOutlineItems; item = item.Key("Next") {
+			key := item.String()
+			if visited[key] {
+				return
+			}
+			visited[key] = true
+			if title := strings.Join(strings.Fields(item.Key("Title").Text()), " "); title != "" {
+				entries = append(entries, OutlineEntry{Title: title, Level: level, Page: destPage(item)})
+			}
+			walk(item, level+1)
+		}
+	}
+	walk(root.Key("Outlines"), 1)
+	return entries
+}
+
+// namedDest looks a destination name up in the catalog's Dests dictionary or Dests name
+// tree
+func namedDest(root, name pdf.Value) pdf.Value {
+	key := name.RawString()
+	if name.Kind() == pdf.Name {
+		key = name.Name()
+	}
+	if dest := root.Key("Dests").Key(key); !dest.IsNull() {
+		return dest
+	}
+
+	var search func(node pdf.Value, depth int) pdf.Value
+	search = func(node pdf.Value, depth int) pdf.Value {
+		if depth > 32 {
+			return pdf.Value{}
+		}
+		names := node.Key("Names")
+		for i := 0; i+1 < names.Len(); i += 2 {
+			if names.Index(i).RawString() == key {
+				return names.Index(i + 1)
+			}
+		}
+		kids := node.Key("Kids")
+		for i := 0; i < kids.Len(); i++ {
+			if dest := search(kids.Index(i), depth+1); !dest.IsNull() {
+				return dest
+			}
+		}
+		return pdf.Value{}
+	}
+	return search(root.Key("Names").Key("Dests"), 0)
+}
+
+// pdfSegment is a piece of a line, with the horizontal extent it covers
+type pdfSegment struct {
+	x, end float64
+	text   string
+}
+
+// pdfLine is a line of text, as one or more segments separated by wide gaps
+type pdfLine struct {
+	y, size  float64 // baseline and largest font size
+	segments []pdfSegment
+	heading  int // heading level, 0 for body text
+}
+
+func (l pdfLine) text() string {
+	parts := make([]string, len(l.segments))
+	for i, segment := range l.segments {
+		parts[i] = segment.text
+	}
+	return strings.Join(parts, " ")
+}
+
+// width is the horizontal extent of the line's segments
+func (l pdfLine) width() float64 {
+	if len(l.segments) == 0 {
+		return 0
+	}
+	return l.segments[len(l.segments)-1].end - l.segments[0].x
+}
+
+// pageLayout is the text of a page as positioned lines, top to bottom
+type pageLayout struct {
+	lines     []pdfLine
+	hasImages bool
+}
+
+// pdfRun is text drawn in one go at consecutive positions
+type pdfRun struct {
+	x, y, end, size float64
+	text            strings.Builder
+	widthKnown      bool
+	lastX           float64
+}
+
+// readPageLayout reads the glyphs of a page and groups them into lines. Pages whose
+// content can't be interpreted fall back to their plain text, one line per text line.
+func readPageLayout(page pdf.Page) (layout *pageLayout, err error) {
+	layout = &pageLayout{hasImages: pageDrawsImages(page)}
+
+	content, ok := pageContent(page)
+	if ok {
+		layout.lines = groupLines(glyphRuns(content.Text))
+	}
+	if !ok || len(layout.lines) == 0 {
+		text, err := page.GetPlainText(nil)
+		if err != nil {
+			if !ok {
+				return nil, err
+			}
+			return layout, nil
+		}
+		for i, line := range strings.Split(text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				layout.lines = append(layout.lines, pdfLine{y: float64(-i), size: 0, segments: []pdfSegment{{text: line}}})
+			}
+		}
+	}
+	return layout, nil
+}
+
+// pageContent interprets a page's content stream, which panics on malformed operators
+func pageContent(page pdf.Page) (content pdf.Content, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return page.Content(), true
+}
+
+// pageDrawsImages reports whether a page's content draws image XObjects
+func pageDrawsImages(page pdf.Page) (found bool) {
+	defer func() {
+		if recover() != nil {
+			found = false
+		}
+	}()
+	xobjects := page.Resources().Key("XObject")
+	images := make(map[string]bool)
+	for _, name := range xobjects.Keys() {
+		if xobjects.Key(name).Key("Subtype").Name() == "Image" {
+			images[name] = true
+		}
+	}
+	if len(images) == 0 {
+		return false
+	}
+
+	pdf.Interpret(page.V.Key("Contents"), func(stk *pdf.Stack, op string) {
+		args := make([]pdf.Value, stk.Len())
+		for i := len(args) - 1; i >= 0; i-- {
+			args[i] = stk.Pop()
+		}
+		if op == "Do" && len(args) == 1 && images[args[0].Name()] {
+			found = true
+		}
+	})
+	return found
+}
+
+// glyphRuns joins glyphs drawn one after the other on the same baseline into runs,
+// inserting spaces where the gap between glyphs is wider than letter spacing
+func glyphRuns(glyphs []pdf.Text) []*pdfRun {
+	var runs []*pdfRun
+	var run *pdfRun
+	finish := func() {
+		if run == nil {
+			return
+		}
+		if !run.widthKnown {
+			// Standard fonts without widths put every glyph of a string at its start
+			run.end = run.x + 0.5*run.size*float64(utf8.RuneCountInString(run.text.String()))
+		}
+		if strings.TrimSpace(run.text.String()) != "" {
+			runs = append(runs, run)
+		}
+		run = nil
+	}
+
+	for _, glyph := range glyphs {
+		if glyph.S == "\n" || glyph.S == "\r" {
+			continue
+		}
+		size := math.Abs(glyph.FontSize)
+		if size == 0 {
+			size = 10
+		}
+		if run != nil {
+			sameLine := math.Abs(glyph.Y-run.y) < 0.3*size
+			gap := glyph.X - run.end
+			if !sameLine || glyph.X < run.lastX-0.5 || gap > 0.8*size {
+				finish()
+			} else if gap > 0.15*size && !strings.HasSuffix(run.text.String(), " ") && glyph.S != " " {
+				run.text.WriteString(" ")
+			}
+		}
+		if run == nil {
+			run = &pdfRun{x: glyph.X, y: glyph.Y, end: glyph.X, size: size}
+		}
+		run.text.WriteString(glyph.S)
+		run.size = max(run.size, size)
+		run.end = max(run.end, glyph.X+glyph.W)
+		run.lastX = glyph.X
+		if glyph.W > 0 {
+			run.widthKnown = true
+		}
+	}
+	finish()
+	return runs
+}
+
+// groupLines groups runs sharing a baseline into lines, top to bottom, splitting each
+// line into segments where runs are more than a space apart
+func groupLines(runs []*pdfRun) []pdfLine {
+	sort.SliceStable(runs, func(i, j int) bool {
+		if runs[i].y != runs[j].y {
+			return runs[i].y > runs[j].y
+		}
+		return runs[i].x < runs[j].x
+	})
+
+	var lines []pdfLine
+	var lineRuns []*pdfRun
+	flush := func() {
+		if len(lineRuns) == 0 {
+			return
+		}
+		sort.SliceStable(lineRuns, func(i, j int) bool { return lineRuns[i].x < lineRuns[j].x })
+		line := pdfLine{y: lineRuns[0].y}
+		for _, run := range lineRuns {
+			line.size = max(line.size, run.size)
+			text := strings.Join(strings.Fields(run.text.String()), " ")
+			last := len(line.segments) - 1
+			if last >= 0 && run.x-line.segments[last].end < run.size {
+				line.segments[last].text += " " + text
+				line.segments[last].end = max(line.segments[last].end, run.end)
+				continue
+			}
+			line.segments = append(line.segments, pdfSegment{x: run.x, end: run.end, text: text})
+		}
+		lines = append(lines, line)
+		lineRuns = nil
+	}
+	for _, run := range runs {
+		if len(lineRuns) > 0 && math.Abs(lineRuns[0].y-run.y) > 0.5*min(lineRuns[0].size, run.size) {
+			flush()
+		}
+		lineRuns = append(lineRuns, run)
 	}
+	flush()
+	return lines
+}
 
-	var chunks []string
-	runes := []rune(text)
+// findGutter looks for a vertical band that splits many lines into a left and a right
+// part of prose-like width without crossing them: the gap between two columns. Which
+// lines a position splits only changes at segment edges, so the edges and the points
+// between them are the only positions tried, however wide the text claims to be.
+func findGutter(lines []pdfLine) (float64, bool) {
+	if len(lines) < 4 {
+		return 0, false
+	}
+	left, right := math.Inf(1), math.Inf(-1)
+	for _, line := range lines {
+		for _, segment := range line.segments {
+			left = min(left, segment.x)
+			right = max(right, segment.end)
+		}
+	}
+	width := right - left
+	if width <= 0 {
+		return 0, false
+	}
+
+	from, to := left+0.2*width, left+0.8*width
+	edges := []float64{from, to}
+	for _, line := range lines {
+		for _, segment := range line.segments {
+			for _, edge := range []float64{segment.x, segment.end} {
+				if edge > from && edge < to {
+					edges = append(edges, edge)
+				}
+			}
+		}
+	}
+	sort.Float64s(edges)
+	var positions []float64
+	for i, edge := range edges {
+		if i > 0 && edge == edges[i-1] {
+			continue
+		}
+		if len(positions) > 0 {
+			positions = append(positions, (positions[len(positions)-1]+edge)/2)
+		}
+		positions = append(positions, edge)
+	}
+
+	type candidate struct {
+		index              int
+		x                  float64
+		twoSided, crossing int
+	}
+	var best []candidate
+	for i, x := range positions {
+		c := candidate{index: i, x: x}
+		for _, line := range lines {
+			leftWidth, rightWidth := 0.0, 0.0
+			crosses := false
+			for _, segment := range line.segments {
+				switch {
+				case segment.end <= x:
+					leftWidth += segment.end - segment.x
+				case segment.x >= x:
+					rightWidth += segment.end - segment.x
+				default:
+					crosses = true
+				}
+			}
+			if crosses {
+				c.crossing++
+			} else if leftWidth >= 0.15*width && rightWidth >= 0.15*width {
+				c.twoSided++
+			}
+		}
+		if c.twoSided < 3 || c.twoSided*10 < 4*(len(lines)-c.crossing) {
+			continue
+		}
+		switch {
+		case len(best) == 0 || c.twoSided > best[0].twoSided ||
+			c.twoSided == best[0].twoSided && c.crossing < best[0].crossing:
+			best = []candidate{c}
+		case c.twoSided == best[0].twoSided && c.crossing == best[0].crossing && i == best[len(best)-1].index+1:
+			// Extend the band of equally good positions, to split in its middle
+			best = append(best, c)
+		}
+	}
+	if len(best) == 0 {
+		return 0, false
+	}
+	return (best[0].x + best[len(best)-1].x) / 2, true
+}
+
+// readingOrder orders the lines of a page into flows read one after the other. Where a
+// gutter splits lines into columns, the left column is read before the right one, until
+// a line crossing the gutter; columns are searched for further gutters.
+func readingOrder(lines []pdfLine, depth int) ([][]pdfLine, bool) {
+	gutter, ok := findGutter(lines)
+	if !ok || depth >= 3 {
+		return [][]pdfLine{lines}, false
+	}
+
+	var flows [][]pdfLine
+	var full, left, right []pdfLine
+	flushColumns := func() {
+		for _, column := range [][]pdfLine{left, right} {
+			if len(column) > 0 {
+				sub, _ := readingOrder(column, depth+1)
+				flows = append(flows, sub...)
+			}
+		}
+		left, right = nil, nil
+	}
+	for _, line := range lines {
+		var leftLine, rightLine pdfLine
+		crosses := false
+		for _, segment := range line.segments {
+			switch {
+			case segment.end <= gutter:
+				leftLine.segments = append(leftLine.segments, segment)
+			case segment.x >= gutter:
+				rightLine.segments = append(rightLine.segments, segment)
+			default:
+				crosses = true
+			}
+		}
+		if crosses {
+			flushColumns()
+			full = append(full, line)
+			continue
+		}
+		if len(full) > 0 {
+			flows = append(flows, full)
+			full = nil
+		}
+		for _, part := range []struct {
+			line   pdfLine
+			column *[]pdfLine
+		}{{leftLine, &left}, {rightLine, &right}} {
+			if len(part.line.segments) > 0 {
+				part.line.y, part.line.size, part.line.heading = line.y, line.size, line.heading
+				*part.column = append(*part.column, part.line)
+			}
+		}
+	}
+	flushColumns()
+	if len(full) > 0 {
+		flows = append(flows, full)
+	}
+	return flows, true
+}
+
+// pdfTable is a run of lines whose segments line up in columns of short cells
+type pdfTable struct {
+	start, end int // the table is lines[start:end]
+	rows       [][]string
+}
+
+// findTables looks for runs of lines that are split into the same columns, with few
+// words per cell; columns of prose are left to readingOrder
+func findTables(lines []pdfLine) []pdfTable {
+	var tables []pdfTable
+	for i := 0; i < len(lines); {
+		j := i
+		for j < len(lines) && len(lines[j].segments) >= 2 && lines[j].heading == 0 {
+			j++
+		}
+		if j-i >= minTableRows {
+			if rows, ok := tableRows(lines[i:j]); ok {
+				tables = append(tables, pdfTable{start: i, end: j, rows: rows})
+			}
+		}
+		i = max(j, i+1)
+	}
+	return tables
+}
+
+// tableRows puts the segments of lines into the columns they share. Columns are the
+// horizontal extents covered by the lines with the most cells, so left, right and
+// centred cells all fall into their column.
+func tableRows(lines []pdfLine) ([][]string, bool) {
+	most := 0
+	for _, line := range lines {
+		most = max(most, len(line.segments))
+	}
+	var extents [][2]float64
+	for _, line := range lines {
+		if len(line.segments) == most {
+			for _, segment := range line.segments {
+				extents = append(extents, [2]float64{segment.x, segment.end})
+			}
+		}
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i][0] < extents[j][0] })
+	var columns [][2]float64
+	for _, extent := range extents {
+		if last := len(columns) - 1; last >= 0 && extent[0] <= columns[last][1] {
+			columns[last][1] = max(columns[last][1], extent[1])
+			continue
+		}
+		columns = append(columns, extent)
+	}
+	if len(columns) < 2 {
+		return nil, false
+	}
+
+	var words []float64
+	rows := make([][]string, len(lines))
+	for i, line := range lines {
+		rows[i] = make([]string, len(columns))
+		for _, segment := range line.segments {
+			column, overlap := 0, math.Inf(-1)
+			for c, extent := range columns {
+				if o := min(segment.end, extent[1]) - max(segment.x, extent[0]); o > overlap {
+					column, overlap = c, o
+				}
+			}
+			rows[i][column] = strings.TrimSpace(rows[i][column] + " " + segment.text)
+			words = append(words, float64(len(strings.Fields(segment.text))))
+		}
+	}
+	// Cells are short; two columns of prose have many words per line
+	maxWords := 5.0
+	if len(columns) == 2 {
+		maxWords = 3
+	}
+	return rows, median(words) <= maxWords
+}
+
+// render writes the page's text in reading order: paragraphs separated by blank lines,
+// words hyphenated across lines joined, headings marked up and tables written as
+// Markdown tables. It reports whether the page has several columns and how many tables.
+func (p *pageLayout) render(headings pageHeadings) (string, bool, int) {
+	lines := make([]pdfLine, len(p.lines))
+	copy(lines, p.lines)
+	for i := range lines {
+		lines[i].heading = headings.level(lines[i])
+	}
+	headings.finish()
+
+	// Tables are taken out first, so their columns aren't read as columns of text. The
+	// text between them is put in reading order part by part.
+	type pagePart struct {
+		flow  []pdfLine
+		table [][]string
+	}
+	var parts []pagePart
+	multiColumn := false
+	addText := func(lines []pdfLine) {
+		if len(lines) == 0 {
+			return
+		}
+		flows, columns := readingOrder(lines, 0)
+		multiColumn = multiColumn || columns
+		for _, flow := range flows {
+			parts = append(parts, pagePart{flow: flow})
+		}
+	}
+	tables := findTables(lines)
 	start := 0
+	for _, table := range tables {
+		addText(lines[start:table.start])
+		parts = append(parts, pagePart{table: table.rows})
+		start = table.end
+	}
+	addText(lines[start:])
+
+	// Lines further apart than usual start a new paragraph. Most gaps between body lines
+	// are line spacing, so the lower quartile is a safe estimate of it.
+	var gaps []float64
+	for _, part := range parts {
+		flow := part.flow
+		for i := 1; i < len(flow); i++ {
+			if gap := flow[i-1].y - flow[i].y; gap > 0 && flow[i-1].heading == 0 && flow[i].heading == 0 {
+				gaps = append(gaps, gap)
+			}
+		}
+	}
+	spacing := quantile(gaps, 0.25)
+
+	blocks := append([]string(nil), headings.unplaced...)
+	for _, part := range parts {
+		if part.table != nil {
+			blocks = append(blocks, MarkdownTable(part.table))
+			continue
+		}
+		flow := part.flow
+		var paragraph strings.Builder
+		endParagraph := func() {
+			if text := strings.TrimSpace(paragraph.String()); text != "" {
+				blocks = append(blocks, text)
+			}
+			paragraph.Reset()
+		}
+		for i, line := range flow {
+			text := line.text()
+			if line.heading > 0 {
+				endParagraph()
+				blocks = append(blocks, strings.Repeat("#", line.heading)+" "+text)
+				continue
+			}
+			if i > 0 && spacing > 0 && flow[i-1].y-line.y > 1.5*spacing {
+				endParagraph()
+			}
+			current := paragraph.String()
+			switch {
+			case current == "":
+				paragraph.WriteString(text)
+			case hyphenated(current, text):
+				paragraph.Reset()
+				paragraph.WriteString(strings.TrimSuffix(current, "-") + text)
+			default:
+				paragraph.WriteString("\n" + text)
+			}
+		}
+		endParagraph()
+	}
+	return strings.Join(blocks, "\n\n"), multiColumn, len(tables)
+}
+
+// hyphenated reports whether a line ends in a word broken with a hyphen that the next
+// line continues
+func hyphenated(text, next string) bool {
+	if !strings.HasSuffix(text, "-") || len(text) < 2 {
+		return false
+	}
+	before, _ := utf8.DecodeLastRuneInString(strings.TrimSuffix(text, "-"))
+	after, _ := utf8.DecodeRuneInString(next)
+	return unicode.IsLetter(before) && unicode.IsLower(after)
+}
+
+func median(values []float64) float64 {
+	return quantile(values, 0.5)
+}
+
+func quantile(values []float64, q float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[int(q*float64(len(sorted)-1)+0.5)]
+}
+
+// headingFinder decides which lines are headings: the bookmarked ones when the document
+// has an outline, otherwise short lines set noticeably larger than the body text
+type headingFinder struct {
+	outline  []OutlineEntry
+	bodySize float64
+	levels   map[float64]int // heading level by rounded font size
+}
+
+func newHeadingFinder(outline []OutlineEntry, sizes []float64, layouts []*pageLayout) *headingFinder {
+	f := &headingFinder{outline: outline, bodySize: median(sizes), levels: make(map[float64]int)}
+	if len(outline) > 0 || f.bodySize == 0 {
+		return f
+	}
 
-	for start < len(runes) {
-		end := start + ChunkSize
-		if end > len(runes) {
-			end = len(runes)
+	var headingSizes []float64
+	for _, layout := range layouts {
+		if layout == nil {
+			continue
 		}
+		for _, line := range layout.lines {
+			size := math.Round(line.size)
+			if f.isHeadingSize(line) && f.levels[size] == 0 {
+				f.levels[size] = -1
+				headingSizes = append(headingSizes, size)
+			}
+		}
+	}
+	// The largest size is level 1; levels below 3 are not told apart
+	sort.Sort(sort.Reverse(sort.Float64Slice(headingSizes)))
+	for i, size := range headingSizes {
+		f.levels[size] = min(i+1, 3)
+	}
+	return f
+}
+
+func (f *headingFinder) isHeadingSize(line pdfLine) bool {
+	words := len(strings.Fields(line.text()))
+	return f.bodySize > 0 && line.size >= headingSizeRatio*f.bodySize && words > 0 && words <= maxHeadingWords
+}
 
-		chunk := string(runes[start:end])
-		chunk = strings.TrimSpace(chunk)
+// pageHeadings finds the headings of one page
+type pageHeadings struct {
+	finder   *headingFinder
+	entries  map[string]int // outline titles pointing to the page, normalized, by level
+	unplaced []string       // headings of outline entries not found among the page's lines
+}
+
+// forPage returns the headings of a page. Bookmarks whose title is not a line of the page
+// are put at its top.
+func (f *headingFinder) forPage(page int) pageHeadings {
+	h := pageHeadings{finder: f, entries: make(map[string]int)}
+	for _, entry := range f.outline {
+		if entry.Page == page {
+			h.entries[normalizeTitle(entry.Title)] = entry.Level
+		}
+	}
+	return h
+}
 
-		if len(chunk) > 0 {
-			chunks = append(chunks, chunk)
+// level returns the heading level of a line, 0 for body text
+func (h *pageHeadings) level(line pdfLine) int {
+	if len(h.finder.outline) > 0 {
+		level, ok := h.entries[normalizeTitle(line.text())]
+		if !ok {
+			return 0
 		}
+		delete(h.entries, normalizeTitle(line.text()))
+		return min(level, 6)
+	}
+	if !h.finder.isHeadingSize(line) {
+		return 0
+	}
+	return max(h.finder.levels[math.Round(line.size)], 0)
+}
 
-		// Move forward, but overlap
-		start += ChunkSize - ChunkOverlap
+// finish lists the page's bookmarks that matched no line, in outline order
+func (h *pageHeadings) finish() {
+	for _, entry := range h.finder.outline {
+		if level, ok := h.entries[normalizeTitle(entry.Title)]; ok {
+			h.unplaced = append(h.unplaced, strings.Repeat("#", min(level, 6))+" "+entry.Title)
+		}
 	}
+}
 
-	return chunks
+// normalizeTitle compares titles by their letters and digits only
+func normalizeTitle(title string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, title)
 }
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pdfText draws lines of text, each as {x, y, size, text}
+func pdfText(lines ...[4]string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		fmt.Fprintf(&b, "BT /F1 %s Tf %s %s Td (%s) Tj ET\n", line[2], line[0], line[1], line[3])
+	}
+	return b.String()
+}
+
+// buildPDF writes a PDF with a page per content stream, using a Helvetica font whose
+// glyphs are all half an em wide. The catalog and trailer can be extended.
+func buildPDF(contents []string, catalog, trailer string, extra ...string) []byte {
+	// 1: catalog, 2: page tree, 3: font, 4: image, then a page and its content per page,
+	// then the extra objects
+	var objects []string
+	kids := make([]string, len(contents))
+	for i := range contents {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	widths := strings.TrimSpace(strings.Repeat("500 ", 95))
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R "+catalog+" >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(contents)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding /FirstChar 32 /LastChar 126 /Widths ["+widths+"] >>",
+		"<< /Type /XObject /Subtype /Image /Width 1 /Height 1 /ColorSpace /DeviceGray /BitsPerComponent 8 /Length 1 >>\nstream\n\x80\nendstream",
+	)
+	for i, content := range contents {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> /XObject << /Im1 4 0 R >> >> /Contents %d 0 R >>", 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+	objects = append(objects, extra...)
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailer, xref)
+	return b.Bytes()
+}
+
+func TestExtractPDFReadsColumnsInOrder(t *testing.T) {
+	left := []string{
+		"Plants turn light into sugar in the",
+		"chloroplasts of their leaves, using",
+		"water from the soil and releasing",
+		"oxygen as they do.",
+	}
+	right := []string{
+		"Cells break sugar down again to make",
+		"energy, using oxygen and giving off",
+		"water and carbon dioxide in the",
+		"process.",
+	}
+	var lines [][4]string
+	lines = append(lines, [4]string{"50", "740", "18", "Energy in Living Things"})
+	for i := range left {
+		y := fmt.Sprint(700 - 14*i)
+		// Draw the columns interleaved, line by line, as many PDF writers do
+		lines = append(lines, [4]string{"50", y, "10", left[i]}, [4]string{"320", y, "10", right[i]})
+	}
+	page1 := pdfText(lines...)
+	page2 := pdfText(
+		[4]string{"50", "740", "10", "Summary"},
+		[4]string{"50", "710", "10", "Both processes are linked: photo-"},
+		[4]string{"50", "696", "10", "synthesis stores the energy that"},
+		[4]string{"50", "682", "10", "respiration releases."},
+	)
+	scanned := "q 500 0 0 700 50 50 cm /Im1 Do Q"
+	broken := "BT /F1 10 Tf 12 Tf (Unreadable) Tj ET"
+
+	// The outline root, its two bookmarks and the info dictionary follow the five pages
+	const first = 5 + 2*5
+	outline := []string{
+		fmt.Sprintf("<< /Type /Outlines /First %d 0 R /Last %d 0 R /Count 2 >>", first+1, first+1),
+		fmt.Sprintf("<< /Title (Energy in Living Things) /Parent %d 0 R /First %d 0 R /Last %d 0 R /Dest [5 0 R /Fit] >>", first, first+2, first+2),
+		fmt.Sprintf("<< /Title (Summary) /Parent %d 0 R /A << /S /GoTo /D [7 0 R /XYZ 0 792 0] >> >>", first+1),
+		"<< /Title (Biology Notes) /Author (A. Teacher) >>",
+	}
+	data := buildPDF([]string{page1, page2, scanned, "", broken},
+		fmt.Sprintf("/Outlines %d 0 R", first), fmt.Sprintf("/Info %d 0 R", first+3), outline...)
+
+	path := writeFile(t, "notes.pdf", string(data))
+	doc, err := ExtractPDF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Info.Title != "Biology Notes" || doc.Info.Author != "A. Teacher" {
+		t.Errorf("document info: %+v", doc.Info)
+	}
+	wantOutline := []OutlineEntry{{"Energy in Living Things", 1, 1}, {"Summary", 2, 2}}
+	if !reflect.DeepEqual(doc.Outline, wantOutline) {
+		t.Errorf("outline: %+v", doc.Outline)
+	}
+
+	wantReport := ExtractionReport{
+		Pages:            5,
+		FailedPages:      []int{5},
+		EmptyPages:       []int{3, 4},
+		ScannedPages:     []int{3},
+		MultiColumnPages: []int{1},
+	}
+	if !reflect.DeepEqual(doc.Report, wantReport) {
+		t.Errorf("report: %+v\nwant %+v", doc.Report, wantReport)
+	}
+
+	if len(doc.Pages) != 2 {
+		t.Fatalf("expected the 2 pages with text, got %+v", doc.Pages)
+	}
+	want := "# Energy in Living Things\n\n" + strings.Join(left, "\n") + "\n\n" + strings.Join(right, "\n")
+	if doc.Pages[0].Text != want {
+		t.Errorf("page 1:\n%s\nwant\n%s", doc.Pages[0].Text, want)
+	}
+	want = "## Summary\n\nBoth processes are linked: photosynthesis stores the energy that\nrespiration releases."
+	if doc.Pages[1].Number != 2 || doc.Pages[1].Text != want {
+		t.Errorf("page 2:\n%s\nwant\n%s", doc.Pages[1].Text, want)
+	}
+}
+
+func TestExtractPDFHeadingsFromFontSizes(t *testing.T) {
+	page := pdfText(
+		[4]string{"50", "740", "20", "Genetics"},
+		[4]string{"50", "700", "14", "Inheritance"},
+		[4]string{"50", "670", "10", "Traits pass from parents to offspring."},
+		[4]string{"50", "656", "10", "Genes come in pairs of alleles."},
+		[4]string{"50", "620", "10", "Dominant alleles mask recessive ones."},
+	)
+	path := writeFile(t, "genetics.pdf", string(buildPDF([]string{page}, "", "")))
+	pages, err := ExtractPagesFromPDF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "# Genetics\n\n## Inheritance\n\nTraits pass from parents to offspring.\nGenes come in pairs of alleles.\n\nDominant alleles mask recessive ones."
+	if len(pages) != 1 || pages[0].Text != want {
+		t.Errorf("got %+v\nwant %q", pages, want)
+	}
+}
+
+func TestExtractPDFTables(t *testing.T) {
+	page := pdfText(
+		[4]string{"50", "740", "10", "Table 1: Boiling points"},
+		[4]string{"50", "710", "10", "Substance"}, [4]string{"200", "710", "10", "Formula"}, [4]string{"350", "710", "10", "Boiling point"},
+		// Numbers are right-aligned under their header
+		[4]string{"50", "696", "10", "Water"}, [4]string{"200", "696", "10", "H2O"}, [4]string{"385", "696", "10", "100"},
+		[4]string{"50", "682", "10", "Ethanol"}, [4]string{"200", "682", "10", "C2H6O"}, [4]string{"390", "682", "10", "78"},
+		[4]string{"50", "668", "10", "Mercury"}, [4]string{"200", "668", "10", "Hg"}, [4]string{"385", "668", "10", "357"},
+		[4]string{"50", "630", "10", "Water boils at a higher temperature than ethanol."},
+	)
+	path := writeFile(t, "chemistry.pdf", string(buildPDF([]string{page}, "", "")))
+	doc, err := ExtractPDF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Table 1: Boiling points\n\n" +
+		"| Substance | Formula | Boiling point |\n| --- | --- | --- |\n| Water | H2O | 100 |\n| Ethanol | C2H6O | 78 |\n| Mercury | Hg | 357 |\n\n" +
+		"Water boils at a higher temperature than ethanol."
+	if len(doc.Pages) != 1 || doc.Pages[0].Text != want {
+		t.Fatalf("got %+v\nwant %q", doc.Pages, want)
+	}
+	if !reflect.DeepEqual(doc.Report.TablePages, []int{1}) || len(doc.Report.MultiColumnPages) != 0 {
+		t.Errorf("report: %+v", doc.Report)
+	}
+
+	chunks := ChunkPages(doc.Pages, DefaultChunkOptions())
+	if len(chunks) != 2 || chunks[0].Kind != ChunkKindTable || chunks[0].Caption != "Table 1: Boiling points" || chunks[0].Table[2][2] != "78" {
+		t.Errorf("expected a table chunk with its caption, got %+v", chunks)
+	}
+}
+
+func TestExtractPDFSurvivesCyclicTrees(t *testing.T) {
+	page := pdfText([4]string{"50", "740", "10", "Cells divide by mitosis."})
+
+	// An untitled bookmark that is its own next item, and a page tree node listing itself
+	// as its kids over and over, after the page and its content
+	const first = 5 + 2
+	tree := fmt.Sprintf("<< /Type /Pages /Kids [5 0 R %[1]d 0 R %[1]d 0 R %[1]d 0 R %[1]d 0 R] /Count 1 >>", first+2)
+	extra := []string{
+		fmt.Sprintf("<< /Type /Outlines /First %d 0 R /Count 1 >>", first+1),
+		fmt.Sprintf("<< /Parent %d 0 R /Next %d 0 R /Dest [5 0 R /Fit] >>", first, first+1),
+		tree,
+	}
+	data := buildPDF([]string{page}, fmt.Sprintf("/Outlines %d 0 R /Pages %d 0 R", first, first+2), "", extra...)
+	path := writeFile(t, "cyclic.pdf", string(data))
+
+	done := make(chan struct{})
+	var doc *Document
+	var err error
+	go func() {
+		defer close(done)
+		doc, err = ExtractPDF(path)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("extraction did not finish")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Outline) != 0 || doc.Report.Pages != 1 || len(doc.Pages) != 1 || doc.Pages[0].Text != "Cells divide by mitosis." {
+		t.Errorf("unexpected document %+v", doc)
+	}
+}
+
+func TestExtractPDFIgnoresFarAwayText(t *testing.T) {
+	var lines [][4]string
+	for i := 0; i < 6; i++ {
+		lines = append(lines, [4]string{"50", fmt.Sprint(700 - 14*i), "10", "Enzymes speed up reactions."})
+	}
+	// A glyph far off the page stretches the text's width to trillions of units
+	lines = append(lines, [4]string{"1000000000000", "600", "10", "x"})
+	path := writeFile(t, "far.pdf", string(buildPDF([]string{pdfText(lines...)}, "", "")))
+
+	start := time.Now()
+	if _, err := ExtractPDF(path); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("extraction took %s", elapsed)
+	}
+}
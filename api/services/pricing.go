@@ -0,0 +1,99 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Price is what a model charges, in USD
+type Price struct {
+	InputPerMTok  float64 `json:"input_per_mtok"`  // per million input tokens
+	OutputPerMTok float64 `json:"output_per_mtok"` // per million output tokens
+	PerImage      float64 `json:"per_image"`
+	PerMChars     float64 `json:"per_mchars"` // per million characters of speech
+}
+
+// PriceTable maps model names to prices. A model without an exact entry uses the longest
+// entry it starts with, so "claude-3-5-sonnet" also prices "claude-3-5-sonnet-20241022".
+type PriceTable map[string]Price
+
+// DefaultPrices lists public list prices of the hosted models the app uses. Local Ollama
+// models aren't listed and cost nothing.
+func DefaultPrices() PriceTable {
+	return PriceTable{
+		"claude-3-5-sonnet":      {InputPerMTok: 3, OutputPerMTok: 15},
+		"claude-3-7-sonnet":      {InputPerMTok: 3, OutputPerMTok: 15},
+		"claude-sonnet-4":        {InputPerMTok: 3, OutputPerMTok: 15},
+		"claude-3-5-haiku":       {InputPerMTok: 0.8, OutputPerMTok: 4},
+		"claude-3-haiku":         {InputPerMTok: 0.25, OutputPerMTok: 1.25},
+		"claude-3-opus":          {InputPerMTok: 15, OutputPerMTok: 75},
+		"claude-opus-4":          {InputPerMTok: 15, OutputPerMTok: 75},
+		"gpt-4o":                 {InputPerMTok: 2.5, OutputPerMTok: 10},
+		"gpt-4o-mini":            {InputPerMTok: 0.15, OutputPerMTok: 0.6},
+		"gpt-4.1":                {InputPerMTok: 2, OutputPerMTok: 8},
+		"gpt-4.1-mini":           {InputPerMTok: 0.4, OutputPerMTok: 1.6},
+		"gpt-4.1-nano":           {InputPerMTok: 0.1, OutputPerMTok: 0.4},
+		"text-embedding-3-small": {InputPerMTok: 0.02},
+		"text-embedding-3-large": {InputPerMTok: 0.13},
+		"text-embedding-ada-002": {InputPerMTok: 0.1},
+		"dall-e-3":               {PerImage: 0.04},
+		"tts-1":                  {PerMChars: 15},
+		"tts-1-hd":               {PerMChars: 30},
+	}
+}
+
+// LoadPriceTable returns the default prices overridden and extended by the JSON object
+// in path, e.g. {"gpt-4o": {"input_per_mtok": 2.5, "output_per_mtok": 10}}
+func LoadPriceTable(path string) (PriceTable, error) {
+	prices := DefaultPrices()
+	if path == "" {
+		return prices, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return prices, fmt.Errorf("failed to read price table: %w", err)
+	}
+	var overrides PriceTable
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return prices, fmt.Errorf("failed to parse price table: %w", err)
+	}
+	for model, price := range overrides {
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// Lookup finds the price of a model
+func (p PriceTable) Lookup(model string) (Price, bool) {
+	// Shortened embeddings ("text-embedding-3-small@512") cost the same as full ones
+	model, _, _ = strings.Cut(model, "@")
+	if price, ok := p[model]; ok {
+		return price, true
+	}
+
+	best := ""
+	for name := range p {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return p[best], true
+}
+
+// Cost returns the price of a call in USD and whether the model has a price
+func (p PriceTable) Cost(usage Usage) (float64, bool) {
+	price, ok := p.Lookup(usage.Model)
+	if !ok {
+		return 0, false
+	}
+	return float64(usage.InputTokens)*price.InputPerMTok/1e6 +
+		float64(usage.OutputTokens)*price.OutputPerMTok/1e6 +
+		float64(usage.Images)*price.PerImage +
+		float64(usage.Characters)*price.PerMChars/1e6, true
+}
@@ -0,0 +1,78 @@
+package services
+
+// rrfK dampens the weight of top ranks in reciprocal-rank fusion; 60 is the value from
+// the original paper (Cormack et al.) and works well without tuning
+const rrfK = 60
+
+// ReciprocalRankFusion merges ranked result lists into one. Each document scores
+// sum(1 / (rrfK + rank)) over the lists it appears in, so only ranks matter and scores
+// on different scales (BM25, cosine) can be combined.
+func ReciprocalRankFusion(lists ...[]Match) []Match {
+	scores := make(map[string]float64)
+	for _, list := range lists {
+		for rank, match := range list {
+			scores[match.ID] += 1 / float64(rrfK+rank+1)
+		}
+	}
+
+	fused := make([]Match, 0, len(scores))
+	for id, score := range scores {
+		fused = append(fused, Match{ID: id, Score: score})
+	}
+	sortMatches(fused)
+	return fused
+}
+
+// MaximalMarginalRelevance picks k of the ranked candidates, trading relevance to the query
+// against similarity to the candidates already picked, so near-duplicate chunks (such as
+// overlapping neighbours) don't fill every slot. lambda 1 is pure relevance, 0 pure diversity.
+// Candidates without a vector keep their rank relevance but can't be compared for diversity.
+func MaximalMarginalRelevance(candidates []Match, vectors map[string][]float64, query []float64, lambda float64, k int) []Match {
+	if len(candidates) <= 1 {
+		return candidates
+	}
+
+	q := normalize(query)
+	normalized := make(map[string][]float32, len(vectors))
+	for id, vector := range vectors {
+		if len(vector) == len(query) {
+			normalized[id] = normalize(vector)
+		}
+	}
+
+	// Relevance is the similarity to the query, or the rank position without a vector
+	relevance := make([]float64, len(candidates))
+	for i, c := range candidates {
+		if v, ok := normalized[c.ID]; ok {
+			relevance[i] = dot(q, v)
+		} else {
+			relevance[i] = 1 - float64(i)/float64(len(candidates))
+		}
+	}
+
+	picked := make([]Match, 0, k)
+	used := make([]bool, len(candidates))
+	for len(picked) < k && len(picked) < len(candidates) {
+		best, bestScore := -1, 0.0
+		for i, c := range candidates {
+			if used[i] {
+				continue
+			}
+			redundancy := 0.0
+			if v, ok := normalized[c.ID]; ok {
+				for _, p := range picked {
+					if pv, ok := normalized[p.ID]; ok {
+						redundancy = max(redundancy, dot(v, pv))
+					}
+				}
+			}
+			score := lambda*relevance[i] - (1-lambda)*redundancy
+			if best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		used[best] = true
+		picked = append(picked, candidates[best])
+	}
+	return picked
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// JSONSchema is the subset of JSON Schema used to describe and validate model output.
+// It marshals to a schema the providers' structured output modes accept.
+type JSONSchema struct {
+	Type                 string                 `json:"type"` // object, array, string, integer, number or boolean
+	Description          string                 `json:"description,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+// Ptr returns a pointer to v, for the optional limits of a JSONSchema
+func Ptr[T any](v T) *T {
+	return &v
+}
+
+// Validate parses data as JSON and checks it against the schema. Every violation is
+// reported with the path of the offending value, e.g. "question.options: expected 4 items".
+func (s *JSONSchema) Validate(data []byte) []string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []string{fmt.Sprintf("not valid JSON: %v", err)}
+	}
+	if decoder.More() {
+		return []string{"unexpected content after the JSON value"}
+	}
+
+	var errs []string
+	s.validate(value, "", &errs)
+	return errs
+}
+
+func (s *JSONSchema) validate(value interface{}, path string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		name := path
+		if name == "" {
+			name = "(root)"
+		}
+		*errs = append(*errs, name+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			fail("expected an object, got %s", jsonKind(value))
+			return
+		}
+		for _, name := range s.Required {
+			if v, ok := obj[name]; !ok || v == nil {
+				fail("missing required field %q", name)
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			switch {
+			case ok && obj[name] != nil:
+				prop.validate(obj[name], joinPath(path, name), errs)
+			case !ok && s.AdditionalProperties != nil && !*s.AdditionalProperties:
+				fail("unknown field %q", name)
+			}
+		}
+
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			fail("expected an array, got %s", jsonKind(value))
+			return
+		}
+		switch {
+		case s.MinItems != nil && s.MaxItems != nil && *s.MinItems == *s.MaxItems && len(arr) != *s.MinItems:
+			fail("expected exactly %d items, got %d", *s.MinItems, len(arr))
+		case s.MinItems != nil && len(arr) < *s.MinItems:
+			fail("expected at least %d items, got %d", *s.MinItems, len(arr))
+		case s.MaxItems != nil && len(arr) > *s.MaxItems:
+			fail("expected at most %d items, got %d", *s.MaxItems, len(arr))
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("expected a string, got %s", jsonKind(value))
+			return
+		}
+		if s.MinLength != nil && len(strings.TrimSpace(str)) < *s.MinLength {
+			if *s.MinLength == 1 {
+				fail("must not be empty")
+			} else {
+				fail("must be at least %d characters", *s.MinLength)
+			}
+		}
+		if len(s.Enum) > 0 && !containsString(s.Enum, str) {
+			fail("%q is not one of %s", str, strings.Join(s.Enum, ", "))
+		}
+
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			expected := "a number"
+			if s.Type == "integer" {
+				expected = "an integer"
+			}
+			fail("expected %s, got %s", expected, jsonKind(value))
+			return
+		}
+		f, err := num.Float64()
+		if err != nil {
+			fail("invalid number %s", num)
+			return
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			fail("expected an integer, got %s", num)
+			return
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be at least %v, got %s", *s.Minimum, num)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("must be at most %v, got %s", *s.Maximum, num)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("expected a boolean, got %s", jsonKind(value))
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	default:
+		return "null"
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
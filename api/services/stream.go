@@ -0,0 +1,263 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// TokenHandler receives each piece of text as the model produces it. Returning an
+// error stops the stream (e.g. when the client has gone away).
+type TokenHandler func(token string) error
+
+// readSSE parses a server-sent event stream, calling fn with the event name and data
+// of every event. Events without an explicit name are reported as "message".
+func readSSE(r io.Reader, fn func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	event := ""
+	var data []string
+	dispatch := func() error {
+		if len(data) == 0 {
+			event = ""
+			return nil
+		}
+		if event == "" {
+			event = "message"
+		}
+		err := fn(event, strings.Join(data, "\n"))
+		event = ""
+		data = nil
+		return err
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, ":"):
+			// Comment / keep-alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	return dispatch()
+}
+
+// openStream sends a streaming request, retrying like any other request. Retrying is
+// safe because nothing has been read from the stream yet. Cancelling ctx closes the
+// connection, which also ends reading the stream.
+func openStream(ctx context.Context, url string, jsonData []byte, headers map[string]string) (*http.Response, error) {
+	streamHeaders := map[string]string{"Accept": "text/event-stream"}
+	for k, v := range headers {
+		streamHeaders[k] = v
+	}
+	return sendWithRetry(ctx, url, jsonData, streamHeaders)
+}
+
+// StreamText streams a Claude completion, calling onToken for every text delta.
+// It returns the complete text once the message has finished.
+func (a *AnthropicProvider) StreamText(ctx context.Context, prompt string, systemPrompt string, onToken TokenHandler) (string, error) {
+	if err := checkTextUsage(ctx, a.GetProviderName(), a.Model, prompt, systemPrompt); err != nil {
+		return "", err
+	}
+
+	reqBody := map[string]interface{}{
+		"model":      a.Model,
+		"max_tokens": 16384,
+		"system":     systemPrompt,
+		"stream":     true,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	resp, err := openStream(ctx, "https://api.anthropic.com/v1/messages", jsonData, map[string]string{
+		"x-api-key":         a.APIKey,
+		"anthropic-version": "2023-06-01",
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var usage anthropicUsage
+	defer func() {
+		recordTextUsage(ctx, a.GetProviderName(), a.Model, usage.InputTokens, usage.OutputTokens, prompt, systemPrompt, text.String())
+	}()
+	done := false
+	err = readSSE(resp.Body, func(event, data string) error {
+		switch event {
+		case "message_start":
+			var start struct {
+				Message struct {
+					Usage anthropicUsage `json:"usage"`
+				} `json:"message"`
+			}
+			if err := json.Unmarshal([]byte(data), &start); err == nil {
+				usage.InputTokens = start.Message.Usage.InputTokens
+			}
+		case "message_delta":
+			// Carries the running output token count
+			var delta struct {
+				Usage anthropicUsage `json:"usage"`
+			}
+			if err := json.Unmarshal([]byte(data), &delta); err == nil {
+				usage.OutputTokens = delta.Usage.OutputTokens
+			}
+		case "content_block_delta":
+			var delta struct {
+				Delta struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				} `json:"delta"`
+			}
+			if err := json.Unmarshal([]byte(data), &delta); err != nil {
+				return fmt.Errorf("failed to parse stream event: %w", err)
+			}
+			if delta.Delta.Type != "text_delta" || delta.Delta.Text == "" {
+				return nil
+			}
+			text.WriteString(delta.Delta.Text)
+			return onToken(delta.Delta.Text)
+		case "message_stop":
+			done = true
+		case "error":
+			var apiErr struct {
+				Error struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			json.Unmarshal([]byte(data), &apiErr)
+			return &APIError{
+				StatusCode: anthropicErrorStatus(apiErr.Error.Type),
+				Message:    fmt.Sprintf("%s: %s", apiErr.Error.Type, apiErr.Error.Message),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return text.String(), err
+	}
+	if !done {
+		return text.String(), fmt.Errorf("stream ended before the message was complete")
+	}
+
+	return text.String(), nil
+}
+
+// anthropicErrorStatus maps the type of an error sent mid-stream to the HTTP status the
+// same error has as a response, so it is retried and failed over the same way
+func anthropicErrorStatus(errorType string) int {
+	switch errorType {
+	case "overloaded_error":
+		return 529
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "api_error":
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// StreamText streams a chat completion, calling onToken for every content delta.
+// It returns the complete text once the stream reports [DONE].
+func (o *OpenAIProvider) StreamText(ctx context.Context, prompt string, systemPrompt string, onToken TokenHandler) (string, error) {
+	if err := checkTextUsage(ctx, o.GetProviderName(), o.Model, prompt, systemPrompt); err != nil {
+		return "", err
+	}
+
+	reqBody := map[string]interface{}{
+		"model": o.Model,
+		"messages": []map[string]string{
+			{"role": "system", "content": systemPrompt},
+			{"role": "user", "content": prompt},
+		},
+		"max_tokens": 16384,
+		"stream":     true,
+		// Ask for a final chunk with the token counts; servers that don't support
+		// it ignore the option and the usage is estimated instead
+		"stream_options": map[string]bool{"include_usage": true},
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	resp, err := openStream(ctx, o.endpoint("/chat/completions"), jsonData, o.authHeaders())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var usage *openAIUsage
+	defer func() {
+		o.recordUsage(ctx, usage, prompt, systemPrompt, text.String())
+	}()
+	done := false
+	err = readSSE(resp.Body, func(event, data string) error {
+		if data == "[DONE]" {
+			done = true
+			return nil
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *openAIUsage `json:"usage"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("failed to parse stream event: %w", err)
+		}
+		if chunk.Error != nil {
+			return fmt.Errorf("API error: %s", chunk.Error.Message)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			return nil
+		}
+
+		token := chunk.Choices[0].Delta.Content
+		text.WriteString(token)
+		return onToken(token)
+	})
+	if err != nil {
+		return text.String(), err
+	}
+	if !done {
+		return text.String(), fmt.Errorf("stream ended before the completion was complete")
+	}
+
+	return text.String(), nil
+}
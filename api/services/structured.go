@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultStructuredAttempts = 3
+	maxRepairEcho             = 8000 // characters of the rejected answer quoted back in a repair prompt
+	maxReportedErrors         = 10
+)
+
+// StructuredOutput names and describes the JSON schema a model's answer must follow
+type StructuredOutput struct {
+	Name        string // identifier the providers use for the tool or response format
+	Description string
+	Schema      *JSONSchema
+}
+
+// StructuredProvider is implemented by providers that can constrain their answer to a
+// schema themselves: Claude through a forced tool call, OpenAI through a json_schema
+// response format and Ollama through its format parameter
+type StructuredProvider interface {
+	GenerateStructured(ctx context.Context, prompt string, systemPrompt string, output StructuredOutput) (string, error)
+}
+
+// StructuredRequest is a prompt whose answer must be JSON matching Output.Schema
+type StructuredRequest struct {
+	Prompt       string
+	SystemPrompt string
+	Output       StructuredOutput
+	Check        func(data []byte) []string // rules the schema can't express, run once the schema passes
+	Attempts     int                        // generations including repairs, default 3
+}
+
+// ValidationError is returned when the answer still breaks the schema after every repair attempt
+type ValidationError struct {
+	Name   string
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Name, strings.Join(e.Errors, "; "))
+}
+
+// GenerateValidated asks the provider for JSON that follows the request's schema, using the
+// provider's structured output mode when it has one. An answer that fails validation is sent
+// back with the list of problems for the model to repair, up to the attempt limit. Provider
+// failures, which the providers have already retried, are returned as they are.
+func GenerateValidated(ctx context.Context, provider AIProvider, req StructuredRequest) ([]byte, error) {
+	attempts := req.Attempts
+	if attempts <= 0 {
+		attempts = defaultStructuredAttempts
+	}
+	structured, native := provider.(StructuredProvider)
+	_, chain := provider.(*FallbackProvider) // falls back to JSON mode per provider itself
+
+	prompt := req.Prompt
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var response string
+		var err error
+		if native {
+			response, err = structured.GenerateStructured(ctx, prompt, req.SystemPrompt, req.Output)
+			if !chain && structuredUnsupported(err) {
+				log.Warn().Err(err).Str("output", req.Output.Name).Msg("Structured output unsupported, falling back to JSON mode")
+				native = false
+				response, err = provider.GenerateJSON(ctx, prompt, req.SystemPrompt)
+			}
+		} else {
+			response, err = provider.GenerateJSON(ctx, prompt, req.SystemPrompt)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.As(err, new(*BudgetError)) {
+			// Retrying can't help until the budget is raised
+			return nil, err
+		}
+		if errors.As(err, new(*APIError)) || errors.As(err, new(*url.Error)) {
+			// The provider failed and was already retried; repairing the prompt can't help
+			return nil, fmt.Errorf("failed to generate %s: %w", req.Output.Name, err)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("failed to generate %s: %w", req.Output.Name, err)
+			log.Warn().Err(err).Str("output", req.Output.Name).Int("attempt", attempt).Msg("Generation attempt failed")
+			continue
+		}
+
+		data := []byte(TrimJSONFences(response))
+		problems := req.Output.Schema.Validate(data)
+		if len(problems) == 0 && req.Check != nil {
+			problems = req.Check(data)
+		}
+		if len(problems) == 0 {
+			return data, nil
+		}
+		if len(problems) > maxReportedErrors {
+			problems = append(problems[:maxReportedErrors], fmt.Sprintf("and %d more problems", len(problems)-maxReportedErrors))
+		}
+
+		lastErr = &ValidationError{Name: req.Output.Name, Errors: problems}
+		log.Warn().Strs("errors", problems).Str("output", req.Output.Name).Int("attempt", attempt).Msg("Generated JSON failed validation")
+		prompt = repairPrompt(req.Prompt, response, problems)
+	}
+	return nil, lastErr
+}
+
+// structuredUnsupported reports whether a structured output request was refused because
+// the server doesn't support the mode: OpenAI-compatible servers don't all accept
+// json_schema, though JSON mode still works
+func structuredUnsupported(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// repairPrompt repeats the original prompt with the rejected answer and what was wrong with it
+func repairPrompt(prompt, response string, problems []string) string {
+	if len(response) > maxRepairEcho {
+		response = response[:maxRepairEcho] + "..."
+	}
+
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\n---\nYour previous answer was rejected because it does not follow the required JSON structure:\n")
+	for _, problem := range problems {
+		b.WriteString("- ")
+		b.WriteString(problem)
+		b.WriteString("\n")
+	}
+	b.WriteString("\nPrevious answer:\n")
+	b.WriteString(response)
+	b.WriteString("\n\nReturn the corrected JSON only, fixing every problem listed above and keeping the rest of the content.")
+	return b.String()
+}
+
+// TrimJSONFences strips the markdown code fences models like to wrap JSON in
+func TrimJSONFences(response string) string {
+	response = strings.TrimSpace(response)
+	response = strings.TrimPrefix(response, "```json")
+	response = strings.TrimPrefix(response, "```")
+	response = strings.TrimSuffix(response, "```")
+	return strings.TrimSpace(response)
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// stubProvider answers every call with the next of its results, recording the methods
+// called. Streams deliver their answer as a single token before returning its error.
+type stubProvider struct {
+	name    string
+	results []stubResult
+	calls   []string
+}
+
+type stubResult struct {
+	text string
+	err  error
+}
+
+func (s *stubProvider) next(method string) (string, error) {
+	s.calls = append(s.calls, method)
+	if len(s.results) == 0 {
+		return "", errors.New("no more results")
+	}
+	result := s.results[0]
+	s.results = s.results[1:]
+	return result.text, result.err
+}
+
+func (s *stubProvider) GetProviderName() string { return s.name }
+
+func (s *stubProvider) GenerateText(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	return s.next("text")
+}
+
+func (s *stubProvider) GenerateJSON(ctx context.Context, prompt string, systemPrompt string) (string, error) {
+	return s.next("json")
+}
+
+func (s *stubProvider) GenerateStructured(ctx context.Context, prompt string, systemPrompt string, output StructuredOutput) (string, error) {
+	return s.next("structured")
+}
+
+func (s *stubProvider) StreamText(ctx context.Context, prompt string, systemPrompt string, onToken TokenHandler) (string, error) {
+	text, err := s.next("stream")
+	if text != "" {
+		if err := onToken(text); err != nil {
+			return "", err
+		}
+	}
+	return text, err
+}
+
+var answerOutput = StructuredOutput{
+	Name: "answer",
+	Schema: &JSONSchema{
+		Type:       "object",
+		Properties: map[string]*JSONSchema{"text": {Type: "string"}},
+		Required:   []string{"text"},
+	},
+}
+
+func TestGenerateValidatedFallsBackOnlyWhenUnsupported(t *testing.T) {
+	// A server without json_schema support answers in JSON mode, and keeps doing so
+	provider := &stubProvider{name: "openai", results: []stubResult{
+		{err: &APIError{StatusCode: http.StatusBadRequest, Message: "response_format json_schema is not supported"}},
+		{text: `{}`},
+		{text: `{"text": "Osmosis"}`},
+	}}
+	data, err := GenerateValidated(context.Background(), provider, StructuredRequest{Prompt: "What is osmosis?", Output: answerOutput})
+	if err != nil || string(data) != `{"text": "Osmosis"}` {
+		t.Fatalf("got %s, %v", data, err)
+	}
+	if want := []string{"structured", "json", "json"}; !reflect.DeepEqual(provider.calls, want) {
+		t.Errorf("expected calls %v, got %v", want, provider.calls)
+	}
+
+	// An outage was already retried by the provider and is returned as it is
+	overloaded := &APIError{StatusCode: 529, Message: "overloaded"}
+	provider = &stubProvider{name: "claude", results: []stubResult{{err: overloaded}}}
+	_, err = GenerateValidated(context.Background(), provider, StructuredRequest{Prompt: "What is osmosis?", Output: answerOutput})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr != overloaded {
+		t.Errorf("expected the overload error, got %v", err)
+	}
+	if want := []string{"structured"}; !reflect.DeepEqual(provider.calls, want) {
+		t.Errorf("expected calls %v, got %v", want, provider.calls)
+	}
+}
+
+func TestFallbackDowngradesStructuredOutputPerProvider(t *testing.T) {
+	primary := &stubProvider{name: "claude", results: []stubResult{
+		{err: &APIError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"}},
+	}}
+	secondary := &stubProvider{name: "openai", results: []stubResult{
+		{err: &APIError{StatusCode: http.StatusNotFound, Message: "unknown parameter json_schema"}},
+		{text: `{"text": "Osmosis"}`},
+	}}
+	chain := NewFallbackProvider([]AIProvider{primary, secondary}, 5, 0)
+
+	data, err := GenerateValidated(context.Background(), chain, StructuredRequest{Prompt: "What is osmosis?", Output: answerOutput})
+	if err != nil || string(data) != `{"text": "Osmosis"}` {
+		t.Fatalf("got %s, %v", data, err)
+	}
+	if want := []string{"structured"}; !reflect.DeepEqual(primary.calls, want) {
+		t.Errorf("primary: expected calls %v, got %v", want, primary.calls)
+	}
+	if want := []string{"structured", "json"}; !reflect.DeepEqual(secondary.calls, want) {
+		t.Errorf("secondary: expected calls %v, got %v", want, secondary.calls)
+	}
+}
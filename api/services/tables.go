@@ -0,0 +1,71 @@
+package services
+
+import (
+	"encoding/csv"
+	"regexp"
+	"strings"
+)
+
+var (
+	// tableCaption matches captions such as "Table 2: Enzyme activity" or "Table: Results"
+	tableCaption = regexp.MustCompile(`^(Table|Tab\.)(\s*\d+[\w.-]*\s*[:.—–-]?|\s*[:—–-])\s*\S`)
+	// figureCaption matches captions such as "Figure 3. The carbon cycle" or "Fig. 2: Cells",
+	// but not sentences such as "Figure 3 shows the cycle"
+	figureCaption = regexp.MustCompile(`^(Figure|Fig\.)(\s*\d+[\w.-]*)?\s*[:.—–-]\s*\S`)
+	// markdownImage matches a Markdown image with its alt text
+	markdownImage = regexp.MustCompile(`^!\[([^\]]*)\]\([^)]*\)$`)
+	// tableRule matches the line under a Markdown table's header
+	tableRule = regexp.MustCompile(`^\|?(\s*:?-{3,}:?\s*\|)*\s*:?-{3,}:?\s*\|?$`)
+)
+
+// splitTableRow splits a Markdown table row into its cells, unescaping pipes
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+
+	var cells []string
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// parseMarkdownTable returns the rows of a Markdown table, header first, without the rule
+// under the header
+func parseMarkdownTable(text string) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || tableRule.MatchString(line) {
+			continue
+		}
+		rows = append(rows, splitTableRow(line))
+	}
+	return rows
+}
+
+// MarkdownTable writes rows as a Markdown table with the first row as the header
+func MarkdownTable(rows [][]string) string {
+	return strings.TrimSuffix((&tableBuilder{rows: rows}).markdown(), "\n")
+}
+
+// tableCSV writes rows as CSV
+func tableCSV(rows [][]string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.WriteAll(rows) // writing to a strings.Builder can't fail
+	return b.String()
+}
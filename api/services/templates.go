@@ -4,6 +4,12 @@ import (
 	"strings"
 )
 
+// SlideLayouts are the layouts a slide may use; the frontend renders the others as "standard"
+var SlideLayouts = []string{"title", "standard", "default", "list", "summary", "concept", "comparison", "split", "data", "highlight", "quote"}
+
+// SlideThemes are the colour themes a slide may use
+var SlideThemes = []string{"blue", "green", "purple", "orange", "gradient"}
+
 // SlideTemplate defines different layout templates
 type SlideTemplate struct {
 	Layout           string
@@ -14,8 +20,9 @@ type SlideTemplate struct {
 	ContentAlignment string // "left", "center"
 }
 
-// GetSlideTemplate intelligently selects a template based on slide characteristics
-func GetSlideTemplate(slideNumber int, title string, content string, isTitle bool, hasImage bool) SlideTemplate {
+// GetSlideTemplate intelligently selects a template based on slide characteristics. Slides
+// presenting a table of source data get the data or comparison layout.
+func GetSlideTemplate(slideNumber int, title string, content string, isTitle bool, hasImage bool, hasData bool) SlideTemplate {
 	// Title slide (first slide)
 	if slideNumber == 1 || isTitle {
 		return SlideTemplate{
@@ -31,10 +38,10 @@ func GetSlideTemplate(slideNumber int, title string, content string, isTitle boo
 	// Summary/conclusion slide (usually last or contains summary keywords)
 	contentLower := strings.ToLower(content)
 	titleLower := strings.ToLower(title)
-	if strings.Contains(titleLower, "summary") ||
+	if !hasData && (strings.Contains(titleLower, "summary") ||
 		strings.Contains(titleLower, "conclusion") ||
 		strings.Contains(titleLower, "recap") ||
-		strings.Contains(contentLower, "in summary") {
+		strings.Contains(contentLower, "in summary")) {
 		return SlideTemplate{
 			Layout:           "summary",
 			Theme:            "purple",
@@ -46,10 +53,10 @@ func GetSlideTemplate(slideNumber int, title string, content string, isTitle boo
 	}
 
 	// List/bullet point slides (content with bullets or numbered items)
-	if strings.Contains(content, "\n- ") ||
+	if !hasData && (strings.Contains(content, "\n- ") ||
 		strings.Contains(content, "\n• ") ||
 		strings.Contains(content, "\n1.") ||
-		strings.Contains(content, "\n2.") {
+		strings.Contains(content, "\n2.")) {
 		return SlideTemplate{
 			Layout:           "list",
 			Theme:            "blue",
@@ -76,7 +83,8 @@ func GetSlideTemplate(slideNumber int, title string, content string, isTitle boo
 	}
 
 	// Data/statistics slides (contains numbers, percentages, data)
-	if strings.Contains(contentLower, "%") ||
+	if hasData ||
+		strings.Contains(contentLower, "%") ||
 		strings.Contains(contentLower, "data") ||
 		strings.Contains(contentLower, "statistics") ||
 		strings.Contains(contentLower, "research shows") {
@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,8 +13,32 @@ import (
 	"github.com/google/uuid"
 )
 
+// SpeechModel is the OpenAI TTS model voiceovers are generated with
+const SpeechModel = "tts-1"
+
+// VoiceoverProvider reads slide scripts out, saving the audio under the course and
+// returning its URL
+type VoiceoverProvider interface {
+	GenerateVoiceover(ctx context.Context, text, courseID, language string, slideNumber int) (string, error)
+	GetProviderName() string
+	GetModelName() string
+}
+
+// OpenAIVoiceover implements voiceovers with OpenAI TTS
+type OpenAIVoiceover struct {
+	APIKey   string
+	AudioDir string // audio is saved in a directory per course below it
+}
+
+func (o *OpenAIVoiceover) GetProviderName() string { return "openai" }
+func (o *OpenAIVoiceover) GetModelName() string    { return SpeechModel }
+
 // GenerateVoiceover generates an audio file using OpenAI TTS
-func GenerateVoiceover(apiKey, text, courseID, language string, slideNumber int) (string, error) {
+func (o *OpenAIVoiceover) GenerateVoiceover(ctx context.Context, text, courseID, language string, slideNumber int) (string, error) {
+	if err := CheckUsage(ctx, Usage{Provider: "openai", Model: SpeechModel, Kind: UsageSpeech, Characters: len([]rune(text))}); err != nil {
+		return "", err
+	}
+
 	url := "https://api.openai.com/v1/audio/speech"
 
 	// Select voice based on language for better pronunciation
@@ -22,7 +47,7 @@ func GenerateVoiceover(apiKey, text, courseID, language string, slideNumber int)
 	// We just use the best general voice for all languages
 
 	reqBody := map[string]interface{}{
-		"model": "tts-1",
+		"model": SpeechModel,
 		"voice": voice,
 		"input": text,
 	}
@@ -32,13 +57,13 @@ func GenerateVoiceover(apiKey, text, courseID, language string, slideNumber int)
 		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.APIKey))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -51,14 +76,21 @@ func GenerateVoiceover(apiKey, text, courseID, language string, slideNumber int)
 		body, _ := io.ReadAll(resp.Body)
 		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, string(body))
 	}
+	// TTS is billed by input characters once the request is accepted
+	RecordUsage(ctx, Usage{Provider: "openai", Model: SpeechModel, Kind: UsageSpeech, Characters: len([]rune(text))})
+
+	return saveAudio(o.AudioDir, courseID, slideNumber, resp.Body)
+}
 
+// saveAudio writes a slide's MP3 to the course's audio directory and returns its URL
+func saveAudio(audioDir, courseID string, slideNumber int, audio io.Reader) (string, error) {
 	// Create audio directory
-	audioDir := filepath.Join("./storage/audio", courseID)
-	os.MkdirAll(audioDir, 0755)
+	courseDir := filepath.Join(audioDir, courseID)
+	os.MkdirAll(courseDir, 0755)
 
 	// Save audio file
 	audioFilename := fmt.Sprintf("slide_%d_%s.mp3", slideNumber, uuid.New().String()[:8])
-	audioPath := filepath.Join(audioDir, audioFilename)
+	audioPath := filepath.Join(courseDir, audioFilename)
 
 	audioFile, err := os.Create(audioPath)
 	if err != nil {
@@ -66,8 +98,11 @@ func GenerateVoiceover(apiKey, text, courseID, language string, slideNumber int)
 	}
 	defer audioFile.Close()
 
-	_, err = io.Copy(audioFile, resp.Body)
+	_, err = io.Copy(audioFile, audio)
 	if err != nil {
+		// Don't leave a truncated file behind when the download is cancelled
+		audioFile.Close()
+		os.Remove(audioPath)
 		return "", fmt.Errorf("failed to save audio: %w", err)
 	}
 
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"fmt"
+)
+
+// Kinds of provider usage
+const (
+	UsageText      = "text"      // LLM completions
+	UsageEmbedding = "embedding" // embedding requests
+	UsageImage     = "image"     // generated images
+	UsageSpeech    = "speech"    // text to speech
+)
+
+// Usage is what one provider call consumed
+type Usage struct {
+	Provider     string
+	Model        string
+	Kind         string
+	InputTokens  int
+	OutputTokens int
+	Images       int
+	Characters   int  // text to speech input
+	Estimated    bool // token counts estimated from text length, the provider reported none
+}
+
+// UsageRecorder receives the usage of every provider call made with a context carrying it
+type UsageRecorder interface {
+	RecordUsage(usage Usage)
+}
+
+// UsageLimiter is implemented by recorders that enforce a budget. Paid calls ask it with
+// an estimate of their usage before they are sent.
+type UsageLimiter interface {
+	CheckUsage(estimate Usage) error
+}
+
+// BudgetError is returned instead of making a call that would take spending over a budget
+type BudgetError struct {
+	Scope    string  // global, course or user
+	Limit    float64 // USD
+	Spent    float64
+	Estimate float64 // estimated cost of the refused call or operation
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s budget of %s would be exceeded: %s spent, this needs about %s more", e.Scope, formatUSD(e.Limit), formatUSD(e.Spent), formatUSD(e.Estimate))
+}
+
+// formatUSD shows cents, or fractions of a cent for the price of a single call
+func formatUSD(amount float64) string {
+	if amount > 0 && amount < 0.01 {
+		return fmt.Sprintf("$%.4f", amount)
+	}
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+type usageRecorderKey struct{}
+
+// WithUsageRecorder returns a context whose provider calls report their usage to recorder
+func WithUsageRecorder(ctx context.Context, recorder UsageRecorder) context.Context {
+	return context.WithValue(ctx, usageRecorderKey{}, recorder)
+}
+
+// RecordUsage reports usage to the context's recorder, if it has one
+func RecordUsage(ctx context.Context, usage Usage) {
+	if recorder, ok := ctx.Value(usageRecorderKey{}).(UsageRecorder); ok {
+		recorder.RecordUsage(usage)
+	}
+}
+
+// CheckUsage asks the context's recorder whether a call with the estimated usage is within
+// budget. Contexts without a limiting recorder allow everything.
+func CheckUsage(ctx context.Context, estimate Usage) error {
+	if limiter, ok := ctx.Value(usageRecorderKey{}).(UsageLimiter); ok {
+		return limiter.CheckUsage(estimate)
+	}
+	return nil
+}
+
+// expectedOutputTokens is the answer length assumed when checking a completion against a
+// budget; slides and chat answers are usually shorter
+const expectedOutputTokens = 1000
+
+// checkTextUsage checks the estimated usage of a completion before it is sent
+func checkTextUsage(ctx context.Context, provider, model, prompt, systemPrompt string) error {
+	return CheckUsage(ctx, Usage{
+		Provider:     provider,
+		Model:        model,
+		Kind:         UsageText,
+		InputTokens:  EstimateTokens(prompt, systemPrompt),
+		OutputTokens: expectedOutputTokens,
+		Estimated:    true,
+	})
+}
+
+// EstimateTokens approximates the token count of text, about four characters per token
+func EstimateTokens(texts ...string) int {
+	chars := 0
+	for _, text := range texts {
+		chars += len(text)
+	}
+	return (chars + 3) / 4
+}
+
+// recordTextUsage reports a completion, estimating the token counts the response didn't
+// include (servers that don't report usage, streams cut off before their final event)
+func recordTextUsage(ctx context.Context, provider, model string, inputTokens, outputTokens int, prompt, systemPrompt, output string) {
+	usage := Usage{
+		Provider:     provider,
+		Model:        model,
+		Kind:         UsageText,
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+	}
+	if usage.InputTokens == 0 {
+		usage.InputTokens = EstimateTokens(prompt, systemPrompt)
+		usage.Estimated = true
+	}
+	if usage.OutputTokens == 0 && output != "" {
+		usage.OutputTokens = EstimateTokens(output)
+		usage.Estimated = true
+	}
+	RecordUsage(ctx, usage)
+}
+
+// recordEmbeddingUsage reports an embedding request, estimating the tokens when the
+// response didn't include them
+func recordEmbeddingUsage(ctx context.Context, provider, model string, tokens int, texts ...string) {
+	usage := Usage{Provider: provider, Model: model, Kind: UsageEmbedding, InputTokens: tokens}
+	if tokens == 0 {
+		usage.InputTokens = EstimateTokens(texts...)
+		usage.Estimated = true
+	}
+	RecordUsage(ctx, usage)
+}
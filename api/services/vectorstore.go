@@ -0,0 +1,138 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Match is one search result: the ID of a document and its score, higher is better.
+// Vector stores score by cosine similarity.
+type Match struct {
+	ID    string
+	Score float64
+}
+
+// VectorStore is a nearest-neighbour index over embedding vectors
+type VectorStore interface {
+	// Add inserts or replaces the vector stored under id
+	Add(id string, vector []float64) error
+	Remove(id string)
+	// Search returns the k vectors most similar to query, best first
+	Search(query []float64, k int) ([]Match, error)
+	Len() int
+}
+
+// PersistentVectorStore is a VectorStore that can be saved to disk and loaded back
+type PersistentVectorStore interface {
+	VectorStore
+	Save(path string) error
+}
+
+// NewVectorStore creates an empty store of the given kind: "hnsw" (default) or "flat"
+func NewVectorStore(kind string) VectorStore {
+	switch strings.ToLower(kind) {
+	case "flat", "bruteforce":
+		return NewBruteForceStore()
+	default:
+		return NewHNSWIndex(DefaultHNSWConfig())
+	}
+}
+
+// normalize returns the unit-length float32 copy of a vector, so cosine similarity is a dot product
+func normalize(vector []float64) []float32 {
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+
+	out := make([]float32, len(vector))
+	if norm == 0 {
+		return out
+	}
+	for i, v := range vector {
+		out[i] = float32(v / norm)
+	}
+	return out
+}
+
+func dot(a, b []float32) float64 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return float64(s0 + s1 + s2 + s3)
+}
+
+// BruteForceStore compares the query with every vector. Exact, and fast enough for a few
+// thousand chunks.
+type BruteForceStore struct {
+	mu      sync.RWMutex
+	dim     int
+	vectors map[string][]float32
+}
+
+func NewBruteForceStore() *BruteForceStore {
+	return &BruteForceStore{vectors: make(map[string][]float32)}
+}
+
+func (s *BruteForceStore) Add(id string, vector []float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(vector) == 0 {
+		return fmt.Errorf("empty vector")
+	}
+	if s.dim != 0 && len(vector) != s.dim {
+		return fmt.Errorf("vector has %d dimensions, index has %d", len(vector), s.dim)
+	}
+	s.dim = len(vector)
+	s.vectors[id] = normalize(vector)
+	return nil
+}
+
+func (s *BruteForceStore) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.vectors, id)
+}
+
+func (s *BruteForceStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.vectors)
+}
+
+func (s *BruteForceStore) Search(query []float64, k int) ([]Match, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.vectors) == 0 || k <= 0 {
+		return nil, nil
+	}
+	if len(query) != s.dim {
+		return nil, fmt.Errorf("query has %d dimensions, index has %d", len(query), s.dim)
+	}
+
+	q := normalize(query)
+	matches := make([]Match, 0, len(s.vectors))
+	for id, vector := range s.vectors {
+		matches = append(matches, Match{ID: id, Score: dot(q, vector)})
+	}
+	sortMatches(matches)
+
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches, nil
+}
@@ -47,12 +47,26 @@ const { TextArea } = Input
 
 const API_BASE = import.meta.env.VITE_API_URL || (window.location.hostname === 'localhost' || window.location.hostname === '127.0.0.1' ? 'http://localhost:8080/api' : '/api')
 
+interface ExtractionReport {
+  pages: number
+  failed_pages?: number[]
+  empty_pages?: number[]
+  scanned_pages?: number[]
+  multi_column_pages?: number[]
+  table_pages?: number[]
+  ocr_pages?: number[]
+}
+
 interface SourceFile {
   id: string
   course_id: string
   filename: string
   file_path: string
   file_size: number
+  mime_type?: string
+  title?: string
+  author?: string
+  extraction_report?: ExtractionReport
   created_at: string
 }
 
@@ -66,13 +80,67 @@ interface Slide {
   image_url?: string
   audio_url?: string
   layout?: string
+  table?: string
   theme?: string
 }
 
+// Splits a slide's table, a Markdown table after an optional caption, into its parts
+const parseSlideTable = (markdown?: string) => {
+  if (!markdown) return null
+  const lines = markdown.split('\n').map((line) => line.trim()).filter(Boolean)
+  const caption = lines.filter((line) => !line.startsWith('|')).join(' ')
+  const rows = lines
+    .filter((line) => line.startsWith('|') && !/^\|(\s*:?-{3,}:?\s*\|)+$/.test(line))
+    .map((line) => line.replace(/^\||\|$/g, '').split(/(?<!\\)\|/).map((cell) => cell.trim().replace(/\\\|/g, '|')))
+  if (rows.length < 2) return null
+  return { caption, columns: rows[0], rows: rows.slice(1) }
+}
+
+// Identifies this browser's learner so chat sessions can be listed per learner
+const getLearnerId = () => {
+  let id = localStorage.getItem('learner_id')
+  if (!id) {
+    id = crypto.randomUUID()
+    localStorage.setItem('learner_id', id)
+  }
+  return id
+}
+
+interface Citation {
+  number: number
+  chunk_id: string
+  source_file_id?: string
+  file_name?: string
+  page_start?: number
+  page_end?: number
+  section?: string
+  ocr_confidence?: number
+  snippet: string
+  score: number
+  slides?: { id: string; slide_number: number; title: string }[]
+}
+
 interface ChatMessage {
   role: 'user' | 'assistant'
   content: string
-  citations?: string[]
+  citations?: Citation[]
+}
+
+// e.g. "notes.pdf, p. 3-4, Cells > Organelles, OCR 87%"
+const citationLabel = (cite: Citation) => {
+  let label = cite.file_name || 'Course material'
+  if (cite.page_start) {
+    label += cite.page_end && cite.page_end > cite.page_start
+      ? `, p. ${cite.page_start}-${cite.page_end}`
+      : `, p. ${cite.page_start}`
+  }
+  if (cite.section) {
+    label += `, ${cite.section}`
+  }
+  if (cite.ocr_confidence !== undefined) {
+    label += `, OCR ${Math.round(cite.ocr_confidence * 100)}%`
+  }
+  return label
 }
 
 interface Question {
@@ -82,6 +150,17 @@ interface Question {
   correct_answer: number
 }
 
+interface GenerationJob {
+  id: string
+  course_id: string
+  status: 'queued' | 'running' | 'failed' | 'succeeded' | 'canceled'
+  step: string
+  progress: number
+  total: number
+  message?: string
+  error?: string
+}
+
 interface QuizAnswer {
   slideId: string
   selectedAnswer: number
@@ -95,10 +174,13 @@ function App() {
   const [slides, setSlides] = useState<Slide[]>([])
   const [currentSlide, setCurrentSlide] = useState(0)
   const [messages, setMessages] = useState<ChatMessage[]>([])
+  const [sessionId, setSessionId] = useState<string | null>(null)
   const [question, setQuestion] = useState('')
   const [loading, setLoading] = useState(false)
   const [uploadLoading, setUploadLoading] = useState(false)
   const [genLoading, setGenLoading] = useState(false)
+  const [genProgress, setGenProgress] = useState(0)
+  const [genMessage, setGenMessage] = useState('')
 
   // Generation settings
   const [genModalVisible, setGenModalVisible] = useState(false)
@@ -142,9 +224,20 @@ function App() {
       setSourceFiles(filesResponse.data.files || [])
 
       message.success(`${response.data.pdf_name} uploaded successfully!`)
+
+      // Pages without text are left out of the course, unless OCR could read them
+      const report: ExtractionReport | undefined = response.data.extraction_report
+      const unreadable = [...new Set([...(report?.failed_pages || []), ...(report?.scanned_pages || [])])]
+        .filter((page) => !report?.ocr_pages?.includes(page))
+        .sort((a, b) => a - b)
+      if (unreadable.length > 0) {
+        message.warning(`No text could be read from page${unreadable.length > 1 ? 's' : ''} ${unreadable.join(', ')}`)
+      }
     } catch (error) {
       console.error('Upload error:', error)
-      message.error('Failed to upload PDF')
+      // Unsupported files and files without any text come back with a reason
+      const reason = axios.isAxiosError(error) ? error.response?.data?.error : undefined
+      message.error(reason || 'Failed to upload document')
     } finally {
       setUploadLoading(false)
     }
@@ -168,6 +261,7 @@ function App() {
         setCourseId(null)
         setSlides([])
         setMessages([])
+        setSessionId(null)
         setQuestions([])
         setQuizAnswers([])
       }
@@ -177,6 +271,34 @@ function App() {
     }
   }
 
+  const waitForJob = (jobId: string) =>
+    new Promise<GenerationJob>((resolve, reject) => {
+      const events = new EventSource(`${API_BASE}/jobs/${jobId}/events`)
+      events.addEventListener('progress', (event) => {
+        const job: GenerationJob = JSON.parse((event as MessageEvent).data)
+        setGenProgress(job.total > 0 ? Math.round((job.progress / job.total) * 100) : 0)
+        setGenMessage(job.message || '')
+        if (job.status !== 'queued' && job.status !== 'running') {
+          events.close()
+          resolve(job)
+        }
+      })
+      events.onerror = () => {
+        // The stream dropped; fall back to reading the job state once
+        events.close()
+        axios.get(`${API_BASE}/jobs/${jobId}`)
+          .then((response) => {
+            const job: GenerationJob = response.data
+            if (job.status !== 'queued' && job.status !== 'running') {
+              resolve(job)
+            } else {
+              resolve(waitForJob(jobId))
+            }
+          })
+          .catch(reject)
+      }
+    })
+
   const handleGenerateCourse = async () => {
     if (!courseId) {
       message.error('Please upload at least one file first')
@@ -185,31 +307,30 @@ function App() {
 
     try {
       setGenLoading(true)
+      setGenProgress(0)
+      setGenMessage('')
       setGenModalVisible(false) // Close modal when generation starts
 
-      try {
-        await axios.post(`${API_BASE}/course/generate`, {
-          course_id: courseId,
-          num_slides: numSlides,
-          presentation_style: presentationStyle,
-          instructor_prompt: instructorPrompt,
-          generate_images: generateImages,
-          use_web_images: useWebImages,
-          use_dalle: useDalle,
-          generate_voiceover: generateVoiceover,
-          generate_questions: generateQuestions,
-          language: language,
-        }, {
-          timeout: 300000, // 5 minutes timeout to match nginx
-        })
-      } catch (genError) {
-        // If timeout or network error, the course might still be generated
-        // Let's try to fetch the slides anyway after a short delay
-        console.log('Generation request failed/timed out, checking for results...')
-        await new Promise(resolve => setTimeout(resolve, 3000))
+      const genResponse = await axios.post(`${API_BASE}/course/generate`, {
+        course_id: courseId,
+        num_slides: numSlides,
+        presentation_style: presentationStyle,
+        instructor_prompt: instructorPrompt,
+        generate_images: generateImages,
+        use_web_images: useWebImages,
+        use_dalle: useDalle,
+        generate_voiceover: generateVoiceover,
+        generate_questions: generateQuestions,
+        language: language,
+      })
+
+      // Generation runs as a background job; follow its progress until it finishes
+      const job = await waitForJob(genResponse.data.job_id)
+      if (job.status !== 'succeeded') {
+        throw new Error(job.error || 'Course generation failed')
       }
 
-      // Fetch the slides (they may have been generated even if request timed out)
+      // Fetch the generated slides
       const slidesResponse = await axios.get(`${API_BASE}/slides/${courseId}`)
 
       if (slidesResponse.data.slides && slidesResponse.data.slides.length > 0) {
@@ -239,23 +360,70 @@ function App() {
     if (!question.trim() || !courseId) return
 
     const userMsg: ChatMessage = { role: 'user', content: question }
-    setMessages((prev) => [...prev, userMsg])
+    const assistantMsg: ChatMessage = { role: 'assistant', content: '' }
+    setMessages((prev) => [...prev, userMsg, assistantMsg])
     setQuestion('')
 
+    // Replace the last (assistant) message as the answer streams in
+    const updateAnswer = (update: Partial<ChatMessage>) => {
+      setMessages((prev) => [...prev.slice(0, -1), { ...prev[prev.length - 1], ...update }])
+    }
+
     try {
       setLoading(true)
-      const response = await axios.post(`${API_BASE}/chat/ask`, {
-        course_id: courseId,
-        question: question,
+      const response = await fetch(`${API_BASE}/chat/ask/stream`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+          course_id: courseId,
+          question: question,
+          session_id: sessionId ?? undefined,
+          learner_id: getLearnerId(),
+        }),
       })
+      if (!response.ok || !response.body) {
+        throw new Error(`HTTP ${response.status}`)
+      }
 
-      const assistantMsg: ChatMessage = {
-        role: 'assistant',
-        content: response.data.answer,
-        citations: response.data.citations,
+      const reader = response.body.getReader()
+      const decoder = new TextDecoder()
+      let buffer = ''
+      let answer = ''
+
+      for (;;) {
+        const { done, value } = await reader.read()
+        if (done) break
+        buffer += decoder.decode(value, { stream: true })
+
+        // Server-sent events are separated by a blank line
+        let boundary
+        while ((boundary = buffer.indexOf('\n\n')) >= 0) {
+          const raw = buffer.slice(0, boundary)
+          buffer = buffer.slice(boundary + 2)
+
+          const event = raw.match(/^event:(.*)$/m)?.[1].trim()
+          const data = raw
+            .split('\n')
+            .filter((line) => line.startsWith('data:'))
+            .map((line) => line.slice(5))
+            .join('\n')
+          if (!event || !data) continue
+
+          const payload = JSON.parse(data)
+          if (event === 'token') {
+            answer += payload.text
+            updateAnswer({ content: answer })
+          } else if (event === 'citations') {
+            setSessionId(payload.session_id)
+            updateAnswer({ citations: payload.citations })
+          } else if (event === 'done') {
+            updateAnswer({ content: payload.answer, citations: payload.citations })
+          } else if (event === 'error') {
+            throw new Error(payload.error)
+          }
+        }
+        chatEndRef.current?.scrollIntoView({ behavior: 'smooth' })
       }
-      setMessages((prev) => [...prev, assistantMsg])
-      setTimeout(() => chatEndRef.current?.scrollIntoView({ behavior: 'smooth' }), 100)
     } catch (error) {
       console.error('Chat error:', error)
       message.error('Failed to get answer')
@@ -311,7 +479,7 @@ function App() {
             <Upload.Dragger
               beforeUpload={handleUpload}
               showUploadList={false}
-              accept=".pdf"
+              accept=".pdf,.docx,.pptx,.epub,.html,.htm,.md,.markdown,.txt,.png,.jpg,.jpeg"
               disabled={uploadLoading}
               style={{ marginBottom: '16px' }}
             >
@@ -319,7 +487,7 @@ function App() {
                 <UploadOutlined style={{ fontSize: '32px', color: '#1890ff' }} />
               </p>
               <p className="ant-upload-text" style={{ fontSize: '14px' }}>
-                {uploadLoading ? 'Processing...' : 'Drop PDF here or click'}
+                {uploadLoading ? 'Processing...' : 'Drop a document here or click'}
               </p>
             </Upload.Dragger>
 
@@ -391,7 +559,7 @@ function App() {
                     <div>
                       <Title level={3}>Welcome to AI eLearning</Title>
                       <Paragraph type="secondary">
-                        Upload PDF files on the left to get started, then click "Generate Course" to create an interactive learning experience with AI.
+                        Upload documents on the left to get started, then click "Generate Course" to create an interactive learning experience with AI.
                       </Paragraph>
                     </div>
                   }
@@ -495,6 +663,34 @@ function App() {
                     const isGradient = slide?.theme === 'gradient'
                     const layout = slide?.layout || 'standard'
 
+                    // Source data of data and comparison slides
+                    const table = parseSlideTable(slide?.table)
+                    const renderTable = () => table && (
+                      <div style={{ margin: '16px auto 0', maxWidth: '700px', textAlign: 'left', overflowX: 'auto' }}>
+                        <table style={{ width: '100%', borderCollapse: 'collapse', background: 'rgba(255,255,255,0.9)', color: '#001529' }}>
+                          <thead>
+                            <tr>
+                              {table.columns.map((column, idx) => (
+                                <th key={idx} style={{ padding: '8px 12px', borderBottom: `2px solid ${theme.border}`, textAlign: 'left' }}>{column}</th>
+                              ))}
+                            </tr>
+                          </thead>
+                          <tbody>
+                            {table.rows.map((row, rowIdx) => (
+                              <tr key={rowIdx}>
+                                {table.columns.map((_, idx) => (
+                                  <td key={idx} style={{ padding: '8px 12px', borderBottom: '1px solid #f0f0f0' }}>{row[idx]}</td>
+                                ))}
+                              </tr>
+                            ))}
+                          </tbody>
+                        </table>
+                        {table.caption && (
+                          <Text type="secondary" style={{ display: 'block', marginTop: '8px', fontSize: '13px' }}>{table.caption}</Text>
+                        )}
+                      </div>
+                    )
+
                     // Render different layouts based on the layout type
                     const renderSlideContent = () => {
                       // Title slide - full screen with centered content and background image
@@ -543,6 +739,7 @@ function App() {
                               <Paragraph style={{ fontSize: '16px', lineHeight: '1.8', whiteSpace: 'pre-line', color: isGradient ? '#fff' : theme.text }}>
                                 {slide.content}
                               </Paragraph>
+                              {renderTable()}
                             </div>
                           </div>
                         )
@@ -642,6 +839,7 @@ function App() {
                               <Paragraph style={{ fontSize: '18px', lineHeight: '1.8', whiteSpace: 'pre-line', color: isGradient ? '#fff' : theme.text }}>
                                 {slide.content}
                               </Paragraph>
+                              {renderTable()}
                             </div>
                           </div>
                         )
@@ -800,10 +998,24 @@ function App() {
                               {msg.citations && msg.citations.length > 0 && (
                                 <div style={{ marginTop: '8px' }}>
                                   <Text type="secondary" style={{ fontSize: '12px' }}>Sources: </Text>
-                                  {msg.citations.map((cite, i) => (
-                                    <Tag key={i} color="blue" style={{ fontSize: '11px' }}>
-                                      {cite}
-                                    </Tag>
+                                  {msg.citations.map((cite) => (
+                                    <div key={cite.chunk_id} style={{ marginTop: '4px' }}>
+                                      <Tooltip title={`"${cite.snippet}"`}>
+                                        <Tag color="blue" style={{ fontSize: '11px' }}>
+                                          [{cite.number}] {citationLabel(cite)}
+                                        </Tag>
+                                      </Tooltip>
+                                      {cite.slides?.map((s) => (
+                                        <Tag
+                                          key={s.id}
+                                          color="green"
+                                          style={{ fontSize: '11px', cursor: 'pointer' }}
+                                          onClick={() => setCurrentSlide(s.slide_number - 1)}
+                                        >
+                                          Slide {s.slide_number}
+                                        </Tag>
+                                      ))}
+                                    </div>
                                   ))}
                                 </div>
                               )}
@@ -991,8 +1203,8 @@ function App() {
 
           {genLoading && (
             <div>
-              <Progress percent={50} status="active" />
-              <Text type="secondary">Generating course content...</Text>
+              <Progress percent={genProgress} status="active" />
+              <Text type="secondary">{genMessage || 'Generating course content...'}</Text>
             </div>
           )}
         </Space>